@@ -23,7 +23,7 @@ func ApplyRoutes(r *gin.RouterGroup) {
 
 		g.GET("/", readAllAccounts)
 		g.POST("/", createAccount)
-		g.POST("/:id/activate", activateAccount)
+		g.POST("/:id/activate", core.RateLimit("activate"), activateAccount)
 		g.GET("/:id/invite", emailAccount)
 		g.GET("/:id", readAllAccounts)
 		g.GET("/:id/users", readUsers)
@@ -31,6 +31,21 @@ func ApplyRoutes(r *gin.RouterGroup) {
 		g.PATCH("/:id", updateAccount)
 		g.DELETE("/:id", deleteAccount)
 		g.DELETE("/:id/soft", softDeleteAccount)
+		g.POST("/:id/transfer", transferAccount)
+		g.GET("/:id/transfers", readTransfers)
+		g.POST("/:id/transfer/:tid/accept", acceptTransfer)
+		g.POST("/:id/transfer/:tid/decline", declineTransfer)
+		g.DELETE("/:id/transfer/:tid", cancelTransfer)
+		g.GET("/:id/audit", readAuditLog)
+		g.GET("/:id/rules", readProvisioningRules)
+		g.POST("/:id/rules", createProvisioningRule)
+		g.DELETE("/:id/rules/:rid", deleteProvisioningRule)
+		g.GET("/:id/webhooks", readWebhooks)
+		g.POST("/:id/webhooks", createWebhook)
+		g.PATCH("/:id/webhooks/:wid", updateWebhook)
+		g.DELETE("/:id/webhooks/:wid", deleteWebhook)
+		g.GET("/:id/webhooks/:wid/deliveries", readDeliveries)
+		g.POST("/:id/webhooks/:wid/deliveries/:did/redeliver", redeliver)
 	}
 }
 
@@ -46,6 +61,14 @@ func ApplyRoutes(r *gin.RouterGroup) {
 func activateAccount(c *gin.Context) {
 	id := c.Param("id")
 
+	// guessing ids is slowed down for each account too
+	if ok, wait := core.Allow("activate", id); !ok {
+		core.TooManyRequests(c, wait)
+		return
+	}
+
+	before, _ := core.ReadAccount(id)
+
 	v, err := core.ActivateAccount(id)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -55,6 +78,8 @@ func activateAccount(c *gin.Context) {
 		return
 	}
 
+	core.Audit(core.RequestActor(c), "account", "update", before, v)
+
 	c.JSON(http.StatusOK, v)
 }
 
@@ -180,6 +205,8 @@ func createAccount(c *gin.Context) {
 		return
 	}
 
+	core.Audit(core.RequestActor(c), "account", "create", nil, v)
+
 	c.JSON(http.StatusOK, v)
 }
 
@@ -335,6 +362,7 @@ func updateAccount(c *gin.Context) {
 		return
 	}
 	update := v.(*model.Account)
+	before := *update
 
 	var bodyBytes []byte
 	if c.Request.Body != nil {
@@ -391,6 +419,16 @@ func updateAccount(c *gin.Context) {
 		return
 	}
 
+	// allowlists are kept on the parent account, and whoever changes
+	// them can't lock themselves out
+	if id != update.Parent {
+		update.AllowedIPs = nil
+		update.DeviceAllowIPs = nil
+	} else if !core.InAllowlist(c.ClientIP(), update.AllowedIPs) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The allowlist must include your address " + c.ClientIP()})
+		return
+	}
+
 	data.UpdatedBy = account.Email
 
 	result, err := core.UpdateAccount(id, update)
@@ -402,6 +440,8 @@ func updateAccount(c *gin.Context) {
 		return
 	}
 
+	core.Audit(core.RequestActor(c), "account", "update", &before, result)
+
 	c.JSON(http.StatusOK, result)
 }
 
@@ -417,7 +457,7 @@ func updateAccount(c *gin.Context) {
 func deleteAccount(c *gin.Context) {
 	id := c.Param("id")
 
-	account, _, err := core.AuthFromContext(c, id)
+	account, v, err := core.AuthFromContext(c, id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -441,6 +481,8 @@ func deleteAccount(c *gin.Context) {
 		return
 	}
 
+	core.Audit(core.RequestActor(c), "account", "delete", v, nil)
+
 	c.JSON(http.StatusOK, gin.H{"status": "OK"})
 }
 
@@ -456,7 +498,7 @@ func deleteAccount(c *gin.Context) {
 func softDeleteAccount(c *gin.Context) {
 	id := c.Param("id")
 
-	account, _, err := core.AuthFromContext(c, id)
+	account, v, err := core.AuthFromContext(c, id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -543,6 +585,8 @@ func softDeleteAccount(c *gin.Context) {
 		return
 	}
 
+	core.Audit(core.RequestActor(c), "account", "delete", v, nil)
+
 	// So much for a soft delete, Apple wants the account gone - hard delete
 	auth0 := os.Getenv("USE_AUTH0")
 	if auth0 == "true" && strings.Contains(account.Sub, "apple") {
@@ -0,0 +1,69 @@
+package account
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// readAuditLog lists the changes made to the account and everything in it
+// @Summary Read the audit log
+// @Description List the changes made to the account's networks, VPNs, devices, services, members, subscriptions and limits, newest first.  The total number of matching entries is returned in X-Total-Count.
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param kind query string false "net, vpn, device, service, account, subscription, limits or rollout"
+// @Param action query string false "create, update or delete"
+// @Param objectId query string false "ID of the changed object"
+// @Param actor query string false "Email or ID of who made the change"
+// @Param from query string false "Changes from this time on (RFC 3339)"
+// @Param to query string false "Changes before this time (RFC 3339)"
+// @Param offset query int false "Entries to skip"
+// @Param limit query int false "Entries to return, 50 by default and at most 500"
+// @Success 200 {array} model.AuditEntry
+// @Failure 400 {object} error
+// @Router /accounts/{id}/audit [get]
+func readAuditLog(c *gin.Context) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Parent != target.Parent || (account.Role != "Owner" && account.Role != "Admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners and admins can read the audit log"})
+		return
+	}
+
+	var q model.AuditQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.AccountID = account.Parent
+
+	entries, total, err := core.ReadAuditLog(&q)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read audit log")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
+	c.JSON(http.StatusOK, entries)
+}
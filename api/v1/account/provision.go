@@ -0,0 +1,141 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// rulesFromContext returns the member making the request, who must be an
+// owner or admin of the account
+func rulesFromContext(c *gin.Context) (*model.Account, bool) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return nil, false
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Parent != target.Parent || (account.Role != "Owner" && account.Role != "Admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners and admins can manage provisioning rules"})
+		return nil, false
+	}
+
+	return account, true
+}
+
+// readProvisioningRules lists the provisioning rules of the account
+// @Summary List provisioning rules
+// @Description List the rules that add users to the account the first time they log in
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Success 200 {array} model.ProvisioningRule
+// @Failure 400 {object} error
+// @Router /accounts/{id}/rules [get]
+func readProvisioningRules(c *gin.Context) {
+	account, ok := rulesFromContext(c)
+	if !ok {
+		return
+	}
+
+	rules, err := core.ReadProvisioningRules(account.Parent)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read provisioning rules")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// createProvisioningRule adds a provisioning rule to the account
+// @Summary Create a provisioning rule
+// @Description Users whose verified email domain or group claim matches the rule join the account with its role, and optionally its network, the first time they log in.  A group rule needs a domain or the issuer of the provider the group comes from
+// @Tags accounts
+// @Security apiKey
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param rule body model.ProvisioningRule true "Provisioning rule"
+// @Success 200 {object} model.ProvisioningRule
+// @Failure 400 {object} error
+// @Router /accounts/{id}/rules [post]
+func createProvisioningRule(c *gin.Context) {
+	account, ok := rulesFromContext(c)
+	if !ok {
+		return
+	}
+
+	var rule model.ProvisioningRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule.AccountID = account.Parent
+	rule.CreatedBy = account.Email
+	rule.UpdatedBy = account.Email
+
+	v, err := core.CreateProvisioningRule(&rule)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create provisioning rule")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Infof("createProvisioningRule: %s added rule %s to %s", account.Email, v.Id, account.Parent)
+
+	c.JSON(http.StatusOK, v)
+}
+
+// deleteProvisioningRule removes a provisioning rule from the account
+// @Summary Delete a provisioning rule
+// @Description Delete a provisioning rule.  Members it already added stay in the account.
+// @Tags accounts
+// @Security apiKey
+// @Param id path string true "Account ID"
+// @Param rid path string true "Rule ID"
+// @Success 200 {object} string "OK"
+// @Failure 400 {object} error
+// @Router /accounts/{id}/rules/{rid} [delete]
+func deleteProvisioningRule(c *gin.Context) {
+	account, ok := rulesFromContext(c)
+	if !ok {
+		return
+	}
+
+	rule, err := core.ReadProvisioningRule(c.Param("rid"))
+	if err != nil || rule.AccountID != account.Parent {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return
+	}
+
+	err = core.DeleteProvisioningRule(rule.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to delete provisioning rule")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Infof("deleteProvisioningRule: %s deleted rule %s from %s", account.Email, rule.Id, account.Parent)
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,243 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+type transferRequest struct {
+	ToAccountID string `json:"toAccountid"`
+}
+
+// transferAccount starts an ownership transfer of the account
+// @Summary Start an account ownership transfer
+// @Description The owner of an account offers ownership to another active member.  The member must accept the transfer.
+// @Tags accounts
+// @Security apiKey
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param transfer body transferRequest true "Member account to transfer to"
+// @Success 200 {object} model.Transfer
+// @Failure 400 {object} error
+// @Router /accounts/{id}/transfer [post]
+func transferAccount(c *gin.Context) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Id != account.Parent || account.Parent != target.Parent {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the account owner can transfer the account"})
+		return
+	}
+
+	var req transferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	transfer, err := core.CreateTransfer(account, req.ToAccountID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create transfer")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, transfer)
+}
+
+// readTransfers lists ownership transfers of the account
+// @Summary List account ownership transfers
+// @Description List the ownership transfers of an account.  Owners and Admins see all transfers, other members see the transfers addressed to them.
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Success 200 {array} model.Transfer
+// @Failure 400 {object} error
+// @Router /accounts/{id}/transfers [get]
+func readTransfers(c *gin.Context) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Parent != target.Parent {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not authorized to read this account"})
+		return
+	}
+
+	transfers, err := core.ReadTransfers(account.Parent)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read transfers")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if account.Role != "Owner" && account.Role != "Admin" {
+		mine := make([]*model.Transfer, 0)
+		for _, t := range transfers {
+			if t.ToEmail == account.Email {
+				mine = append(mine, t)
+			}
+		}
+		transfers = mine
+	}
+
+	c.JSON(http.StatusOK, transfers)
+}
+
+// acceptTransfer accepts an ownership transfer
+// @Summary Accept an account ownership transfer
+// @Description The recipient of a pending transfer becomes the owner of the account.  The previous owner remains a member as an Admin.
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param tid path string true "Transfer ID"
+// @Success 200 {object} model.Transfer
+// @Failure 400 {object} error
+// @Router /accounts/{id}/transfer/{tid}/accept [post]
+func acceptTransfer(c *gin.Context) {
+	account, transfer, ok := transferFromContext(c)
+	if !ok {
+		return
+	}
+
+	if transfer.ToEmail != account.Email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This transfer is not addressed to you"})
+		return
+	}
+
+	result, err := core.AcceptTransfer(transfer.Id, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to accept transfer")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// declineTransfer declines an ownership transfer
+// @Summary Decline an account ownership transfer
+// @Description The recipient of a pending transfer declines it
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param tid path string true "Transfer ID"
+// @Success 200 {object} model.Transfer
+// @Failure 400 {object} error
+// @Router /accounts/{id}/transfer/{tid}/decline [post]
+func declineTransfer(c *gin.Context) {
+	account, transfer, ok := transferFromContext(c)
+	if !ok {
+		return
+	}
+
+	if transfer.ToEmail != account.Email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This transfer is not addressed to you"})
+		return
+	}
+
+	result, err := core.CloseTransfer(transfer.Id, account.Email, "Declined")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to decline transfer")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// cancelTransfer cancels an ownership transfer
+// @Summary Cancel an account ownership transfer
+// @Description The owner cancels a pending transfer
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param tid path string true "Transfer ID"
+// @Success 200 {object} model.Transfer
+// @Failure 400 {object} error
+// @Router /accounts/{id}/transfer/{tid} [delete]
+func cancelTransfer(c *gin.Context) {
+	account, transfer, ok := transferFromContext(c)
+	if !ok {
+		return
+	}
+
+	if account.Id != account.Parent {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the account owner can cancel a transfer"})
+		return
+	}
+
+	result, err := core.CloseTransfer(transfer.Id, account.Email, "Cancelled")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to cancel transfer")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// transferFromContext authenticates the caller against the account and loads the transfer
+func transferFromContext(c *gin.Context) (*model.Account, *model.Transfer, bool) {
+	id := c.Param("id")
+	tid := c.Param("tid")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return nil, nil, false
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Parent != target.Parent {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not authorized to access this account"})
+		return nil, nil, false
+	}
+
+	transfer, err := core.ReadTransfer(tid)
+	if err != nil || transfer.AccountID != account.Parent {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return nil, nil, false
+	}
+
+	return account, transfer, true
+}
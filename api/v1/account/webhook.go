@@ -0,0 +1,266 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// webhooksFromContext returns the member making the request, who must be an
+// owner or admin of the account
+func webhooksFromContext(c *gin.Context) (*model.Account, bool) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read account from context")
+		return nil, false
+	}
+	target := v.(*model.Account)
+
+	if account == nil || account.Parent != target.Parent || (account.Role != "Owner" && account.Role != "Admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only owners and admins can manage webhooks"})
+		return nil, false
+	}
+
+	return account, true
+}
+
+// webhookFromContext returns the member making the request and the webhook
+// of the account it's for
+func webhookFromContext(c *gin.Context) (*model.Account, *model.Webhook, bool) {
+	account, ok := webhooksFromContext(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	webhook, err := core.ReadWebhook(c.Param("wid"))
+	if err != nil || webhook.AccountID != account.Parent {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return nil, nil, false
+	}
+
+	return account, webhook, true
+}
+
+// readWebhooks lists the webhooks of the account
+// @Summary List webhooks
+// @Description List the webhooks the account's events are sent to
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Success 200 {array} model.Webhook
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks [get]
+func readWebhooks(c *gin.Context) {
+	account, ok := webhooksFromContext(c)
+	if !ok {
+		return
+	}
+
+	webhooks, err := core.ReadWebhooks(account.Parent)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read webhooks")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// createWebhook adds a webhook to the account
+// @Summary Create a webhook
+// @Description Send the account's events of the chosen types, or "*" for all, to a URL as JSON signed with the webhook's secret.  A secret is made if none is given.
+// @Tags accounts
+// @Security apiKey
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param webhook body model.Webhook true "Webhook"
+// @Success 200 {object} model.Webhook
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks [post]
+func createWebhook(c *gin.Context) {
+	account, ok := webhooksFromContext(c)
+	if !ok {
+		return
+	}
+
+	var webhook model.Webhook
+	if err := c.ShouldBindJSON(&webhook); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	webhook.AccountID = account.Parent
+	webhook.CreatedBy = account.Email
+	webhook.UpdatedBy = account.Email
+
+	v, err := core.CreateWebhook(&webhook)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create webhook")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	core.Audit(core.RequestActor(c), "webhook", "create", nil, v)
+
+	log.Infof("createWebhook: %s added webhook %s to %s", account.Email, v.Id, account.Parent)
+
+	c.JSON(http.StatusOK, v)
+}
+
+// updateWebhook changes a webhook
+// @Summary Update a webhook
+// @Description Change a webhook's URL, events or secret, or turn it on or off.  The secret is kept if none is given.
+// @Tags accounts
+// @Security apiKey
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param wid path string true "Webhook ID"
+// @Param webhook body model.Webhook true "Webhook"
+// @Success 200 {object} model.Webhook
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks/{wid} [patch]
+func updateWebhook(c *gin.Context) {
+	account, webhook, ok := webhookFromContext(c)
+	if !ok {
+		return
+	}
+
+	var data model.Webhook
+	if err := c.ShouldBindJSON(&data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	data.UpdatedBy = account.Email
+
+	v, err := core.UpdateWebhook(webhook, &data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to update webhook")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	core.Audit(core.RequestActor(c), "webhook", "update", webhook, v)
+
+	c.JSON(http.StatusOK, v)
+}
+
+// deleteWebhook removes a webhook from the account
+// @Summary Delete a webhook
+// @Description Delete a webhook and its delivery log
+// @Tags accounts
+// @Security apiKey
+// @Param id path string true "Account ID"
+// @Param wid path string true "Webhook ID"
+// @Success 200 {object} string "OK"
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks/{wid} [delete]
+func deleteWebhook(c *gin.Context) {
+	account, webhook, ok := webhookFromContext(c)
+	if !ok {
+		return
+	}
+
+	err := core.DeleteWebhook(webhook.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to delete webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	core.Audit(core.RequestActor(c), "webhook", "delete", webhook, nil)
+
+	log.Infof("deleteWebhook: %s deleted webhook %s from %s", account.Email, webhook.Id, account.Parent)
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// readDeliveries lists the latest deliveries to a webhook
+// @Summary List webhook deliveries
+// @Description List the latest 100 deliveries to a webhook, newest first, with their payloads, attempts and responses
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param wid path string true "Webhook ID"
+// @Success 200 {array} model.Delivery
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks/{wid}/deliveries [get]
+func readDeliveries(c *gin.Context) {
+	_, webhook, ok := webhookFromContext(c)
+	if !ok {
+		return
+	}
+
+	deliveries, err := core.ReadDeliveries(webhook.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read deliveries")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// redeliver sends a delivery's event to the webhook again
+// @Summary Redeliver a webhook event
+// @Description Send the payload of a delivery to the webhook again, as a new delivery
+// @Tags accounts
+// @Security apiKey
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param wid path string true "Webhook ID"
+// @Param did path string true "Delivery ID"
+// @Success 200 {object} model.Delivery
+// @Failure 400 {object} error
+// @Router /accounts/{id}/webhooks/{wid}/deliveries/{did}/redeliver [post]
+func redeliver(c *gin.Context) {
+	account, webhook, ok := webhookFromContext(c)
+	if !ok {
+		return
+	}
+
+	delivery, err := core.ReadDelivery(c.Param("did"))
+	if err != nil || delivery.WebhookID != webhook.Id {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return
+	}
+
+	v, err := core.Redeliver(delivery)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to redeliver")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Infof("redeliver: %s redelivered %s to %s", account.Email, delivery.Id, webhook.Id)
+
+	c.JSON(http.StatusOK, v)
+}
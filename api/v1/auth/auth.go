@@ -8,7 +8,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
+	providers "github.com/nettica-com/nettica-admin/auth"
+	core "github.com/nettica-com/nettica-admin/core"
 	model "github.com/nettica-com/nettica-admin/model"
 	"github.com/nettica-com/nettica-admin/shadow"
 	util "github.com/nettica-com/nettica-admin/util"
@@ -22,13 +23,42 @@ func ApplyRoutes(r *gin.RouterGroup) {
 	g := r.Group("/auth")
 	{
 		g.GET("/oauth2_url", oauth2URL)
-		g.POST("/oauth2_exchange", oauth2Exchange)
-		g.POST("/token", token)
+		g.POST("/oauth2_exchange", core.RateLimit("login"), oauth2Exchange)
+		g.POST("/token", core.RateLimit("login"), token)
 		g.POST("/validate", validate)
-		g.POST("/login", login)
+		g.POST("/login", core.RateLimit("login"), login)
 		g.GET("/user", user)
 		g.GET("/logout", logout)
 		g.GET("/redirect", redirect)
+		g.GET("/jwks", jwks)
+		g.POST("/refresh", refresh)
+		g.GET("/sessions", sessions)
+		g.DELETE("/sessions/:id", deleteSession)
+		g.GET("/history", history)
+		g.POST("/device/code", core.RateLimit("device_code"), deviceAuthCode)
+		g.POST("/device/token", deviceAuthToken)
+		g.GET("/device", deviceAuthRead)
+		g.POST("/device/approve", deviceAuthApprove)
+		g.POST("/device/deny", deviceAuthDeny)
+		g.POST("/local/signup", core.RateLimit("email"), localSignup)
+		g.POST("/local/verify", core.RateLimit("login"), localVerify)
+		g.POST("/local/reset", core.RateLimit("email"), localRequestReset)
+		g.POST("/local/reset/confirm", core.RateLimit("login"), localReset)
+		g.POST("/local/password", core.RateLimit("login"), localChangePassword)
+		g.GET("/mfa", mfaStatus)
+		g.POST("/mfa/enroll", mfaEnroll)
+		g.POST("/mfa/verify", core.RateLimit("mfa"), mfaVerify)
+		g.POST("/mfa/confirm", mfaConfirm)
+		g.POST("/mfa/recovery", mfaRecovery)
+		g.POST("/mfa/disable", mfaDisable)
+		g.POST("/webauthn/register/begin", webauthnRegisterBegin)
+		g.POST("/webauthn/register/finish", webauthnRegisterFinish)
+		g.GET("/webauthn/credentials", webauthnCredentials)
+		g.DELETE("/webauthn/credentials/:id", webauthnDeleteCredential)
+		g.POST("/webauthn/login/begin", core.RateLimit("login"), webauthnLoginBegin)
+		g.POST("/webauthn/login/finish", core.RateLimit("login"), webauthnLoginFinish)
+		g.GET("/saml/metadata", samlMetadata)
+		g.POST("/saml/acs", samlACS)
 	}
 }
 
@@ -37,16 +67,35 @@ func ApplyRoutes(r *gin.RouterGroup) {
  */
 func oauth2URL(c *gin.Context) {
 	cacheDb := c.MustGet("cache").(*cache.Cache)
-	oauth2Client := c.MustGet("oauth2Client").(model.Authentication)
 
 	referer := c.Request.URL.Query().Get("referer")
 	connection := c.Request.URL.Query().Get("connection")
+	provider := c.Request.URL.Query().Get("provider")
 
-	providers := []string{}
+	oauth2Client, ok := providers.Provider(provider)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown provider " + provider})
+		return
+	}
+
+	// with several providers and none chosen the login page offers them all
+	choose := provider == "" && len(providers.ProviderNames()) > 1
+
+	// native apps and integrations must be registered, public ones use PKCE
+	request := model.Auth{
+		Client:              c.Request.URL.Query().Get("client_id"),
+		Redirect:            c.Request.URL.Query().Get("redirect_uri"),
+		CodeChallenge:       c.Request.URL.Query().Get("code_challenge"),
+		CodeChallengeMethod: c.Request.URL.Query().Get("code_challenge_method"),
+	}
+	client, grant, ok := authorizeClient(c, &request)
+	if !ok {
+		return
+	}
 
 	var err error
 	var state, clientId, codeUrl, audience, redirect_uri string
-	if c.Request.URL.Query().Get("redirect_uri") == "com.nettica.agent://callback/agent" {
+	if client != nil && client.Agent {
 		clientId, err = util.GenerateRandomString(32)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -70,6 +119,10 @@ func oauth2URL(c *gin.Context) {
 
 		cacheDb.Set(clientId, state, 1*time.Hour)
 		cacheDb.Set(state, state, 1*time.Hour)
+		if provider != "" {
+			cacheDb.Set("provider-"+state, provider, 1*time.Hour)
+		}
+		saveGrant(cacheDb, state, grant)
 	} else {
 
 		state, err = util.GenerateRandomString(32)
@@ -92,7 +145,15 @@ func oauth2URL(c *gin.Context) {
 		// save clientId and state so we can retrieve for verification
 		cacheDb.Set(clientId, state, 1*time.Hour)
 		cacheDb.Set(state, state, 1*time.Hour)
-		codeUrl = oauth2Client.CodeUrl(state)
+		if provider != "" {
+			cacheDb.Set("provider-"+state, provider, 1*time.Hour)
+		}
+		saveGrant(cacheDb, state, grant)
+		if choose {
+			codeUrl = os.Getenv("SERVER") + "/login?state=" + state + "&providers=" + strings.Join(providers.ProviderNames(), ",")
+		} else {
+			codeUrl = oauth2Client.CodeUrl(state)
+		}
 		if referer != "" {
 			codeUrl = codeUrl + "&referer=" + referer
 		}
@@ -101,10 +162,6 @@ func oauth2URL(c *gin.Context) {
 		}
 	}
 
-	if os.Getenv("PROVIDERS") != "" {
-		providers = strings.Split(os.Getenv("PROVIDERS"), ",")
-	}
-
 	data := &model.Auth{
 		Oauth2:    true,
 		ClientId:  clientId,
@@ -112,7 +169,14 @@ func oauth2URL(c *gin.Context) {
 		CodeUrl:   codeUrl,
 		Audience:  audience,
 		Redirect:  redirect_uri,
-		Providers: providers,
+		Providers: []string{},
+		Provider:  provider,
+	}
+
+	if os.Getenv("PROVIDERS") != "" {
+		data.Providers = strings.Split(os.Getenv("PROVIDERS"), ",")
+	} else if len(providers.ProviderNames()) > 1 {
+		data.Providers = providers.ProviderNames()
 	}
 
 	log.Infof("model.Auth = %v", data)
@@ -160,17 +224,26 @@ func oauth2Exchange(c *gin.Context) {
 		}
 	}
 
-	savedCode, exists := cacheDb.Get(loginVals.Code)
-	if exists {
-		loginVals.Code = savedCode.(string)
+	client, ok := verifyClient(c, cacheDb, &loginVals)
+	if !ok {
+		return
 	}
 
-	oauth2Client := c.MustGet("oauth2Client").(model.Authentication)
+	name, oauth2Client := requestProvider(c, cacheDb, &loginVals)
+
+	savedCode, exists := cacheDb.Get(loginVals.Code)
+	if code, ok := savedCode.(string); exists && ok {
+		loginVals.Code = code
+	} else if p, ok := oauth2Client.(model.PasswordAuthentication); ok {
+		if !checkRawLogin(c, name, p, loginVals.Code) {
+			return
+		}
+	}
 
 	var oauth2Token *oauth2.Token
 	var err error
 
-	if loginVals.Redirect != "com.nettica.agent://callback/agent" || loginVals.Connection == "apple" {
+	if client == nil || !client.Agent || loginVals.Connection == "apple" {
 		oauth2Token, err = oauth2Client.Exchange(loginVals)
 	} else {
 		oauth2Token, err = oauth2Client.Exchange2(loginVals.Code)
@@ -187,9 +260,7 @@ func oauth2Exchange(c *gin.Context) {
 	// normally we should delete this, but frankly it causes more errors on the website to do that.
 	// Let it be expired out of the cache instead of deleting it.
 	// cacheDb.Delete(loginVals.ClientId)
-	cacheDb.Set(oauth2Token.AccessToken, oauth2Token, 24*time.Hour)
-
-	c.JSON(http.StatusOK, oauth2Token.AccessToken)
+	sendToken(c, cacheDb, oauth2Token, name)
 }
 
 /*
@@ -229,12 +300,27 @@ func token(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	oauth2Client := c.MustGet("oauth2Client").(model.Authentication)
+
+	client, ok := verifyClient(c, cacheDb, &loginVals)
+	if !ok {
+		return
+	}
+
+	name, oauth2Client := requestProvider(c, cacheDb, &loginVals)
+
+	if p, ok := oauth2Client.(model.PasswordAuthentication); ok {
+		savedCode, exists := cacheDb.Get(loginVals.Code)
+		if code, ok := savedCode.(string); exists && ok {
+			loginVals.Code = code
+		} else if !checkRawLogin(c, name, p, loginVals.Code) {
+			return
+		}
+	}
 
 	var oauth2Token *oauth2.Token
 	var err error
 
-	if loginVals.Redirect != "com.nettica.agent://callback/agent" {
+	if client == nil || !client.Agent {
 		oauth2Token, err = oauth2Client.Exchange(loginVals)
 	} else {
 		oauth2Token, err = oauth2Client.Exchange2(loginVals.Code)
@@ -247,9 +333,7 @@ func token(c *gin.Context) {
 		return
 	}
 
-	cacheDb.Set(oauth2Token.AccessToken, oauth2Token, 24*time.Hour)
-
-	c.JSON(http.StatusOK, oauth2Token.AccessToken)
+	sendToken(c, cacheDb, oauth2Token, name)
 	/*
 	   //	cacheDb.Delete(loginVals.ClientId)
 	   var token oauth2.Token
@@ -297,6 +381,21 @@ func login(c *gin.Context) {
 		}
 	}
 
+	// the client the login page was opened for, from oauth2_url or this request
+	grant := savedGrant(cacheDb, &loginVals)
+	if grant == nil || loginVals.CodeChallenge != "" {
+		var ok bool
+		_, grant, ok = authorizeClient(c, &loginVals)
+		if !ok {
+			return
+		}
+	}
+	if grant != nil {
+		loginVals.Client = grant.ClientID
+		loginVals.Redirect = grant.Redirect
+		loginVals.CodeChallenge = grant.Challenge
+	}
+
 	// code contains the username and password base64 encoded
 	// base64 decode the string
 
@@ -323,20 +422,57 @@ func login(c *gin.Context) {
 	user := parts[0]
 	pass := parts[1]
 
-	x := strings.Split(user, "@")
-	if len(x) > 0 {
-		user = x[0]
+	if !allowLogin(c, user) {
+		return
 	}
 
 	// validate the username and password
-	err = shadow.ShadowAuthPlain(user, pass)
+	email := ""
+	name, oauth2Client := requestProvider(c, cacheDb, &loginVals)
+	if _, ok := oauth2Client.(model.PasswordAuthentication); !ok {
+		// the form on the login page is for whichever provider checks passwords
+		if n, ok := providers.PasswordProvider(); ok {
+			name = n
+			oauth2Client, _ = providers.Provider(n)
+		}
+	}
+	loginVals.Provider = name
+	if p, ok := oauth2Client.(model.PasswordAuthentication); ok {
+		err = p.Authenticate(user, pass)
+		email = p.LoginEmail(user)
+	} else {
+		x := strings.Split(user, "@")
+		if len(x) > 0 {
+			user = x[0]
+		}
+		err = shadow.ShadowAuthPlain(user, pass)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("invalid username or password")
+		core.LoginFailed(parts[0])
+		if email == "" {
+			email = parts[0]
+		}
+		core.RecordLogin(email, name, false, "invalid username or password", c.ClientIP(), c.Request.UserAgent())
 		c.JSON(http.StatusForbidden, gin.H{"error": "invalid username or password"})
 		return
 	}
+	core.LoginSucceeded(parts[0])
+
+	// a second factor is needed before the code is issued
+	if email != "" && (core.MFAEnabled(email) || core.MFARequired(email)) {
+		startMFA(c, cacheDb, &loginVals, email)
+		return
+	}
+
+	issueLoginCode(c, cacheDb, &loginVals, true)
+}
+
+// issueLoginCode caches the credentials under a one time code and sends the
+// client on to oauth2_exchange
+func issueLoginCode(c *gin.Context, cacheDb *cache.Cache, loginVals *model.Auth, allowRedirect bool) {
 
 	code, err := util.GenerateRandomString(32)
 	if err != nil {
@@ -350,17 +486,27 @@ func login(c *gin.Context) {
 	// save the code and basic auth in the cache for
 	// later retrieval in oauth2_exchange
 	cacheDb.Set(code, loginVals.Code, 1*time.Hour)
+	cacheDb.Set("provider-"+code, loginVals.Provider, 1*time.Hour)
+	if loginVals.Client != "" {
+		saveGrant(cacheDb, code, &clientGrant{
+			ClientID:  loginVals.Client,
+			Redirect:  loginVals.Redirect,
+			Challenge: loginVals.CodeChallenge,
+		})
+	}
 
 	redirect := "/?code=" + code + "&state=" + loginVals.State
 
 	if loginVals.Redirect != "" {
 		redirect = loginVals.Redirect + "?code=" + code + "&state=" + loginVals.State
 
-		// If it's the nettica agent application send a redirect
-		if loginVals.Redirect == "com.nettica.agent://callback/agent" {
-
-			c.Redirect(http.StatusPermanentRedirect, redirect)
-			return
+		// If it's a registered native app send a redirect
+		if allowRedirect && loginVals.Client != "" {
+			client, err := core.ReadClient(loginVals.Client, loginVals.Redirect)
+			if err == nil && client.Public {
+				c.Redirect(http.StatusPermanentRedirect, redirect)
+				return
+			}
 		}
 	}
 
@@ -370,6 +516,85 @@ func login(c *gin.Context) {
 	c.JSON(http.StatusOK, loginVals)
 }
 
+// requestProvider finds the provider a login or exchange is for: the one the
+// code or state was issued for, else the one named in the request, else the default
+func requestProvider(c *gin.Context, cacheDb *cache.Cache, loginVals *model.Auth) (string, model.Authentication) {
+	name := loginVals.Provider
+
+	for _, key := range []string{loginVals.Code, loginVals.State} {
+		if v, exists := cacheDb.Get("provider-" + key); key != "" && exists {
+			name = v.(string)
+			break
+		}
+	}
+
+	if p, ok := providers.Provider(name); ok && name != "" {
+		return name, p
+	}
+
+	return providers.DefaultProvider(), c.MustGet("oauth2Client").(model.Authentication)
+}
+
+// checkRawLogin handles a username and password sent straight to a token
+// endpoint instead of through login.  They get the same checks login does,
+// and users with a second factor must go through login.
+func checkRawLogin(c *gin.Context, name string, p model.PasswordAuthentication, code string) bool {
+
+	userpass, err := base64.StdEncoding.DecodeString(code)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return false
+	}
+
+	parts := strings.SplitN(string(userpass), ":", 2)
+	if len(parts) != 2 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return false
+	}
+
+	if !allowLogin(c, parts[0]) {
+		return false
+	}
+
+	email := p.LoginEmail(parts[0])
+
+	err = p.Authenticate(parts[0], parts[1])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("invalid username or password")
+		core.LoginFailed(parts[0])
+		core.RecordLogin(email, name, false, "invalid username or password", c.ClientIP(), c.Request.UserAgent())
+		c.JSON(http.StatusForbidden, gin.H{"error": "invalid username or password"})
+		return false
+	}
+	core.LoginSucceeded(parts[0])
+
+	if core.MFAEnabled(email) || core.MFARequired(email) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "mfa required, use login"})
+		return false
+	}
+
+	return true
+}
+
+// allowLogin refuses a password login for a user who is locked out or is
+// trying too often, whichever address the attempts come from
+func allowLogin(c *gin.Context, username string) bool {
+	if wait, locked := core.LoginLocked(username); locked {
+		log.Infof("login for %s refused, locked out for %s", username, wait)
+		core.TooManyRequests(c, wait)
+		return false
+	}
+
+	if ok, wait := core.Allow("login", "user:"+strings.ToLower(username)); !ok {
+		core.TooManyRequests(c, wait)
+		return false
+	}
+
+	return true
+}
+
 func validate(c *gin.Context) {
 	var t model.OAuth2Token
 	if err := c.ShouldBindJSON(&t); err != nil {
@@ -380,67 +605,83 @@ func validate(c *gin.Context) {
 		return
 	}
 	cacheDb := c.MustGet("cache").(*cache.Cache)
-	oauth2Token, exists := cacheDb.Get(util.GetCleanAuthToken(c))
 
-	if exists && oauth2Token.(*oauth2.Token).AccessToken == util.GetCleanAuthToken(c) {
+	// a token the server already knows, or one of its own session tokens
+	if _, exists := requestToken(c); exists {
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	if _, exists := providers.FindToken(cacheDb, t.AccessToken); exists {
 		c.JSON(http.StatusOK, gin.H{})
 		return
 	}
 
-	// validate the JWT with our private key
-
-	// verify the jwt signature
-
-	token := t.AccessToken
-
-	// parse the token
-	parsedToken, err := jwt.ParseWithClaims(token, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return os.Getenv("OAUTH2_CLIENT_SECRET"), nil
-	})
-
+	// otherwise it must be a JWT from a trusted issuer, checked against its published keys
+	idToken, name, err := providers.ValidateJWT(t.AccessToken)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("failed to parse jwt token")
-		c.AbortWithStatus(http.StatusUnauthorized)
+		}).Error("oauth2 AccessToken is not recognized")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// validate the claims
-	if claims, ok := parsedToken.Claims.(*CustomClaims); ok && parsedToken.Valid {
-		log.WithFields(log.Fields{
-			"claims": claims,
-		}).Info("claims")
-
-		// create a new oauth2.Token from the claims
-		oauth2Token := &oauth2.Token{
-			AccessToken:  token,
-			TokenType:    "Bearer",
-			RefreshToken: "",
-			Expiry:       time.Now().Add(4 * time.Hour),
-		}
+	log.WithFields(log.Fields{
+		"issuer":  idToken.Issuer,
+		"subject": idToken.Subject,
+	}).Info("validated jwt")
 
-		oauth2Token = oauth2Token.WithExtra(map[string]interface{}{ // Add the ID token to the extra parameters
-			"id_token": token})
+	oauth2Token := &oauth2.Token{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      idToken.Expiry,
+	}
 
-		cacheDb.Set(oauth2Token.AccessToken, oauth2Token, 24*time.Hour)
+	oauth2Token = oauth2Token.WithExtra(map[string]interface{}{ // Add the ID token to the extra parameters
+		"id_token": t.AccessToken})
 
-		c.JSON(http.StatusOK, gin.H{})
-		return
+	if name != "" {
+		providers.SetTokenProvider(oauth2Token, name)
 	}
 
-	// otherwise we have an invalid token
+	// the token is good until it expires, but no longer than a day
+	cacheDb.Set(oauth2Token.AccessToken, oauth2Token, min(time.Until(idToken.Expiry), 24*time.Hour))
 
-	log.Error("oauth2 AccessToken is not recognized")
-
-	c.AbortWithStatus(http.StatusUnauthorized)
+	c.JSON(http.StatusOK, gin.H{})
 }
 
-// A custom struct to hold the jwt claims
-type CustomClaims struct {
-	Email string `json:"email"`
+// mayLogOutUser allows the user themselves, and the owners and admins of
+// their accounts, to log out every session of a user
+func mayLogOutUser(c *gin.Context, user string) bool {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return false
+	}
+	if strings.EqualFold(email, user) {
+		return true
+	}
 
-	jwt.StandardClaims
+	admins, err := core.ReadAllAccounts(email)
+	if err == nil {
+		members, err := core.ReadAllAccounts(user)
+		if err == nil {
+			for _, a := range admins {
+				if a.Status != "Active" || (a.Role != "Owner" && a.Role != "Admin") {
+					continue
+				}
+				for _, m := range members {
+					if m.Parent == a.Parent {
+						return true
+					}
+				}
+			}
+		}
+	}
+
+	log.Infof("SECURITY: %s is not allowed to log out %s", email, user)
+	c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+	return false
 }
 
 func logout(c *gin.Context) {
@@ -448,14 +689,32 @@ func logout(c *gin.Context) {
 	cacheDb := c.MustGet("cache").(*cache.Cache)
 
 	if c.Request.URL.Query().Get("user") != "" {
+		if !mayLogOutUser(c, c.Request.URL.Query().Get("user")) {
+			return
+		}
+
+		// session tokens aren't kept anywhere, so the user's sessions are revoked
+		if core.SessionsEnabled() {
+			err := core.RevokeUserSessions(c.Request.URL.Query().Get("user"))
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("failed to revoke sessions")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{})
+			return
+		}
+
 		oauth2Client := c.MustGet("oauth2Client").(model.Authentication)
 		// delete all tokens for this user
 		items := cacheDb.Items()
 		for _, token := range items {
 			// check to see if the item is a string or a token
-			if _, ok := token.Object.(*oauth2.Token); ok {
+			if t, ok := token.Object.(*oauth2.Token); ok {
 
-				user, err := oauth2Client.UserInfo(token.Object.(*oauth2.Token))
+				user, err := providers.TokenProvider(oauth2Client, t).UserInfo(t)
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
@@ -472,7 +731,14 @@ func logout(c *gin.Context) {
 		return
 	}
 
-	cacheDb.Delete(util.GetCleanAuthToken(c))
+	// the provider the user logged in with decides where they log out
+	name := providers.DefaultProvider()
+	if t, exists := requestToken(c); exists {
+		if providers.TokenProviderName(t) != "" {
+			name = providers.TokenProviderName(t)
+		}
+		revokeToken(cacheDb, t)
+	}
 
 	var logoutUrl string
 	var redirect_uri string
@@ -490,7 +756,7 @@ func logout(c *gin.Context) {
 		}
 	}
 
-	logoutUrl = os.Getenv("OAUTH2_LOGOUT_URL")
+	logoutUrl = providers.ProviderSetting(name, "OAUTH2_LOGOUT_URL")
 	if logoutUrl != "" {
 		c.Redirect(http.StatusTemporaryRedirect, logoutUrl)
 		return
@@ -502,27 +768,15 @@ func logout(c *gin.Context) {
 func user(c *gin.Context) {
 	cacheDb := c.MustGet("cache").(*cache.Cache)
 	token := util.GetCleanAuthToken(c)
-	oauth2Token, exists := cacheDb.Get(token)
+	oauth2Token, exists := requestToken(c)
 	id_token := c.Request.Header.Get("X-OAUTH2-ID-TOKEN")
 
 	if id_token != "" {
-		new_token := &oauth2.Token{
-			AccessToken:  token,
-			TokenType:    "Bearer",
-			RefreshToken: "",
-			Expiry:       time.Now().Add(time.Hour * 24),
-		}
-		m := make(map[string]interface{})
-		m["id_token"] = id_token
-		new_token = new_token.WithExtra(m)
-
-		// check if token is valid
-		var err error
-		oauth2Token, err = util.ValidateToken(new_token.AccessToken)
+		// check the access token is a JWT from a trusted issuer
+		new_token, err := providers.ValidateIDTokenBearer(token, id_token)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"err":   err,
-				"token": oauth2Token,
+				"err": err,
 			}).Error("failed to get token info")
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
@@ -530,10 +784,10 @@ func user(c *gin.Context) {
 		oauth2Token = new_token
 	}
 
-	if id_token != "" || (exists && oauth2Token.(*oauth2.Token).AccessToken == util.GetCleanAuthToken(c)) {
-		oauth2Client := c.MustGet("oauth2Client").(model.Authentication)
+	if id_token != "" || exists {
+		oauth2Client := providers.TokenProvider(c.MustGet("oauth2Client").(model.Authentication), oauth2Token)
 
-		user, err := oauth2Client.UserInfo(oauth2Token.(*oauth2.Token))
+		user, err := oauth2Client.UserInfo(oauth2Token)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
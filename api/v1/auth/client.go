@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// clientGrant is what a registered client's authorization request was made
+// with.  It is kept with the state, then the code, until the code is exchanged.
+type clientGrant struct {
+	ClientID  string
+	Redirect  string
+	Challenge string
+}
+
+// authorizeClient checks the client, redirect URI and PKCE challenge of an
+// authorization request.  A request without a client or redirect URI is the
+// web app's own and has no client or grant.
+func authorizeClient(c *gin.Context, loginVals *model.Auth) (*model.Client, *clientGrant, bool) {
+	if loginVals.Client == "" && loginVals.Redirect == "" {
+		return nil, nil, true
+	}
+
+	client, err := core.ReadClient(loginVals.Client, loginVals.Redirect)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("client is not registered")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unauthorized_client", "error_description": err.Error()})
+		return nil, nil, false
+	}
+
+	if loginVals.CodeChallenge != "" && loginVals.CodeChallengeMethod != "S256" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "code_challenge_method must be S256"})
+		return nil, nil, false
+	}
+
+	if client.RequiresPKCE() && loginVals.CodeChallenge == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "code_challenge is required"})
+		return nil, nil, false
+	}
+
+	redirect := loginVals.Redirect
+	if redirect == "" {
+		redirect = client.RedirectURIs[0]
+	}
+
+	return client, &clientGrant{
+		ClientID:  client.Id,
+		Redirect:  redirect,
+		Challenge: loginVals.CodeChallenge,
+	}, true
+}
+
+// saveGrant keeps a grant until the state or code it was issued with is used
+func saveGrant(cacheDb *cache.Cache, key string, grant *clientGrant) {
+	if grant != nil && key != "" {
+		cacheDb.Set("client-"+key, grant, 1*time.Hour)
+	}
+}
+
+// savedGrant finds the grant a code or state was issued with
+func savedGrant(cacheDb *cache.Cache, loginVals *model.Auth) *clientGrant {
+	for _, key := range []string{loginVals.Code, loginVals.State} {
+		if v, exists := cacheDb.Get("client-" + key); key != "" && exists {
+			return v.(*clientGrant)
+		}
+	}
+	return nil
+}
+
+// verifyClient checks a code exchange against the grant it was issued with:
+// the redirect URI must match and the PKCE code verifier must answer the
+// challenge.  It returns the client, or nil for the web app.
+func verifyClient(c *gin.Context, cacheDb *cache.Cache, loginVals *model.Auth) (*model.Client, bool) {
+	grant := savedGrant(cacheDb, loginVals)
+
+	if grant == nil {
+		if loginVals.Client == "" && loginVals.Redirect == "" {
+			return nil, true
+		}
+
+		// a code that didn't come through oauth2_url or login has no challenge
+		client, err := core.ReadClient(loginVals.Client, loginVals.Redirect)
+		if err != nil || client.RequiresPKCE() {
+			log.WithFields(log.Fields{
+				"err":          err,
+				"redirect_uri": loginVals.Redirect,
+			}).Error("code was not issued to a registered client")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return nil, false
+		}
+		return client, true
+	}
+
+	client, err := core.ReadClient(grant.ClientID, grant.Redirect)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("client is no longer registered")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return nil, false
+	}
+
+	if loginVals.Redirect != "" && loginVals.Redirect != grant.Redirect {
+		log.WithFields(log.Fields{
+			"redirect_uri": loginVals.Redirect,
+			"client_id":    grant.ClientID,
+		}).Error("redirect_uri does not match the authorization request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return nil, false
+	}
+
+	if grant.Challenge != "" && !core.VerifyCodeChallenge(grant.Challenge, loginVals.CodeVerifier) {
+		log.WithFields(log.Fields{
+			"client_id": grant.ClientID,
+		}).Error("code_verifier does not match the code challenge")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return nil, false
+	}
+
+	return client, true
+}
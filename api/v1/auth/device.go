@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// the grant type an agent polls /auth/device/token with
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+type deviceCodeRequest struct {
+	ClientId string `json:"client_id" form:"client_id"`
+	Scope    string `json:"scope"     form:"scope"`
+	Name     string `json:"name"      form:"name"`
+	Platform string `json:"platform"  form:"platform"`
+	OS       string `json:"os"        form:"os"`
+	Arch     string `json:"arch"      form:"arch"`
+}
+
+type deviceTokenRequest struct {
+	GrantType  string `json:"grant_type"  form:"grant_type"`
+	DeviceCode string `json:"device_code" form:"device_code"`
+}
+
+type deviceApproveRequest struct {
+	UserCode  string `json:"user_code"`
+	AccountID string `json:"accountid"`
+	Name      string `json:"name"`
+}
+
+// an agent without a browser asks for a code a person can approve
+func deviceAuthCode(c *gin.Context) {
+	var req deviceCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": err.Error()})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "name is required"})
+		return
+	}
+
+	deviceCode, da, err := core.StartDeviceAuthorization(req.Name, req.Platform, req.OS, req.Arch, c.ClientIP())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to start device authorization")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	userCode := core.FormatUserCode(da.UserCode)
+	verification := os.Getenv("SERVER") + "/device"
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verification,
+		"verification_uri_complete": verification + "?user_code=" + userCode,
+		"expires_in":                int(da.Expires.Sub(da.Created).Seconds()),
+		"interval":                  da.Interval,
+	})
+}
+
+// the agent polls until the code is approved, then receives its device and api key
+func deviceAuthToken(c *gin.Context) {
+	var req deviceTokenRequest
+	if err := c.ShouldBind(&req); err != nil || req.DeviceCode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	if req.GrantType != deviceCodeGrantType {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	// agents understand slow_down, not 429s
+	if ok, _ := core.Allow("device_token", "ip:"+c.ClientIP()); !ok {
+		log.Infof("rate limit device_token reached by %s", c.ClientIP())
+		c.JSON(http.StatusBadRequest, gin.H{"error": core.ErrSlowDown.Error()})
+		return
+	}
+
+	device, err := core.PollDeviceAuthorization(req.DeviceCode)
+	switch err {
+	case nil:
+	case core.ErrAuthorizationPending, core.ErrSlowDown, core.ErrAccessDenied, core.ErrExpiredToken, core.ErrInvalidGrant:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to poll device authorization")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": device.ApiKey,
+		"token_type":   "X-API-KEY",
+		"device":       device,
+	})
+}
+
+// show the device waiting behind a user code before it is approved
+func deviceAuthRead(c *gin.Context) {
+	if _, err := tokenEmail(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	da, err := core.ReadDeviceAuthorization(c.Query("user_code"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	da.UserCode = core.FormatUserCode(da.UserCode)
+
+	c.JSON(http.StatusOK, da)
+}
+
+// an owner or admin approves the device into one of their accounts
+func deviceAuthApprove(c *gin.Context) {
+	if _, err := tokenEmail(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req deviceApproveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	device, err := core.ApproveDeviceAuthorization(req.UserCode, req.AccountID, strings.TrimSpace(req.Name), core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to approve device")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+// refuse the device waiting behind a user code
+func deviceAuthDeny(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req deviceApproveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = core.DenyDeviceAuthorization(req.UserCode, email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
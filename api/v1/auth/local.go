@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	providers "github.com/nettica-com/nettica-admin/auth"
+	"github.com/nettica-com/nettica-admin/auth/local"
+	core "github.com/nettica-com/nettica-admin/core"
+	log "github.com/sirupsen/logrus"
+)
+
+type localRequest struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Current  string `json:"current"`
+	Token    string `json:"token"`
+}
+
+// localEnabled binds the request and makes sure the local provider is in use
+func localEnabled(c *gin.Context, req *localRequest) bool {
+	oauth2Client, _ := providers.Provider("local")
+	if _, ok := oauth2Client.(*local.Local); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "local users are not enabled"})
+		return false
+	}
+
+	if err := c.ShouldBindJSON(req); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// self-service signup, when LOCAL_ALLOW_SIGNUP is set
+func localSignup(c *gin.Context) {
+	var req localRequest
+	if !localEnabled(c, &req) {
+		return
+	}
+
+	err := core.LocalSignup(req.Email, req.Name, req.Password)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("local signup failed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "Check your email to verify your address"})
+}
+
+// verify the email address from the signup link
+func localVerify(c *gin.Context) {
+	var req localRequest
+	if !localEnabled(c, &req) {
+		return
+	}
+
+	err := core.LocalVerify(req.Email, req.Token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("local verify failed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// email a password reset link.  The response is the same whether or not the user exists.
+func localRequestReset(c *gin.Context) {
+	var req localRequest
+	if !localEnabled(c, &req) {
+		return
+	}
+
+	err := core.LocalRequestReset(req.Email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("local password reset request failed")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "If the address is registered, a reset link has been sent"})
+}
+
+// set a new password with the token from the reset link
+func localReset(c *gin.Context) {
+	var req localRequest
+	if !localEnabled(c, &req) {
+		return
+	}
+
+	err := core.LocalReset(req.Email, req.Token, req.Password)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("local password reset failed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
+
+// change the password given the current one.  A wrong current password
+// counts towards locking the user out, the same as a failed login.
+func localChangePassword(c *gin.Context) {
+	var req localRequest
+	if !localEnabled(c, &req) {
+		return
+	}
+
+	if !allowLogin(c, req.Email) {
+		return
+	}
+
+	err := core.LocalChangePassword(req.Email, req.Current, req.Password)
+	if errors.Is(err, core.ErrInvalidLogin) {
+		core.LoginFailed(req.Email)
+		core.RecordLogin(req.Email, "local", false, "invalid password on password change", c.ClientIP(), c.Request.UserAgent())
+	} else if err == nil {
+		core.LoginSucceeded(req.Email)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("local password change failed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
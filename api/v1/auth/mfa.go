@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	providers "github.com/nettica-com/nettica-admin/auth"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	util "github.com/nettica-com/nettica-admin/util"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// a login waiting for its second factor.  The cache hands every request the
+// same challenge, so its attempts are counted under a lock.
+type mfaChallenge struct {
+	Email string
+	Auth  model.Auth
+
+	mu       sync.Mutex
+	attempts int
+}
+
+// attempt counts an attempt at the challenge and returns how many there's been
+func (m *mfaChallenge) attempt() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	return m.attempts
+}
+
+const mfaChallengeLifetime = 10 * time.Minute
+const mfaMaxAttempts = 5
+
+type mfaRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// startMFA parks a successful password login until the second factor is given
+func startMFA(c *gin.Context, cacheDb *cache.Cache, loginVals *model.Auth, email string) {
+
+	challenge, err := util.GenerateRandomString(32)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to generate random string")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	mode := "verify"
+	if !core.MFAEnabled(email) {
+		mode = "enroll"
+	}
+
+	cacheDb.Set("mfa-"+challenge, &mfaChallenge{Email: email, Auth: *loginVals}, mfaChallengeLifetime)
+
+	c.JSON(http.StatusOK, model.Auth{
+		ClientId:  loginVals.ClientId,
+		State:     loginVals.State,
+		MFA:       mode,
+		Challenge: challenge,
+	})
+}
+
+func getChallenge(cacheDb *cache.Cache, challenge string) (*mfaChallenge, bool) {
+	if challenge == "" {
+		return nil, false
+	}
+	v, exists := cacheDb.Get("mfa-" + challenge)
+	if !exists {
+		return nil, false
+	}
+	return v.(*mfaChallenge), true
+}
+
+// tokenEmail returns the email of the user holding the bearer token, who
+// makes the request
+func tokenEmail(c *gin.Context) (string, error) {
+	oauth2Token, exists := requestToken(c)
+	if !exists {
+		return "", errors.New("not logged in")
+	}
+
+	oauth2Client := providers.TokenProvider(c.MustGet("oauth2Client").(model.Authentication), oauth2Token)
+	user, err := oauth2Client.UserInfo(oauth2Token)
+	if err != nil {
+		return "", err
+	}
+	core.SetUserActor(c, oauth2Token, user.Email)
+
+	return user.Email, nil
+}
+
+// start enrolling an authenticator, either as part of a login that
+// requires one or from a logged in session
+func mfaEnroll(c *gin.Context) {
+	var req mfaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	email := ""
+	if req.Challenge != "" {
+		challenge, exists := getChallenge(cacheDb, req.Challenge)
+		// an enrolled user must prove their current authenticator first
+		if !exists || core.MFAEnabled(challenge.Email) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge"})
+			return
+		}
+		email = challenge.Email
+	} else {
+		var err error
+		email, err = tokenEmail(c)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// replacing an enabled authenticator takes a current code from it
+	enrollment, err := core.BeginMFAEnrollment(email, req.Code)
+	if errors.Is(err, core.ErrInvalidMFACode) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to start mfa enrollment")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// finish a login with a TOTP or recovery code.  A login that is enrolling
+// confirms the new authenticator and gets its recovery codes back.
+func mfaVerify(c *gin.Context) {
+	var req mfaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	challenge, exists := getChallenge(cacheDb, req.Challenge)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid challenge"})
+		return
+	}
+
+	if challenge.attempt() > mfaMaxAttempts {
+		cacheDb.Delete("mfa-" + req.Challenge)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "too many attempts, login again"})
+		return
+	}
+
+	var codes []string
+	var err error
+	if core.MFAEnabled(challenge.Email) {
+		err = core.VerifyMFA(challenge.Email, req.Code)
+	} else {
+		codes, err = core.ConfirmMFAEnrollment(challenge.Email, req.Code)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"email": challenge.Email,
+		}).Error("mfa verification failed")
+		core.RecordLogin(challenge.Email, challenge.Auth.Provider, false, "second factor failed", c.ClientIP(), c.Request.UserAgent())
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	cacheDb.Delete("mfa-" + req.Challenge)
+
+	loginVals := challenge.Auth
+	loginVals.Recovery = codes
+
+	issueLoginCode(c, cacheDb, &loginVals, false)
+}
+
+// MFA status of the logged in user
+func mfaStatus(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	m, err := core.ReadMFA(email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, m)
+}
+
+// confirm an authenticator enrolled from a logged in session
+func mfaConfirm(c *gin.Context) {
+	var req mfaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := core.ConfirmMFAEnrollment(email, req.Code)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// replace the recovery codes
+func mfaRecovery(c *gin.Context) {
+	var req mfaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := core.RegenerateRecoveryCodes(email, req.Code)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// turn MFA off, unless an account requires it
+func mfaDisable(c *gin.Context) {
+	var req mfaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	err = core.DisableMFA(email, req.Code)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "OK"})
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	providers "github.com/nettica-com/nettica-admin/auth"
+	"github.com/nettica-com/nettica-admin/auth/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// samlProvider returns the SAML provider, or answers 404 if it is not enabled
+func samlProvider(c *gin.Context) (*saml.Saml, bool) {
+	oauth2Client, _ := providers.Provider("saml")
+	p, ok := oauth2Client.(*saml.Saml)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "saml is not enabled"})
+		return nil, false
+	}
+	return p, true
+}
+
+// the service provider metadata to register with the IdP
+func samlMetadata(c *gin.Context) {
+	p, ok := samlProvider(c)
+	if !ok {
+		return
+	}
+
+	metadata, err := p.Metadata()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create saml metadata")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// the assertion consumer service the IdP posts its response to
+func samlACS(c *gin.Context) {
+	p, ok := samlProvider(c)
+	if !ok {
+		return
+	}
+
+	redirect, err := p.ACS(c.Request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("saml response rejected")
+		c.JSON(http.StatusForbidden, gin.H{"error": "SAML login failed"})
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, redirect)
+}
@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	providers "github.com/nettica-com/nettica-admin/auth"
+	"github.com/nettica-com/nettica-admin/auth/session"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	util "github.com/nettica-com/nettica-admin/util"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// refreshTokenHeader carries the refresh token of a new session
+const refreshTokenHeader = "X-Refresh-Token"
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// sendToken answers a completed login with the token the client will use.
+// The provider is asked about the user once, for the login history.  With
+// session tokens on the client gets a signed session token in place of the
+// provider's, which any API replica can verify.
+func sendToken(c *gin.Context, cacheDb *cache.Cache, oauth2Token *oauth2.Token, name string) {
+	providers.SetTokenProvider(oauth2Token, name)
+
+	oauth2Client := providers.TokenProvider(c.MustGet("oauth2Client").(model.Authentication), oauth2Token)
+
+	user, err := oauth2Client.UserInfo(oauth2Token)
+	if err == nil {
+		core.RecordLogin(user.Email, providers.TokenProviderName(oauth2Token), true, "", c.ClientIP(), c.Request.UserAgent())
+	}
+
+	if core.SessionsEnabled() {
+		if err == nil {
+			var raw, refresh string
+			raw, refresh, err = core.IssueSession(user, providers.TokenProviderName(oauth2Token), c.Request.UserAgent(), c.ClientIP())
+			if err == nil {
+				// the body stays the bare token the apps expect
+				c.Header(refreshTokenHeader, refresh)
+				c.JSON(http.StatusOK, raw)
+				return
+			}
+		}
+
+		// the provider's token still works on this replica
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to issue session token")
+	}
+
+	cacheDb.Set(oauth2Token.AccessToken, oauth2Token, 24*time.Hour)
+
+	c.JSON(http.StatusOK, oauth2Token.AccessToken)
+}
+
+// requestToken returns the token the request was made with
+func requestToken(c *gin.Context) (*oauth2.Token, bool) {
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	return providers.FindToken(cacheDb, util.GetCleanAuthToken(c))
+}
+
+// revokeToken logs out a token.  Session tokens go on the shared denylist,
+// provider tokens are dropped from the cache.
+func revokeToken(cacheDb *cache.Cache, oauth2Token *oauth2.Token) {
+	if claims, ok := session.Claims(oauth2Token); ok {
+		err := core.RevokeSession(claims)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("failed to revoke session")
+		}
+		return
+	}
+
+	cacheDb.Delete(oauth2Token.AccessToken)
+}
+
+// the public keys session tokens are signed with
+func jwks(c *gin.Context) {
+	keys, err := core.SessionJWKS()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read session keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, keys)
+}
+
+// exchange a refresh token for a new session token.  The refresh token is
+// rotated, the one sent can't be used again.
+func refresh(c *gin.Context) {
+	var req refreshRequest
+	if err := c.ShouldBind(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	raw, refresh, err := core.RefreshSession(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to refresh session")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":  raw,
+		"token_type":    "Bearer",
+		"refresh_token": refresh,
+		"expires_in":    int(core.SessionLifetime().Seconds()),
+	})
+}
+
+// list the sessions of the logged in user
+func sessions(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	sessions, err := core.ReadSessions(email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read sessions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if t, exists := requestToken(c); exists {
+		if claims, ok := session.Claims(t); ok {
+			for _, s := range sessions {
+				s.Current = s.Id == claims.SessionID
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// log out one of the logged in user's sessions
+func deleteSession(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	err = core.DeleteSession(email, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// the login history of the logged in user.  Owners and admins can read the
+// history of a member of their accounts with ?email=
+func history(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if member := c.Query("email"); member != "" && member != email {
+		if !core.ManagesMember(email, member) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		email = member
+	}
+
+	events, err := core.ReadLoginHistory(email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read login history")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/nettica-com/nettica-admin/auth/passkey"
+	core "github.com/nettica-com/nettica-admin/core"
+	util "github.com/nettica-com/nettica-admin/util"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+// a registration or login ceremony waiting for the authenticator's response
+type webauthnCeremony struct {
+	Email   string
+	Session webauthn.SessionData
+}
+
+const webauthnCeremonyLifetime = 5 * time.Minute
+
+type webauthnLoginRequest struct {
+	Email string `json:"email"`
+}
+
+// startCeremony caches the session data and returns the id the client sends back
+func startCeremony(c *gin.Context, email string, session *webauthn.SessionData, options interface{}) {
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	id, err := util.GenerateRandomString(32)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to generate random string")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cacheDb.Set("webauthn-"+id, &webauthnCeremony{Email: email, Session: *session}, webauthnCeremonyLifetime)
+
+	c.JSON(http.StatusOK, gin.H{"session": id, "options": options})
+}
+
+// finishCeremony returns the cached ceremony, which can only be used once
+func finishCeremony(c *gin.Context) (*webauthnCeremony, bool) {
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	id := c.Query("session")
+	if id == "" {
+		return nil, false
+	}
+
+	v, exists := cacheDb.Get("webauthn-" + id)
+	if !exists {
+		return nil, false
+	}
+	cacheDb.Delete("webauthn-" + id)
+
+	ceremony, ok := v.(*webauthnCeremony)
+	return ceremony, ok
+}
+
+// start registering a passkey for the logged in user
+func webauthnRegisterBegin(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	options, session, err := core.BeginPasskeyRegistration(email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to begin passkey registration")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	startCeremony(c, email, session, options)
+}
+
+// the body is the credential created by the authenticator
+func webauthnRegisterFinish(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ceremony, ok := finishCeremony(c)
+	if !ok || ceremony.Email != email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "registration has expired, please try again"})
+		return
+	}
+
+	wc, err := core.FinishPasskeyRegistration(email, strings.TrimSpace(c.Query("name")), ceremony.Session, c.Request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to finish passkey registration")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, wc)
+}
+
+// list the passkeys of the logged in user
+func webauthnCredentials(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	credentials, err := core.ReadPasskeys(email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read passkeys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// remove one of the logged in user's passkeys
+func webauthnDeleteCredential(c *gin.Context) {
+	email, err := tokenEmail(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	err = core.DeletePasskey(email, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// start a passkey login, optionally for a given email
+func webauthnLoginBegin(c *gin.Context) {
+	var req webauthnLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	options, session, err := core.BeginPasskeyLogin(strings.ToLower(strings.TrimSpace(req.Email)))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to begin passkey login")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	startCeremony(c, "", session, options)
+}
+
+// the body is the assertion signed by the authenticator.  A passkey with user
+// verification is already two factors, so no MFA challenge follows it.
+func webauthnLoginFinish(c *gin.Context) {
+	cacheDb := c.MustGet("cache").(*cache.Cache)
+
+	ceremony, ok := finishCeremony(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "login has expired, please try again"})
+		return
+	}
+
+	email, err := core.FinishPasskeyLogin(ceremony.Session, c.Request)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("passkey login failed")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	oauth2Token, err := passkey.NewToken(email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create token")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Passkey login for %s", email)
+
+	sendToken(c, cacheDb, oauth2Token, passkey.Provider)
+}
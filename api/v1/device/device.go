@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -24,9 +25,12 @@ func ApplyRoutes(r *gin.RouterGroup) {
 		g.GET("/:id", readDevice)
 		g.PATCH("/:id", updateDevice)
 		g.DELETE("/:id", deleteDevice)
+		g.POST("/:id/lock", lockDevice)
+		g.DELETE("/:id/lock", unlockDevice)
 		g.POST("/:id/push", pushDevice)
 		g.GET("", readDevices)
-		g.GET("/:id/status", statusDevice)
+		g.GET("/:id/status", core.RateLimit("status"), statusDevice)
+		g.POST("/:id/handshakes", core.RateLimit("status"), reportHandshakes)
 	}
 
 }
@@ -98,7 +102,7 @@ func createDevice(c *gin.Context) {
 		}
 	}
 
-	client, err := core.CreateDevice(&data)
+	client, err := core.CreateDevice(&data, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -138,31 +142,8 @@ func pushDevice(c *gin.Context) {
 
 	log.Infof("Push Device: %v", p)
 
-	//if !p.IsVoIP && strings.Contains(p.Message, "is calling") {
-	//	log.Warn("VoIP message detected but IsVoIP is false, setting IsVoIP to true")
-	//	p.IsVoIP = true
-	//}
-
-	if p.IsVoIP {
-		token, exists := core.Push.VoipDevices[p.ToDeviceID]
-		if exists {
-			err := core.Push.SendVoipNotification(token, p.Title, p.Message)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send voip notification")
-				c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"message": "VoIP notification sent"})
-			return
-		}
-	}
-
-	// fallback to regular push if voip push fails or if it's not a voip push
-
-	tok, exists := core.Push.PushDevices[p.ToDeviceID]
-	if !exists {
+	err := core.PushDevice(&p)
+	if err != nil {
 		log.WithFields(log.Fields{
 			"device": p.ToDeviceID,
 		}).Error("device not found in push devices")
@@ -170,14 +151,6 @@ func pushDevice(c *gin.Context) {
 		return
 	}
 
-	err := core.Push.SendPushNotification(tok, p.Title, p.Message, p.IsVoIP)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to send push notification")
-		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
-		return
-	}
 	c.JSON(http.StatusOK, gin.H{"message": "Push notification sent"})
 }
 
@@ -307,43 +280,15 @@ func updateDevice(c *gin.Context) {
 		data.UpdatedBy = account.Email
 	}
 
-	client, err := core.UpdateDevice(id, &data, false)
+	client, err := core.UpdateDevice(id, &data, false, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("failed to update device")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	core.FlushCache(id)
-
-	if client.Push != nil && *client.Push != "" {
-		// Add the push token to the list of push devices
-		if core.Push.PushDevices[id] != *client.Push {
-			core.Push.RemovePushToken(core.Push.PushDevices[id])
-			core.Push.AddDevice(id, *client.Push)
-		}
-		err = core.Push.SendPushNotification(*data.Push, "Device Updated", "Device "+device.Name+" has been updated")
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("failed to send push notification")
-		}
-	} else {
-		// Remove the push token from the list of push devices
-		core.Push.RemoveDevice(id)
-	}
-
-	if client.VoIP != nil && *client.VoIP != "" {
-		if core.Push.VoipDevices[id] != *client.VoIP {
-			core.Push.RemoveVoipDevice(id)
-			core.Push.AddVoipDevice(id, *client.VoIP)
-		}
-	} else {
-		core.Push.RemoveVoipDevice(id)
-	}
-
 	c.JSON(http.StatusOK, client)
 }
 
@@ -359,6 +304,7 @@ func updateDevice(c *gin.Context) {
 // @Failure 401 {object} error
 // @Failure 403 {object} error
 // @Failure 404 {object} error
+// @Failure 409 {object} error
 // @Router /device/{id} [delete]
 func deleteDevice(c *gin.Context) {
 	id := c.Param("id")
@@ -385,12 +331,17 @@ func deleteDevice(c *gin.Context) {
 		log.Infof("Device %s deleted itself", device.Id)
 	}
 
-	err = core.DeleteDevice(id)
+	err = core.DeleteDevice(id, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("failed to delete device")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := core.LockedStatus(err, http.StatusInternalServerError)
+		if errors.Is(err, core.ErrCritical) {
+			// its vpns in critical networks have to leave them with change requests first
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -485,13 +436,21 @@ func statusDevice(c *gin.Context) {
 		if !device.Registered {
 			device.Registered = true
 			device.EZCode = ""
-			_, err = core.UpdateDevice(device.Id, device, true)
+			_, err = core.UpdateDevice(device.Id, device, true, core.RequestActor(c))
 			if err != nil {
 				log.Error(err)
 			}
 		}
 	}
 
+	// without its api key a device is throttled, so the shortcuts below can't be guessed
+	if !authorized {
+		if ok, wait := core.Allow("device", deviceId); !ok {
+			core.TooManyRequests(c, wait)
+			return
+		}
+	}
+
 	if !authorized && !device.Registered && (device.InstanceID != "" || device.EZCode != "") {
 		authorized = true
 	}
@@ -511,10 +470,11 @@ func statusDevice(c *gin.Context) {
 		e := m.(string)
 		if e == etag {
 			c.AbortWithStatus(http.StatusNotModified)
+			actor := core.RequestActor(c)
 			go func() {
 				now := time.Now()
 				device.LastSeen = &now
-				_, err = core.UpdateDevice(device.Id, device, true)
+				_, err = core.UpdateDevice(device.Id, device, true, actor)
 				if err != nil {
 					log.Error(err)
 				}
@@ -680,7 +640,10 @@ func statusDevice(c *gin.Context) {
 					}
 					if update {
 						client.UpdatedBy = device.Name
-						core.UpdateVPN(client.Id, client, true)
+						err = core.ReportVPNEndpoint(client.Id, client.Current.Endpoint, client.Current.ListenPort, device.Name)
+						if err != nil {
+							log.Errorf("failed to record the endpoint of vpn %s: %v", client.Id, err)
+						}
 					}
 				}
 				//				device2 := *device
@@ -738,7 +701,7 @@ func statusDevice(c *gin.Context) {
 
 	now := time.Now()
 	device.LastSeen = &now
-	_, err = core.UpdateDevice(device.Id, device, true)
+	_, err = core.UpdateDevice(device.Id, device, true, core.RequestActor(c))
 	if err != nil {
 		log.Error(err)
 	}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// reportHandshakes records the latest handshakes of a device's VPNs
+// @Summary Report handshakes
+// @Description Agents report the time of the latest WireGuard handshake on each of the device's VPNs, so staged rollouts can tell whether canaries still connect
+// @Tags devices
+// @Security apiKey
+// @Accept  json
+// @Param id path string true "Device ID"
+// @Param handshakes body []model.Handshake true "Latest handshake of each VPN, by VPN ID"
+// @Success 200 {object} string "OK"
+// @Failure 401 {object} error
+// @Router /device/{id}/handshakes [post]
+func reportHandshakes(c *gin.Context) {
+	device, err := core.ReadDevice(c.Param("id"))
+	if err != nil || device.ApiKey == "" || device.ApiKey != c.Request.Header.Get("X-API-KEY") {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	var handshakes []*model.Handshake
+	if err := c.ShouldBindJSON(&handshakes); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = core.ReportHandshakes(device, handshakes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to record handshakes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+)
+
+// lockDevice makes a device read only
+// @Summary Lock a device
+// @Description Make a device read only until you or an owner release it, or the lock expires.  Locking it again changes the reason or expiry.
+// @Tags devices
+// @Accept  json
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Device ID"
+// @Param lock body model.Lock false "Reason and expiry"
+// @Success 200 {object} model.Device
+// @Failure 423 {object} error
+// @Router /device/{id}/lock [post]
+func lockDevice(c *gin.Context) {
+	core.LockFromContext(c, "device")
+}
+
+// unlockDevice releases the lock of a device
+// @Summary Unlock a device
+// @Description Release the lock of a device.  Only whoever holds the lock or an owner can, unless it has expired.
+// @Tags devices
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Device ID"
+// @Success 200 {object} model.Device
+// @Failure 403 {object} error
+// @Failure 423 {object} error
+// @Router /device/{id}/lock [delete]
+func unlockDevice(c *gin.Context) {
+	core.UnlockFromContext(c, "device")
+}
@@ -0,0 +1,148 @@
+package net
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// changeFromContext returns the network in the request, one of its change
+// requests, and the member making the request
+func changeFromContext(c *gin.Context) (*model.Account, *model.Network, *model.ChangeRequest, bool) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return nil, nil, nil, false
+	}
+	net := v.(*model.Network)
+
+	if account.Status == "Suspended" {
+		log.Infof("changeFromContext: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return nil, nil, nil, false
+	}
+
+	request, err := core.ReadChangeRequest(c.Param("cid"))
+	if err != nil || request.NetId != net.Id {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return nil, nil, nil, false
+	}
+
+	return account, net, request, true
+}
+
+// readChangeRequests lists the change requests of a network
+// @Summary List the change requests of a network
+// @Description List the changes to a critical network held for approval, newest first
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Success 200 {array} model.ChangeRequest
+// @Failure 400 {object} error
+// @Router /net/{id}/changes [get]
+func readChangeRequests(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account.Status == "Suspended" {
+		log.Infof("readChangeRequests: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	requests, err := core.ReadChangeRequests(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read change requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// approveChangeRequest makes a change held for approval
+// @Summary Approve a change request
+// @Description Approve and make a pending change to a critical network.  It must be approved by an owner or admin other than whoever asked for it.
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param cid path string true "Change request ID"
+// @Success 200 {object} model.ChangeRequest
+// @Failure 400 {object} error
+// @Router /net/{id}/changes/{cid}/approve [post]
+func approveChangeRequest(c *gin.Context) {
+	account, _, request, ok := changeFromContext(c)
+	if !ok {
+		return
+	}
+
+	_, err := core.ApproveChangeRequest(request, account, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to approve change request")
+		c.JSON(core.LockedStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+
+	request, err = core.ReadChangeRequest(request.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
+
+// rejectChangeRequest turns down a change held for approval
+// @Summary Reject a change request
+// @Description Reject a pending change to a critical network, or withdraw your own
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param cid path string true "Change request ID"
+// @Success 200 {object} model.ChangeRequest
+// @Failure 400 {object} error
+// @Router /net/{id}/changes/{cid}/reject [post]
+func rejectChangeRequest(c *gin.Context) {
+	account, _, request, ok := changeFromContext(c)
+	if !ok {
+		return
+	}
+
+	err := core.RejectChangeRequest(request, account)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to reject change request")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request, err = core.ReadChangeRequest(request.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, request)
+}
@@ -0,0 +1,37 @@
+package net
+
+import (
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+)
+
+// lockNet makes a network read only
+// @Summary Lock a network
+// @Description Make a network read only until you or an owner release it, or the lock expires.  Locking it again changes the reason or expiry.
+// @tags net
+// @Accept  json
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param lock body model.Lock false "Reason and expiry"
+// @Success 200 {object} model.Network
+// @Failure 423 {object} error
+// @Router /net/{id}/lock [post]
+func lockNet(c *gin.Context) {
+	core.LockFromContext(c, "net")
+}
+
+// unlockNet releases the lock of a network
+// @Summary Unlock a network
+// @Description Release the lock of a network.  Only whoever holds the lock or an owner can, unless it has expired.
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Success 200 {object} model.Network
+// @Failure 403 {object} error
+// @Failure 423 {object} error
+// @Router /net/{id}/lock [delete]
+func unlockNet(c *gin.Context) {
+	core.UnlockFromContext(c, "net")
+}
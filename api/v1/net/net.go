@@ -7,7 +7,6 @@ import (
 	"github.com/gin-gonic/gin"
 	core "github.com/nettica-com/nettica-admin/core"
 	model "github.com/nettica-com/nettica-admin/model"
-	"github.com/nettica-com/nettica-admin/util"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -20,6 +19,17 @@ func ApplyRoutes(r *gin.RouterGroup) {
 		g.GET("/:id", readNet)
 		g.PATCH("/:id", updateNet)
 		g.DELETE("/:id", deleteNet)
+		g.POST("/:id/lock", lockNet)
+		g.DELETE("/:id/lock", unlockNet)
+		g.GET("/:id/revisions", readNetRevisions)
+		g.GET("/:id/revisions/:number/diff", diffNetRevision)
+		g.POST("/:id/revisions/:number/rollback", rollbackNet)
+		g.GET("/:id/rollouts", readRollouts)
+		g.POST("/:id/rollouts/:rid/approve", approveRollout)
+		g.POST("/:id/rollouts/:rid/abort", abortRollout)
+		g.GET("/:id/changes", readChangeRequests)
+		g.POST("/:id/changes/:cid/approve", approveChangeRequest)
+		g.POST("/:id/changes/:cid/reject", rejectChangeRequest)
 		g.GET("", readNetworks)
 	}
 }
@@ -98,7 +108,7 @@ func createNet(c *gin.Context) {
 		}
 	}
 
-	client, err := core.CreateNet(&data)
+	client, err := core.CreateNet(&data, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -142,14 +152,20 @@ func readNet(c *gin.Context) {
 
 // UpdateNet updates a network
 // @Summary Update a network
-// @Description Update a network
+// @Description Update a network.  With dryRun, nothing is saved; the changes to the network and to each VPN a forced update would rewrite are returned with any validation errors, locks, or the change request a critical network needs.  A network with a rollout in progress can't be previewed.  With canaryTag or canaryPercent, a forced update is rolled out to canary VPNs first and the rollout is returned.
 // @tags net
 // @Accept  json
 // @Produce  json
 // @Security apiKey
 // @Param id path string true "Network ID"
 // @Param net body model.Network true "Network"
+// @Param dryRun query bool false "Preview the update"
+// @Param canaryTag query string false "Roll a forced update out to the online VPNs with this tag first"
+// @Param canaryPercent query int false "Roll a forced update out to this percentage of the VPNs first"
+// @Param wait query string false "How long the canaries must stay healthy, 15m by default"
+// @Param auto query bool false "Finish the rollout without approval once the canaries are healthy"
 // @Success 200 {object} model.Network
+// @Success 202 {object} model.ChangeRequest
 // @Failure 400 {object} error
 // @Router /net/{id} [patch]
 func updateNet(c *gin.Context) {
@@ -224,133 +240,55 @@ func updateNet(c *gin.Context) {
 
 	data.UpdatedBy = account.Email
 
-	result, err := core.UpdateNet(id, &data)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to update network")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if rollout, ok := core.ActiveRollout(id); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout " + rollout.Id + " of this network is in progress"})
 		return
 	}
 
-	updateMTU := false
-	updateAddress := false
-	updateDNS := false
-	updateAllowed := false
-	updateFailSafe := false
-	updatePresharedKey := false
-	if data.ForceUpdate {
-		log.Infof("updateNet: force update for %s %s", data.NetName, id)
-		if data.Default.Mtu != net.Default.Mtu {
-			log.Infof("updateNet: updateMTU for %s %d", data.NetName, data.Default.Mtu)
-			updateMTU = true
-		}
-		if !util.CompareArrays(data.Default.Address, net.Default.Address) {
-			log.Infof("updateNet: updateAddress for %s %v", data.NetName, data.Default.Address)
-			updateAddress = true
-			updateDNS = true
-		}
-		if !util.CompareArrays(data.Default.AllowedIPs, net.Default.AllowedIPs) {
-			log.Infof("updateNet: updateAllowed for %s %v", data.NetName, data.Default.AllowedIPs)
-			updateAllowed = true
-		}
-		if data.Default.FailSafe != net.Default.FailSafe {
-			log.Infof("updateNet: updateFailSafe for %s %v", data.NetName, data.Default.FailSafe)
-			updateFailSafe = true
+	// a preview reports what would stop the change being made now
+	if c.Query("dryRun") == "true" {
+		preview, err := core.PreviewNetChange(net, &data)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("failed to preview network update")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
-		if data.Default.PresharedKey != net.Default.PresharedKey {
-			log.Infof("updateNet: updatePresharedKey for %s", data.NetName)
-			updatePresharedKey = true
+		if net.Critical {
+			preview.Errors = append(preview.Errors, "network "+net.NetName+" is critical, the change will wait for an approved change request")
 		}
-	}
-	// Clear the device cache for policy changes
-	vpns, err := core.ReadVPN2("netid", net.Id)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to read vpns")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusOK, preview)
 		return
 	}
 
-	for _, v := range vpns {
-		changed := false
-		if updateMTU && (v.Current.Mtu != data.Default.Mtu || v.Default.Mtu != data.Default.Mtu) {
-			log.Infof("updateNet: updateMTU for %s %d", v.Id, data.Default.Mtu)
-			v.Default.Mtu = data.Default.Mtu
-			v.Current.Mtu = data.Default.Mtu
-			changed = true
-		}
-		if updateDNS {
-			log.Infof("updateNet: updateDNS for %s %v", v.Id, data.Default.Address)
-			v.Default.Dns = data.Default.Dns
-			for x, dns := range v.Current.Dns {
-				if dns == v.Current.Address[0] {
-					v.Current.Dns = append(v.Current.Dns[:x], v.Current.Dns[x+1:]...)
-					break
-				}
-				ip, err := util.GetIpFromCidr(v.Current.Address[0])
-				if err == nil && dns == ip {
-					v.Current.Dns = append(v.Current.Dns[:x], v.Current.Dns[x+1:]...)
-					break
-				}
-			}
-			changed = true
-		}
-		if updateAddress && !util.CompareArrays(v.Default.Address, data.Default.Address) {
-			log.Infof("updateNet: updateAddress for %s %v", v.Id, data.Default.Address)
-			v.Default.Address = data.Default.Address
-			v.Current.Address = make([]string, 0)
-			changed = true
-		}
-		if updateAllowed && !util.CompareArrays(v.Default.AllowedIPs, data.Default.AllowedIPs) {
-			log.Infof("updateNet: updateAllowed for %s %v", v.Id, data.Default.AllowedIPs)
-			allowedIPs := make([]string, 0)
-			for _, subnet := range v.Default.AllowedIPs {
-				for _, cidr := range v.Current.AllowedIPs {
-					if !util.IsInCidr(cidr, subnet) {
-						allowedIPs = append(allowedIPs, cidr)
-					} else if cidr == subnet {
-						allowedIPs = append(allowedIPs, data.Default.AllowedIPs...)
-					}
-				}
-			}
-			v.Current.AllowedIPs = allowedIPs
-			v.Default.AllowedIPs = data.Default.AllowedIPs
-			changed = true
-		}
-		if updateFailSafe && v.Default.FailSafe != data.Default.FailSafe {
-			log.Infof("updateNet: updateFailSafe for %s %v", v.Id, data.Default.FailSafe)
-			v.Default.FailSafe = data.Default.FailSafe
-			v.Current.FailSafe = data.Default.FailSafe
-			changed = true
-		}
-		if updatePresharedKey && v.Default.PresharedKey != data.Default.PresharedKey {
-			log.Infof("updateNet: updatePresharedKey for %s", v.Id)
-			v.Default.PresharedKey = data.Default.PresharedKey
-			v.Current.PresharedKey = data.Default.PresharedKey
-			changed = true
-		}
+	rollout := c.Query("canaryTag") != "" || c.Query("canaryPercent") != ""
 
-		if changed {
-			_, err := core.UpdateVPN(v.Id, v, true)
-			if err != nil {
-				log.Errorf("forceUpdate: failed to update vpn %s %v", v.Id, err)
+	if net.Critical {
+		request := &model.ChangeRequest{Kind: "update", Net: &data}
+		if rollout {
+			plan, ok := rolloutPlan(c)
+			if !ok {
+				return
 			}
+			request.Rollout = plan
 		}
+		core.RequestChange(c, account, net.Id, request)
+		return
+	}
 
-		// flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
+	if rollout {
+		startRollout(c, net, &data)
+		return
+	}
 
-		// send push notification if appropriate
-		if core.Push.PushDevices[v.DeviceID] != "" {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
+	result, err := core.UpdateNet(id, &data, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to update network")
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, result)
@@ -363,6 +301,7 @@ func updateNet(c *gin.Context) {
 // @Security apiKey
 // @Param id path string true "Network ID"
 // @Success 200 {object} string
+// @Success 202 {object} model.ChangeRequest
 // @Failure 400 {object} error
 // @Router /net/{id} [delete]
 func deleteNet(c *gin.Context) {
@@ -396,41 +335,20 @@ func deleteNet(c *gin.Context) {
 	}
 
 	if net.Critical {
-		log.Infof("deleteNet: user %s is deleting critical network %s", account.Email, net.NetName)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Sir, you must turn off critical status to delete this network"})
-		return
-	}
-
-	vpns, err := core.ReadVPN2("netid", id)
-	if err != nil {
-		log.Infof("deleteNet: failed to read vpns for net %s: %v", net.Id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log.Infof("deleteNet: user %s asked to delete critical network %s", account.Email, net.NetName)
+		core.RequestChange(c, account, net.Id, &model.ChangeRequest{Kind: "delete"})
 		return
 	}
 
-	err = core.DeleteNet(id)
+	err = core.DeleteNet(id, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("failed to delete network")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns { // flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
-
-		// send push notification if appropriate
-		if core.Push.PushDevices[v.DeviceID] != "" {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" deleted", v.NetName+" has been deleted")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-	}
-
 	c.JSON(http.StatusOK, gin.H{"status": "OK"})
 }
 
@@ -0,0 +1,162 @@
+package net
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// readNetRevisions lists the revisions of a network's settings
+// @Summary List the revisions of a network
+// @Description List the numbered revisions of a network's default settings, newest first
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Success 200 {array} model.Revision
+// @Failure 400 {object} error
+// @Router /net/{id}/revisions [get]
+func readNetRevisions(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account.Status == "Suspended" {
+		log.Infof("readNetRevisions: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	revisions, err := core.ReadRevisions(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read revisions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// diffNetRevision lists what changed in a network since a revision
+// @Summary Diff revisions of a network
+// @Description List the settings that differ between a revision and another, by default the latest
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param number path int true "Revision"
+// @Param to query int false "Revision to compare with, the latest if not given"
+// @Success 200 {array} model.AuditChange
+// @Failure 400 {object} error
+// @Router /net/{id}/revisions/{number}/diff [get]
+func diffNetRevision(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account.Status == "Suspended" {
+		log.Infof("diffNetRevision: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+	to, err := strconv.Atoi(c.DefaultQuery("to", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	changes, err := core.DiffRevisions(id, number, to)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// rollbackNet rolls a network back to a revision
+// @Summary Roll a network back
+// @Description Restore a network's default settings to a revision, and the VPNs that later changes to the network touched to their settings from before those changes
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param number path int true "Revision"
+// @Success 200 {object} model.Rollback
+// @Success 202 {object} model.ChangeRequest
+// @Failure 400 {object} error
+// @Router /net/{id}/revisions/{number}/rollback [post]
+func rollbackNet(c *gin.Context) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+	net := v.(*model.Network)
+
+	if account.Status == "Suspended" {
+		log.Infof("rollbackNet: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	if net.CreatedBy != account.Email && account.Role != "Admin" && account.Role != "Owner" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not authorized to update this network"})
+		return
+	}
+
+	if rollout, ok := core.ActiveRollout(id); ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout " + rollout.Id + " of this network is in progress"})
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	if net.Critical {
+		core.RequestChange(c, account, net.Id, &model.ChangeRequest{Kind: "rollback", Revision: number})
+		return
+	}
+
+	rollback, err := core.RollbackNet(net, number, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to roll back network")
+		c.JSON(core.LockedStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollback)
+}
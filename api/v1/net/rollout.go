@@ -0,0 +1,198 @@
+package net
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// rolloutPlan returns the canaries, wait and approval the query asks a
+// rollout for
+func rolloutPlan(c *gin.Context) (*model.Rollout, bool) {
+	plan := model.Rollout{
+		Tag:  c.Query("canaryTag"),
+		Wait: c.Query("wait"),
+		Auto: c.Query("auto") == "true",
+	}
+	if p := c.Query("canaryPercent"); p != "" {
+		percent, err := strconv.Atoi(p)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid canaryPercent"})
+			return nil, false
+		}
+		plan.Percent = percent
+	}
+
+	return &plan, true
+}
+
+// startRollout saves an update to a network and starts rolling it out to
+// the canaries the query chooses
+func startRollout(c *gin.Context, net *model.Network, data *model.Network) {
+	plan, ok := rolloutPlan(c)
+	if !ok {
+		return
+	}
+
+	rollout, err := core.StartRollout(net, data, plan, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to start rollout")
+		c.JSON(core.LockedStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollout)
+}
+
+// rolloutFromContext returns the rollout of the network in the request and
+// the member making it, who must be able to update the network
+func rolloutFromContext(c *gin.Context) (*model.Account, *model.Rollout, bool) {
+	id := c.Param("id")
+
+	account, v, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return nil, nil, false
+	}
+	net := v.(*model.Network)
+
+	if net.CreatedBy != account.Email && account.Role != "Admin" && account.Role != "Owner" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not authorized to update this network"})
+		return nil, nil, false
+	}
+
+	rollout, err := core.ReadRollout(c.Param("rid"))
+	if err != nil || rollout.NetId != net.Id {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not Found"})
+		return nil, nil, false
+	}
+
+	return account, rollout, true
+}
+
+// readRollouts lists the rollouts of a network
+// @Summary List the rollouts of a network
+// @Description List the staged rollouts of changes to a network, newest first
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Success 200 {array} model.Rollout
+// @Failure 400 {object} error
+// @Router /net/{id}/rollouts [get]
+func readRollouts(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account.Status == "Suspended" {
+		log.Infof("readRollouts: account %s is suspended", account.Email)
+		c.JSON(http.StatusForbidden, gin.H{"error": "account is suspended"})
+		return
+	}
+
+	rollouts, err := core.ReadRollouts(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read rollouts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollouts)
+}
+
+// approveRollout applies a rollout to the rest of its network
+// @Summary Approve a rollout
+// @Description Apply a rollout whose canaries are healthy to the rest of the network
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param rid path string true "Rollout ID"
+// @Success 200 {object} model.Rollout
+// @Failure 400 {object} error
+// @Router /net/{id}/rollouts/{rid}/approve [post]
+func approveRollout(c *gin.Context) {
+	_, rollout, ok := rolloutFromContext(c)
+	if !ok {
+		return
+	}
+
+	if rollout.Status != "Ready" {
+		c.JSON(http.StatusConflict, gin.H{"error": "The rollout is " + rollout.Status + ", not Ready"})
+		return
+	}
+
+	err := core.ProceedRollout(rollout, core.RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to proceed with rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollout, err = core.ReadRollout(rollout.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollout)
+}
+
+// abortRollout rolls a rollout back
+// @Summary Abort a rollout
+// @Description Roll the network and the canaries of a rollout in progress back
+// @tags net
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "Network ID"
+// @Param rid path string true "Rollout ID"
+// @Success 200 {object} model.Rollout
+// @Failure 400 {object} error
+// @Router /net/{id}/rollouts/{rid}/abort [post]
+func abortRollout(c *gin.Context) {
+	account, rollout, ok := rolloutFromContext(c)
+	if !ok {
+		return
+	}
+
+	if rollout.Status != "Canary" && rollout.Status != "Ready" {
+		c.JSON(http.StatusConflict, gin.H{"error": "The rollout is " + rollout.Status})
+		return
+	}
+
+	err := core.AbortRollout(rollout, core.RequestActor(c), "Aborted by "+account.Email)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to abort rollout")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	rollout, err = core.ReadRollout(rollout.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rollout)
+}
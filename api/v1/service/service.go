@@ -122,7 +122,7 @@ func createService(c *gin.Context) {
 		return
 	}
 
-	client, err := core.CreateService(&data)
+	client, err := core.CreateService(&data, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -197,7 +197,7 @@ func updateService(c *gin.Context) {
 
 		data.UpdatedBy = account.Email
 	}
-	client, err := core.UpdateService(id, &data)
+	client, err := core.UpdateService(id, &data, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
@@ -226,7 +226,7 @@ func deleteService(c *gin.Context) {
 		return
 	}
 
-	err = core.DeleteService(id)
+	err = core.DeleteService(id, core.RequestActor(c))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
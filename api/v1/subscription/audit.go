@@ -0,0 +1,59 @@
+package subscription
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	"github.com/nettica-com/nettica-admin/mongo"
+)
+
+// saveSubscription writes a subscription and records the change in the audit log
+func saveSubscription(c *gin.Context, subscription *model.Subscription) error {
+	before, _ := core.ReadSubscription(subscription.Id)
+
+	err := mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+	if err != nil {
+		return err
+	}
+
+	if before == nil {
+		core.Audit(core.RequestActor(c), "subscription", "create", nil, subscription)
+	} else {
+		core.Audit(core.RequestActor(c), "subscription", "update", before, subscription)
+	}
+
+	return nil
+}
+
+// auditUpdate updates a subscription and records the change in the audit log
+func auditUpdate(c *gin.Context, subscription *model.Subscription) (*model.Subscription, error) {
+	before, _ := core.ReadSubscription(subscription.Id)
+
+	result, err := core.UpdateSubscription(subscription.Id, subscription)
+	if err != nil {
+		return nil, err
+	}
+
+	core.Audit(core.RequestActor(c), "subscription", "update", before, result)
+
+	return result, nil
+}
+
+// saveLimits writes the limits of an account and records the change in the
+// audit log.  c is nil when the change isn't made for a request.
+func saveLimits(c *gin.Context, limits *model.Limits) error {
+	before, _ := core.ReadLimits(limits.AccountID)
+
+	err := mongo.Serialize(limits.Id, "id", "limits", limits)
+	if err != nil {
+		return err
+	}
+
+	if before == nil {
+		core.Audit(core.RequestActor(c), "limits", "create", nil, limits)
+	} else {
+		core.Audit(core.RequestActor(c), "limits", "update", before, limits)
+	}
+
+	return nil
+}
@@ -36,14 +36,14 @@ func ApplyRoutes(r *gin.RouterGroup) {
 	g := r.Group("/subscriptions")
 	{
 
-		g.POST("/helio", createHelioSubscription)
-		g.POST("", createSubscription)
-		g.POST("/update", updateSubscriptionWoo)
+		g.POST("/helio", core.RateLimit("webhook"), createHelioSubscription)
+		g.POST("", core.RateLimit("webhook"), createSubscription)
+		g.POST("/update", core.RateLimit("webhook"), updateSubscriptionWoo)
 		g.POST("/apple", createSubscriptionApple2)
-		g.POST("/apple/webhook", handleAppleWebhook2)
+		g.POST("/apple/webhook", core.RateLimit("webhook"), handleAppleWebhook2)
 		g.POST("/apple/discount", handleAppleDiscount)
 		g.POST("/android", createSubscriptionAndroid)
-		g.POST("/android/webhook", handleAndroidWebhook2)
+		g.POST("/android/webhook", core.RateLimit("webhook"), handleAndroidWebhook2)
 		g.GET("/offers/:id", getOffers)
 		g.POST("/trial/:id", createTrial)
 		g.GET("/:id", readSubscription)
@@ -66,20 +66,18 @@ func deleteTrialSubscriptions(c *gin.Context) {
 		return
 	}
 
-	subscriptions, err := core.ReadAllTrials()
+	// the scheduler expires them on its own, this just doesn't wait for it
+	err := core.RunJob("expire-subscriptions")
+	if err == core.ErrJobRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		log.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "deleteTrialSubscriptions: Internal server error"})
 		return
 	}
 
-	now := time.Now().UTC()
-	for _, subscription := range subscriptions {
-		if subscription.Status == "active" && subscription.Expires.Before(now) && !subscription.Expires.Before(*subscription.Issued) {
-			log.Infof("suspending trial subscription %v", subscription)
-			core.ExpireSubscription(subscription.Id)
-		}
-	}
 	c.JSON(http.StatusOK, gin.H{"status": "OK", "message": "Service for expired trial subscriptions suspended"})
 }
 
@@ -153,7 +151,7 @@ func createTrial(c *gin.Context) {
 	}
 
 	// save limits to mongodb
-	mongo.Serialize(limits.Id, "id", "limits", limits)
+	saveLimits(c, limits)
 
 	// create a new subscription
 	var subscription model.Subscription
@@ -191,7 +189,7 @@ func createTrial(c *gin.Context) {
 	}
 
 	// save subscription to mongodb
-	mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+	saveSubscription(c, &subscription)
 
 	log.Infof("created trial subscription: %s for %s", subscription.Id, user.Email)
 
@@ -453,7 +451,7 @@ func createSubscriptionAndroid(c *gin.Context) {
 	}
 
 	// save limits to mongodb
-	mongo.Serialize(limits.Id, "id", "limits", limits)
+	saveLimits(c, limits)
 
 	// generate a random subscription id
 	id, err := util.RandomString(8)
@@ -496,7 +494,7 @@ func createSubscriptionAndroid(c *gin.Context) {
 	}
 
 	// save subscription to mongodb
-	mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+	saveSubscription(c, &subscription)
 
 	err = core.SubscriptionEmail(&subscription)
 	if err != nil {
@@ -991,7 +989,7 @@ func handleAndroidWebhook2(c *gin.Context) {
 				Receipt:     purchaseToken,
 			}
 			log.Infof("created subscription stub: %v", subscription)
-			mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+			saveSubscription(c, subscription)
 		}
 
 		subscriptionState, _ := sub["subscriptionState"].(string)
@@ -1037,7 +1035,7 @@ func handleAndroidWebhook2(c *gin.Context) {
 				}
 			}
 			subscription.UpdatedBy = "google"
-			core.UpdateSubscription(subscription.Id, subscription)
+			auditUpdate(c, subscription)
 		}
 
 		switch subscriptionState {
@@ -1050,7 +1048,7 @@ func handleAndroidWebhook2(c *gin.Context) {
 
 		case "SUBSCRIPTION_STATE_CANCELED":
 			subscription.Status = "cancelled"
-			core.UpdateSubscription(subscription.Id, subscription)
+			auditUpdate(c, subscription)
 			core.ExpireSubscription(subscription.Id)
 			core.SubscriptionEmail(subscription)
 			log.Infof("subscription cancelled: %s", subscription.Id)
@@ -1059,7 +1057,7 @@ func handleAndroidWebhook2(c *gin.Context) {
 
 		case "SUBSCRIPTION_STATE_IN_GRACE_PERIOD":
 			subscription.Status = "grace"
-			core.UpdateSubscription(subscription.Id, subscription)
+			auditUpdate(c, subscription)
 			core.SubscriptionEmail(subscription)
 			log.Infof("subscription grace: %s", subscription.Id)
 			c.JSON(http.StatusOK, gin.H{"status": "grace"})
@@ -1480,7 +1478,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		// Create a stub when not found so createSubscriptionApple2 can claim it.
 		if notFound {
 			subscription = appleNewStub(originalTxId, productId, &now)
-			if serErr := mongo.Serialize(subscription.Id, "id", "subscriptions", subscription); serErr != nil {
+			if serErr := saveSubscription(c, subscription); serErr != nil {
 				log.Errorf("handleAppleWebhook2: SUBSCRIBED stub serialize: %v", serErr)
 			}
 		}
@@ -1506,7 +1504,7 @@ func handleAppleWebhook2(c *gin.Context) {
 				log.Errorf("handleAppleWebhook2: SUBSCRIBED RenewSubscription: %v", err)
 			}
 		}
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: SUBSCRIBED UpdateSubscription: %v", err)
 		}
 		if wasInactive && subscription.AccountID != "" {
@@ -1519,7 +1517,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		// Auto-renewal succeeded, or billing recovered after a grace period.
 		if notFound {
 			subscription = appleNewStub(originalTxId, productId, &now)
-			if serErr := mongo.Serialize(subscription.Id, "id", "subscriptions", subscription); serErr != nil {
+			if serErr := saveSubscription(c, subscription); serErr != nil {
 				log.Errorf("handleAppleWebhook2: DID_RENEW stub serialize: %v", serErr)
 			}
 		}
@@ -1543,7 +1541,7 @@ func handleAppleWebhook2(c *gin.Context) {
 				log.Errorf("handleAppleWebhook2: DID_RENEW RenewSubscription: %v", err)
 			}
 		}
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: DID_RENEW UpdateSubscription: %v", err)
 		}
 		if wasInactive && subscription.AccountID != "" {
@@ -1571,7 +1569,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		}
 		subscription.LastUpdated = &now
 		subscription.UpdatedBy = "apple"
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: DID_CHANGE_RENEWAL_STATUS UpdateSubscription: %v", err)
 		}
 		log.Infof("handleAppleWebhook2: DID_CHANGE_RENEWAL_STATUS subtype=%s autoRenew=%v for %s",
@@ -1596,7 +1594,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		subscription.AutoRenew = false
 		subscription.LastUpdated = &now
 		subscription.UpdatedBy = "apple"
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: DID_FAIL_TO_RENEW UpdateSubscription: %v", err)
 		}
 		// ExpireSubscription reads fresh from DB; it requires Expires to be in the
@@ -1627,7 +1625,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		subscription.AutoRenew = false
 		subscription.LastUpdated = &now
 		subscription.UpdatedBy = "apple"
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: %s UpdateSubscription: %v", notificationType, err)
 		}
 		if err := core.ExpireSubscription(subscription.Id); err != nil {
@@ -1652,7 +1650,7 @@ func handleAppleWebhook2(c *gin.Context) {
 		subscription.AutoRenew = false
 		subscription.LastUpdated = &now
 		subscription.UpdatedBy = "apple"
-		if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+		if _, err := auditUpdate(c, subscription); err != nil {
 			log.Errorf("handleAppleWebhook2: REFUND UpdateSubscription: %v", err)
 		}
 		// ExpireSubscription reads status="cancelled" from DB and sees Expires in
@@ -1692,7 +1690,7 @@ func handleAppleWebhook2(c *gin.Context) {
 			subscription.IsDeleted = &falseVal
 			subscription.LastUpdated = &now
 			subscription.UpdatedBy = "apple"
-			if _, err := core.UpdateSubscription(subscription.Id, subscription); err != nil {
+			if _, err := auditUpdate(c, subscription); err != nil {
 				log.Errorf("handleAppleWebhook2: DID_CHANGE_RENEWAL_PREF UPGRADE UpdateSubscription: %v", err)
 			}
 			log.Infof("handleAppleWebhook2: DID_CHANGE_RENEWAL_PREF UPGRADE %s sku %s→%s until %s",
@@ -2484,7 +2482,7 @@ func appleAddLimits(accountID, email string, sku appleSkuDef) error {
 		}
 		return fmt.Errorf("limits validation failed")
 	}
-	return mongo.Serialize(limits.Id, "id", "limits", limits)
+	return saveLimits(nil, limits)
 }
 
 // ── Main handler ──────────────────────────────────────────────────────────────
@@ -2655,7 +2653,7 @@ func createSubscriptionApple2(c *gin.Context) {
 
 		if wasInactive {
 			existing.Status = "active"
-			if _, updateErr := core.UpdateSubscription(existing.Id, existing); updateErr != nil {
+			if _, updateErr := auditUpdate(c, existing); updateErr != nil {
 				log.Errorf("createSubscriptionApple2: UpdateSubscription failed: %v", updateErr)
 			}
 			if renewErr := core.RenewSubscription(existing.Id); renewErr != nil {
@@ -2674,7 +2672,7 @@ func createSubscriptionApple2(c *gin.Context) {
 		} else {
 			// Subscription is already active — update metadata and expiry only.
 			// Do NOT touch limits; they were already granted at the original purchase.
-			if _, updateErr := core.UpdateSubscription(existing.Id, existing); updateErr != nil {
+			if _, updateErr := auditUpdate(c, existing); updateErr != nil {
 				log.Errorf("createSubscriptionApple2: UpdateSubscription failed: %v", updateErr)
 			}
 			if isStub {
@@ -2743,7 +2741,7 @@ func createSubscriptionApple2(c *gin.Context) {
 		return
 	}
 
-	if err := mongo.Serialize(sub.Id, "id", "subscriptions", sub); err != nil {
+	if err := saveSubscription(c, &sub); err != nil {
 		log.Errorf("createSubscriptionApple2: Serialize failed: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save subscription"})
 		return
@@ -3138,7 +3136,7 @@ func createHelioSubscription(c *gin.Context) {
 		}
 
 		// save limits to mongodb
-		mongo.Serialize(limits.Id, "id", "limits", limits)
+		saveLimits(c, limits)
 
 		// construct a subscription object
 		issued := time.Now()
@@ -3173,7 +3171,7 @@ func createHelioSubscription(c *gin.Context) {
 		}
 
 		// save subscription to mongodb
-		mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+		saveSubscription(c, &subscription)
 
 	}()
 
@@ -3473,7 +3471,7 @@ func createSubscription(c *gin.Context) {
 		}
 
 		// save limits to mongodb
-		mongo.Serialize(limits.Id, "id", "limits", limits)
+		saveLimits(c, limits)
 
 		// construct a subscription object
 		issued := time.Now()
@@ -3508,7 +3506,7 @@ func createSubscription(c *gin.Context) {
 		}
 
 		// save subscription to mongodb
-		mongo.Serialize(subscription.Id, "id", "subscriptions", subscription)
+		saveSubscription(c, &subscription)
 
 	}()
 
@@ -3622,7 +3620,7 @@ func updateSubscriptionWoo(c *gin.Context) {
 		}
 
 		s.UpdatedBy = "woo"
-		_, err = core.UpdateSubscription(s.Id, s)
+		_, err = auditUpdate(c, s)
 		core.SubscriptionEmail(s)
 
 		if err != nil {
@@ -3677,6 +3675,9 @@ func updateSubscription(c *gin.Context) {
 		return
 	}
 	data.UpdatedBy = user.Email
+	core.SetUserActor(c, oauth2Token, user.Email)
+
+	before, _ := core.ReadSubscription(id)
 
 	client, err := core.UpdateSubscription(id, &data)
 	if err != nil {
@@ -3686,6 +3687,7 @@ func updateSubscription(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	core.Audit(core.RequestActor(c), "subscription", "update", before, client)
 	core.SubscriptionEmail(client)
 
 	c.JSON(http.StatusOK, client)
@@ -3694,6 +3696,8 @@ func updateSubscription(c *gin.Context) {
 func deleteSubscription(c *gin.Context) {
 	id := c.Param("id")
 
+	before, _ := core.ReadSubscription(id)
+
 	err := core.DeleteSubscription(id)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -3702,6 +3706,7 @@ func deleteSubscription(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	core.Audit(core.RequestActor(c), "subscription", "delete", before, nil)
 
 	c.JSON(http.StatusOK, gin.H{})
 }
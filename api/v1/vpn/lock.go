@@ -0,0 +1,37 @@
+package client
+
+import (
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+)
+
+// lockVPN makes a VPN read only
+// @Summary Lock a VPN
+// @Description Make a VPN read only until you or an owner release it, or the lock expires.  Locking it again changes the reason or expiry.
+// @Tags vpn
+// @Accept  json
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "VPN ID"
+// @Param lock body model.Lock false "Reason and expiry"
+// @Success 200 {object} model.VPN
+// @Failure 423 {object} error
+// @Router /vpn/{id}/lock [post]
+func lockVPN(c *gin.Context) {
+	core.LockFromContext(c, "vpn")
+}
+
+// unlockVPN releases the lock of a VPN
+// @Summary Unlock a VPN
+// @Description Release the lock of a VPN.  Only whoever holds the lock or an owner can, unless it has expired.
+// @Tags vpn
+// @Produce  json
+// @Security apiKey
+// @Param id path string true "VPN ID"
+// @Success 200 {object} model.VPN
+// @Failure 403 {object} error
+// @Failure 423 {object} error
+// @Router /vpn/{id}/lock [delete]
+func unlockVPN(c *gin.Context) {
+	core.UnlockFromContext(c, "vpn")
+}
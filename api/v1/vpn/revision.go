@@ -0,0 +1,94 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	core "github.com/nettica-com/nettica-admin/core"
+	log "github.com/sirupsen/logrus"
+)
+
+// readVPNRevisions lists the revisions of a VPN's settings
+// @Summary List the revisions of a VPN
+// @Description List the numbered revisions of a VPN's settings, newest first.  Revisions made by a change to the network name its revision in netRevision.
+// @Tags vpn
+// @Produce  json
+// @Param id path string true "VPN ID"
+// @Security apiKey
+// @Success 200 {array} model.Revision
+// @Router /vpn/{id}/revisions [get]
+func readVPNRevisions(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account == nil || account.Status == "Suspended" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	revisions, err := core.ReadRevisions(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read revisions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// diffVPNRevision lists what changed in a VPN since a revision
+// @Summary Diff revisions of a VPN
+// @Description List the settings that differ between a revision and another, by default the latest
+// @Tags vpn
+// @Produce  json
+// @Param id path string true "VPN ID"
+// @Param number path int true "Revision"
+// @Param to query int false "Revision to compare with, the latest if not given"
+// @Security apiKey
+// @Success 200 {array} model.AuditChange
+// @Router /vpn/{id}/revisions/{number}/diff [get]
+func diffVPNRevision(c *gin.Context) {
+	id := c.Param("id")
+
+	account, _, err := core.AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account == nil || account.Status == "Suspended" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+	to, err := strconv.Atoi(c.DefaultQuery("to", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+
+	changes, err := core.DiffRevisions(id, number, to)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
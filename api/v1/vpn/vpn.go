@@ -2,6 +2,7 @@ package client
 
 import (
 	"archive/zip"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -24,8 +25,12 @@ func ApplyRoutes(r *gin.RouterGroup) {
 		g.PATCH("/:id/enable", enableVPN)
 		g.PATCH("/:id/disable", disableVPN)
 		g.DELETE("/:id", deleteVPN)
+		g.POST("/:id/lock", lockVPN)
+		g.DELETE("/:id/lock", unlockVPN)
 		g.GET("", readVPNs)
 		g.GET("/:id/config", configVPN)
+		g.GET("/:id/revisions", readVPNRevisions)
+		g.GET("/:id/revisions/:number/diff", diffVPNRevision)
 	}
 
 }
@@ -39,6 +44,7 @@ func ApplyRoutes(r *gin.RouterGroup) {
 // @Produce  json
 // @Param vpn body model.VPN true "VPN"
 // @Success 200 {object} model.VPN
+// @Success 202 {object} model.ChangeRequest
 // @Router /vpn [post]
 func createVPN(c *gin.Context) {
 	var data model.VPN
@@ -84,40 +90,19 @@ func createVPN(c *gin.Context) {
 		}
 	}
 
-	vpn, err := core.CreateVPN(&data)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to create client")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	vpn, err := core.CreateVPN(&data, core.RequestActor(c))
+	if errors.Is(err, core.ErrCritical) {
+		core.RequestChange(c, account, data.NetId, &model.ChangeRequest{Kind: "join", VPN: &data})
 		return
 	}
-
-	vpns, err := core.ReadVPN2("netid", vpn.NetId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("failed to read vpns")
+		}).Error("failed to create client")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns {
-		// flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
-
-		// send push notification if appropriate
-		if core.Push.PushDevices[v.DeviceID] != "" && v.Enable {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-
-	}
-
 	c.JSON(http.StatusOK, vpn)
 }
 
@@ -190,6 +175,7 @@ func readVPN(c *gin.Context) {
 // @Param id path string true "VPN ID"
 // @Security apiKey
 // @Success 200 {object} model.VPN
+// @Success 202 {object} model.ChangeRequest
 // @Router /vpn/{id}/enable [patch]
 func enableVPN(c *gin.Context) {
 	id := c.Param("id")
@@ -252,57 +238,20 @@ func enableVPN(c *gin.Context) {
 	vpn.UpdatedBy = by
 	vpn.Updated = &now
 
-	vpn, err = core.UpdateVPN(id, vpn, true)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to enable VPN")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, err := core.UpdateVPN(id, vpn, true, core.RequestActor(c))
+	if errors.Is(err, core.ErrCritical) {
+		core.RequestChange(c, account, vpn.NetId, &model.ChangeRequest{Kind: "edit", VPN: vpn})
 		return
 	}
-
-	vpns, err := core.ReadVPN2("netid", vpn.NetId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("failed to read vpns")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}).Error("failed to enable VPN")
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns {
-		// flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
-
-		if core.Push.PushDevices[v.DeviceID] != "" && v.Enable && v.DeviceID == vpn.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" enabled", "Connection to "+v.NetName+" has been established")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		} else if core.Push.PushDevices[v.DeviceID] != "" && v.Enable {
-			// send push notification if appropriate
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-
-		// send push notification to the device that just had the VPN disabled
-		if core.Push.PushDevices[v.DeviceID] != "" && !v.Enable && v.DeviceID == vpn.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" disabled", "The VPN configuration for "+v.NetName+" has been disabled")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-	}
-
-	c.JSON(http.StatusOK, vpn)
+	c.JSON(http.StatusOK, result)
 }
 
 // disableVPN disables a VPN
@@ -313,6 +262,7 @@ func enableVPN(c *gin.Context) {
 // @Param id path string true "VPN ID"
 // @Security apiKey
 // @Success 200 {object} model.VPN
+// @Success 202 {object} model.ChangeRequest
 // @Router /vpn/{id}/disable [patch]
 func disableVPN(c *gin.Context) {
 	id := c.Param("id")
@@ -375,57 +325,20 @@ func disableVPN(c *gin.Context) {
 	vpn.UpdatedBy = by
 	vpn.Updated = &now
 
-	vpn, err = core.UpdateVPN(id, vpn, true)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to disable VPN")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, err := core.UpdateVPN(id, vpn, true, core.RequestActor(c))
+	if errors.Is(err, core.ErrCritical) {
+		core.RequestChange(c, account, vpn.NetId, &model.ChangeRequest{Kind: "edit", VPN: vpn})
 		return
 	}
-
-	vpns, err := core.ReadVPN2("netid", vpn.NetId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("failed to read vpns")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}).Error("failed to disable VPN")
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns {
-		// flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
-
-		if core.Push.PushDevices[v.DeviceID] != "" && v.Enable && v.DeviceID == vpn.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" enabled", "Connection to "+v.NetName+" has been established")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		} else if core.Push.PushDevices[v.DeviceID] != "" && v.Enable {
-			// send push notification if appropriate
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-
-		// send push notification to the device that just had the VPN disabled
-		if core.Push.PushDevices[v.DeviceID] != "" && !v.Enable && v.DeviceID == vpn.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" disabled", "The VPN configuration for "+v.NetName+" has been disabled")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-	}
-
-	c.JSON(http.StatusOK, vpn)
+	c.JSON(http.StatusOK, result)
 }
 
 // UpdateVPN updates a VPN
@@ -438,6 +351,7 @@ func disableVPN(c *gin.Context) {
 // @Param id path string true "VPN ID"
 // @Param vpn body model.VPN true "VPN"
 // @Success 200 {object} model.VPN
+// @Success 202 {object} model.ChangeRequest
 // @Router /vpn/{id} [patch]
 func updateVPN(c *gin.Context) {
 	var data model.VPN
@@ -538,56 +452,20 @@ func updateVPN(c *gin.Context) {
 		return
 	}
 
-	result, err := core.UpdateVPN(id, &data, false)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to update vpn")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	result, err := core.UpdateVPN(id, &data, false, core.RequestActor(c))
+	if errors.Is(err, core.ErrCritical) {
+		data.CreatedBy = vpn.CreatedBy
+		core.RequestChange(c, account, vpn.NetId, &model.ChangeRequest{Kind: "edit", VPN: &data})
 		return
 	}
-
-	vpns, err := core.ReadVPN2("netid", result.NetId)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Error("failed to read vpns")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}).Error("failed to update vpn")
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns {
-		// flush the cache for this vpn
-		core.FlushCache(v.DeviceID)
-
-		if core.Push.PushDevices[v.DeviceID] != "" && v.Enable && v.DeviceID == result.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" enabled", "Connection to "+v.NetName+" has been established")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		} else if core.Push.PushDevices[v.DeviceID] != "" && v.Enable {
-			// send push notification if appropriate
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-
-		// send push notification to the device that just had the VPN disabled
-		if core.Push.PushDevices[v.DeviceID] != "" && !v.Enable && v.DeviceID == result.DeviceID {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" disabled", "The VPN configuration for "+v.NetName+" has been disabled")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-	}
-
 	c.JSON(http.StatusOK, result)
 }
 
@@ -615,6 +493,7 @@ func CompareArrays(a []string, b []string) bool {
 // @Tags vpn
 // @Security apiKey
 // @Success 200 {object} string "OK"
+// @Success 202 {object} model.ChangeRequest
 // @Param id path string true "VPN ID"
 // @Router /vpn/{id} [delete]
 func deleteVPN(c *gin.Context) {
@@ -666,41 +545,19 @@ func deleteVPN(c *gin.Context) {
 		log.Infof("User %s deleted vpn %s", account.Email, id)
 	}
 
-	vpns, err := core.ReadVPN2("netid", vpn.NetId)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("failed to read vpns")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err = core.DeleteVPN(id, core.RequestActor(c))
+	if errors.Is(err, core.ErrCritical) {
+		core.RequestChange(c, account, vpn.NetId, &model.ChangeRequest{Kind: "leave", VPN: vpn})
 		return
 	}
-
-	err = core.DeleteVPN(id)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 		}).Error("failed to remove client")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(core.LockedStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 
-	for _, v := range vpns {
-		// flush the cache for this vpn
-
-		core.FlushCache(v.DeviceID)
-
-		// send push notification if appropriate
-		if core.Push.PushDevices[v.DeviceID] != "" && v.Enable {
-			err := core.Push.SendPushNotification(core.Push.PushDevices[v.DeviceID], v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("failed to send push notification")
-			}
-		}
-
-	}
-
 	c.JSON(http.StatusOK, gin.H{})
 }
 
@@ -3,24 +3,80 @@ package auth
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/nettica-com/nettica-admin/auth/basic"
 	"github.com/nettica-com/nettica-admin/auth/fake"
 	"github.com/nettica-com/nettica-admin/auth/github"
 	"github.com/nettica-com/nettica-admin/auth/google"
+	"github.com/nettica-com/nettica-admin/auth/ldap"
+	"github.com/nettica-com/nettica-admin/auth/local"
 	"github.com/nettica-com/nettica-admin/auth/microsoft"
 	"github.com/nettica-com/nettica-admin/auth/microsoft2"
 	"github.com/nettica-com/nettica-admin/auth/oauth2oidc"
+	"github.com/nettica-com/nettica-admin/auth/passkey"
+	"github.com/nettica-com/nettica-admin/auth/saml"
+	"github.com/nettica-com/nettica-admin/auth/session"
+	core "github.com/nettica-com/nettica-admin/core"
 	model "github.com/nettica-com/nettica-admin/model"
+	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 )
 
-// GetAuthProvider  get an instance of auth provider based on config
+var passkeyClient = &passkey.Passkey{}
+
+var sessionClient = &session.Session{}
+
+// the enabled providers by name, in the order OAUTH2_PROVIDER_NAME lists them
+var (
+	providers     = map[string]model.Authentication{}
+	providerNames = []string{}
+)
+
+// the provider that issued each token, by access token.  Tokens are cached
+// for a day, so the provider is remembered as long.
+var tokenProviders = cache.New(24*time.Hour, time.Hour)
+
+// GetAuthProvider sets up every provider in OAUTH2_PROVIDER_NAME, a comma
+// separated list, and returns the first, which is the default.
 func GetAuthProvider() (model.Authentication, error) {
+
+	for _, name := range strings.Split(os.Getenv("OAUTH2_PROVIDER_NAME"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, exists := providers[name]; exists {
+			return nil, fmt.Errorf("auth provider %s is listed twice", name)
+		}
+
+		oauth2Client, err := newProvider(name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setupProvider(name, oauth2Client)
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %s: %v", name, err)
+		}
+
+		providers[name] = oauth2Client
+		providerNames = append(providerNames, name)
+	}
+
+	if len(providerNames) == 0 {
+		return nil, fmt.Errorf("auth provider name %s unknown", os.Getenv("OAUTH2_PROVIDER_NAME"))
+	}
+
+	return providers[providerNames[0]], nil
+}
+
+func newProvider(name string) (model.Authentication, error) {
 	var oauth2Client model.Authentication
-	var err error
 
-	switch os.Getenv("OAUTH2_PROVIDER_NAME") {
+	switch name {
 	case "fake":
 		log.Warn("Oauth is set to fake, no actual authentication will be performed")
 		oauth2Client = &fake.Fake{}
@@ -41,6 +97,18 @@ func GetAuthProvider() (model.Authentication, error) {
 		log.Warn("Oauth is set to basic.  Authenication against the shadow file")
 		oauth2Client = &basic.Oauth2Basic{}
 
+	case "local":
+		log.Warn("Oauth is set to local.  Authentication against the local user directory")
+		oauth2Client = &local.Local{}
+
+	case "ldap":
+		log.Warn("Oauth is set to ldap.  Authentication against the LDAP directory")
+		oauth2Client = &ldap.Ldap{}
+
+	case "saml":
+		log.Warn("Oauth is set to saml.  Users sign in with the SAML IdP")
+		oauth2Client = &saml.Saml{}
+
 	case "github":
 		log.Warn("Oauth is set to github, no openid will be used")
 		oauth2Client = &github.Github{}
@@ -50,10 +118,155 @@ func GetAuthProvider() (model.Authentication, error) {
 		oauth2Client = &google.OAuth2Google{}
 
 	default:
-		return nil, fmt.Errorf("auth provider name %s unknown", os.Getenv("OAUTH2_PROVIDER_NAME"))
+		return nil, fmt.Errorf("auth provider name %s unknown", name)
+	}
+
+	return oauth2Client, nil
+}
+
+// setupProvider runs Setup with the provider's own settings in place of the
+// shared ones.  GOOGLE_OAUTH2_CLIENT_ID stands in for OAUTH2_CLIENT_ID while
+// google is set up, and so on for any OAUTH2_ setting.  Settings providers
+// read after setup, such as the agent settings, are shared.
+func setupProvider(name string, oauth2Client model.Authentication) error {
+	prefix := strings.ToUpper(name) + "_"
+
+	saved := map[string]*string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, prefix+"OAUTH2_") {
+			continue
+		}
+		shared := strings.TrimPrefix(key, prefix)
+		if old, ok := os.LookupEnv(shared); ok {
+			saved[shared] = &old
+		} else {
+			saved[shared] = nil
+		}
+		os.Setenv(shared, value)
+	}
+
+	defer func() {
+		for key, value := range saved {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+	}()
+
+	return oauth2Client.Setup()
+}
+
+// ProviderSetting returns a provider's own OAUTH2_ setting.  The shared
+// setting belongs to the default provider.
+func ProviderSetting(name string, key string) string {
+	if v := os.Getenv(strings.ToUpper(name) + "_" + key); v != "" {
+		return v
 	}
+	if name == "" || name == DefaultProvider() {
+		return os.Getenv(key)
+	}
+	return ""
+}
 
-	err = oauth2Client.Setup()
+// Provider returns an enabled provider by name.  The empty name is the default provider.
+func Provider(name string) (model.Authentication, bool) {
+	if name == "" {
+		name = DefaultProvider()
+	}
+	p, ok := providers[strings.ToLower(name)]
+	return p, ok
+}
+
+// ProviderNames lists the enabled providers, the default first
+func ProviderNames() []string {
+	return providerNames
+}
+
+// DefaultProvider is the name of the first provider in OAUTH2_PROVIDER_NAME
+func DefaultProvider() string {
+	if len(providerNames) == 0 {
+		return ""
+	}
+	return providerNames[0]
+}
+
+// PasswordProvider returns the name of the first enabled provider that checks passwords itself
+func PasswordProvider() (string, bool) {
+	for _, name := range providerNames {
+		if _, ok := providers[name].(model.PasswordAuthentication); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SetTokenProvider remembers which provider issued a token
+func SetTokenProvider(token *oauth2.Token, name string) {
+	if token != nil {
+		tokenProviders.Set(token.AccessToken, name, cache.DefaultExpiration)
+	}
+}
+
+// TokenProviderName returns the name of the provider that issued the token
+func TokenProviderName(token *oauth2.Token) string {
+	if token == nil {
+		return ""
+	}
+	if name, ok := token.Extra("provider").(string); ok && name != "" {
+		return name
+	}
+	if v, exists := tokenProviders.Get(token.AccessToken); exists {
+		return v.(string)
+	}
+	return ""
+}
+
+// TokenProvider returns the provider that issued the token, whose UserInfo
+// validates it.  Session tokens are answered from their claims, tokens from
+// a passkey login by the passkey provider, tokens of unknown origin by the
+// configured default.
+func TokenProvider(oauth2Client model.Authentication, token *oauth2.Token) model.Authentication {
+	if _, ok := session.Claims(token); ok {
+		return sessionClient
+	}
+	name := TokenProviderName(token)
+	if name == passkey.Provider {
+		return passkeyClient
+	}
+	if p, ok := providers[name]; ok {
+		return p
+	}
+	return oauth2Client
+}
+
+// FindToken returns the token for a bearer token sent by a client.  Tokens
+// the provider issued are found in the cache, session tokens are verified
+// by their signature so any replica can accept them.
+func FindToken(cacheDb *cache.Cache, token string) (*oauth2.Token, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	if v, exists := cacheDb.Get(token); exists {
+		if t, ok := v.(*oauth2.Token); ok && t.AccessToken == token {
+			return t, true
+		}
+	}
+
+	if !core.SessionsEnabled() || strings.Count(token, ".") != 2 {
+		return nil, false
+	}
+
+	claims, err := core.VerifySession(token)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Debug("session token rejected")
+		return nil, false
+	}
 
-	return oauth2Client, err
+	return session.NewToken(token, claims), true
 }
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 
 	mongodb "github.com/nettica-com/nettica-admin/mongo"
+	"github.com/nettica-com/nettica-admin/shadow"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -32,6 +33,25 @@ func (o *Oauth2Basic) Logout() error {
 	return nil
 }
 
+// Authenticate the user against the shadow file
+func (o *Oauth2Basic) Authenticate(username string, password string) error {
+
+	x := strings.Split(username, "@")
+	if len(x) > 0 {
+		username = x[0]
+	}
+
+	return shadow.ShadowAuthPlain(username, password)
+}
+
+// LoginEmail maps a shadow user name to the email UserInfo reports
+func (o *Oauth2Basic) LoginEmail(username string) string {
+	if !strings.Contains(username, "@") {
+		username = username + "@" + getServerName()
+	}
+	return strings.ToLower(username)
+}
+
 // CodeUrl get url to redirect client for auth
 func (o *Oauth2Basic) CodeUrl(state string) string {
 
@@ -154,7 +174,11 @@ func (o *Oauth2Basic) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
 	if err != nil {
 		log.Error(err)
 	} else {
-		//  If there's no error and no account, create one.
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
 		if len(accounts) == 0 {
 			var account model.Account
 			host, _ := os.Hostname()
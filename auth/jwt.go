@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnknownIssuer is returned for a JWT from an issuer that isn't trusted
+var ErrUnknownIssuer = errors.New("token issuer is not trusted")
+
+// a trusted issuer, discovered the first time one of its tokens is seen.
+// go-oidc caches the issuer's keys and fetches them again for a new key id.
+// mutex guards verifier and failed, so discovery only holds up tokens from this issuer.
+type jwtIssuer struct {
+	url      string
+	provider string
+	mutex    sync.Mutex
+	verifier *oidc.IDTokenVerifier
+	failed   time.Time
+}
+
+var (
+	jwtIssuers      []*jwtIssuer
+	jwtAudiences    []string
+	jwtIssuersMutex sync.Mutex
+)
+
+// how long before discovery of an issuer that failed is tried again
+const jwtDiscoveryRetry = time.Minute
+
+// loadJWTIssuers lists the issuers and audiences JWTs are accepted from.
+// JWT_ISSUERS and JWT_AUDIENCES are comma separated; without them the
+// OAUTH2_PROVIDER and client ids of the enabled providers and the agent are used.
+func loadJWTIssuers() {
+	if jwtIssuers != nil {
+		return
+	}
+
+	add := func(list []string, value string) []string {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return list
+		}
+		for _, v := range list {
+			if v == value {
+				return list
+			}
+		}
+		return append(list, value)
+	}
+
+	jwtIssuers = []*jwtIssuer{}
+
+	issuer := func(url string, provider string) {
+		if !strings.HasPrefix(url, "https://") {
+			return
+		}
+		for _, i := range jwtIssuers {
+			if i.url == url {
+				return
+			}
+		}
+		jwtIssuers = append(jwtIssuers, &jwtIssuer{url: url, provider: provider})
+	}
+
+	if os.Getenv("JWT_ISSUERS") != "" {
+		for _, url := range strings.Split(os.Getenv("JWT_ISSUERS"), ",") {
+			url = strings.TrimSpace(url)
+			provider := ""
+			for _, name := range providerNames {
+				if ProviderSetting(name, "OAUTH2_PROVIDER") == url {
+					provider = name
+				}
+			}
+			issuer(url, provider)
+		}
+	} else {
+		for _, name := range providerNames {
+			issuer(ProviderSetting(name, "OAUTH2_PROVIDER"), name)
+		}
+		issuer(os.Getenv("OAUTH2_AGENT_PROVIDER"), DefaultProvider())
+	}
+
+	if os.Getenv("JWT_AUDIENCES") != "" {
+		for _, aud := range strings.Split(os.Getenv("JWT_AUDIENCES"), ",") {
+			jwtAudiences = add(jwtAudiences, aud)
+		}
+	} else {
+		for _, name := range providerNames {
+			jwtAudiences = add(jwtAudiences, ProviderSetting(name, "OAUTH2_CLIENT_ID"))
+		}
+		jwtAudiences = add(jwtAudiences, os.Getenv("OAUTH2_AGENT_CLIENT_ID"))
+		jwtAudiences = add(jwtAudiences, os.Getenv("OAUTH2_AGENT_AUDIENCE"))
+	}
+}
+
+// discover finds the issuer's keys the first time they are needed
+func (i *jwtIssuer) discover() *oidc.IDTokenVerifier {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.verifier != nil || time.Since(i.failed) < jwtDiscoveryRetry {
+		return i.verifier
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	ctx := oidc.ClientContext(context.Background(), client)
+
+	provider, err := oidc.NewProvider(ctx, i.url)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"issuer": i.url,
+		}).Error("failed to discover token issuer")
+		i.failed = time.Now()
+		return nil
+	}
+
+	// the audience is checked against every allowed audience below
+	i.verifier = provider.Verifier(&oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: []string{oidc.RS256, oidc.ES256},
+	})
+
+	return i.verifier
+}
+
+// ValidateJWT verifies a JWT from a trusted issuer: its signature against the
+// issuer's published keys, its issuer, audience and expiry.  It returns the
+// token and the provider the issuer belongs to, if any.
+func ValidateJWT(raw string) (*oidc.IDToken, string, error) {
+	jwtIssuersMutex.Lock()
+	loadJWTIssuers()
+
+	var issuer *jwtIssuer
+	iss, err := unverifiedIssuer(raw)
+	if err == nil {
+		for _, i := range jwtIssuers {
+			if i.url == iss {
+				issuer = i
+				break
+			}
+		}
+	}
+	jwtIssuersMutex.Unlock()
+
+	if err != nil {
+		return nil, "", err
+	}
+	if issuer == nil {
+		return nil, "", ErrUnknownIssuer
+	}
+
+	// discovery is a network call, so it is kept out of jwtIssuersMutex
+	verifier := issuer.discover()
+	if verifier == nil {
+		return nil, "", errors.New("token issuer keys are unavailable")
+	}
+
+	token, err := verifier.Verify(context.Background(), raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, aud := range token.Audience {
+		for _, allowed := range jwtAudiences {
+			if aud == allowed {
+				return token, issuer.provider, nil
+			}
+		}
+	}
+
+	return nil, "", errors.New("token audience is not allowed")
+}
+
+// ValidateIDTokenBearer checks the access token a client sent along with its
+// X-OAUTH2-ID-TOKEN the same way as any other JWT, and returns the oauth2 token
+// the provider's UserInfo reads the id token from.
+func ValidateIDTokenBearer(accessToken string, idToken string) (*oauth2.Token, error) {
+	token, name, err := ValidateJWT(accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	oauth2Token := &oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		Expiry:      token.Expiry,
+	}
+	oauth2Token = oauth2Token.WithExtra(map[string]interface{}{
+		"id_token": idToken})
+
+	if name != "" {
+		SetTokenProvider(oauth2Token, name)
+	}
+
+	return oauth2Token, nil
+}
+
+// unverifiedIssuer reads the iss claim to pick the issuer whose keys verify the token
+func unverifiedIssuer(raw string) (string, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token is not a JWT")
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Issuer, nil
+}
@@ -0,0 +1,538 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongodb "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// roles that groups can grant, strongest first
+var groupRoles = []string{"Admin", "User", "Guest"}
+
+// Ldap authenticates against an LDAP directory such as Active Directory.  The
+// service account finds the user, then the user's own password is checked by
+// binding as them.
+type Ldap struct {
+	url          string
+	startTLS     bool
+	tlsConfig    *tls.Config
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	mailAttr     string
+	nameAttr     string
+	groupAttr    string
+	groupBaseDN  string
+	groupFilter  string
+	groups       map[string]string
+	accountID    string
+}
+
+// claims about the user carried in the token from Exchange to UserInfo
+type ldapClaims struct {
+	Issuer   string    `json:"iss"`
+	Subject  string    `json:"sub"`
+	Email    string    `json:"email"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role,omitempty"`
+	Groups   []string  `json:"groups,omitempty"`
+	IssuedAt time.Time `json:"iat"`
+	Expiry   time.Time `json:"exp"`
+}
+
+func getenv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// Setup reads the directory settings
+func (o *Ldap) Setup() error {
+	o.url = os.Getenv("LDAP_URL")
+	o.baseDN = os.Getenv("LDAP_BASE_DN")
+	if o.url == "" || o.baseDN == "" {
+		return errors.New("LDAP_URL and LDAP_BASE_DN are required")
+	}
+
+	o.startTLS = os.Getenv("LDAP_START_TLS") == "true"
+	o.bindDN = os.Getenv("LDAP_BIND_DN")
+	o.bindPassword = os.Getenv("LDAP_BIND_PASSWORD")
+	o.userFilter = getenv("LDAP_USER_FILTER", "(|(uid={username})(sAMAccountName={username})(mail={username}))")
+	o.mailAttr = getenv("LDAP_MAIL_ATTRIBUTE", "mail")
+	o.nameAttr = getenv("LDAP_NAME_ATTRIBUTE", "displayName")
+	o.groupAttr = getenv("LDAP_GROUP_ATTRIBUTE", "memberOf")
+	o.groupBaseDN = getenv("LDAP_GROUP_BASE_DN", o.baseDN)
+	o.groupFilter = os.Getenv("LDAP_GROUP_FILTER")
+	o.accountID = os.Getenv("LDAP_ACCOUNT_ID")
+
+	o.tlsConfig = &tls.Config{
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+	}
+	if ca := os.Getenv("LDAP_CA_FILE"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", ca)
+		}
+		o.tlsConfig.RootCAs = pool
+	}
+
+	// LDAP_GROUP_ROLES=cn=vpn-admins,ou=groups,dc=example,dc=com:Admin;vpn-users:User
+	o.groups = make(map[string]string)
+	for _, mapping := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+		mapping = strings.TrimSpace(mapping)
+		if mapping == "" {
+			continue
+		}
+		i := strings.LastIndex(mapping, ":")
+		if i <= 0 {
+			return fmt.Errorf("invalid LDAP_GROUP_ROLES entry %s", mapping)
+		}
+		role := strings.TrimSpace(mapping[i+1:])
+		if !slices.Contains(groupRoles, role) {
+			return fmt.Errorf("invalid role %s in LDAP_GROUP_ROLES", role)
+		}
+		o.groups[normalizeDN(mapping[:i])] = role
+	}
+
+	if len(o.groups) > 0 && o.accountID == "" {
+		return errors.New("LDAP_ACCOUNT_ID is required with LDAP_GROUP_ROLES")
+	}
+
+	return nil
+}
+
+// normalizeDN lower cases a DN and removes the spaces around its separators
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		kv := strings.SplitN(p, "=", 2)
+		for j := range kv {
+			kv[j] = strings.TrimSpace(kv[j])
+		}
+		parts[i] = strings.Join(kv, "=")
+	}
+	return strings.ToLower(strings.Join(parts, ","))
+}
+
+// connect to the directory and bind as the service account
+func (o *Ldap) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(o.url, ldap.DialWithTLSConfig(o.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.startTLS {
+		err = conn.StartTLS(o.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if o.bindDN != "" {
+		err = conn.Bind(o.bindDN, o.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// find the single entry matching the login name
+func (o *Ldap) find(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	filter := strings.ReplaceAll(o.userFilter, "{username}", ldap.EscapeFilter(username))
+
+	attributes := []string{"dn", o.mailAttr, o.nameAttr, "cn"}
+	if o.groupFilter == "" {
+		attributes = append(attributes, o.groupAttr)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		o.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		filter, attributes, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, core.ErrInvalidLogin
+	}
+
+	return result.Entries[0], nil
+}
+
+// groups the entry is a member of
+func (o *Ldap) memberOf(conn *ldap.Conn, entry *ldap.Entry) ([]string, error) {
+	if o.groupFilter == "" {
+		return entry.GetAttributeValues(o.groupAttr), nil
+	}
+
+	filter := strings.ReplaceAll(o.groupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		o.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+		filter, []string{"dn"}, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// role maps the user's groups to the strongest role they grant.  A mapping
+// may name a group by its DN or just its cn.
+func (o *Ldap) role(groups []string) string {
+	granted := map[string]bool{}
+	for _, g := range groups {
+		dn := normalizeDN(g)
+		if role, ok := o.groups[dn]; ok {
+			granted[role] = true
+		}
+		cn := strings.SplitN(dn, ",", 2)[0]
+		if role, ok := o.groups[strings.TrimPrefix(cn, "cn=")]; ok {
+			granted[role] = true
+		}
+	}
+
+	for _, role := range groupRoles {
+		if granted[role] {
+			return role
+		}
+	}
+	return ""
+}
+
+// groupNames returns the cn of each group, which provisioning rules name groups by
+func groupNames(groups []string) []string {
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		cn := strings.SplitN(normalizeDN(g), ",", 2)[0]
+		names = append(names, strings.TrimPrefix(cn, "cn="))
+	}
+	return names
+}
+
+// login checks the password by binding as the user and returns what the
+// directory says about them
+func (o *Ldap) login(username string, password string) (*ldapClaims, error) {
+	if username == "" || password == "" {
+		// an empty password would be an unauthenticated bind, which succeeds
+		return nil, core.ErrInvalidLogin
+	}
+
+	conn, err := o.connect()
+	if err != nil {
+		log.Errorf("ldap: %v", err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := o.find(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := o.memberOf(conn, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		return nil, core.ErrInvalidLogin
+	}
+
+	claims := &ldapClaims{
+		Issuer:  "LDAP",
+		Subject: entry.DN,
+		Email:   strings.ToLower(entry.GetAttributeValue(o.mailAttr)),
+		Name:    entry.GetAttributeValue(o.nameAttr),
+		Role:    o.role(groups),
+		Groups:  groupNames(groups),
+	}
+	if claims.Name == "" {
+		claims.Name = entry.GetAttributeValue("cn")
+	}
+
+	if !util.RegexpEmail.MatchString(claims.Email) {
+		return nil, fmt.Errorf("ldap user %s has no %s attribute", entry.DN, o.mailAttr)
+	}
+
+	if len(o.groups) > 0 && claims.Role == "" {
+		o.suspend(claims)
+		return nil, fmt.Errorf("ldap user %s is not in a group with access", entry.DN)
+	}
+
+	return claims, nil
+}
+
+// Authenticate the user against the directory
+func (o *Ldap) Authenticate(username string, password string) error {
+	_, err := o.login(username, password)
+	return err
+}
+
+// LoginEmail looks up the mail attribute of the login name
+func (o *Ldap) LoginEmail(username string) string {
+	conn, err := o.connect()
+	if err == nil {
+		defer conn.Close()
+		var entry *ldap.Entry
+		entry, err = o.find(conn, username)
+		if err == nil {
+			return strings.ToLower(entry.GetAttributeValue(o.mailAttr))
+		}
+	}
+	log.Errorf("ldap: %v", err)
+	return strings.ToLower(username)
+}
+
+// CodeUrl get url to redirect client for auth
+func (o *Ldap) CodeUrl(state string) string {
+
+	server := os.Getenv("SERVER")
+	return server + "/login?state=" + state
+}
+
+func (o *Ldap) CodeUrl2(state string) string {
+	return o.CodeUrl(state)
+}
+
+// Exchange exchange code for Oauth2 token.  The password is checked again
+// and the user's membership updated from their groups.
+func (o *Ldap) Exchange(auth model.Auth) (*oauth2.Token, error) {
+
+	// code contains the username and password base64 encoded
+	userpass, err := base64.StdEncoding.DecodeString(auth.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(userpass), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid username and password")
+	}
+
+	claims, err := o.login(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(o.groups) > 0 {
+		err = o.membership(claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rand, err := util.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  rand,
+		TokenType:    "Bearer",
+		RefreshToken: "",
+		Expiry:       time.Now().Add(time.Hour * 24),
+	}
+	claims.IssuedAt = time.Now()
+	claims.Expiry = token.Expiry
+
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	m["id_token"] = string(raw)
+	token = token.WithExtra(m)
+
+	return token, nil
+}
+
+func (o *Ldap) Exchange2(code string) (*oauth2.Token, error) {
+	return o.Exchange(model.Auth{Code: code})
+}
+
+// membership adds the user to LDAP_ACCOUNT_ID with the role their groups
+// grant, or brings an existing membership in line with it.  The owner of the
+// account is left alone.
+func (o *Ldap) membership(claims *ldapClaims) error {
+	parent, err := core.ReadAccount(o.accountID)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := mongodb.ReadAllAccounts(claims.Email)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range accounts {
+		if a.Parent != parent.Id {
+			continue
+		}
+		if a.Id == a.Parent || (a.Role == claims.Role && a.Status == "Active") {
+			return nil
+		}
+		log.Infof("ldap: %s is now %s in account %s", claims.Email, claims.Role, parent.Id)
+		a.Role = claims.Role
+		a.Status = "Active"
+		a.UpdatedBy = claims.Email
+		_, err = core.UpdateAccount(a.Id, a)
+		return err
+	}
+
+	account := &model.Account{
+		Parent:      parent.Id,
+		Email:       claims.Email,
+		Name:        claims.Name,
+		Sub:         claims.Subject,
+		AccountName: parent.AccountName,
+		Picture:     os.Getenv("SERVER") + "/account-circle.png",
+		Role:        claims.Role,
+		Status:      "Active",
+		CreatedBy:   claims.Email,
+		UpdatedBy:   claims.Email,
+	}
+	_, err = core.CreateAccount(account)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("ldap: added %s to account %s as %s", claims.Email, parent.Id, claims.Role)
+
+	return nil
+}
+
+// suspend the membership of a user who is no longer in any mapped group
+func (o *Ldap) suspend(claims *ldapClaims) {
+	accounts, err := mongodb.ReadAllAccounts(claims.Email)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, a := range accounts {
+		if a.Parent == o.accountID && a.Id != a.Parent && a.Status != "Suspended" {
+			log.Infof("ldap: %s removed from all groups, suspending in account %s", claims.Email, a.Parent)
+			a.Status = "Suspended"
+			a.UpdatedBy = claims.Email
+			_, err = core.UpdateAccount(a.Id, a)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// UserInfo get token user
+func (o *Ldap) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token field in oauth2 token")
+	}
+
+	var claims ldapClaims
+
+	err := json.Unmarshal([]byte(rawIDToken), &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != "LDAP" {
+		return nil, fmt.Errorf("token was not issued by the ldap provider")
+	}
+
+	user := &model.User{}
+	user.Sub = claims.Subject
+	user.Email = claims.Email
+	user.Name = claims.Name
+	if user.Name == "" {
+		user.Name = claims.Email
+	}
+	user.Picture = os.Getenv("SERVER") + "/account-circle.png"
+	user.Issuer = claims.Issuer
+	user.Groups = claims.Groups
+	// the directory vouches for the email
+	user.Verified = true
+	user.IssuedAt = claims.IssuedAt
+
+	// check if user exists
+	accounts, err := mongodb.ReadAllAccounts(user.Email)
+	if err != nil {
+		log.Error(err)
+	} else {
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
+		if len(accounts) == 0 {
+			var account model.Account
+			account.AccountName = "Company"
+			account.Name = user.Name
+			account.Sub = user.Sub
+			account.Email = user.Email
+			account.Role = "Owner"
+			account.Status = "Active"
+			account.CreatedBy = user.Email
+			account.UpdatedBy = user.Email
+			account.Picture = user.Picture
+			a, err := core.CreateAccount(&account)
+			log.Infof("CREATE ACCOUNT = %v", a)
+			if err != nil {
+				log.Error(err)
+			}
+			accounts, err = mongodb.ReadAllAccounts(user.Email)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	for i := 0; i < len(accounts); i++ {
+		if accounts[i].Id == accounts[i].Parent {
+			user.AccountID = accounts[i].Id
+			user.Picture = accounts[i].Picture
+			break
+		}
+	}
+	if user.AccountID == "" && len(accounts) > 0 {
+		user.AccountID = accounts[0].Id
+	}
+
+	err = mongodb.UpsertUser(user)
+	if err != nil {
+		log.Error(err)
+	}
+	return user, nil
+}
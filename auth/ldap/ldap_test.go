@@ -0,0 +1,466 @@
+package ldap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+)
+
+// fakeEntry is an entry in the fake directory, with the password that binds as it
+type fakeEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// fakeDirectory is just enough of an LDAP server to bind and search
+type fakeDirectory struct {
+	entries []*fakeEntry
+
+	mu    sync.Mutex
+	binds []string
+}
+
+const (
+	serviceDN       = "cn=nettica,ou=services,dc=example,dc=com"
+	servicePassword = "service-secret"
+)
+
+func newFakeDirectory(t *testing.T) (*fakeDirectory, string) {
+	t.Helper()
+
+	d := &fakeDirectory{
+		entries: []*fakeEntry{
+			{dn: serviceDN, password: servicePassword, attributes: map[string][]string{
+				"objectClass": {"person"},
+				"cn":          {"nettica"},
+			}},
+			{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alice-secret", attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"alice"},
+				"cn":          {"alice"},
+				"displayName": {"Alice Admin"},
+				"mail":        {"Alice@Example.com"},
+				"memberOf":    {"CN=VPN-Admins, OU=Groups, DC=example, DC=com", "cn=staff,ou=groups,dc=example,dc=com"},
+			}},
+			{dn: "uid=bob,ou=people,dc=example,dc=com", password: "bob-secret", attributes: map[string][]string{
+				"objectClass":    {"person"},
+				"uid":            {"bob"},
+				"sAMAccountName": {"bob"},
+				"cn":             {"Bob"},
+				"mail":           {"bob@example.com"},
+				"memberOf":       {"cn=vpn-users,ou=groups,dc=example,dc=com", "cn=vpn-guests,ou=groups,dc=example,dc=com"},
+			}},
+			{dn: "uid=nomail,ou=people,dc=example,dc=com", password: "nomail-secret", attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {"nomail"},
+			}},
+			{dn: "cn=vpn-admins,ou=groups,dc=example,dc=com", attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"vpn-admins"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+			}},
+			{dn: "cn=vpn-users,ou=groups,dc=example,dc=com", attributes: map[string][]string{
+				"objectClass": {"groupOfNames"},
+				"cn":          {"vpn-users"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			}},
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+
+	return d, "ldap://" + l.Addr().String()
+}
+
+func (d *fakeDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			d.bind(conn, id, op)
+		case ldap.ApplicationSearchRequest:
+			d.search(conn, id, op)
+		default:
+			return
+		}
+	}
+}
+
+func (d *fakeDirectory) bind(conn net.Conn, id int64, op *ber.Packet) {
+	dn := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	d.mu.Lock()
+	d.binds = append(d.binds, dn)
+	d.mu.Unlock()
+
+	code := ldap.LDAPResultInvalidCredentials
+	if dn == "" && password == "" {
+		code = ldap.LDAPResultSuccess
+	}
+	for _, e := range d.entries {
+		if strings.EqualFold(e.dn, dn) && e.password != "" && e.password == password {
+			code = ldap.LDAPResultSuccess
+		}
+	}
+
+	respond(conn, id, result(ldap.ApplicationBindResponse, code))
+}
+
+func (d *fakeDirectory) search(conn net.Conn, id int64, op *ber.Packet) {
+	base := strings.ToLower(op.Children[0].Value.(string))
+	filter := op.Children[6]
+
+	var wanted []string
+	for _, a := range op.Children[7].Children {
+		wanted = append(wanted, a.Value.(string))
+	}
+
+	for _, e := range d.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), base) || !e.matches(filter) {
+			continue
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		attributes := ber.NewSequence("")
+		for name, values := range e.attributes {
+			if len(wanted) > 0 && !slices.ContainsFunc(wanted, func(w string) bool { return strings.EqualFold(w, name) }) {
+				continue
+			}
+			attribute := ber.NewSequence("")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+		entry.AppendChild(attributes)
+		respond(conn, id, entry)
+	}
+
+	respond(conn, id, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// matches evaluates the and, or, not, equality and presence filters
+func (e *fakeEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, f := range filter.Children {
+			if !e.matches(f) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, f := range filter.Children {
+			if e.matches(f) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !e.matches(filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		name := filter.Children[0].Value.(string)
+		value := filter.Children[1].Value.(string)
+		for k, values := range e.attributes {
+			if strings.EqualFold(k, name) && slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, value) }) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		name := filter.Data.String()
+		for k := range e.attributes {
+			if strings.EqualFold(k, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+func respond(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.NewSequence("")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+// setup configures the provider for the fake directory from the environment
+func setup(t *testing.T, url string, env map[string]string) *Ldap {
+	t.Helper()
+
+	t.Setenv("LDAP_URL", url)
+	t.Setenv("LDAP_BASE_DN", "dc=example,dc=com")
+	t.Setenv("LDAP_BIND_DN", serviceDN)
+	t.Setenv("LDAP_BIND_PASSWORD", servicePassword)
+	for _, key := range []string{"LDAP_GROUP_ROLES", "LDAP_GROUP_FILTER", "LDAP_GROUP_BASE_DN", "LDAP_ACCOUNT_ID", "LDAP_USER_FILTER"} {
+		t.Setenv(key, "")
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+
+	o := &Ldap{}
+	if err := o.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+var groupRoleEnv = map[string]string{
+	"LDAP_GROUP_ROLES": "cn=vpn-admins,ou=groups,dc=example,dc=com:Admin; vpn-users:User; vpn-guests:Guest",
+	"LDAP_ACCOUNT_ID":  "account-1",
+}
+
+func TestSetupGroupRoles(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, groupRoleEnv)
+
+	want := map[string]string{
+		"cn=vpn-admins,ou=groups,dc=example,dc=com": "Admin",
+		"vpn-users":  "User",
+		"vpn-guests": "Guest",
+	}
+	if len(o.groups) != len(want) {
+		t.Fatalf("groups = %v, want %v", o.groups, want)
+	}
+	for g, role := range want {
+		if o.groups[g] != role {
+			t.Errorf("group %s maps to %q, want %q", g, o.groups[g], role)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{"unknown role", map[string]string{"LDAP_GROUP_ROLES": "vpn-users:Owner", "LDAP_ACCOUNT_ID": "account-1"}},
+		{"no role", map[string]string{"LDAP_GROUP_ROLES": "vpn-users", "LDAP_ACCOUNT_ID": "account-1"}},
+		{"no account", map[string]string{"LDAP_GROUP_ROLES": "vpn-users:User"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("LDAP_ACCOUNT_ID", "")
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			if err := (&Ldap{}).Setup(); err == nil {
+				t.Error("Setup succeeded")
+			}
+		})
+	}
+}
+
+func TestRole(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, groupRoleEnv)
+
+	for _, tc := range []struct {
+		groups []string
+		role   string
+	}{
+		{[]string{"CN=VPN-Admins, OU=Groups, DC=example, DC=com"}, "Admin"},
+		{[]string{"cn=vpn-users,ou=other,dc=example,dc=com"}, "User"},
+		{[]string{"cn=vpn-guests,ou=groups,dc=example,dc=com", "cn=vpn-users,ou=groups,dc=example,dc=com"}, "User"},
+		{[]string{"cn=vpn-users,ou=groups,dc=example,dc=com", "cn=vpn-admins,ou=groups,dc=example,dc=com"}, "Admin"},
+		{[]string{"cn=vpn-admins,ou=other,dc=example,dc=com"}, ""},
+		{[]string{"cn=staff,ou=groups,dc=example,dc=com"}, ""},
+		{nil, ""},
+	} {
+		if role := o.role(tc.groups); role != tc.role {
+			t.Errorf("role(%v) = %q, want %q", tc.groups, role, tc.role)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	d, url := newFakeDirectory(t)
+	o := setup(t, url, groupRoleEnv)
+
+	claims, err := o.login("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+
+	if claims.Subject != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("subject = %q", claims.Subject)
+	}
+	if claims.Email != "alice@example.com" {
+		t.Errorf("email = %q, want it lower cased", claims.Email)
+	}
+	if claims.Name != "Alice Admin" {
+		t.Errorf("name = %q, want the display name", claims.Name)
+	}
+	if claims.Role != "Admin" {
+		t.Errorf("role = %q, want Admin", claims.Role)
+	}
+	if !slices.Equal(claims.Groups, []string{"vpn-admins", "staff"}) {
+		t.Errorf("groups = %v, want the cn of each group", claims.Groups)
+	}
+
+	// the service account finds the user, then the user binds as themselves
+	d.mu.Lock()
+	binds := slices.Clone(d.binds)
+	d.mu.Unlock()
+	if !slices.Equal(binds, []string{serviceDN, "uid=alice,ou=people,dc=example,dc=com"}) {
+		t.Errorf("binds = %v", binds)
+	}
+
+	claims, err = o.login("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if claims.Role != "User" || claims.Name != "Bob" {
+		t.Errorf("role = %q name = %q, want User and the cn", claims.Role, claims.Name)
+	}
+}
+
+func TestLoginRefused(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, nil)
+
+	for _, tc := range []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "alice", "wrong"},
+		{"empty password", "alice", ""},
+		{"unknown user", "carol", "carol-secret"},
+		{"filter injection", "*", "alice-secret"},
+		{"another user's password", "alice", "bob-secret"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := o.login(tc.username, tc.password)
+			if !errors.Is(err, core.ErrInvalidLogin) {
+				t.Errorf("login = %v, want %v", err, core.ErrInvalidLogin)
+			}
+		})
+	}
+
+	if _, err := o.login("nomail", "nomail-secret"); err == nil {
+		t.Error("login of a user without a mail attribute succeeded")
+	}
+}
+
+func TestLoginBadServiceAccount(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, map[string]string{"LDAP_BIND_PASSWORD": "wrong"})
+
+	if _, err := o.login("alice", "alice-secret"); err == nil {
+		t.Error("login with a bad service account succeeded")
+	}
+}
+
+func TestLoginGroupFilter(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	env := map[string]string{
+		"LDAP_GROUP_FILTER":  "(&(objectClass=groupOfNames)(member={dn}))",
+		"LDAP_GROUP_BASE_DN": "ou=groups,dc=example,dc=com",
+	}
+	for k, v := range groupRoleEnv {
+		env[k] = v
+	}
+	o := setup(t, url, env)
+
+	// alice's memberOf is ignored, her groups are searched for
+	claims, err := o.login("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if claims.Role != "Admin" {
+		t.Errorf("role = %q, want Admin", claims.Role)
+	}
+	if !slices.Equal(claims.Groups, []string{"vpn-admins", "vpn-users"}) {
+		t.Errorf("groups = %v", claims.Groups)
+	}
+
+	claims, err = o.login("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if claims.Role != "User" || !slices.Equal(claims.Groups, []string{"vpn-users"}) {
+		t.Errorf("role = %q groups = %v, want User from vpn-users", claims.Role, claims.Groups)
+	}
+}
+
+func TestLoginEmail(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, nil)
+
+	if email := o.LoginEmail("alice"); email != "alice@example.com" {
+		t.Errorf("LoginEmail = %q, want the mail attribute", email)
+	}
+	if email := o.LoginEmail("Carol@Example.com"); email != "carol@example.com" {
+		t.Errorf("LoginEmail = %q, want the login name", email)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	_, url := newFakeDirectory(t)
+	o := setup(t, url, nil)
+
+	code := base64.StdEncoding.EncodeToString([]byte("bob:bob-secret"))
+	token, err := o.Exchange(model.Auth{Code: code})
+	if err != nil {
+		t.Fatalf("exchange failed: %v", err)
+	}
+
+	var claims ldapClaims
+	if err := json.Unmarshal([]byte(token.Extra("id_token").(string)), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != "LDAP" || claims.Email != "bob@example.com" || claims.Role != "" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	code = base64.StdEncoding.EncodeToString([]byte("bob:wrong"))
+	if _, err := o.Exchange(model.Auth{Code: code}); err == nil {
+		t.Error("exchange with a wrong password succeeded")
+	}
+}
@@ -0,0 +1,188 @@
+package local
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongodb "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Local authenticates against users stored in the database
+type Local struct{}
+
+// Setup the local provider
+func (o *Local) Setup() error {
+	return nil
+}
+
+// Authenticate the user against the local user directory
+func (o *Local) Authenticate(username string, password string) error {
+	return core.LocalAuthenticate(username, password)
+}
+
+// LoginEmail local users log in with their email
+func (o *Local) LoginEmail(username string) string {
+	return strings.ToLower(username)
+}
+
+// CodeUrl get url to redirect client for auth
+func (o *Local) CodeUrl(state string) string {
+
+	server := os.Getenv("SERVER")
+	return server + "/login?state=" + state
+}
+
+func (o *Local) CodeUrl2(state string) string {
+	return o.CodeUrl(state)
+}
+
+// Exchange exchange code for Oauth2 token.  Unlike basic, the password is
+// checked again here so a code that did not come from login is useless.
+func (o *Local) Exchange(auth model.Auth) (*oauth2.Token, error) {
+
+	// code contains the username and password base64 encoded
+	userpass, err := base64.StdEncoding.DecodeString(auth.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(userpass), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("invalid username and password")
+	}
+	user := strings.ToLower(parts[0])
+
+	err = core.LocalAuthenticate(user, parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	rand, err := util.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  rand,
+		TokenType:    "Bearer",
+		RefreshToken: "",
+		Expiry:       time.Now().Add(time.Hour * 24),
+	}
+	// add the user to the token
+	idtoken := &oidc.IDToken{Subject: user, Issuer: "Local", IssuedAt: time.Now(), Expiry: time.Now().Add(time.Hour * 24)}
+
+	raw, err := json.Marshal(idtoken)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	m["id_token"] = string(raw)
+	token = token.WithExtra(m)
+
+	return token, nil
+}
+
+func (o *Local) Exchange2(code string) (*oauth2.Token, error) {
+	return o.Exchange(model.Auth{Code: code})
+}
+
+// UserInfo get token user
+func (o *Local) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token field in oauth2 token")
+	}
+
+	var idToken *oidc.IDToken
+
+	err := json.Unmarshal([]byte(rawIDToken), &idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Issuer != "Local" {
+		return nil, fmt.Errorf("token was not issued by the local provider")
+	}
+
+	local, err := mongodb.ReadLocalUser(idToken.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if local.Status != "Active" {
+		return nil, fmt.Errorf("user %s is suspended", local.Email)
+	}
+
+	user := &model.User{}
+	user.Sub = local.Email
+	user.Email = local.Email
+	user.Name = local.Name
+	if user.Name == "" {
+		user.Name = local.Email
+	}
+	user.Picture = os.Getenv("SERVER") + "/account-circle.png"
+	user.Issuer = idToken.Issuer
+	user.Verified = local.Verified
+	user.IssuedAt = idToken.IssuedAt
+
+	// check if user exists
+	accounts, err := mongodb.ReadAllAccounts(user.Email)
+	if err != nil {
+		log.Error(err)
+	} else {
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
+		if len(accounts) == 0 {
+			var account model.Account
+			account.AccountName = "Company"
+			account.Name = user.Name
+			account.Sub = user.Sub
+			account.Email = user.Email
+			account.Role = "Owner"
+			account.Status = "Active"
+			account.CreatedBy = user.Email
+			account.UpdatedBy = user.Email
+			account.Picture = user.Picture
+			a, err := core.CreateAccount(&account)
+			log.Infof("CREATE ACCOUNT = %v", a)
+			if err != nil {
+				log.Error(err)
+			}
+			accounts, err = mongodb.ReadAllAccounts(user.Email)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	for i := 0; i < len(accounts); i++ {
+		if accounts[i].Id == accounts[i].Parent {
+			user.AccountID = accounts[i].Id
+			user.Picture = accounts[i].Picture
+			break
+		}
+	}
+	if user.AccountID == "" && len(accounts) > 0 {
+		user.AccountID = accounts[0].Id
+	}
+
+	err = mongodb.UpsertUser(user)
+	if err != nil {
+		log.Error(err)
+	}
+	return user, nil
+}
@@ -132,6 +132,8 @@ func (o *Oauth2Msft) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
 	}
 
 	user.Issuer = idToken.Issuer
+	user.Groups = core.ClaimGroups(claims)
+	user.Verified = core.ClaimEmailVerified(claims)
 	user.IssuedAt = idToken.IssuedAt
 	log.Infof("user %s token expires %v", user.Email, idToken.Expiry)
 
@@ -139,7 +141,11 @@ func (o *Oauth2Msft) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
 	if err != nil {
 		log.Error(err)
 	} else {
-		//  If there's no error and no account, create one.
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
 		if len(accounts) == 0 {
 			var account model.Account
 			account.Name = "Me"
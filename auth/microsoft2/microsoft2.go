@@ -2,6 +2,8 @@ package microsoft2
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -177,6 +179,7 @@ func (o *Oauth2Microsoft) UserInfo(oauth2Token *oauth2.Token) (*model.User, erro
 	user.Picture = os.Getenv("SERVER") + "/account-circle.png"
 
 	user.Issuer = authResult.IDToken.Issuer
+	user.Verified = core.ClaimEmailVerified(idTokenClaims(authResult.IDToken.RawToken))
 	user.IssuedAt = time.Unix(authResult.IDToken.IssuedAt, 0)
 	log.Infof("user %s token expires %v", user.Email, authResult.IDToken.ExpirationTime)
 
@@ -184,7 +187,11 @@ func (o *Oauth2Microsoft) UserInfo(oauth2Token *oauth2.Token) (*model.User, erro
 	if err != nil {
 		log.Error(err)
 	} else {
-		//  If there's no error and no account, create one.
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
 		if len(accounts) == 0 {
 			var account model.Account
 			account.Name = "Me"
@@ -225,3 +232,23 @@ func (o *Oauth2Microsoft) UserInfo(oauth2Token *oauth2.Token) (*model.User, erro
 	userCache.Set(oauth2Token.AccessToken, user, 0)
 	return user, nil
 }
+
+// idTokenClaims reads the claims of an id token msal has already verified
+func idTokenClaims(raw string) map[string]interface{} {
+	claims := map[string]interface{}{}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		log.Error(err)
+	}
+
+	return claims
+}
@@ -0,0 +1,131 @@
+package passkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongodb "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// Provider is the value of the provider extra on tokens issued after a passkey login
+const Provider = "webauthn"
+
+// Passkey authenticates users with a WebAuthn credential they registered
+// while logged in through the configured provider.  It never creates accounts.
+type Passkey struct{}
+
+// Setup the passkey provider
+func (o *Passkey) Setup() error {
+	return nil
+}
+
+// CodeUrl passkey logins start on the login page
+func (o *Passkey) CodeUrl(state string) string {
+	return os.Getenv("SERVER") + "/login?state=" + state
+}
+
+func (o *Passkey) CodeUrl2(state string) string {
+	return o.CodeUrl(state)
+}
+
+// Exchange is not used, tokens are issued by the webauthn login endpoint
+func (o *Passkey) Exchange(auth model.Auth) (*oauth2.Token, error) {
+	return nil, errors.New("passkey logins do not exchange codes")
+}
+
+func (o *Passkey) Exchange2(code string) (*oauth2.Token, error) {
+	return o.Exchange(model.Auth{Code: code})
+}
+
+// NewToken issues a token for a user that completed a passkey login
+func NewToken(email string) (*oauth2.Token, error) {
+	rand, err := util.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  rand,
+		TokenType:    "Bearer",
+		RefreshToken: "",
+		Expiry:       time.Now().Add(time.Hour * 24),
+	}
+	// add the user to the token
+	idtoken := &oidc.IDToken{Subject: email, Issuer: "WebAuthn", IssuedAt: time.Now(), Expiry: time.Now().Add(time.Hour * 24)}
+
+	raw, err := json.Marshal(idtoken)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	m["id_token"] = string(raw)
+	m["provider"] = Provider
+	token = token.WithExtra(m)
+
+	return token, nil
+}
+
+// UserInfo get token user
+func (o *Passkey) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token field in oauth2 token")
+	}
+
+	var idToken *oidc.IDToken
+
+	err := json.Unmarshal([]byte(rawIDToken), &idToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Issuer != "WebAuthn" {
+		return nil, fmt.Errorf("token was not issued by the passkey provider")
+	}
+
+	accounts, err := mongodb.ReadAllAccounts(idToken.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, fmt.Errorf("user %s has no accounts", idToken.Subject)
+	}
+
+	user := &model.User{}
+	user.Sub = idToken.Subject
+	user.Email = idToken.Subject
+	user.Issuer = idToken.Issuer
+	user.IssuedAt = idToken.IssuedAt
+
+	for i := 0; i < len(accounts); i++ {
+		if accounts[i].Id == accounts[i].Parent {
+			user.AccountID = accounts[i].Id
+			user.Name = accounts[i].Name
+			user.Picture = accounts[i].Picture
+			break
+		}
+	}
+	if user.AccountID == "" {
+		user.AccountID = accounts[0].Id
+		user.Name = accounts[0].Name
+		user.Picture = accounts[0].Picture
+	}
+	if user.Name == "" {
+		user.Name = user.Email
+	}
+
+	err = mongodb.UpsertUser(user)
+	if err != nil {
+		log.Error(err)
+	}
+	return user, nil
+}
@@ -0,0 +1,446 @@
+package saml
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	gosaml "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongodb "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	"github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// attributes tried, in order, when SAML_EMAIL_ATTRIBUTE or SAML_NAME_ATTRIBUTE are not set
+var emailAttributes = []string{
+	"email",
+	"mail",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	"urn:oid:0.9.2342.19200300.100.1.3",
+}
+
+var nameAttributes = []string{
+	"displayName",
+	"name",
+	"http://schemas.microsoft.com/identity/claims/displayname",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+	"urn:oid:2.16.840.1.113730.3.1.241",
+	"cn",
+	"urn:oid:2.5.4.3",
+}
+
+// attributes tried for the user's groups when SAML_GROUP_ATTRIBUTE is not set
+var groupAttributes = []string{
+	"groups",
+	"memberOf",
+	"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+}
+
+// Saml is a SAML 2.0 service provider.  The IdP posts its assertion to the
+// ACS endpoint, which hands the browser a code to exchange like any OAuth2
+// provider would.
+type Saml struct {
+	sp *gosaml.ServiceProvider
+
+	// outstanding AuthnRequest ids and the state they were made for
+	requests *cache.Cache
+
+	// verified assertions waiting to be exchanged, by code
+	codes *cache.Cache
+}
+
+// a login started by CodeUrl or CodeUrl2
+type samlRequest struct {
+	State string
+	Agent bool
+}
+
+// claims about the user carried in the token from Exchange to UserInfo
+type samlClaims struct {
+	Issuer   string    `json:"iss"`
+	Subject  string    `json:"sub"`
+	Email    string    `json:"email"`
+	Name     string    `json:"name"`
+	Groups   []string  `json:"groups,omitempty"`
+	IssuedAt time.Time `json:"iat"`
+}
+
+// Setup loads the IdP metadata and the SP's key pair
+func (o *Saml) Setup() error {
+	server := os.Getenv("SERVER")
+
+	metadataURL, err := url.Parse(server + "/api/v1.0/auth/saml/metadata")
+	if err != nil {
+		return err
+	}
+	acsURL, err := url.Parse(server + "/api/v1.0/auth/saml/acs")
+	if err != nil {
+		return err
+	}
+
+	o.sp = &gosaml.ServiceProvider{
+		EntityID:          os.Getenv("SAML_ENTITY_ID"),
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		AuthnNameIDFormat: gosaml.UnspecifiedNameIDFormat,
+		AllowIDPInitiated: false,
+	}
+	if o.sp.EntityID == "" {
+		o.sp.EntityID = metadataURL.String()
+	}
+
+	if os.Getenv("SAML_SP_CERT") != "" || os.Getenv("SAML_SP_KEY") != "" {
+		pair, err := tls.LoadX509KeyPair(os.Getenv("SAML_SP_CERT"), os.Getenv("SAML_SP_KEY"))
+		if err != nil {
+			return err
+		}
+		o.sp.Certificate, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return errors.New("SAML_SP_KEY cannot sign")
+		}
+		o.sp.Key = signer
+		o.sp.SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	}
+
+	switch {
+	case os.Getenv("SAML_IDP_METADATA_URL") != "":
+		idpURL, err := url.Parse(os.Getenv("SAML_IDP_METADATA_URL"))
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		o.sp.IDPMetadata, err = samlsp.FetchMetadata(ctx, http.DefaultClient, *idpURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch SAML_IDP_METADATA_URL: %v", err)
+		}
+
+	case os.Getenv("SAML_IDP_METADATA_FILE") != "":
+		data, err := os.ReadFile(os.Getenv("SAML_IDP_METADATA_FILE"))
+		if err != nil {
+			return err
+		}
+		o.sp.IDPMetadata, err = samlsp.ParseMetadata(data)
+		if err != nil {
+			return fmt.Errorf("failed to parse SAML_IDP_METADATA_FILE: %v", err)
+		}
+
+	default:
+		return errors.New("SAML_IDP_METADATA_URL or SAML_IDP_METADATA_FILE is required")
+	}
+
+	o.requests = cache.New(10*time.Minute, 10*time.Minute)
+	o.codes = cache.New(5*time.Minute, 10*time.Minute)
+
+	return nil
+}
+
+// Metadata is the SP metadata to register with the IdP
+func (o *Saml) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(o.sp.Metadata(), "", "  ")
+}
+
+func (o *Saml) authnRequest(state string, agent bool) string {
+	idpURL := o.sp.GetSSOBindingLocation(gosaml.HTTPRedirectBinding)
+	if idpURL == "" {
+		log.Error("saml: the IdP metadata has no HTTP-Redirect single sign on service")
+		return ""
+	}
+
+	req, err := o.sp.MakeAuthenticationRequest(idpURL, gosaml.HTTPRedirectBinding, gosaml.HTTPPostBinding)
+	if err != nil {
+		log.Errorf("saml: %v", err)
+		return ""
+	}
+
+	redirect, err := req.Redirect(state, o.sp)
+	if err != nil {
+		log.Errorf("saml: %v", err)
+		return ""
+	}
+
+	o.requests.Set(req.ID, &samlRequest{State: state, Agent: agent}, cache.DefaultExpiration)
+
+	return redirect.String()
+}
+
+// CodeUrl get url to redirect client for auth
+func (o *Saml) CodeUrl(state string) string {
+	return o.authnRequest(state, false)
+}
+
+// CodeUrl2 get url to redirect the agent for auth
+func (o *Saml) CodeUrl2(state string) string {
+	return o.authnRequest(state, true)
+}
+
+// ACS verifies the assertion the IdP posted and returns where to send the
+// browser: the redirect url with a code and the state of the login.
+func (o *Saml) ACS(r *http.Request) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", err
+	}
+
+	ids := make([]string, 0)
+	for id := range o.requests.Items() {
+		ids = append(ids, id)
+	}
+
+	assertion, err := o.sp.ParseResponse(r, ids)
+	if err != nil {
+		var ire *gosaml.InvalidResponseError
+		if errors.As(err, &ire) {
+			log.Errorf("saml: %v", ire.PrivateErr)
+		}
+		return "", err
+	}
+
+	if assertion.Subject == nil {
+		return "", errors.New("saml assertion has no subject")
+	}
+
+	// the request this assertion answers must be the one the state was issued for
+	var request *samlRequest
+	for _, sc := range assertion.Subject.SubjectConfirmations {
+		if sc.SubjectConfirmationData == nil {
+			continue
+		}
+		id := sc.SubjectConfirmationData.InResponseTo
+		if v, exists := o.requests.Get(id); exists {
+			request = v.(*samlRequest)
+			o.requests.Delete(id)
+			break
+		}
+	}
+	if request == nil || request.State != r.Form.Get("RelayState") {
+		return "", errors.New("saml response does not match a login in progress")
+	}
+
+	claims, err := o.claims(assertion)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := util.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+	o.codes.Set(code, claims, cache.DefaultExpiration)
+
+	redirect := os.Getenv("OAUTH2_REDIRECT_URL")
+	if request.Agent {
+		redirect = os.Getenv("OAUTH2_AGENT_REDIRECT_URL")
+	}
+	if redirect == "" {
+		redirect = os.Getenv("SERVER")
+	}
+
+	return redirect + "?code=" + url.QueryEscape(code) + "&state=" + url.QueryEscape(request.State), nil
+}
+
+// claims maps the NameID and attributes of the assertion to the user
+func (o *Saml) claims(assertion *gosaml.Assertion) (*samlClaims, error) {
+	if assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, errors.New("saml assertion has no NameID")
+	}
+
+	attributes := make(map[string]string)
+	groups := make(map[string][]string)
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if len(attr.Values) == 0 {
+				continue
+			}
+			attributes[attr.Name] = attr.Values[0].Value
+			if attr.FriendlyName != "" {
+				attributes[attr.FriendlyName] = attr.Values[0].Value
+			}
+			// groups are the one attribute with many values
+			for _, v := range attr.Values {
+				groups[attr.Name] = append(groups[attr.Name], v.Value)
+				if attr.FriendlyName != "" {
+					groups[attr.FriendlyName] = append(groups[attr.FriendlyName], v.Value)
+				}
+			}
+		}
+	}
+
+	lookup := func(setting string, defaults []string) string {
+		names := defaults
+		if os.Getenv(setting) != "" {
+			names = []string{os.Getenv(setting)}
+		}
+		for _, name := range names {
+			if v := strings.TrimSpace(attributes[name]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	claims := &samlClaims{
+		Issuer:   "SAML",
+		Subject:  assertion.Subject.NameID.Value,
+		Email:    strings.ToLower(lookup("SAML_EMAIL_ATTRIBUTE", emailAttributes)),
+		Name:     lookup("SAML_NAME_ATTRIBUTE", nameAttributes),
+		IssuedAt: time.Now(),
+	}
+
+	names := groupAttributes
+	if os.Getenv("SAML_GROUP_ATTRIBUTE") != "" {
+		names = []string{os.Getenv("SAML_GROUP_ATTRIBUTE")}
+	}
+	for _, name := range names {
+		if len(groups[name]) > 0 {
+			claims.Groups = groups[name]
+			break
+		}
+	}
+
+	if claims.Email == "" && util.RegexpEmail.MatchString(claims.Subject) {
+		claims.Email = strings.ToLower(claims.Subject)
+	}
+	if !util.RegexpEmail.MatchString(claims.Email) {
+		return nil, fmt.Errorf("saml assertion for %s has no email", claims.Subject)
+	}
+
+	return claims, nil
+}
+
+// Exchange exchange the code from the ACS endpoint for an Oauth2 token
+func (o *Saml) Exchange(auth model.Auth) (*oauth2.Token, error) {
+	v, exists := o.codes.Get(auth.Code)
+	if !exists {
+		return nil, errors.New("invalid or expired code")
+	}
+	o.codes.Delete(auth.Code)
+	claims := v.(*samlClaims)
+
+	rand, err := util.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  rand,
+		TokenType:    "Bearer",
+		RefreshToken: "",
+		Expiry:       time.Now().Add(time.Hour * 24),
+	}
+
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	m["id_token"] = string(raw)
+	token = token.WithExtra(m)
+
+	return token, nil
+}
+
+func (o *Saml) Exchange2(code string) (*oauth2.Token, error) {
+	return o.Exchange(model.Auth{Code: code})
+}
+
+// UserInfo get token user
+func (o *Saml) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token field in oauth2 token")
+	}
+
+	var claims samlClaims
+
+	err := json.Unmarshal([]byte(rawIDToken), &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != "SAML" {
+		return nil, fmt.Errorf("token was not issued by the saml provider")
+	}
+
+	user := &model.User{}
+	user.Sub = claims.Subject
+	user.Email = claims.Email
+	user.Name = claims.Name
+	if user.Name == "" {
+		user.Name = claims.Email
+	}
+	user.Picture = os.Getenv("SERVER") + "/account-circle.png"
+	user.Issuer = claims.Issuer
+	user.Groups = claims.Groups
+	// the identity provider the server trusts vouches for the email
+	user.Verified = true
+	user.IssuedAt = claims.IssuedAt
+
+	// check if user exists
+	accounts, err := mongodb.ReadAllAccounts(user.Email)
+	if err != nil {
+		log.Error(err)
+	} else {
+		//  If there's no error and no account, the provisioning rules may add the user to one
+		if len(accounts) == 0 {
+			accounts = core.ProvisionUser(user)
+		}
+		//  Otherwise create one.
+		if len(accounts) == 0 {
+			var account model.Account
+			account.AccountName = "Company"
+			account.Name = user.Name
+			account.Sub = user.Sub
+			account.Email = user.Email
+			account.Role = "Owner"
+			account.Status = "Active"
+			account.CreatedBy = user.Email
+			account.UpdatedBy = user.Email
+			account.Picture = user.Picture
+			a, err := core.CreateAccount(&account)
+			log.Infof("CREATE ACCOUNT = %v", a)
+			if err != nil {
+				log.Error(err)
+			}
+			accounts, err = mongodb.ReadAllAccounts(user.Email)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	for i := 0; i < len(accounts); i++ {
+		if accounts[i].Id == accounts[i].Parent {
+			user.AccountID = accounts[i].Id
+			user.Picture = accounts[i].Picture
+			break
+		}
+	}
+	if user.AccountID == "" && len(accounts) > 0 {
+		user.AccountID = accounts[0].Id
+	}
+
+	err = mongodb.UpsertUser(user)
+	if err != nil {
+		log.Error(err)
+	}
+	return user, nil
+}
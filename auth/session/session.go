@@ -0,0 +1,91 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+
+	core "github.com/nettica-com/nettica-admin/core"
+	model "github.com/nettica-com/nettica-admin/model"
+	"golang.org/x/oauth2"
+)
+
+// Session answers for the signed session tokens the server issues after a
+// login.  The provider the user logged in with has already been asked about
+// the user, so its answer is read back from the token's claims.
+type Session struct{}
+
+// Setup the session provider
+func (o *Session) Setup() error {
+	return nil
+}
+
+// CodeUrl sessions are not logged in to directly
+func (o *Session) CodeUrl(state string) string {
+	return ""
+}
+
+func (o *Session) CodeUrl2(state string) string {
+	return ""
+}
+
+// Exchange is not used, sessions are issued after another provider's exchange
+func (o *Session) Exchange(auth model.Auth) (*oauth2.Token, error) {
+	return nil, errors.New("session tokens do not exchange codes")
+}
+
+func (o *Session) Exchange2(code string) (*oauth2.Token, error) {
+	return o.Exchange(model.Auth{Code: code})
+}
+
+// NewToken wraps a verified session token so it can be used like a provider's token
+func NewToken(raw string, claims *core.SessionClaims) *oauth2.Token {
+	token := &oauth2.Token{
+		AccessToken: raw,
+		TokenType:   "Bearer",
+		Expiry:      claims.ExpiresAt.Time,
+	}
+
+	m := make(map[string]interface{})
+	m["id_token"] = raw
+	m["provider"] = claims.Provider
+	m["session"] = claims
+
+	return token.WithExtra(m)
+}
+
+// Claims returns the claims of a session token, or false for any other token
+func Claims(oauth2Token *oauth2.Token) (*core.SessionClaims, bool) {
+	if oauth2Token == nil {
+		return nil, false
+	}
+	claims, ok := oauth2Token.Extra("session").(*core.SessionClaims)
+	return claims, ok
+}
+
+// UserInfo get token user
+func (o *Session) UserInfo(oauth2Token *oauth2.Token) (*model.User, error) {
+	claims, ok := Claims(oauth2Token)
+	if !ok {
+		var err error
+		claims, err = core.VerifySession(oauth2Token.AccessToken)
+		if err != nil {
+			return nil, fmt.Errorf("not a valid session token: %v", err)
+		}
+	}
+
+	user := &model.User{}
+	user.Sub = claims.Subject
+	user.Email = claims.Email
+	user.Name = claims.Name
+	user.Picture = claims.Picture
+	user.AccountID = claims.AccountID
+	user.Issuer = claims.Issuer
+	if claims.IssuedAt != nil {
+		user.IssuedAt = claims.IssuedAt.Time
+	}
+	if user.Name == "" {
+		user.Name = user.Email
+	}
+
+	return user, nil
+}
@@ -22,7 +22,6 @@ import (
 	version "github.com/nettica-com/nettica-admin/version"
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -105,6 +104,7 @@ func main() {
 	config.AllowAllOrigins = true
 	config.AddAllowHeaders("Authorization", util.AuthTokenHeaderName)
 	config.AddAllowHeaders("X-API-KEY")
+	config.AddExposeHeaders("X-Refresh-Token")
 	app.Use(cors.New(config))
 
 	// protection middleware
@@ -128,6 +128,9 @@ func main() {
 	app.GET("/login", serveIndex)
 	app.GET("/consent", serveIndex)
 	app.GET("/join", serveIndex)
+	app.GET("/device", serveIndex)
+	app.GET("/verify", serveIndex)
+	app.GET("/reset", serveIndex)
 
 	// setup Oauth2 client
 	oauth2Client, err := auth.GetAuthProvider()
@@ -137,6 +140,16 @@ func main() {
 		}).Fatal("failed to setup Oauth2")
 	}
 
+	// the apps allowed to send users through login
+	err = core.LoadClients()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("failed to load clients")
+	}
+
+	app.Use(core.RequestID())
+
 	app.Use(func(ctx *gin.Context) {
 		ctx.Set("oauth2Client", oauth2Client)
 		ctx.Next()
@@ -151,38 +164,29 @@ func main() {
 
 		token := util.GetCleanAuthToken(c)
 
-		oauth2Token, exists := cacheDb.Get(token)
-		if exists && oauth2Token.(*oauth2.Token).AccessToken == token {
+		// provider tokens are cached, session tokens are verified by signature
+		oauth2Token, exists := auth.FindToken(cacheDb, token)
+		if exists {
 			// will be accessible in auth endpoints
 			c.Set("oauth2Token", oauth2Token)
+			c.Set("oauth2Client", auth.TokenProvider(oauth2Client, oauth2Token))
 			c.Next()
 			return
 		} else if token != "" {
 			id_token := c.Request.Header.Get("X-OAUTH2-ID-TOKEN")
 			if id_token != "" {
-				new_token := &oauth2.Token{
-					AccessToken:  token,
-					TokenType:    "Bearer",
-					RefreshToken: "",
-					Expiry:       time.Now().Add(time.Hour * 24),
-				}
-				m := make(map[string]interface{})
-				m["id_token"] = id_token
-				new_token = new_token.WithExtra(m)
-
-				// check if token is valid
-				oauth2Token, err := util.ValidateToken(new_token.AccessToken)
+				// check the access token is a JWT from a trusted issuer
+				new_token, err := auth.ValidateIDTokenBearer(token, id_token)
 				if err != nil {
 					log.WithFields(log.Fields{
-						"err":   err,
-						"token": oauth2Token,
+						"err": err,
 					}).Error("failed to get token info")
 					c.AbortWithStatus(http.StatusUnauthorized)
 					return
 				}
 
-				// cache token
-				cacheDb.Set(token, new_token, 4*time.Hour)
+				// cache token until it expires, but no longer than four hours
+				cacheDb.Set(token, new_token, min(time.Until(new_token.Expiry), 4*time.Hour))
 
 				// will be accessible in auth endpoints
 				c.Set("oauth2Token", new_token)
@@ -217,6 +221,10 @@ func main() {
 		log.Error(err)
 	}
 
+	// run the background jobs: expiring subscriptions, staged rollouts,
+	// change requests, webhook retries and the rest
+	go core.RunScheduler()
+
 	app.SetTrustedProxies([]string{"127.0.0.1"})
 
 	err = app.Run(fmt.Sprintf("%s:%s", os.Getenv("LISTEN_ADDR"), os.Getenv("PORT")))
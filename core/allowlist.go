@@ -0,0 +1,77 @@
+package core
+
+import (
+	"net"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// AddressAllowed checks an address against the allowlists of a parent
+// account.  Device and service keys are checked against DeviceAllowIPs, users
+// and account api keys against AllowedIPs.  An empty list allows any address.
+func AddressAllowed(parent string, ip string, device bool) bool {
+	if parent == "" {
+		return true
+	}
+
+	account, err := ReadAccount(parent)
+	if err != nil {
+		// the handler reports the missing account
+		return true
+	}
+
+	list := account.AllowedIPs
+	if device {
+		list = account.DeviceAllowIPs
+	}
+
+	return InAllowlist(ip, list)
+}
+
+// InAllowlist returns true if the list is empty or one of its CIDRs contains ip
+func InAllowlist(ip string, list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, cidr := range list {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Errorf("allowlist entry %s is not a CIDR", cidr)
+			continue
+		}
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ownerOf returns the parent account of the object a request names, or of the
+// caller's account when it names none
+func ownerOf(account *model.Account, v interface{}) string {
+	switch o := v.(type) {
+	case *model.Account:
+		return o.Parent
+	case *model.Device:
+		return o.AccountID
+	case *model.Network:
+		return o.AccountID
+	case *model.VPN:
+		return o.AccountID
+	case *model.Service:
+		return o.AccountID
+	}
+
+	if account != nil {
+		return account.Parent
+	}
+	return ""
+}
@@ -0,0 +1,313 @@
+package core
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// the header a caller can give the reason for a change in
+const auditReasonHeader = "X-Audit-Reason"
+
+// secrets are recorded as changed without their values
+var auditRedacted = map[string]bool{
+	"apiKey":        true,
+	"apikey":        true,
+	"serviceApiKey": true,
+	"privateKey":    true,
+	"presharedKey":  true,
+	"receipt":       true,
+	"secret":        true,
+}
+
+// fields that change on every write
+var auditIgnored = map[string]bool{
+	"updated":   true,
+	"updatedBy": true,
+	"lastSeen":  true,
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID is middleware that gives every request an id, the one the client
+// or a proxy sent in X-Request-ID if it is sane, and returns it in the
+// response so a request can be found in the logs and the audit log
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id, _ = util.RandomString(16)
+		}
+		c.Set("requestId", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// setActor remembers who made a request for the audit log
+func setActor(c *gin.Context, actor string, credential string) {
+	c.Set("auditActor", actor)
+	c.Set("auditCredential", credential)
+}
+
+// SetUserActor remembers the user who made a request, and whether they used
+// a session or a token from their identity provider
+func SetUserActor(c *gin.Context, token *oauth2.Token, email string) {
+	if _, ok := token.Extra("session").(*SessionClaims); ok {
+		setActor(c, email, "session")
+	} else {
+		setActor(c, email, "oauth2")
+	}
+}
+
+// Actor is who made a change, for the audit log.  Approval is the approved
+// change request, or the rollout it started, that lets them change a
+// critical network.
+type Actor struct {
+	Name       string
+	Credential string
+	IP         string
+	RequestID  string
+	Reason     string
+	Approval   string
+}
+
+// SystemActor makes the changes nobody asked for, like the ones scheduled
+// jobs make
+var SystemActor = Actor{Name: "system", Credential: "none"}
+
+// RequestActor returns who made a request: the actor and credential
+// AuthFromContext found, where the request came from and the reason the
+// caller gave.  Requests that aren't authenticated, like store webhooks, are
+// made by their route, and without a request it's SystemActor.
+func RequestActor(c *gin.Context) Actor {
+	if c == nil {
+		return SystemActor
+	}
+
+	actor := Actor{
+		Name:       c.GetString("auditActor"),
+		Credential: c.GetString("auditCredential"),
+		IP:         c.ClientIP(),
+		RequestID:  c.GetString("requestId"),
+		Reason:     AuditReason(c),
+	}
+	if actor.Name == "" {
+		actor.Name = c.FullPath()
+		actor.Credential = "none"
+	}
+	return actor
+}
+
+// Audit appends a change made by actor to the audit log of the account that
+// owns the object.  before is nil for a create and after is nil for a
+// delete.  The entry is published as Audited, whose subscribers record it
+// and send changes to members and subscriptions on to the account's
+// webhooks.
+func Audit(actor Actor, kind string, action string, before interface{}, after interface{}) {
+	object, changes := auditChange(before, after)
+	if action == "update" && len(changes) == 0 {
+		return
+	}
+
+	id, err := util.RandomString(16)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	entry := &model.AuditEntry{
+		Id:         "audit-" + id,
+		AccountID:  auditString(object["accountid"]),
+		Kind:       kind,
+		Action:     action,
+		ObjectID:   auditString(object["id"]),
+		Actor:      actor.Name,
+		Credential: actor.Credential,
+		IP:         actor.IP,
+		RequestID:  actor.RequestID,
+		Reason:     actor.Reason,
+		Changes:    changes,
+		Created:    time.Now().UTC(),
+	}
+	if entry.AccountID == "" {
+		entry.AccountID = auditString(object["parent"])
+	}
+
+	Publish(Audited{Entry: entry, Object: object})
+}
+
+// Networks, VPNs and devices are audited by the changes published on the
+// bus, so the ones made inside core, like a forced update rewriting a
+// network's VPNs or a scheduled job turning off a device, are audited too.
+func init() {
+	Subscribe(Sync, func(e NetworkCreated) { Audit(e.Actor, "net", "create", nil, e.Net) })
+	Subscribe(Sync, func(e NetworkUpdated) { Audit(e.Actor, "net", "update", e.Before, e.After) })
+	Subscribe(Sync, func(e NetworkDeleted) { Audit(e.Actor, "net", "delete", e.Net, nil) })
+
+	Subscribe(Sync, func(e VPNCreated) { Audit(e.Actor, "vpn", "create", nil, e.VPN) })
+	Subscribe(Sync, func(e VPNUpdated) { Audit(e.Actor, "vpn", "update", e.Before, e.After) })
+	Subscribe(Sync, func(e VPNDeleted) { Audit(e.Actor, "vpn", "delete", e.VPN, nil) })
+
+	Subscribe(Sync, func(e DeviceCreated) { Audit(e.Actor, "device", "create", nil, e.Device) })
+	Subscribe(Sync, func(e DeviceUpdated) { Audit(e.Actor, "device", "update", e.Before, e.After) })
+	Subscribe(Sync, func(e DeviceDeleted) { Audit(e.Actor, "device", "delete", e.Device, nil) })
+
+	Subscribe(Sync, func(e Locked) { Audit(e.Actor, e.Kind, "update", e.Before, e.After) })
+	Subscribe(Sync, func(e Unlocked) { Audit(e.Actor, e.Kind, "update", e.Before, e.After) })
+
+	Subscribe(Sync, recordAudit)
+}
+
+// recordAudit appends an audited change to the audit log
+func recordAudit(e Audited) {
+	err := mongo.InsertAuditEntry(e.Entry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("failed to audit %s of %s %s", e.Entry.Action, e.Entry.Kind, e.Entry.ObjectID)
+	}
+}
+
+// AuditReason returns the reason the caller gave for a request, if any
+func AuditReason(c *gin.Context) string {
+	reason := strings.TrimSpace(c.Request.Header.Get(auditReasonHeader))
+	if len(reason) > 500 {
+		reason = reason[:500]
+	}
+	return reason
+}
+
+// ReadAuditLog reads a page of an account's audit log
+func ReadAuditLog(q *model.AuditQuery) ([]*model.AuditEntry, int64, error) {
+	if q.Limit <= 0 || q.Limit > 500 {
+		q.Limit = 50
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	return mongo.ReadAuditEntries(q)
+}
+
+// auditChange returns the fields of a changed object, after the change or
+// before it for a delete, and what changed
+func auditChange(before interface{}, after interface{}) (map[string]interface{}, []model.AuditChange) {
+	b := auditFields(before)
+	a := auditFields(after)
+
+	object := a
+	if len(object) == 0 {
+		object = b
+	}
+
+	return object, auditDiff("", b, a, make([]model.AuditChange, 0))
+}
+
+// auditFields turns an object into the fields of its JSON
+func auditFields(v interface{}) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if v == nil {
+		return fields
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return fields
+	}
+
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(b, &fields)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+
+	return fields
+}
+
+// auditDiff lists the fields that differ between before and after, going
+// into nested objects.  Lists are compared whole.
+func auditDiff(path string, before interface{}, after interface{}, changes []model.AuditChange) []model.AuditChange {
+	b, bok := before.(map[string]interface{})
+	a, aok := after.(map[string]interface{})
+	if bok && after == nil {
+		a, aok = map[string]interface{}{}, true
+	}
+	if aok && before == nil {
+		b, bok = map[string]interface{}{}, true
+	}
+	if bok && aok {
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range b {
+			keys = append(keys, k)
+		}
+		for k := range a {
+			if _, ok := b[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if auditIgnored[k] {
+				continue
+			}
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			changes = auditDiff(p, b[k], a[k], changes)
+		}
+		return changes
+	}
+
+	if reflect.DeepEqual(before, after) {
+		return changes
+	}
+
+	key := path[strings.LastIndex(path, ".")+1:]
+
+	return append(changes, model.AuditChange{Path: path, From: auditScrub(key, before), To: auditScrub(key, after)})
+}
+
+// auditScrub replaces the secrets in a value, however deep they are
+func auditScrub(key string, v interface{}) interface{} {
+	if auditRedacted[key] {
+		if v == nil || v == "" {
+			return v
+		}
+		return "[redacted]"
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		scrubbed := make(map[string]interface{}, len(t))
+		for k, x := range t {
+			scrubbed[k] = auditScrub(k, x)
+		}
+		return scrubbed
+	case []interface{}:
+		scrubbed := make([]interface{}, len(t))
+		for i, x := range t {
+			scrubbed[i] = auditScrub("", x)
+		}
+		return scrubbed
+	}
+
+	return v
+}
+
+func auditString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -15,8 +15,33 @@ import (
 // object used to find the account, along with any error.
 //
 //	Example: account, device, err := GetFromContext(c, id)
+//
+// Requests from an address outside the allowlist of the account that owns the
+// object are refused.
 func AuthFromContext(c *gin.Context, id string) (*model.Account, interface{}, error) {
 
+	account, v, err := authFromContext(c, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the account the request is for may only be managed from some addresses
+	apikey := c.Request.Header.Get("X-API-KEY")
+	device := strings.HasPrefix(apikey, "device-api-") || strings.HasPrefix(apikey, "service-api-")
+	parent := ownerOf(account, v)
+
+	if !AddressAllowed(parent, c.ClientIP(), device) {
+		log.Infof("SECURITY: request from %s refused by the allowlist of %s", c.ClientIP(), parent)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden from this address"})
+		return nil, nil, errors.New("address is not in the account's allowlist")
+	}
+
+	return account, v, nil
+}
+
+// authFromContext finds the caller and the object the request names
+func authFromContext(c *gin.Context, id string) (*model.Account, interface{}, error) {
+
 	var accounts []*model.Account
 	var device *model.Device
 	var account *model.Account
@@ -37,6 +62,7 @@ func AuthFromContext(c *gin.Context, id string) (*model.Account, interface{}, er
 			c.JSON(http.StatusForbidden, gin.H{"error": "Account Suspended"})
 			return nil, nil, errors.New("account is suspended")
 		}
+		setActor(c, account.Email, "nettica-api")
 
 	} else if strings.HasPrefix(apikey, "device-api-") {
 
@@ -57,6 +83,7 @@ func AuthFromContext(c *gin.Context, id string) (*model.Account, interface{}, er
 				return nil, nil, err
 			}
 		}
+		setActor(c, device.Id, "device-api")
 	} else if strings.HasPrefix(apikey, "service-api-") {
 
 		service, err = ReadService(id)
@@ -64,6 +91,7 @@ func AuthFromContext(c *gin.Context, id string) (*model.Account, interface{}, er
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return nil, nil, err
 		}
+		setActor(c, service.Id, "service-api")
 
 	} else {
 
@@ -99,6 +127,8 @@ func AuthFromContext(c *gin.Context, id string) (*model.Account, interface{}, er
 			return nil, nil, err
 		}
 
+		SetUserActor(c, oauth2Token, user.Email)
+
 		if len(accounts) > 0 {
 			account = accounts[0]
 		}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"reflect"
+	"sync"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// The core CRUD functions publish what they change on the bus, with the
+// Actor who changed it, and the side effects of a change, like flushing
+// caches, push notifications, the audit log and webhooks, subscribe to it.
+// A handler that changes something gets them all without having to know
+// about any of them.
+
+// Mode is how a subscriber is called
+type Mode int
+
+const (
+	// Sync subscribers are called in the order they subscribed, before
+	// Publish returns
+	Sync Mode = iota
+	// Async subscribers are each called in a goroutine of their own
+	Async
+)
+
+// NetworkCreated is published when a network is created
+type NetworkCreated struct {
+	Net   *model.Network
+	Actor Actor
+}
+
+// NetworkUpdated is published when a network's settings are changed
+type NetworkUpdated struct {
+	Before *model.Network
+	After  *model.Network
+	Actor  Actor
+}
+
+// NetworkPropagated is published once a change to a network has been passed
+// on to its VPNs, or a rollback has restored them.  The devices of VPNs have
+// to fetch their configuration again.
+type NetworkPropagated struct {
+	Net  *model.Network
+	VPNs []*model.VPN
+}
+
+// NetworkDeleted is published when a network and its VPNs are deleted
+type NetworkDeleted struct {
+	Net   *model.Network
+	VPNs  []*model.VPN
+	Actor Actor
+}
+
+// VPNCreated is published when a device joins a network
+type VPNCreated struct {
+	VPN   *model.VPN
+	Actor Actor
+}
+
+// VPNUpdated is published when a VPN is changed.  ByNetwork is set when the
+// change was made by a change to its network, whose NetworkPropagated tells
+// the network's devices.
+type VPNUpdated struct {
+	Before    *model.VPN
+	After     *model.VPN
+	ByNetwork bool
+	Actor     Actor
+}
+
+// VPNDeleted is published when a device leaves a network.  WithNetwork is
+// set when the whole network is being deleted.
+type VPNDeleted struct {
+	VPN         *model.VPN
+	WithNetwork bool
+	Actor       Actor
+}
+
+// DeviceCreated is published when a device is created
+type DeviceCreated struct {
+	Device *model.Device
+	Actor  Actor
+}
+
+// DeviceUpdated is published when a device is changed, but not when it
+// checks in
+type DeviceUpdated struct {
+	Before *model.Device
+	After  *model.Device
+	Actor  Actor
+}
+
+// DeviceDeleted is published when a device and its VPNs are deleted
+type DeviceDeleted struct {
+	Device *model.Device
+	Actor  Actor
+}
+
+// DevicePushed is published when a device sends another device a push
+// notification
+type DevicePushed struct {
+	Push *model.DevicePush
+}
+
+// Locked is published when a network, VPN or device of Kind net, vpn or
+// device is locked, or its lock is changed.  Before and After are the object.
+type Locked struct {
+	Kind   string
+	Before interface{}
+	After  interface{}
+	Actor  Actor
+}
+
+// Unlocked is published when the lock of a network, VPN or device is
+// released
+type Unlocked struct {
+	Kind   string
+	Before interface{}
+	After  interface{}
+	Actor  Actor
+}
+
+// Audited is published when a change is audited.  Object is the audited
+// object's fields, after the change or before it for a delete.
+type Audited struct {
+	Entry  *model.AuditEntry
+	Object map[string]interface{}
+}
+
+type subscriber struct {
+	mode   Mode
+	handle func(interface{})
+}
+
+var (
+	busMu       sync.RWMutex
+	subscribers = make(map[reflect.Type][]subscriber)
+)
+
+// Subscribe calls handle with every event of type E that's published
+func Subscribe[E any](mode Mode, handle func(E)) {
+	busMu.Lock()
+	defer busMu.Unlock()
+
+	t := reflect.TypeFor[E]()
+	subscribers[t] = append(subscribers[t], subscriber{
+		mode:   mode,
+		handle: func(event interface{}) { handle(event.(E)) },
+	})
+}
+
+// Publish passes an event to its subscribers.  A subscriber that fails is
+// logged and doesn't stop the others.
+func Publish(event interface{}) {
+	busMu.RLock()
+	subs := subscribers[reflect.TypeOf(event)]
+	busMu.RUnlock()
+
+	for _, s := range subs {
+		if s.mode == Async {
+			go deliver(s, event)
+		} else {
+			deliver(s, event)
+		}
+	}
+}
+
+func deliver(s subscriber, event interface{}) {
+	defer func() {
+		if rcvr := recover(); rcvr != nil {
+			log.Errorf("bus: subscriber to %T failed: %v", event, rcvr)
+		}
+	}()
+
+	s.handle(event)
+}
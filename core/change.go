@@ -0,0 +1,363 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	template "github.com/nettica-com/nettica-admin/template"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCritical is returned for a change to a critical network, or the VPNs in
+// it, that wasn't approved with a change request
+var ErrCritical = errors.New("critical")
+
+// checkCritical returns an error wrapping ErrCritical if a network is
+// critical and the actor's change to it wasn't approved
+func checkCritical(net *model.Network, actor Actor) error {
+	if !net.Critical || actor.Approval != "" {
+		return nil
+	}
+	return fmt.Errorf("%w: network %s is critical, the change must be approved with a change request", ErrCritical, net.NetName)
+}
+
+// checkCriticalVPN returns an error wrapping ErrCritical if a VPN's network
+// is critical and the actor's change to the VPN wasn't approved
+func checkCriticalVPN(vpn *model.VPN, actor Actor) error {
+	if actor.Approval != "" {
+		return nil
+	}
+	net, err := ReadNet(vpn.NetId)
+	if err != nil {
+		return nil
+	}
+	return checkCritical(net, actor)
+}
+
+// RequestChange holds a change to a critical network for a second owner or
+// admin to approve, and responds with the change request.  A change a device
+// or service asks for, without an account, is asked for on behalf of whoever
+// created the VPN.
+func RequestChange(c *gin.Context, account *model.Account, netId string, request *model.ChangeRequest) {
+	net, err := ReadNet(netId)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read network")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if account != nil && account.Email != "" {
+		request.CreatedBy = account.Email
+	} else if request.VPN != nil {
+		request.CreatedBy = request.VPN.CreatedBy
+	}
+	request.Reason = AuditReason(c)
+
+	result, err := CreateChangeRequest(request, net)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to create change request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, result)
+}
+
+// CreateChangeRequest holds a change to a critical network for approval and
+// asks the network's other owners and admins to approve it.  Requests that
+// aren't decided in CHANGE_REQUEST_EXPIRY, 72h by default, expire.
+func CreateChangeRequest(request *model.ChangeRequest, net *model.Network) (*model.ChangeRequest, error) {
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	request.Id = "change-" + id
+	request.AccountID = net.AccountID
+	request.NetId = net.Id
+	request.NetName = net.NetName
+	request.Base = net.Updated
+	request.Status = "Pending"
+	request.Created = now
+	request.Updated = now
+	request.Expires = now.Add(sessionDuration("CHANGE_REQUEST_EXPIRY", 72*time.Hour))
+
+	err = mongo.InsertChangeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("change: %s requested %s %s of critical network %s", request.CreatedBy, request.Id, request.Kind, net.NetName)
+
+	go notifyApprovers(request)
+
+	return request, nil
+}
+
+// ReadChangeRequest by id
+func ReadChangeRequest(id string) (*model.ChangeRequest, error) {
+	return mongo.ReadChangeRequest(id)
+}
+
+// ReadChangeRequests of a network, newest first
+func ReadChangeRequests(netId string) ([]*model.ChangeRequest, error) {
+	return mongo.ReadChangeRequests(netId)
+}
+
+// ApproveChangeRequest makes a pending change.  The approver must be an owner
+// or admin of the network's account other than whoever asked for it, and
+// the change is made by them, for the reason it was asked for unless they
+// give one.  What the change returns, such as the updated network, is
+// returned.
+func ApproveChangeRequest(request *model.ChangeRequest, approver *model.Account, actor Actor) (interface{}, error) {
+	if approver.Parent != request.AccountID || (approver.Role != "Owner" && approver.Role != "Admin") {
+		return nil, errors.New("only owners and admins can approve changes")
+	}
+	if approver.Email == request.CreatedBy {
+		return nil, errors.New("a change must be approved by someone other than who asked for it")
+	}
+	if err := pendingChangeRequest(request); err != nil {
+		return nil, err
+	}
+
+	ok, err := mongo.UpdateChangeRequestStatus(request.Id, "Pending", "Approved", approver.Email, "")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("the change request has already been decided")
+	}
+
+	if actor.Reason == "" {
+		actor.Reason = request.Reason
+	}
+
+	result, err := applyChangeRequest(request, actor)
+	if err != nil {
+		_, uerr := mongo.UpdateChangeRequestStatus(request.Id, "Approved", "Failed", "", err.Error())
+		if uerr != nil {
+			log.Error(uerr)
+		}
+		changeRequestEmail(request, "failed", fmt.Sprintf("%s approved the change, but it failed: %s", approver.Email, err.Error()))
+		return nil, err
+	}
+
+	log.Infof("change: %s approved %s %s of %s", approver.Email, request.Id, request.Kind, request.NetName)
+
+	changeRequestEmail(request, "was approved", approver.Email+" approved the change and it has been made.")
+
+	return result, nil
+}
+
+// RejectChangeRequest turns a pending change down.  Whoever asked for it can
+// withdraw it, and the network's owners and admins can reject it.
+func RejectChangeRequest(request *model.ChangeRequest, account *model.Account) error {
+	if account.Email != request.CreatedBy &&
+		(account.Parent != request.AccountID || (account.Role != "Owner" && account.Role != "Admin")) {
+		return errors.New("only owners and admins can reject changes")
+	}
+	if err := pendingChangeRequest(request); err != nil {
+		return err
+	}
+
+	status := "Rejected"
+	if account.Email == request.CreatedBy {
+		status = "Withdrawn"
+	}
+
+	ok, err := mongo.UpdateChangeRequestStatus(request.Id, "Pending", status, account.Email, "")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the change request has already been decided")
+	}
+
+	log.Infof("change: %s set %s of %s to %s", account.Email, request.Id, request.NetName, status)
+
+	if status == "Rejected" {
+		changeRequestEmail(request, "was rejected", account.Email+" rejected the change.")
+	}
+
+	return nil
+}
+
+// pendingChangeRequest returns an error if a request can't be decided, and
+// marks it expired if it's too old
+func pendingChangeRequest(request *model.ChangeRequest) error {
+	if request.Status != "Pending" {
+		return fmt.Errorf("the change request is %s", request.Status)
+	}
+
+	if time.Now().After(request.Expires) {
+		expireChangeRequest(request)
+		return errors.New("the change request has expired")
+	}
+
+	return nil
+}
+
+// applyChangeRequest makes the change a request holds
+func applyChangeRequest(request *model.ChangeRequest, actor Actor) (interface{}, error) {
+	actor.Approval = request.Id
+
+	switch request.Kind {
+	case "update", "rollback":
+		net, err := ReadNet(request.NetId)
+		if err != nil {
+			return nil, err
+		}
+		if !updatedAt(net.Updated, request.Base) {
+			return nil, errors.New("the network has changed since the request was made")
+		}
+		if rollout, ok := ActiveRollout(net.Id); ok {
+			return nil, fmt.Errorf("rollout %s of the network is in progress", rollout.Id)
+		}
+
+		if request.Kind == "rollback" {
+			return RollbackNet(net, request.Revision, actor)
+		}
+
+		if request.Rollout != nil {
+			return StartRollout(net, request.Net, request.Rollout, actor)
+		}
+
+		return UpdateNet(net.Id, request.Net, actor)
+
+	case "delete":
+		return nil, DeleteNet(request.NetId, actor)
+
+	case "join":
+		return CreateVPN(request.VPN, actor)
+
+	case "edit":
+		return UpdateVPN(request.VPN.Id, request.VPN, false, actor)
+
+	case "leave":
+		return nil, DeleteVPN(request.VPN.Id, actor)
+	}
+
+	return nil, fmt.Errorf("unknown change %s", request.Kind)
+}
+
+// updatedAt compares the times a network was updated.  The database keeps
+// times to the millisecond.
+func updatedAt(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Truncate(time.Millisecond).Equal(b.Truncate(time.Millisecond))
+}
+
+// ExpireChangeRequests marks the pending change requests that are past their
+// expiry as expired and tells whoever asked for them
+func ExpireChangeRequests() {
+	requests, err := mongo.ReadChangeRequests("", "Pending")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	now := time.Now()
+	for _, request := range requests {
+		if now.After(request.Expires) {
+			expireChangeRequest(request)
+		}
+	}
+}
+
+func expireChangeRequest(request *model.ChangeRequest) {
+	ok, err := mongo.UpdateChangeRequestStatus(request.Id, "Pending", "Expired", "", "")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if ok {
+		log.Infof("change: %s of %s expired", request.Id, request.NetName)
+		changeRequestEmail(request, "expired", "Nobody approved the change before it expired.  Ask for it again if it's still needed.")
+	}
+}
+
+// notifyApprovers emails the owners and admins of the network's account,
+// other than whoever asked for the change
+func notifyApprovers(request *model.ChangeRequest) {
+	members, err := ReadAllAccounts(request.AccountID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	title := "A change to " + request.NetName + " needs approval"
+	message := fmt.Sprintf("%s asked to %s of the critical network %s.", request.CreatedBy, changeDescription(request), request.NetName)
+	if request.Reason != "" {
+		message += "  Reason: " + request.Reason
+	}
+	message += fmt.Sprintf("  The request expires at %s.", request.Expires.Format(time.RFC1123))
+
+	body, err := template.NotifyEmail(title, message, os.Getenv("SERVER"), "Review the change")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, member := range members {
+		if member.Email == request.CreatedBy || member.Status != "Active" || (member.Role != "Owner" && member.Role != "Admin") {
+			continue
+		}
+		err = SendEmail(member.Email, title, body)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorf("failed to ask %s to approve %s", member.Email, request.Id)
+		}
+	}
+}
+
+// changeRequestEmail tells whoever asked for a change what happened to it
+func changeRequestEmail(request *model.ChangeRequest, what string, message string) {
+	title := "Your change to " + request.NetName + " " + what
+	message = "You asked to " + changeDescription(request) + ".  " + message
+
+	body, err := template.NotifyEmail(title, message, os.Getenv("SERVER"), "Open Nettica")
+	if err == nil {
+		err = SendEmail(request.CreatedBy, title, body)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("failed to email %s about %s", request.CreatedBy, request.Id)
+	}
+}
+
+func changeDescription(request *model.ChangeRequest) string {
+	switch request.Kind {
+	case "update":
+		if request.Rollout != nil {
+			return "roll out a change to the settings"
+		}
+		return "change the settings"
+	case "rollback":
+		return fmt.Sprintf("roll the network back to revision %d", request.Revision)
+	case "delete":
+		return "delete the network"
+	case "join":
+		return "add " + request.VPN.Name + " to the network"
+	case "edit":
+		return "change " + request.VPN.Name + " in the network"
+	case "leave":
+		return "remove " + request.VPN.Name + " from the network"
+	}
+	return request.Kind
+}
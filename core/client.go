@@ -0,0 +1,115 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// the client every server knows, so agents keep working without a registry
+var agentClient = &model.Client{
+	Id:           "com.nettica.agent",
+	Name:         "Nettica Agent",
+	RedirectURIs: []string{"com.nettica.agent://callback/agent"},
+	Public:       true,
+	PKCEOptional: true,
+	Agent:        true,
+}
+
+var (
+	clients      []*model.Client
+	clientsMutex sync.RWMutex
+)
+
+// LoadClients reads the client registry from the JSON file named by
+// OAUTH2_CLIENTS_FILE.  The Nettica agent is always registered, as the file
+// has it or as the built in agentClient when it doesn't.
+func LoadClients() error {
+	list := []*model.Client{}
+
+	if os.Getenv("OAUTH2_CLIENTS_FILE") != "" {
+		data, err := os.ReadFile(os.Getenv("OAUTH2_CLIENTS_FILE"))
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !slices.ContainsFunc(list, func(c *model.Client) bool { return c.Id == agentClient.Id }) {
+		list = append([]*model.Client{agentClient}, list...)
+	}
+
+	ids := make(map[string]bool)
+	for _, client := range list {
+		if client.Id == "" {
+			return errors.New("client_id is required")
+		}
+		if ids[client.Id] {
+			return fmt.Errorf("client %s is registered twice", client.Id)
+		}
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("client %s has no redirect_uris", client.Id)
+		}
+		ids[client.Id] = true
+	}
+
+	clientsMutex.Lock()
+	clients = list
+	clientsMutex.Unlock()
+
+	log.Infof("%d clients registered", len(list))
+
+	return nil
+}
+
+// ReadClient finds the registered client an authorization request is for,
+// by its id or, for apps that don't send one, by its redirect URI.  The
+// redirect URI must be one the client registered.
+func ReadClient(id string, redirect string) (*model.Client, error) {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	for _, client := range clients {
+		if id != "" && client.Id != id {
+			continue
+		}
+		if id == "" && !client.HasRedirect(redirect) {
+			continue
+		}
+		if redirect != "" && !client.HasRedirect(redirect) {
+			return nil, errors.New("redirect_uri is not registered for " + client.Id)
+		}
+		return client, nil
+	}
+
+	if id != "" {
+		return nil, errors.New("unknown client " + id)
+	}
+	return nil, errors.New("redirect_uri is not registered")
+}
+
+// VerifyCodeChallenge checks a PKCE code verifier against the S256 code
+// challenge the authorization request was made with
+func VerifyCodeChallenge(challenge string, verifier string) bool {
+	// RFC 7636 verifiers are 43 to 128 characters
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	h := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(h[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
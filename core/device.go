@@ -14,7 +14,7 @@ import (
 )
 
 // CreateDevice device with all necessary data
-func CreateDevice(device *model.Device) (*model.Device, error) {
+func CreateDevice(device *model.Device, actor Actor) (*model.Device, error) {
 
 	var err error
 	device.Id, err = util.RandomString(12)
@@ -61,6 +61,8 @@ func CreateDevice(device *model.Device) (*model.Device, error) {
 	}
 	device = v.(*model.Device)
 
+	Publish(DeviceCreated{Device: device, Actor: actor})
+
 	// data modified, dump new config
 	return device, nil
 }
@@ -100,18 +102,32 @@ func ReadDevice(id string) (*model.Device, error) {
 	return device, nil
 }
 
-// UpdateDevice preserve keys
-func UpdateDevice(Id string, device *model.Device, fUpdated bool) (*model.Device, error) {
+// UpdateDevice preserve keys.  A locked device can't be changed, though
+// what it reports about itself when it checks in, with fUpdated, is still
+// recorded.
+func UpdateDevice(Id string, device *model.Device, fUpdated bool, actor Actor) (*model.Device, error) {
+	return updateDevice(Id, device, fUpdated, !fUpdated, actor)
+}
+
+func updateDevice(Id string, device *model.Device, fUpdated bool, checkLocked bool, actor Actor) (*model.Device, error) {
 	v, err := mongo.Deserialize(Id, "id", "devices", reflect.TypeOf(model.Device{}))
 	if err != nil {
 		return nil, err
 	}
 	current := v.(*model.Device)
+	before := *current
 
 	if current.Id != device.Id {
 		return nil, errors.New("records Id mismatch")
 	}
 
+	if checkLocked {
+		err = checkLock("device "+current.Name, current.ReadOnly, current.Lock)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if current.Updated.After(device.Updated) {
 		log.Errorf("UpdateDevice: device %s has been updated from stale data", device.Id)
 	}
@@ -255,6 +271,11 @@ func UpdateDevice(Id string, device *model.Device, fUpdated bool) (*model.Device
 		return nil, err
 	}
 
+	// checking in isn't a change anyone needs to hear about
+	if !fUpdated {
+		Publish(DeviceUpdated{Before: &before, After: current, Actor: actor})
+	}
+
 	//	v, err = mongo.Deserialize(Id, "id", "devices", reflect.TypeOf(model.Device{}))
 	//	if err != nil {
 	//		return nil, err
@@ -268,25 +289,70 @@ func UpdateDevice(Id string, device *model.Device, fUpdated bool) (*model.Device
 }
 
 // DeleteDevice from database
-func DeleteDevice(id string) error {
+func DeleteDevice(id string, actor Actor) error {
 
 	if id == "" {
 		return errors.New("id is empty")
 	}
 
+	device, err := ReadDevice(id)
+	if err != nil {
+		return err
+	}
+	err = checkLock("device "+device.Name, device.ReadOnly, device.Lock)
+	if err != nil {
+		return err
+	}
+
 	vpns, err := mongo.ReadAllVPNs("deviceid", id)
 
 	if err != nil {
 		return err
 	}
+
+	// nothing is deleted if any of them is locked or in a critical network
 	for _, vpn := range vpns {
-		err = DeleteVPN(vpn.Id)
+		err = checkLock("vpn "+vpn.Name, vpn.ReadOnly, vpn.Lock)
+		if err != nil {
+			return err
+		}
+		err = checkCriticalVPN(vpn, actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, vpn := range vpns {
+		err = DeleteVPN(vpn.Id, actor)
 		if err != nil {
 			return err
 		}
 	}
 
-	return mongo.Delete(id, "id", "devices")
+	err = mongo.Delete(id, "id", "devices")
+	if err != nil {
+		return err
+	}
+
+	Publish(DeviceDeleted{Device: device, Actor: actor})
+
+	return nil
+}
+
+// ErrNoPushToken is returned when a device can't be sent push notifications
+var ErrNoPushToken = errors.New("the device has no push token")
+
+// PushDevice sends a device a push notification from another device
+func PushDevice(p *model.DevicePush) error {
+	_, push := Push.PushDevices[p.ToDeviceID]
+	_, voip := Push.VoipDevices[p.ToDeviceID]
+	if !push && !(p.IsVoIP && voip) {
+		return ErrNoPushToken
+	}
+
+	Publish(DevicePushed{Push: p})
+
+	return nil
 }
 
 // ReadDeviceByApiKey(device.ApiKey)
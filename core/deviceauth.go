@@ -0,0 +1,279 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// The errors a polling agent is answered with.  Their text is the RFC 8628 error code.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	ErrInvalidGrant         = errors.New("invalid_grant")
+)
+
+// how long a person has to approve a device, and how often it may poll
+const (
+	deviceAuthLifetime = 10 * time.Minute
+	deviceAuthInterval = 5
+)
+
+// user codes avoid vowels, so they don't spell words, and look-alike characters
+const userCodeLetters = "BCDFGHJKLMNPQRSTVWXZ"
+
+func deviceCodeHash(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// NormalizeUserCode uppercases a user code and drops the dash and spaces people type
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeLetters))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeLetters[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// FormatUserCode formats a user code the way it is shown, e.g. BCDF-GHJK
+func FormatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// StartDeviceAuthorization begins a device authorization for an agent.  It
+// returns the device code the agent polls with.
+func StartDeviceAuthorization(name, platform, os, arch, ip string) (string, *model.DeviceAuthorization, error) {
+	deviceCode, err := util.RandomString(43)
+	if err != nil {
+		return "", nil, err
+	}
+
+	userCode, err := newUserCode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	da := &model.DeviceAuthorization{
+		DeviceCode:   deviceCodeHash(deviceCode),
+		UserCode:     userCode,
+		Status:       "pending",
+		Name:         name,
+		Platform:     platform,
+		OS:           os,
+		Architecture: arch,
+		IP:           ip,
+		Interval:     deviceAuthInterval,
+		Created:      now,
+		Expires:      now.Add(deviceAuthLifetime),
+	}
+
+	err = mongo.InsertDeviceAuthorization(da)
+	if err != nil {
+		return "", nil, err
+	}
+
+	log.Infof("Device authorization %s started for %s from %s", FormatUserCode(userCode), name, ip)
+
+	return deviceCode, da, nil
+}
+
+// ReadDeviceAuthorization reads a device authorization waiting for approval by its user code
+func ReadDeviceAuthorization(userCode string) (*model.DeviceAuthorization, error) {
+	da, err := mongo.ReadDeviceAuthorization("userCode", NormalizeUserCode(userCode))
+	if err != nil || da.Status != "pending" || time.Now().After(da.Expires) {
+		return nil, errors.New("code is invalid or has expired")
+	}
+	return da, nil
+}
+
+// deviceAuthAccount returns the membership that lets a user approve devices
+// for an account.  Only owners and admins may.
+func deviceAuthAccount(email string, accountid string) (*model.Account, error) {
+	accounts, err := mongo.ReadAllAccounts(email)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range accounts {
+		if a.Id != accountid && a.Parent != accountid {
+			continue
+		}
+		if a.Status == "Suspended" {
+			return nil, errors.New("account is suspended")
+		}
+		if a.Role != "Owner" && a.Role != "Admin" {
+			return nil, errors.New("only owners and admins can approve devices")
+		}
+		return a, nil
+	}
+
+	return nil, errors.New("account not found")
+}
+
+// ApproveDeviceAuthorization creates the device in the account and hands it
+// to the waiting agent with its next poll.  The user approving it is the
+// actor.
+func ApproveDeviceAuthorization(userCode string, accountid string, name string, actor Actor) (*model.Device, error) {
+	email := actor.Name
+
+	da, err := ReadDeviceAuthorization(userCode)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := deviceAuthAccount(email, accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	if EnforceLimits() {
+		limit, err := ReadLimits(account.Parent)
+		if err != nil {
+			return nil, err
+		}
+		devices, err := ReadDevicesForAccount(account.Parent)
+		if err != nil {
+			return nil, err
+		}
+		if limit.DevicesLimitReached(len(devices)) {
+			return nil, errors.New("device limit reached")
+		}
+	}
+
+	// only one approval can create the device
+	ok, err := mongo.ClaimDeviceAuthorization(da.DeviceCode, "pending", "approving")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("code is invalid or has expired")
+	}
+
+	if name == "" {
+		name = da.Name
+	}
+
+	device := &model.Device{
+		AccountID:     account.Parent,
+		Owner:         &account.Id,
+		Name:          name,
+		Platform:      da.Platform,
+		OS:            da.OS,
+		Architecture:  da.Architecture,
+		Enable:        true,
+		CheckInterval: 10,
+		CreatedBy:     email,
+		UpdatedBy:     email,
+	}
+
+	device, err = CreateDevice(device, actor)
+	if err != nil {
+		if _, e := mongo.ClaimDeviceAuthorization(da.DeviceCode, "approving", "pending"); e != nil {
+			log.Error(e)
+		}
+		return nil, err
+	}
+
+	da.Status = "approved"
+	da.AccountID = account.Parent
+	da.DeviceID = device.Id
+	da.ApprovedBy = email
+	err = mongo.UpdateDeviceAuthorization(da)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Device authorization %s approved by %s, device %s created in %s", FormatUserCode(da.UserCode), email, device.Id, account.Parent)
+
+	return device, nil
+}
+
+// DenyDeviceAuthorization refuses a device, its agent stops polling
+func DenyDeviceAuthorization(userCode string, email string) error {
+	da, err := ReadDeviceAuthorization(userCode)
+	if err != nil {
+		return err
+	}
+
+	ok, err := mongo.ClaimDeviceAuthorization(da.DeviceCode, "pending", "denied")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("code is invalid or has expired")
+	}
+
+	log.Infof("Device authorization %s denied by %s", FormatUserCode(da.UserCode), email)
+
+	return nil
+}
+
+// PollDeviceAuthorization answers an agent polling with its device code.
+// Once approved the device is returned exactly once.
+func PollDeviceAuthorization(deviceCode string) (*model.Device, error) {
+	da, err := mongo.ReadDeviceAuthorization("deviceCode", deviceCodeHash(deviceCode))
+	if err != nil {
+		return nil, ErrInvalidGrant
+	}
+
+	now := time.Now().UTC()
+
+	switch da.Status {
+	case "denied":
+		return nil, ErrAccessDenied
+	case "approved":
+		ok, err := mongo.ClaimDeviceAuthorization(da.DeviceCode, "approved", "complete")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ErrInvalidGrant
+		}
+		return ReadDevice(da.DeviceID)
+	case "pending", "approving":
+		if now.After(da.Expires) {
+			return nil, ErrExpiredToken
+		}
+		// an agent polling faster than the interval is told to slow down for good
+		tooSoon := da.LastPoll != nil && now.Sub(*da.LastPoll) < time.Duration(da.Interval)*time.Second
+		if tooSoon {
+			da.Interval += deviceAuthInterval
+		}
+		if err := mongo.UpdateDeviceAuthorizationPoll(da.DeviceCode, now, da.Interval); err != nil {
+			log.Error(err)
+		}
+		if tooSoon {
+			return nil, ErrSlowDown
+		}
+		return nil, ErrAuthorizationPending
+	}
+
+	return nil, ErrInvalidGrant
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"os"
+	"strconv"
+
+	"gopkg.in/gomail.v2"
+)
+
+// SendEmail sends an html email through the configured SMTP server
+func SendEmail(to string, subject string, body []byte) error {
+
+	// port to int
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		return err
+	}
+
+	d := gomail.NewDialer(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	s, err := d.Dial()
+	if err != nil {
+		return err
+	}
+	m := gomail.NewMessage()
+
+	m.SetHeader("From", os.Getenv("SMTP_FROM"))
+	m.SetAddressHeader("To", to, to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", string(body))
+
+	return gomail.Send(s, m)
+}
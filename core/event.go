@@ -0,0 +1,213 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// the kinds of audited objects without events of their own on the bus, by
+// the name of their events
+var eventKinds = map[string]string{
+	"account":      "member",
+	"subscription": "subscription",
+}
+
+// the names of the events of the kinds of objects that can be locked
+var lockEvents = map[string]string{
+	"net":    "network",
+	"vpn":    "vpn",
+	"device": "device",
+}
+
+var eventActions = map[string]string{
+	"create": "created",
+	"update": "updated",
+	"delete": "deleted",
+}
+
+// Networks, VPNs and devices are sent to webhooks from the changes published
+// on the bus, whoever made them, and members and subscriptions once they're
+// audited.
+func init() {
+	Subscribe(Async, func(e NetworkCreated) { emitObject("network", "create", e.Actor, nil, e.Net) })
+	Subscribe(Async, func(e NetworkUpdated) { emitObject("network", "update", e.Actor, e.Before, e.After) })
+	Subscribe(Async, func(e NetworkDeleted) { emitObject("network", "delete", e.Actor, e.Net, nil) })
+
+	Subscribe(Async, func(e VPNCreated) { emitObject("vpn", "create", e.Actor, nil, e.VPN) })
+	Subscribe(Async, func(e VPNUpdated) { emitObject("vpn", "update", e.Actor, e.Before, e.After) })
+	Subscribe(Async, func(e VPNDeleted) { emitObject("vpn", "delete", e.Actor, e.VPN, nil) })
+
+	Subscribe(Async, func(e DeviceCreated) { emitObject("device", "create", e.Actor, nil, e.Device) })
+	Subscribe(Async, func(e DeviceUpdated) { emitObject("device", "update", e.Actor, e.Before, e.After) })
+	Subscribe(Async, func(e DeviceDeleted) { emitObject("device", "delete", e.Actor, e.Device, nil) })
+
+	Subscribe(Async, func(e Locked) { emitObject(lockEvents[e.Kind], "update", e.Actor, e.Before, e.After) })
+	Subscribe(Async, func(e Unlocked) { emitObject(lockEvents[e.Kind], "update", e.Actor, e.Before, e.After) })
+
+	Subscribe(Async, emitChange)
+}
+
+// emitObject makes an event of a change to an object.  before is nil for a
+// create and after is nil for a delete, and an update that changes nothing
+// isn't an event.
+func emitObject(name string, action string, actor Actor, before interface{}, after interface{}) {
+	object, changes := auditChange(before, after)
+	if action == "update" && len(changes) == 0 {
+		return
+	}
+
+	data, _ := auditScrub("", object).(map[string]interface{})
+
+	Emit(&model.Event{
+		Type:      name + "." + eventActions[action],
+		AccountID: auditString(object["accountid"]),
+		ObjectID:  auditString(object["id"]),
+		Actor:     actor.Name,
+		Data:      data,
+		Changes:   changes,
+	})
+}
+
+// emitChange makes an event of a change that was audited
+func emitChange(e Audited) {
+	name, ok := eventKinds[e.Entry.Kind]
+	if !ok {
+		return
+	}
+
+	data, _ := auditScrub("", e.Object).(map[string]interface{})
+
+	Emit(&model.Event{
+		Type:      name + "." + eventActions[e.Entry.Action],
+		AccountID: e.Entry.AccountID,
+		ObjectID:  e.Entry.ObjectID,
+		Actor:     e.Entry.Actor,
+		Data:      data,
+		Changes:   e.Entry.Changes,
+	})
+}
+
+// Emit sends an event to the webhooks of its account that subscribe to it.
+// An event given an id is only sent once however many times, or on however
+// many replicas, it's emitted.
+func Emit(event *model.Event) {
+	webhooks, err := mongo.ReadWebhooks(event.AccountID, event.Type)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	if event.Id == "" {
+		id, err := util.RandomString(16)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		event.Id = "event-" + id
+	}
+	event.Created = time.Now().UTC()
+	event.Expires = event.Created.Add(sessionDuration("WEBHOOK_LOG_RETENTION", 30*24*time.Hour))
+
+	ok, err := mongo.InsertEvent(event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("failed to record event %s", event.Type)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		_, err = queueDelivery(webhook, event.Id, event.Type, string(payload), "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Errorf("failed to queue %s for webhook %s", event.Id, webhook.Id)
+		}
+	}
+}
+
+var (
+	offlineMu   sync.Mutex
+	offlineSent = make(map[string]time.Time)
+)
+
+// checkOfflineDevices emits device.offline for the enabled devices of the
+// accounts that subscribe to it that haven't checked in for
+// DEVICE_OFFLINE_AFTER, 5m by default.  Devices that went offline more than
+// an hour before are left alone, so a restart doesn't report old outages.
+func checkOfflineDevices() {
+	webhooks, err := mongo.ReadWebhooks("", "device.offline")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	accounts := make(map[string]bool)
+	for _, webhook := range webhooks {
+		accounts[webhook.AccountID] = true
+	}
+
+	after := sessionDuration("DEVICE_OFFLINE_AFTER", 5*time.Minute)
+
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+
+	for accountID := range accounts {
+		devices, err := ReadDevicesForAccount(accountID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, device := range devices {
+			if !device.Enable || device.LastSeen == nil {
+				continue
+			}
+			since := time.Since(*device.LastSeen)
+			if since < after || since > after+time.Hour {
+				continue
+			}
+			if sent, ok := offlineSent[device.Id]; ok && sent.Equal(*device.LastSeen) {
+				continue
+			}
+			offlineSent[device.Id] = *device.LastSeen
+
+			data, _ := auditScrub("", auditFields(device)).(map[string]interface{})
+
+			// the same outage has the same id on every replica
+			Emit(&model.Event{
+				Id:        fmt.Sprintf("event-offline-%s-%d", device.Id, device.LastSeen.Unix()),
+				Type:      "device.offline",
+				AccountID: device.AccountID,
+				ObjectID:  device.Id,
+				Data:      data,
+			})
+		}
+	}
+
+	// forget the devices that have been offline too long to be reported
+	for id, seen := range offlineSent {
+		if time.Since(seen) > after+time.Hour {
+			delete(offlineSent, id)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	template "github.com/nettica-com/nettica-admin/template"
+	util "github.com/nettica-com/nettica-admin/util"
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	geoipOnce sync.Once
+	geoip     *maxminddb.Reader
+)
+
+// Country looks up the ISO country code of an IP address in the MaxMind
+// database at GEOIP_DATABASE, a GeoLite2 Country or City file.  Without a
+// database, or for private addresses, it returns "".
+func Country(ip string) string {
+	geoipOnce.Do(func() {
+		file := os.Getenv("GEOIP_DATABASE")
+		if file == "" {
+			return
+		}
+		reader, err := maxminddb.Open(file)
+		if err != nil {
+			log.Errorf("failed to open GeoIP database %s: %v", file, err)
+			return
+		}
+		geoip = reader
+	})
+
+	addr := net.ParseIP(ip)
+	if geoip == nil || addr == nil {
+		return ""
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	err := geoip.Lookup(addr, &record)
+	if err != nil {
+		log.Errorf("GeoIP lookup of %s: %v", ip, err)
+		return ""
+	}
+
+	return record.Country.ISOCode
+}
+
+// RecordLogin adds a login attempt to the user's login history.  When an
+// admin logs in from a country or device they haven't used before, the owners
+// of their accounts are told by email.
+func RecordLogin(email string, provider string, success bool, reason string, ip string, userAgent string) {
+	if email == "" {
+		return
+	}
+
+	id, err := util.RandomString(16)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	event := &model.LoginEvent{
+		Id:        "login-" + id,
+		Email:     email,
+		Provider:  provider,
+		Success:   success,
+		Reason:    reason,
+		IP:        ip,
+		UserAgent: userAgent,
+		Country:   Country(ip),
+		Created:   time.Now().UTC(),
+	}
+	event.Expires = event.Created.Add(sessionDuration("LOGIN_HISTORY_RETENTION", 90*24*time.Hour))
+
+	// what was seen before has to be read before this login is added
+	var history []*model.LoginEvent
+	if success && os.Getenv("LOGIN_ALERTS") != "false" {
+		history, err = mongo.ReadLoginHistory(email, 200)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	err = mongo.InsertLoginEvent(event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to record login")
+		return
+	}
+
+	if what := newLoginLocation(event, history); what != "" {
+		go alertOwners(event, what)
+	}
+}
+
+// ReadLoginHistory of a user, newest first
+func ReadLoginHistory(email string) ([]*model.LoginEvent, error) {
+	return mongo.ReadLoginHistory(email, 100)
+}
+
+// ManagesMember returns true if email is an owner or admin of an account
+// member is in
+func ManagesMember(email string, member string) bool {
+	accounts, err := ReadAllAccounts(email)
+	if err != nil {
+		return false
+	}
+	memberships, err := ReadAllAccounts(member)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range accounts {
+		if a.Status != "Active" || (a.Role != "Owner" && a.Role != "Admin") {
+			continue
+		}
+		for _, m := range memberships {
+			if m.Parent == a.Parent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newLoginLocation compares a login with the user's earlier successful ones
+// and says whether it is from a new country or device.  The first login of a
+// user is nothing new.
+func newLoginLocation(event *model.LoginEvent, history []*model.LoginEvent) string {
+	before := false
+	country := event.Country == ""
+	device := false
+
+	for _, e := range history {
+		if !e.Success {
+			continue
+		}
+		before = true
+		if e.Country == event.Country {
+			country = true
+		}
+		if e.UserAgent == event.UserAgent {
+			device = true
+		}
+	}
+
+	switch {
+	case !before:
+		return ""
+	case !country:
+		return "a new country (" + event.Country + ")"
+	case !device:
+		return "a new device"
+	}
+	return ""
+}
+
+// alertOwners emails the owners of every account the user is an admin of
+func alertOwners(event *model.LoginEvent, what string) {
+	accounts, err := ReadAllAccounts(event.Email)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	notified := map[string]bool{}
+	for _, account := range accounts {
+		if account.Role != "Admin" || account.Status != "Active" {
+			continue
+		}
+
+		members, err := ReadAllAccounts(account.Parent)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		for _, owner := range members {
+			if owner.Role != "Owner" || owner.Email == event.Email || notified[owner.Email] {
+				continue
+			}
+			notified[owner.Email] = true
+
+			title := "New login by an admin of " + account.AccountName
+			message := fmt.Sprintf("%s, an admin of %s, logged in from %s at %s.  Provider: %s, address: %s, device: %s.  "+
+				"If you don't expect this, review their sessions and role.",
+				event.Email, account.AccountName, what, event.Created.Format(time.RFC1123),
+				event.Provider, event.IP, event.UserAgent)
+
+			body, err := template.NotifyEmail(title, message, os.Getenv("SERVER"), "Open Nettica")
+			if err == nil {
+				err = SendEmail(owner.Email, title, body)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Errorf("failed to alert %s of a new login", owner.Email)
+				continue
+			}
+
+			log.Infof("SECURITY: %s logged in from %s, %s was alerted", event.Email, what, owner.Email)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	template "github.com/nettica-com/nettica-admin/template"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2id parameters, RFC 9106 second recommended option
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+)
+
+// reset and verification links are good for an hour
+const localTokenLifetime = time.Hour
+
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+// compared against when the user does not exist so that the response
+// time does not reveal which emails have accounts
+var dummyHash string
+var dummyOnce sync.Once
+
+// HashPassword hashes a password with argon2id, or bcrypt if LOCAL_PASSWORD_HASH=bcrypt
+func HashPassword(password string) (string, error) {
+
+	if os.Getenv("LOCAL_PASSWORD_HASH") == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	}
+
+	salt, err := util.GenerateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), []byte(salt), argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString([]byte(salt)),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword compares a password to an argon2id or bcrypt hash
+func CheckPassword(hash string, password string) bool {
+
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, iterations uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads)
+	if err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// CheckPasswordPolicy enforces LOCAL_PASSWORD_MIN_LENGTH and LOCAL_PASSWORD_COMPLEXITY
+func CheckPasswordPolicy(email string, password string) error {
+
+	min := 12
+	if os.Getenv("LOCAL_PASSWORD_MIN_LENGTH") != "" {
+		x, err := strconv.Atoi(os.Getenv("LOCAL_PASSWORD_MIN_LENGTH"))
+		if err == nil {
+			min = x
+		}
+	}
+
+	if len([]rune(password)) < min {
+		return fmt.Errorf("password must be at least %d characters", min)
+	}
+
+	if len(password) > 256 {
+		return errors.New("password is too long")
+	}
+
+	name := strings.SplitN(strings.ToLower(email), "@", 2)[0]
+	if len(name) > 2 && strings.Contains(strings.ToLower(password), name) {
+		return errors.New("password must not contain your email address")
+	}
+
+	if os.Getenv("LOCAL_PASSWORD_COMPLEXITY") != "false" {
+		var upper, lower, digit, other int
+		for _, r := range password {
+			switch {
+			case unicode.IsUpper(r):
+				upper = 1
+			case unicode.IsLower(r):
+				lower = 1
+			case unicode.IsDigit(r):
+				digit = 1
+			default:
+				other = 1
+			}
+		}
+		if upper+lower+digit+other < 3 {
+			return errors.New("password must contain at least three of: upper case, lower case, digits and symbols")
+		}
+	}
+
+	return nil
+}
+
+// LocalSignupAllowed reports whether self-service signup is enabled for the email
+func LocalSignupAllowed(email string) bool {
+
+	if os.Getenv("LOCAL_ALLOW_SIGNUP") != "true" {
+		return false
+	}
+
+	domains := os.Getenv("LOCAL_SIGNUP_DOMAINS")
+	if domains == "" {
+		return true
+	}
+
+	parts := strings.SplitN(email, "@", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	for _, d := range strings.Split(domains, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), parts[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LocalAuthenticate checks an email and password against the local user directory
+func LocalAuthenticate(email string, password string) error {
+
+	email = strings.ToLower(email)
+
+	user, err := mongo.ReadLocalUser(email)
+	if err != nil {
+		dummyOnce.Do(func() {
+			dummyHash, _ = HashPassword("nettica-dummy-password")
+		})
+		CheckPassword(dummyHash, password)
+		return ErrInvalidLogin
+	}
+
+	if !CheckPassword(user.Hash, password) {
+		return ErrInvalidLogin
+	}
+
+	if user.Status != "Active" {
+		return errors.New("user is suspended")
+	}
+
+	if !user.Verified && os.Getenv("LOCAL_REQUIRE_VERIFIED") != "false" {
+		return errors.New("email address has not been verified")
+	}
+
+	return nil
+}
+
+// LocalSignup creates an unverified local user and emails a verification link
+func LocalSignup(email string, name string, password string) error {
+
+	email = strings.ToLower(email)
+
+	if !util.RegexpEmail.MatchString(email) {
+		return fmt.Errorf("email %s is invalid", email)
+	}
+
+	if !LocalSignupAllowed(email) {
+		return errors.New("signup is not allowed")
+	}
+
+	err := CheckPasswordPolicy(email, password)
+	if err != nil {
+		return err
+	}
+
+	// don't reveal whether the user exists
+	_, err = mongo.ReadLocalUser(email)
+	if err == nil {
+		log.Infof("local signup for existing user %s ignored", email)
+		return nil
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	token, err := util.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	user := &model.LocalUser{
+		Email:       email,
+		Name:        name,
+		Hash:        hash,
+		Status:      "Active",
+		VerifyToken: hashLocalToken(token),
+		PasswordSet: &now,
+		CreatedBy:   email,
+		UpdatedBy:   email,
+		Created:     now,
+		Updated:     now,
+	}
+
+	errs := user.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("local user validation error")
+		}
+		return errors.New("failed to validate user")
+	}
+
+	err = mongo.UpsertLocalUser(user)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("SERVER") + "/verify?email=" + url.QueryEscape(email) + "&token=" + token
+
+	return sendLocalEmail(email, "Verify your email address",
+		"Click the button below to verify your email address and finish creating your account.", link, "Verify Email")
+}
+
+// LocalVerify marks the local user's email address as verified
+func LocalVerify(email string, token string) error {
+
+	email = strings.ToLower(email)
+
+	user, err := mongo.ReadLocalUser(email)
+	if err != nil {
+		return errors.New("invalid verification link")
+	}
+
+	if user.VerifyToken == "" || subtle.ConstantTimeCompare([]byte(user.VerifyToken), []byte(hashLocalToken(token))) != 1 {
+		return errors.New("invalid verification link")
+	}
+
+	user.Verified = true
+	user.VerifyToken = ""
+	user.UpdatedBy = email
+	user.Updated = time.Now().UTC()
+
+	return mongo.UpsertLocalUser(user)
+}
+
+// LocalRequestReset emails a password reset link.  Members invited to an account
+// who have never set a password use the same flow to create their local user.
+func LocalRequestReset(email string) error {
+
+	email = strings.ToLower(email)
+
+	user, err := mongo.ReadLocalUser(email)
+	if err != nil {
+		accounts, err := mongo.ReadAllAccounts(email)
+		if err != nil || len(accounts) == 0 {
+			if !LocalSignupAllowed(email) {
+				log.Infof("password reset for unknown user %s ignored", email)
+				return nil
+			}
+		}
+		now := time.Now().UTC()
+		user = &model.LocalUser{
+			Email:     email,
+			Status:    "Active",
+			CreatedBy: email,
+			Created:   now,
+		}
+	}
+
+	if user.Status != "Active" {
+		log.Infof("password reset for suspended user %s ignored", email)
+		return nil
+	}
+
+	token, err := util.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().UTC().Add(localTokenLifetime)
+	user.ResetToken = hashLocalToken(token)
+	user.ResetExpires = &expires
+	user.UpdatedBy = email
+	user.Updated = time.Now().UTC()
+
+	err = mongo.UpsertLocalUser(user)
+	if err != nil {
+		return err
+	}
+
+	link := os.Getenv("SERVER") + "/reset?email=" + url.QueryEscape(email) + "&token=" + token
+
+	return sendLocalEmail(email, "Reset your password",
+		"Someone asked to reset the password for this email address.  If it was you, click the button below within the hour.  Otherwise you can ignore this email.", link, "Reset Password")
+}
+
+// LocalReset sets a new password using an emailed reset token.  Since the token
+// was delivered by email, a successful reset also verifies the address.
+func LocalReset(email string, token string, password string) error {
+
+	email = strings.ToLower(email)
+
+	user, err := mongo.ReadLocalUser(email)
+	if err != nil {
+		return errors.New("invalid or expired reset link")
+	}
+
+	if user.ResetToken == "" || user.ResetExpires == nil || time.Now().UTC().After(*user.ResetExpires) ||
+		subtle.ConstantTimeCompare([]byte(user.ResetToken), []byte(hashLocalToken(token))) != 1 {
+		return errors.New("invalid or expired reset link")
+	}
+
+	err = CheckPasswordPolicy(email, password)
+	if err != nil {
+		return err
+	}
+
+	return setLocalPassword(user, password)
+}
+
+// LocalChangePassword changes the password of a user who knows the current one
+func LocalChangePassword(email string, current string, password string) error {
+
+	email = strings.ToLower(email)
+
+	err := LocalAuthenticate(email, current)
+	if err != nil {
+		return err
+	}
+
+	err = CheckPasswordPolicy(email, password)
+	if err != nil {
+		return err
+	}
+
+	user, err := mongo.ReadLocalUser(email)
+	if err != nil {
+		return err
+	}
+
+	return setLocalPassword(user, password)
+}
+
+func setLocalPassword(user *model.LocalUser, password string) error {
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	user.Hash = hash
+	user.Verified = true
+	user.VerifyToken = ""
+	user.ResetToken = ""
+	user.ResetExpires = nil
+	user.PasswordSet = &now
+	user.UpdatedBy = user.Email
+	user.Updated = now
+
+	errs := user.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("local user validation error")
+		}
+		return errors.New("failed to validate user")
+	}
+
+	log.Infof("password set for local user %s", user.Email)
+
+	return mongo.UpsertLocalUser(user)
+}
+
+// only a digest of emailed tokens is stored
+func hashLocalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sendLocalEmail(email, title, message, link, button string) error {
+
+	body, err := template.NotifyEmail(title, message, link, button)
+	if err != nil {
+		return err
+	}
+
+	return SendEmail(email, title, body)
+}
@@ -0,0 +1,273 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrLocked is returned for a change to a network, VPN or device that is
+// locked
+var ErrLocked = errors.New("locked")
+
+// LockedStatus is the HTTP status for an error from a change: 423 if the
+// object was locked, or status otherwise
+func LockedStatus(err error, status int) int {
+	if errors.Is(err, ErrLocked) {
+		return http.StatusLocked
+	}
+	return status
+}
+
+// the collections of the kinds of objects that can be locked
+var lockCollections = map[string]string{
+	"net":    "networks",
+	"vpn":    "vpns",
+	"device": "devices",
+}
+
+// checkLock returns an error wrapping ErrLocked if an object is read only.
+// An object marked read only without a lock, from before locks were kept,
+// is locked until an owner releases it.
+func checkLock(name string, readOnly *bool, lock *model.Lock) error {
+	if readOnly == nil || !*readOnly {
+		return nil
+	}
+	if lock == nil {
+		return fmt.Errorf("%w: %s is read only", ErrLocked, name)
+	}
+	if lock.Expired() {
+		return nil
+	}
+
+	if lock.Reason != "" {
+		return fmt.Errorf("%w: %s is held by %s, %s", ErrLocked, name, lock.Owner, lock.Reason)
+	}
+	return fmt.Errorf("%w: %s is held by %s", ErrLocked, name, lock.Owner)
+}
+
+// readLock returns the lock of a network, VPN or device, with what it is
+// and its account
+func readLock(kind string, id string) (string, string, *bool, *model.Lock, error) {
+	switch kind {
+	case "net":
+		net, err := ReadNet(id)
+		if err != nil {
+			return "", "", nil, nil, err
+		}
+		return "network " + net.NetName, net.AccountID, net.ReadOnly, net.Lock, nil
+	case "vpn":
+		vpn, err := ReadVPN(id)
+		if err != nil {
+			return "", "", nil, nil, err
+		}
+		return "vpn " + vpn.Name, vpn.AccountID, vpn.ReadOnly, vpn.Lock, nil
+	case "device":
+		device, err := ReadDevice(id)
+		if err != nil {
+			return "", "", nil, nil, err
+		}
+		return "device " + device.Name, device.AccountID, device.ReadOnly, device.Lock, nil
+	}
+
+	return "", "", nil, nil, fmt.Errorf("a %s can't be locked", kind)
+}
+
+// readLocked reads a locked or unlocked network, VPN or device
+func readLocked(kind string, id string) interface{} {
+	switch kind {
+	case "net":
+		if net, err := ReadNet(id); err == nil {
+			return net
+		}
+	case "vpn":
+		if vpn, err := ReadVPN(id); err == nil {
+			return vpn
+		}
+	case "device":
+		if device, err := ReadDevice(id); err == nil {
+			return device
+		}
+	}
+
+	return nil
+}
+
+// Lock makes a network, VPN or device read only for lock.Owner, until they
+// or an owner of its account release it or the lock expires.  Whoever holds
+// a lock can lock the object again to change its reason or expiry; nobody
+// else can until it's released.
+func Lock(kind string, id string, lock *model.Lock, actor Actor) error {
+	name, _, readOnly, current, err := readLock(kind, id)
+	if err != nil {
+		return err
+	}
+	before := readLocked(kind, id)
+
+	err = checkLock(name, readOnly, current)
+	if err != nil && (current == nil || current.Owner != lock.Owner) {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if lock.Expires != nil && !lock.Expires.After(now) {
+		return errors.New("the lock must expire in the future")
+	}
+	lock.Created = now
+
+	ok, err := mongo.SetLock(id, lockCollections[kind], current, lock)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s was locked or unlocked by someone else", ErrLocked, name)
+	}
+
+	log.Infof("lock: %s locked %s %s", lock.Owner, kind, id)
+
+	Publish(Locked{Kind: kind, Before: before, After: readLocked(kind, id), Actor: actor})
+
+	return nil
+}
+
+// Unlock releases the lock of a network, VPN or device.  Only whoever holds
+// the lock or an owner of the object's account can, unless it has expired.
+func Unlock(kind string, id string, account *model.Account, actor Actor) error {
+	name, accountID, readOnly, lock, err := readLock(kind, id)
+	if err != nil {
+		return err
+	}
+	before := readLocked(kind, id)
+	if readOnly == nil || !*readOnly {
+		return fmt.Errorf("%s isn't locked", name)
+	}
+
+	owner := account.Role == "Owner" && account.Parent == accountID
+	if checkLock(name, readOnly, lock) != nil && !owner && (lock == nil || lock.Owner != account.Email) {
+		return errors.New("only whoever holds the lock or an owner can release it")
+	}
+
+	ok, err := mongo.SetLock(id, lockCollections[kind], lock, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s was locked or unlocked by someone else", ErrLocked, name)
+	}
+
+	log.Infof("lock: %s unlocked %s %s", account.Email, kind, id)
+
+	Publish(Unlocked{Kind: kind, Before: before, After: readLocked(kind, id), Actor: actor})
+
+	return nil
+}
+
+// the names of the kinds of objects that can be locked, for people
+var lockNames = map[string]string{
+	"net":    "network",
+	"vpn":    "VPN",
+	"device": "device",
+}
+
+// LockFromContext locks the network, VPN or device the request names for
+// the member making it, who must have created it or be an admin or owner,
+// and responds with it
+func LockFromContext(c *gin.Context, kind string) {
+	var data model.Lock
+	id := c.Param("id")
+
+	if err := c.ShouldBindJSON(&data); err != nil && !errors.Is(err, io.EOF) {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to bind")
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, v, err := AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account == nil || account.Status == "Suspended" ||
+		(createdBy(v) != account.Email && account.Role != "Admin" && account.Role != "Owner") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot lock this " + lockNames[kind]})
+		return
+	}
+
+	data.Owner = account.Email
+
+	err = Lock(kind, id, &data, RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to lock " + lockNames[kind])
+		c.JSON(LockedStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+
+	lockedResult(c, kind, id)
+}
+
+// UnlockFromContext releases the lock of the network, VPN or device the
+// request names, and responds with it
+func UnlockFromContext(c *gin.Context, kind string) {
+	id := c.Param("id")
+
+	account, _, err := AuthFromContext(c, id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to get account from context")
+		return
+	}
+
+	if account == nil || account.Status == "Suspended" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot unlock this " + lockNames[kind]})
+		return
+	}
+
+	err = Unlock(kind, id, account, RequestActor(c))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to unlock " + lockNames[kind])
+		c.JSON(LockedStatus(err, http.StatusForbidden), gin.H{"error": err.Error()})
+		return
+	}
+
+	lockedResult(c, kind, id)
+}
+
+func lockedResult(c *gin.Context, kind string, id string) {
+	result := readLocked(kind, id)
+	if result == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read " + lockNames[kind]})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// createdBy returns who created a network, VPN or device
+func createdBy(v interface{}) string {
+	switch o := v.(type) {
+	case *model.Network:
+		return o.CreatedBy
+	case *model.VPN:
+		return o.CreatedBy
+	case *model.Device:
+		return o.CreatedBy
+	}
+	return ""
+}
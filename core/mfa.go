@@ -0,0 +1,336 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// RFC 6238 defaults understood by every authenticator app
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+const recoveryCodeCount = 10
+
+var ErrInvalidMFACode = errors.New("invalid verification code")
+
+// MFAEnrollment is returned when a user starts enrolling an authenticator
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	Url    string `json:"url"`
+	QRCode []byte `json:"qrcode"`
+}
+
+// ReadMFA returns the MFA status of a user
+func ReadMFA(email string) (*model.MFA, error) {
+	m, err := mongo.ReadMFA(email)
+	if err != nil {
+		m = &model.MFA{Email: email}
+	}
+
+	m.Remaining = len(m.RecoveryCodes)
+	m.Required = MFARequired(email)
+
+	return m, nil
+}
+
+// MFAEnabled reports whether the user has a confirmed authenticator
+func MFAEnabled(email string) bool {
+	m, err := mongo.ReadMFA(email)
+	return err == nil && m.Enabled
+}
+
+// MFARequired reports whether any account the user belongs to requires MFA
+func MFARequired(email string) bool {
+
+	accounts, err := mongo.ReadAllAccounts(email)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	for _, a := range accounts {
+		if a.Status != "Active" {
+			continue
+		}
+		if a.Id == a.Parent {
+			if a.RequireMFA {
+				return true
+			}
+			continue
+		}
+		parent, err := ReadAccount(a.Parent)
+		if err == nil && parent.RequireMFA {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BeginMFAEnrollment creates a new, unconfirmed TOTP secret for the user.  An
+// already enabled authenticator keeps working until the new one is confirmed,
+// and a current code from it is required to replace it.
+func BeginMFAEnrollment(email string, code string) (*MFAEnrollment, error) {
+
+	if MFAEnabled(email) {
+		err := VerifyMFA(email, code)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+
+	m, err := mongo.ReadMFA(email)
+	if err != nil {
+		m = &model.MFA{Email: email, Created: time.Now().UTC()}
+	}
+
+	// a pending secret lives next to the enabled one until confirmed
+	if m.Enabled {
+		m.Pending = secret
+	} else {
+		m.Secret = secret
+	}
+	m.Updated = time.Now().UTC()
+
+	err = mongo.UpsertMFA(m)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Nettica"
+	}
+
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + email,
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	u.RawQuery = q.Encode()
+
+	png, err := qrcode.Encode(u.String(), qrcode.Medium, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{Secret: secret, Url: u.String(), QRCode: png}, nil
+}
+
+// ConfirmMFAEnrollment enables the pending authenticator once the user proves
+// they have it, and returns a fresh set of recovery codes
+func ConfirmMFAEnrollment(email string, code string) ([]string, error) {
+
+	m, err := mongo.ReadMFA(email)
+	if err != nil {
+		return nil, errors.New("enrollment has not been started")
+	}
+
+	secret := m.Secret
+	if m.Enabled {
+		secret = m.Pending
+	}
+
+	if secret == "" {
+		return nil, errors.New("enrollment has not been started")
+	}
+
+	step, ok := checkTOTP(secret, code, 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Secret = secret
+	m.Pending = ""
+	m.Enabled = true
+	m.LastStep = step
+	m.RecoveryCodes = hashes
+	m.Updated = time.Now().UTC()
+
+	err = mongo.UpsertMFA(m)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("MFA enabled for %s", email)
+
+	return codes, nil
+}
+
+// VerifyMFA checks a TOTP code, or consumes a recovery code
+func VerifyMFA(email string, code string) error {
+
+	m, err := mongo.ReadMFA(email)
+	if err != nil || !m.Enabled {
+		return errors.New("mfa is not enabled")
+	}
+
+	code = strings.TrimSpace(code)
+
+	if len(code) == totpDigits {
+		step, ok := checkTOTP(m.Secret, code, m.LastStep)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		m.LastStep = step
+		m.Updated = time.Now().UTC()
+		return mongo.UpsertMFA(m)
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, h := range m.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			m.RecoveryCodes = append(m.RecoveryCodes[:i], m.RecoveryCodes[i+1:]...)
+			m.Updated = time.Now().UTC()
+			log.Infof("MFA recovery code used by %s, %d remaining", email, len(m.RecoveryCodes))
+			return mongo.UpsertMFA(m)
+		}
+	}
+
+	return ErrInvalidMFACode
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a current code
+func RegenerateRecoveryCodes(email string, code string) ([]string, error) {
+
+	err := VerifyMFA(email, code)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := mongo.ReadMFA(email)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	m.RecoveryCodes = hashes
+	m.Updated = time.Now().UTC()
+
+	return codes, mongo.UpsertMFA(m)
+}
+
+// DisableMFA removes the authenticator after checking a current code.  Users
+// of an account that requires MFA cannot turn it off.
+func DisableMFA(email string, code string) error {
+
+	if MFARequired(email) {
+		return errors.New("mfa is required by your account")
+	}
+
+	err := VerifyMFA(email, code)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("MFA disabled for %s", email)
+
+	return mongo.DeleteMFA(email)
+}
+
+// checkTOTP accepts a code for the current time step or its neighbours, but
+// never a step at or before the last one used
+func checkTOTP(secret string, code string, lastStep int64) (int64, bool) {
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpPeriod
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := now + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totp computes the RFC 6238 code for a time step
+func totp(key []byte, step int64) string {
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := util.RandomString(10)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = strings.ToLower(code[:5] + "-" + code[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
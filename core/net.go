@@ -14,7 +14,7 @@ import (
 )
 
 // CreateNet net with all necessary data
-func CreateNet(net *model.Network) (*model.Network, error) {
+func CreateNet(net *model.Network, actor Actor) (*model.Network, error) {
 
 	var err error
 	net.Id, err = util.RandomString(12)
@@ -73,6 +73,10 @@ func CreateNet(net *model.Network) (*model.Network, error) {
 	}
 	net = v.(*model.Network)
 
+	recordRevision(netRevision(net, revisionCause{}))
+
+	Publish(NetworkCreated{Net: net, Actor: actor})
+
 	// data modified, dump new config
 	return net, nil
 }
@@ -88,24 +92,43 @@ func ReadNet(id string) (*model.Network, error) {
 	return net, nil
 }
 
-// UpdateNet preserve keys
-func UpdateNet(Id string, net *model.Network) (*model.Network, error) {
+// UpdateNet preserve keys, and pass the change on to the network's VPNs
+func UpdateNet(Id string, net *model.Network, actor Actor) (*model.Network, error) {
+	return updateNet(Id, net, actor, revisionCause{}, nil)
+}
+
+// updateNet passes the change on to the VPNs include accepts, or to every
+// VPN in the network if include is nil
+func updateNet(Id string, net *model.Network, actor Actor, cause revisionCause, include func(*model.VPN) bool) (*model.Network, error) {
 	v, err := mongo.Deserialize(Id, "id", "networks", reflect.TypeOf(model.Network{}))
 	if err != nil {
 		return nil, err
 	}
-	//	current := v.(*model.Network)
 
 	if v == nil {
 		return nil, errors.New("net is nil")
 		//		x: = fmt.Sprintf("could not retrieve net %s", Id)
 		//		return nil, errors.New(x)
 	}
+	current := v.(*model.Network)
 
 	//	if current.ID != Id {
 	//		return nil, errors.New("records Id mismatch")
 	//	}
 
+	err = checkLock("network "+current.NetName, current.ReadOnly, current.Lock)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCritical(current, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// locks are only changed by Lock and Unlock
+	net.ReadOnly = current.ReadOnly
+	net.Lock = current.Lock
+
 	// check if net is valid
 	errs := net.IsValid()
 	if len(errs) != 0 {
@@ -119,6 +142,9 @@ func UpdateNet(Id string, net *model.Network) (*model.Network, error) {
 	u := time.Now().UTC()
 	net.Updated = &u
 
+	// networks from before revisions were kept get their first one now
+	recordRevision(netRevision(current, revisionCause{}))
+
 	err = mongo.Serialize(net.Id, "id", "networks", net)
 	if err != nil {
 		return nil, err
@@ -130,17 +156,39 @@ func UpdateNet(Id string, net *model.Network) (*model.Network, error) {
 	}
 	net = v.(*model.Network)
 
+	recordRevision(netRevision(net, cause))
+
+	Publish(NetworkUpdated{Before: current, After: net, Actor: actor})
+
+	err = propagateNetChange(current, net, include, actor)
+	if err != nil {
+		return nil, err
+	}
+
 	// data modified, dump new config
 	return net, nil
 }
 
 // DeleteNet from database
-func DeleteNet(id string) error {
+func DeleteNet(id string, actor Actor) error {
 
 	if id == "" {
 		return errors.New("id is empty")
 	}
 
+	net, err := ReadNet(id)
+	if err != nil {
+		return err
+	}
+	err = checkLock("network "+net.NetName, net.ReadOnly, net.Lock)
+	if err != nil {
+		return err
+	}
+	err = checkCritical(net, actor)
+	if err != nil {
+		return err
+	}
+
 	// Delete all vpns associated with this network
 
 	vpns, err := mongo.ReadAllVPNs("netid", id)
@@ -148,8 +196,17 @@ func DeleteNet(id string) error {
 	if err != nil {
 		return err
 	}
+
+	// nothing is deleted if any of them is locked
 	for _, vpn := range vpns {
-		err = DeleteVPN(vpn.Id)
+		err = checkLock("vpn "+vpn.Name, vpn.ReadOnly, vpn.Lock)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, vpn := range vpns {
+		err = deleteVPN(vpn.Id, true, actor)
 		if err != nil {
 			return err
 		}
@@ -162,6 +219,8 @@ func DeleteNet(id string) error {
 		return err
 	}
 
+	Publish(NetworkDeleted{Net: net, VPNs: vpns, Actor: actor})
+
 	return nil
 }
 
@@ -218,3 +277,208 @@ func ReadNetworks(email string) ([]*model.Network, error) {
 
 	return results, err
 }
+
+// propagateNetChange passes a change to a network's settings on to the VPNs
+// include accepts, or to every VPN in the network if include is nil.  Only a
+// change with ForceUpdate set rewrites the VPNs' settings; either way their
+// devices are told to fetch their configuration again.
+func propagateNetChange(before *model.Network, after *model.Network, include func(*model.VPN) bool, actor Actor) error {
+	change := changeToNet(before, after)
+
+	// the vpn revisions this makes belong to the network's latest revision
+	cause := revisionCause{}
+	if r, err := ReadLatestRevision(after.Id); err == nil {
+		cause.netRevision = r.Number
+	}
+
+	vpns, err := ReadVPN2("netid", before.Id)
+	if err != nil {
+		return err
+	}
+
+	included := make([]*model.VPN, 0)
+	for _, v := range vpns {
+		if include != nil && !include(v) {
+			continue
+		}
+		if change.apply(after, v) {
+			v.UpdatedBy = after.UpdatedBy
+			_, err := updateVPN(v.Id, v, true, actor, cause)
+			if err != nil {
+				log.Errorf("forceUpdate: failed to update vpn %s %v", v.Id, err)
+			}
+		}
+		included = append(included, v)
+	}
+
+	Publish(NetworkPropagated{Net: after, VPNs: included})
+
+	return nil
+}
+
+// PreviewNetChange works out what a change to a network would do to it and
+// its VPNs, the same way updating it with UpdateNet would, without saving
+// anything
+func PreviewNetChange(before *model.Network, after *model.Network) (*model.NetPreview, error) {
+	preview := &model.NetPreview{
+		Changes: auditDiff("", auditFields(before), auditFields(after), make([]model.AuditChange, 0)),
+		VPNs:    make([]*model.VPNPreview, 0),
+	}
+	for _, err := range after.IsValid() {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+	if err := checkLock("network "+before.NetName, before.ReadOnly, before.Lock); err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+
+	change := changeToNet(before, after)
+
+	vpns, err := ReadVPN2("netid", before.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// addresses the vpns before this one would be given
+	reserved := make([]string, 0)
+
+	for _, v := range vpns {
+		current := auditFields(v)
+		if !change.apply(after, v) {
+			continue
+		}
+
+		p := &model.VPNPreview{
+			Id:       v.Id,
+			Name:     v.Name,
+			DeviceID: v.DeviceID,
+		}
+
+		// prepareVPN checks the change against the vpn as it's saved
+		original, err := ReadVPN(v.Id)
+		if err == nil {
+			err = checkLock("vpn "+original.Name, original.ReadOnly, original.Lock)
+		}
+		if err == nil {
+			err = prepareVPN(original, v, reserved)
+		}
+		if err != nil {
+			p.Errors = append(p.Errors, err.Error())
+			for _, e := range v.IsValid() {
+				p.Errors = append(p.Errors, e.Error())
+			}
+		}
+		for _, address := range v.Current.Address {
+			if ip, err := util.GetIpFromCidr(address); err == nil {
+				reserved = append(reserved, ip)
+			}
+		}
+
+		p.Changes = auditDiff("", current, auditFields(v), make([]model.AuditChange, 0))
+		preview.VPNs = append(preview.VPNs, p)
+	}
+
+	return preview, nil
+}
+
+// netChange is which of a network's settings a forced update passes on to
+// its VPNs
+type netChange struct {
+	mtu          bool
+	address      bool
+	dns          bool
+	allowed      bool
+	failSafe     bool
+	presharedKey bool
+}
+
+func changeToNet(before *model.Network, after *model.Network) netChange {
+	var change netChange
+	if after.ForceUpdate {
+		log.Infof("updateNet: force update for %s %s", after.NetName, after.Id)
+		if after.Default.Mtu != before.Default.Mtu {
+			log.Infof("updateNet: updateMTU for %s %d", after.NetName, after.Default.Mtu)
+			change.mtu = true
+		}
+		if !util.CompareArrays(after.Default.Address, before.Default.Address) {
+			log.Infof("updateNet: updateAddress for %s %v", after.NetName, after.Default.Address)
+			change.address = true
+			change.dns = true
+		}
+		if !util.CompareArrays(after.Default.AllowedIPs, before.Default.AllowedIPs) {
+			log.Infof("updateNet: updateAllowed for %s %v", after.NetName, after.Default.AllowedIPs)
+			change.allowed = true
+		}
+		if after.Default.FailSafe != before.Default.FailSafe {
+			log.Infof("updateNet: updateFailSafe for %s %v", after.NetName, after.Default.FailSafe)
+			change.failSafe = true
+		}
+		if after.Default.PresharedKey != before.Default.PresharedKey {
+			log.Infof("updateNet: updatePresharedKey for %s", after.NetName)
+			change.presharedKey = true
+		}
+	}
+	return change
+}
+
+// apply the change to the network's settings to one of its VPNs, and return
+// true if the VPN changed
+func (change netChange) apply(after *model.Network, v *model.VPN) bool {
+	changed := false
+	if change.mtu && (v.Current.Mtu != after.Default.Mtu || v.Default.Mtu != after.Default.Mtu) {
+		log.Infof("updateNet: updateMTU for %s %d", v.Id, after.Default.Mtu)
+		v.Default.Mtu = after.Default.Mtu
+		v.Current.Mtu = after.Default.Mtu
+		changed = true
+	}
+	if change.dns {
+		log.Infof("updateNet: updateDNS for %s %v", v.Id, after.Default.Address)
+		v.Default.Dns = after.Default.Dns
+		for x, dns := range v.Current.Dns {
+			if dns == v.Current.Address[0] {
+				v.Current.Dns = append(v.Current.Dns[:x], v.Current.Dns[x+1:]...)
+				break
+			}
+			ip, err := util.GetIpFromCidr(v.Current.Address[0])
+			if err == nil && dns == ip {
+				v.Current.Dns = append(v.Current.Dns[:x], v.Current.Dns[x+1:]...)
+				break
+			}
+		}
+		changed = true
+	}
+	if change.address && !util.CompareArrays(v.Default.Address, after.Default.Address) {
+		log.Infof("updateNet: updateAddress for %s %v", v.Id, after.Default.Address)
+		v.Default.Address = after.Default.Address
+		v.Current.Address = make([]string, 0)
+		changed = true
+	}
+	if change.allowed && !util.CompareArrays(v.Default.AllowedIPs, after.Default.AllowedIPs) {
+		log.Infof("updateNet: updateAllowed for %s %v", v.Id, after.Default.AllowedIPs)
+		allowedIPs := make([]string, 0)
+		for _, subnet := range v.Default.AllowedIPs {
+			for _, cidr := range v.Current.AllowedIPs {
+				if !util.IsInCidr(cidr, subnet) {
+					allowedIPs = append(allowedIPs, cidr)
+				} else if cidr == subnet {
+					allowedIPs = append(allowedIPs, after.Default.AllowedIPs...)
+				}
+			}
+		}
+		v.Current.AllowedIPs = allowedIPs
+		v.Default.AllowedIPs = after.Default.AllowedIPs
+		changed = true
+	}
+	if change.failSafe && v.Default.FailSafe != after.Default.FailSafe {
+		log.Infof("updateNet: updateFailSafe for %s %v", v.Id, after.Default.FailSafe)
+		v.Default.FailSafe = after.Default.FailSafe
+		v.Current.FailSafe = after.Default.FailSafe
+		changed = true
+	}
+	if change.presharedKey && v.Default.PresharedKey != after.Default.PresharedKey {
+		log.Infof("updateNet: updatePresharedKey for %s", v.Id)
+		v.Default.PresharedKey = after.Default.PresharedKey
+		v.Current.PresharedKey = after.Default.PresharedKey
+		changed = true
+	}
+	return changed
+}
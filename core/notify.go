@@ -0,0 +1,216 @@
+package core
+
+import (
+	model "github.com/nettica-com/nettica-admin/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// Devices fetch their configuration again when they're sent a push
+// notification or their cached configuration is flushed.  Caches are flushed
+// before a change is returned, so a device never gets a stale configuration
+// for it, and the notifications are sent afterwards.
+func init() {
+	Subscribe(Sync, func(e NetworkPropagated) {
+		for _, v := range e.VPNs {
+			FlushCache(v.DeviceID)
+		}
+	})
+	Subscribe(Async, pushNetPropagated)
+
+	Subscribe(Sync, func(e VPNCreated) { flushNet(e.VPN.NetId) })
+	Subscribe(Async, pushVPNCreated)
+
+	Subscribe(Sync, func(e VPNUpdated) {
+		if !e.ByNetwork {
+			flushNet(e.After.NetId)
+		}
+	})
+	Subscribe(Async, pushVPNUpdated)
+
+	Subscribe(Sync, func(e VPNDeleted) {
+		if !e.WithNetwork {
+			FlushCache(e.VPN.DeviceID)
+			flushNet(e.VPN.NetId)
+		}
+	})
+	Subscribe(Async, pushVPNDeleted)
+
+	Subscribe(Sync, func(e NetworkDeleted) {
+		for _, v := range e.VPNs {
+			FlushCache(v.DeviceID)
+		}
+	})
+	Subscribe(Async, pushNetworkDeleted)
+
+	Subscribe(Sync, func(e DeviceUpdated) { FlushCache(e.After.Id) })
+	Subscribe(Sync, keepPushTokens)
+	Subscribe(Async, pushDeviceUpdated)
+
+	Subscribe(Sync, func(e DeviceDeleted) {
+		FlushCache(e.Device.Id)
+		Push.RemoveDevice(e.Device.Id)
+		Push.RemoveVoipDevice(e.Device.Id)
+	})
+	Subscribe(Async, pushFromDevice)
+}
+
+// flushNet flushes the cached configuration of every device in a network
+func flushNet(netId string) {
+	vpns, err := ReadVPN2("netid", netId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, v := range vpns {
+		FlushCache(v.DeviceID)
+	}
+}
+
+// sendPush sends a push notification to a device, if it has a push token
+func sendPush(deviceId string, title string, message string) {
+	token := Push.PushDevices[deviceId]
+	if token == "" {
+		return
+	}
+
+	err := Push.SendPushNotification(token, title, message)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to send push notification")
+	}
+}
+
+// pushNetChanged tells the devices of a network's enabled VPNs that its
+// configuration changed
+func pushNetChanged(vpns []*model.VPN) {
+	for _, v := range vpns {
+		if v.Enable {
+			sendPush(v.DeviceID, v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
+		}
+	}
+}
+
+// pushNetPropagated tells the devices of every VPN a change to their network
+// was passed on to, enabled or not, that their configuration changed
+func pushNetPropagated(e NetworkPropagated) {
+	for _, v := range e.VPNs {
+		sendPush(v.DeviceID, v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
+	}
+}
+
+func pushVPNCreated(e VPNCreated) {
+	vpns, err := ReadVPN2("netid", e.VPN.NetId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	pushNetChanged(vpns)
+}
+
+// pushVPNUpdated tells the device of a VPN that it was enabled or disabled,
+// and the rest of its network that it changed
+func pushVPNUpdated(e VPNUpdated) {
+	if e.ByNetwork {
+		return
+	}
+
+	vpns, err := ReadVPN2("netid", e.After.NetId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, v := range vpns {
+		switch {
+		case v.DeviceID != e.After.DeviceID:
+			if v.Enable {
+				sendPush(v.DeviceID, v.NetName+" updated", "The VPN configuration for "+v.NetName+" has been updated")
+			}
+		case v.Enable:
+			sendPush(v.DeviceID, v.NetName+" enabled", "Connection to "+v.NetName+" has been established")
+		default:
+			sendPush(v.DeviceID, v.NetName+" disabled", "The VPN configuration for "+v.NetName+" has been disabled")
+		}
+	}
+}
+
+// pushVPNDeleted tells the device that left a network, and the rest of the
+// network, that it changed
+func pushVPNDeleted(e VPNDeleted) {
+	if e.WithNetwork {
+		return
+	}
+
+	vpns, err := ReadVPN2("netid", e.VPN.NetId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	pushNetChanged(append(vpns, e.VPN))
+}
+
+func pushNetworkDeleted(e NetworkDeleted) {
+	for _, v := range e.VPNs {
+		sendPush(v.DeviceID, v.NetName+" deleted", v.NetName+" has been deleted")
+	}
+}
+
+// keepPushTokens keeps the push tokens of a device up to date when it's
+// changed
+func keepPushTokens(e DeviceUpdated) {
+	id := e.After.Id
+
+	if e.After.Push != nil && *e.After.Push != "" {
+		if Push.PushDevices[id] != *e.After.Push {
+			Push.RemovePushToken(Push.PushDevices[id])
+			Push.AddDevice(id, *e.After.Push)
+		}
+	} else {
+		Push.RemoveDevice(id)
+	}
+
+	if e.After.VoIP != nil && *e.After.VoIP != "" {
+		if Push.VoipDevices[id] != *e.After.VoIP {
+			Push.RemoveVoipDevice(id)
+			Push.AddVoipDevice(id, *e.After.VoIP)
+		}
+	} else {
+		Push.RemoveVoipDevice(id)
+	}
+}
+
+func pushDeviceUpdated(e DeviceUpdated) {
+	sendPush(e.After.Id, "Device Updated", "Device "+e.Before.Name+" has been updated")
+}
+
+// pushFromDevice sends a push notification from one device to another, as
+// a VoIP notification if it's a call and the device can take one
+func pushFromDevice(e DevicePushed) {
+	p := e.Push
+
+	if p.IsVoIP {
+		if token, ok := Push.VoipDevices[p.ToDeviceID]; ok {
+			err := Push.SendVoipNotification(token, p.Title, p.Message)
+			if err == nil {
+				return
+			}
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("failed to send voip notification")
+		}
+	}
+
+	// fallback to regular push if voip push fails or if it's not a voip push
+	token := Push.PushDevices[p.ToDeviceID]
+	if token == "" {
+		return
+	}
+
+	err := Push.SendPushNotification(token, p.Title, p.Message, p.IsVoIP)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to send push notification")
+	}
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// CreateProvisioningRule adds a rule to the parent account
+func CreateProvisioningRule(rule *model.ProvisioningRule) (*model.ProvisioningRule, error) {
+
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.Id = "rule-" + id
+	rule.Domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(rule.Domain), "@"))
+	rule.Group = strings.ToLower(strings.TrimSpace(rule.Group))
+	rule.Issuer = strings.TrimSpace(rule.Issuer)
+	rule.Created = time.Now().UTC()
+	rule.Updated = rule.Created
+
+	if rule.NetId != "" {
+		net, err := ReadNet(rule.NetId)
+		if err != nil || net.AccountID != rule.AccountID {
+			return nil, errors.New("network is not in this account")
+		}
+		rule.NetName = net.NetName
+	} else {
+		rule.NetName = ""
+	}
+
+	errs := rule.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("provisioning rule validation error")
+		}
+		return nil, errs[0]
+	}
+
+	err = mongo.Serialize(rule.Id, "id", "provisioning_rules", rule)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// ReadProvisioningRule by id
+func ReadProvisioningRule(id string) (*model.ProvisioningRule, error) {
+	v, err := mongo.Deserialize(id, "id", "provisioning_rules", reflect.TypeOf(model.ProvisioningRule{}))
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*model.ProvisioningRule), nil
+}
+
+// ReadProvisioningRules of a parent account
+func ReadProvisioningRules(accountid string) ([]*model.ProvisioningRule, error) {
+	return mongo.ReadAllProvisioningRules(accountid)
+}
+
+// DeleteProvisioningRule by id.  Members it already created stay.
+func DeleteProvisioningRule(id string) error {
+	return mongo.Delete(id, "id", "provisioning_rules")
+}
+
+// ProvisionUser runs the provisioning rules for a user logging in for the
+// first time and creates a membership in each account a rule matches.  When
+// several rules of an account match the first one wins.  The memberships
+// created are returned; errors are logged so the login goes on.  Domain rules
+// only apply when the provider says the email is verified, since some let
+// users sign up with, or edit, any address.
+func ProvisionUser(user *model.User) []*model.Account {
+	accounts := make([]*model.Account, 0)
+
+	at := strings.LastIndex(user.Email, "@")
+	if at < 0 {
+		return accounts
+	}
+	domain := ""
+	if user.Verified {
+		domain = strings.ToLower(user.Email[at+1:])
+	}
+
+	// groups are matched without regard to case
+	groups := make([]string, 0, len(user.Groups))
+	for _, g := range user.Groups {
+		groups = append(groups, strings.ToLower(g))
+	}
+
+	rules, err := mongo.ReadMatchingProvisioningRules(domain, groups)
+	if err != nil {
+		log.Error(err)
+		return accounts
+	}
+
+	joined := map[string]bool{}
+	for _, rule := range rules {
+		if joined[rule.AccountID] || !rule.Matches(user.Issuer, domain, groups) {
+			continue
+		}
+
+		parent, err := ReadAccount(rule.AccountID)
+		if err != nil || parent.Status == "Suspended" {
+			continue
+		}
+
+		if EnforceLimits() {
+			members, err := ReadAllAccounts(rule.AccountID)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			limits, err := ReadLimits(rule.AccountID)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if limits.MembersLimitReached(len(members)) {
+				log.Infof("provisioning rule %s: %s has reached the members limit", rule.Id, rule.AccountID)
+				continue
+			}
+		}
+
+		account := &model.Account{
+			Parent:      rule.AccountID,
+			Email:       user.Email,
+			Sub:         user.Sub,
+			Name:        user.Name,
+			AccountName: parent.AccountName,
+			NetId:       rule.NetId,
+			NetName:     rule.NetName,
+			Picture:     user.Picture,
+			Role:        rule.Role,
+			Status:      "Active",
+			CreatedBy:   rule.Id,
+			UpdatedBy:   rule.Id,
+		}
+		if account.Picture == "" {
+			account.Picture = os.Getenv("SERVER") + "/account-circle.png"
+		}
+
+		account, err = CreateAccount(account)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		log.Infof("provisioning rule %s added %s to %s as %s", rule.Id, user.Email, rule.AccountID, rule.Role)
+
+		joined[rule.AccountID] = true
+		accounts = append(accounts, account)
+	}
+
+	return accounts
+}
+
+// ClaimGroups reads the groups a provider lists in the user's claims, from
+// the claim named by PROVISIONING_GROUPS_CLAIM, groups by default
+func ClaimGroups(claims map[string]interface{}) []string {
+	name := os.Getenv("PROVISIONING_GROUPS_CLAIM")
+	if name == "" {
+		name = "groups"
+	}
+
+	groups := make([]string, 0)
+	switch v := claims[name].(type) {
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok && s != "" {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		if v != "" {
+			groups = append(groups, v)
+		}
+	}
+
+	return groups
+}
+
+// ClaimEmailVerified returns true if the user's claims say their email is
+// verified: email_verified, which some providers send as a string, or
+// xms_edov from Microsoft, which says the tenant owns the email's domain
+func ClaimEmailVerified(claims map[string]interface{}) bool {
+	for _, name := range []string{"email_verified", "xms_edov"} {
+		switch v := claims[name].(type) {
+		case bool:
+			if v {
+				return true
+			}
+		case string:
+			if strings.EqualFold(v, "true") || v == "1" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
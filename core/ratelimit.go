@@ -0,0 +1,180 @@
+package core
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	log "github.com/sirupsen/logrus"
+)
+
+// the limits used unless RATE_LIMIT_<NAME> sets another, as requests per period
+var defaultRateLimits = map[string]string{
+	"login":        "10/1m",
+	"mfa":          "10/1m",
+	"activate":     "5/1m",
+	"status":       "600/1m",
+	"device":       "30/1m",
+	"device_code":  "10/1m",
+	"device_token": "60/1m",
+	"webhook":      "120/1m",
+	"email":        "5/1h",
+}
+
+// a token bucket holds burst tokens and refills at rate tokens a second
+type rateLimit struct {
+	burst float64
+	rate  float64
+}
+
+// rateLimitFor reads a limit such as 10/1m.  0 or off turns the limit off.
+func rateLimitFor(name string) (rateLimit, bool) {
+	key := "RATE_LIMIT_" + strings.ToUpper(name)
+	value := os.Getenv(key)
+	if value == "" {
+		value = defaultRateLimits[name]
+	}
+	if value == "" || value == "0" || value == "off" || os.Getenv("RATE_LIMIT") == "false" {
+		return rateLimit{}, false
+	}
+
+	count, period, _ := strings.Cut(value, "/")
+	n, err := strconv.Atoi(count)
+	d, err2 := time.ParseDuration(period)
+	if err != nil || err2 != nil || n <= 0 || d <= 0 {
+		log.Errorf("%s is not a valid rate limit, using %s", key, defaultRateLimits[name])
+		count, period, _ = strings.Cut(defaultRateLimits[name], "/")
+		n, _ = strconv.Atoi(count)
+		d, _ = time.ParseDuration(period)
+	}
+
+	return rateLimit{burst: float64(n), rate: float64(n) / d.Seconds()}, true
+}
+
+// Allow takes a token from the bucket the limit keeps for key, an IP address
+// or an identifier like a user name.  When the bucket is empty it returns
+// false and how long until the next token.  Buckets live in the database so
+// every replica shares them; if it can't be reached requests are allowed.
+func Allow(name string, key string) (bool, time.Duration) {
+	limit, ok := rateLimitFor(name)
+	if !ok {
+		return true, 0
+	}
+
+	// an empty bucket is full again after burst/rate, then it can go
+	full := time.Duration(limit.burst / limit.rate * float64(time.Second))
+
+	allowed, tokens, err := mongo.TakeRateLimitToken(name+":"+key, limit.burst, limit.rate, time.Now().UTC().Add(full))
+	if err != nil {
+		log.Errorf("rate limit %s: %v", name, err)
+		return true, 0
+	}
+	if allowed {
+		return true, 0
+	}
+
+	wait := time.Duration((1 - tokens) / limit.rate * float64(time.Second))
+	return false, wait
+}
+
+// TooManyRequests answers a request over its limit
+func TooManyRequests(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+}
+
+// RateLimit is middleware that limits the requests each IP address makes to
+// the routes it is added to
+func RateLimit(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := Allow(name, "ip:"+c.ClientIP())
+		if !ok {
+			log.Infof("rate limit %s reached by %s", name, c.ClientIP())
+			TooManyRequests(c, wait)
+			return
+		}
+		c.Next()
+	}
+}
+
+func lockoutThreshold() int {
+	if n, err := strconv.Atoi(os.Getenv("LOCKOUT_THRESHOLD")); err == nil {
+		return n
+	}
+	return 5
+}
+
+// LoginLocked returns how much longer a user is locked out after too many
+// failed logins, or false if they may try
+func LoginLocked(username string) (time.Duration, bool) {
+	if lockoutThreshold() <= 0 {
+		return 0, false
+	}
+
+	failure, err := mongo.ReadLoginFailure(strings.ToLower(username))
+	if err != nil || failure.LockedUntil == nil {
+		return 0, false
+	}
+
+	wait := time.Until(*failure.LockedUntil)
+	return wait, wait > 0
+}
+
+// LoginFailed counts a failed login.  From LOCKOUT_THRESHOLD failures on the
+// user is locked out, for LOCKOUT_BACKOFF at first and twice as long with
+// each further failure, up to LOCKOUT_MAX.
+func LoginFailed(username string) {
+	threshold := lockoutThreshold()
+	if threshold <= 0 {
+		return
+	}
+
+	backoff := sessionDuration("LOCKOUT_BACKOFF", time.Minute)
+	max := sessionDuration("LOCKOUT_MAX", time.Hour)
+
+	// failures are forgotten a day after the last one
+	id := strings.ToLower(username)
+	failure, err := mongo.AddLoginFailure(id, time.Now().UTC().Add(24*time.Hour))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if failure.Failures < threshold {
+		return
+	}
+
+	lock := backoff
+	for i := threshold; i < failure.Failures && lock < max; i++ {
+		lock *= 2
+	}
+	if lock > max {
+		lock = max
+	}
+
+	until := time.Now().UTC().Add(lock)
+	err = mongo.LockLogin(id, until, until.Add(24*time.Hour))
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	log.Infof("SECURITY: %s is locked out for %s after %d failed logins", id, lock, failure.Failures)
+}
+
+// LoginSucceeded clears the failed logins of a user
+func LoginSucceeded(username string) {
+	if lockoutThreshold() <= 0 {
+		return
+	}
+
+	err := mongo.DeleteLoginFailure(strings.ToLower(username))
+	if err != nil {
+		log.Error(err)
+	}
+}
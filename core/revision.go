@@ -0,0 +1,310 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// why a revision was made, when it wasn't an ordinary update
+type revisionCause struct {
+	netRevision int // the revision of the network whose change made it
+	rollback    int // the revision it rolled back to
+}
+
+// netRevision is the revision of a network's settings
+func netRevision(net *model.Network, cause revisionCause) *model.Revision {
+	return &model.Revision{
+		Kind:      "net",
+		ObjectID:  net.Id,
+		AccountID: net.AccountID,
+		NetId:     net.Id,
+		Rollback:  cause.rollback,
+		Default:   revisionSettings(net.Default),
+		CreatedBy: net.UpdatedBy,
+	}
+}
+
+// vpnRevision is the revision of a VPN's settings
+func vpnRevision(vpn *model.VPN, cause revisionCause) *model.Revision {
+	return &model.Revision{
+		Kind:        "vpn",
+		ObjectID:    vpn.Id,
+		AccountID:   vpn.AccountID,
+		NetId:       vpn.NetId,
+		NetRevision: cause.netRevision,
+		Rollback:    cause.rollback,
+		Default:     revisionSettings(vpn.Default),
+		Current:     revisionSettings(vpn.Current),
+		CreatedBy:   vpn.UpdatedBy,
+	}
+}
+
+// revisionSettings copies settings for a revision.  The private key is left
+// out, and empty lists are made the same as missing ones so they compare
+// equal once read back.
+func revisionSettings(s *model.Settings) *model.Settings {
+	if s == nil {
+		return nil
+	}
+
+	settings := *s
+	settings.PrivateKey = ""
+	if settings.AllowedIPs == nil {
+		settings.AllowedIPs = []string{}
+	}
+	if settings.Address == nil {
+		settings.Address = []string{}
+	}
+	if settings.Dns == nil {
+		settings.Dns = []string{}
+	}
+
+	return &settings
+}
+
+// recordRevision adds a revision of an object if its settings changed since
+// the last one, and returns the number of its latest revision.  Failing to
+// record a revision doesn't fail the change, it's logged.
+func recordRevision(revision *model.Revision) int {
+	var err error
+
+	// a revision numbered at the same time by another request is a duplicate
+	for i := 0; i < 3; i++ {
+		latest, _ := mongo.ReadLatestRevision(revision.ObjectID)
+
+		revision.Number = 1
+		if latest != nil {
+			if reflect.DeepEqual(latest.Default, revision.Default) && reflect.DeepEqual(latest.Current, revision.Current) {
+				return latest.Number
+			}
+			revision.Number = latest.Number + 1
+		}
+
+		var id string
+		id, err = util.RandomString(16)
+		if err != nil {
+			break
+		}
+		revision.Id = "rev-" + id
+		revision.Created = time.Now().UTC()
+
+		err = mongo.InsertRevision(revision)
+		if err == nil {
+			return revision.Number
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"err": err,
+	}).Errorf("failed to record revision of %s %s", revision.Kind, revision.ObjectID)
+
+	return 0
+}
+
+// ReadRevisions of a network or VPN, newest first
+func ReadRevisions(id string) ([]*model.Revision, error) {
+	return mongo.ReadRevisions(id)
+}
+
+// ReadRevision of a network or VPN by its number
+func ReadRevision(id string, number int) (*model.Revision, error) {
+	revision, err := mongo.ReadRevision(id, number)
+	if err != nil {
+		return nil, fmt.Errorf("revision %d of %s not found", number, id)
+	}
+	return revision, nil
+}
+
+// ReadLatestRevision of a network or VPN
+func ReadLatestRevision(id string) (*model.Revision, error) {
+	revision, err := mongo.ReadLatestRevision(id)
+	if err != nil {
+		return nil, fmt.Errorf("%s has no revisions", id)
+	}
+	return revision, nil
+}
+
+// DiffRevisions lists the settings of a network or VPN that changed from one
+// revision to another, or to its latest revision if to is 0
+func DiffRevisions(id string, from int, to int) ([]model.AuditChange, error) {
+	a, err := ReadRevision(id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var b *model.Revision
+	if to == 0 {
+		b, err = ReadLatestRevision(id)
+	} else {
+		b, err = ReadRevision(id, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return diffRevisions(a, b), nil
+}
+
+func diffRevisions(from *model.Revision, to *model.Revision) []model.AuditChange {
+	type settings struct {
+		Default *model.Settings `json:"default,omitempty"`
+		Current *model.Settings `json:"current,omitempty"`
+	}
+
+	a := auditFields(settings{Default: from.Default, Current: from.Current})
+	b := auditFields(settings{Default: to.Default, Current: to.Current})
+
+	return auditDiff("", a, b, make([]model.AuditChange, 0))
+}
+
+// RollbackNet restores a network's settings to an earlier revision.  Every
+// VPN that a later change to the network touched is restored to the revision
+// it had before that change; a VPN that can't be restored, because it's gone
+// or its old address has been given to another VPN, is reported and left as
+// it is.
+func RollbackNet(net *model.Network, number int, actor Actor) (*model.Rollback, error) {
+	revision, err := ReadRevision(net.Id, number)
+	if err != nil {
+		return nil, err
+	}
+	if revision.Kind != "net" || revision.Default == nil {
+		return nil, errors.New("not a network revision")
+	}
+
+	// the first revision each VPN got from a change after this one
+	touched, err := mongo.ReadRevisionsForNet(net.Id, number)
+	if err != nil {
+		return nil, err
+	}
+	first := make(map[string]*model.Revision)
+	vpns := make([]string, 0)
+	for _, r := range touched {
+		if _, ok := first[r.ObjectID]; !ok {
+			first[r.ObjectID] = r
+			vpns = append(vpns, r.ObjectID)
+		}
+	}
+
+	update := *net
+	settings := *revision.Default
+	if net.Default != nil {
+		settings.PrivateKey = net.Default.PrivateKey
+	}
+	update.Default = &settings
+	update.UpdatedBy = actor.Name
+
+	// the vpns are restored from their own revisions below
+	result, err := updateNet(net.Id, &update, actor, revisionCause{rollback: number}, func(*model.VPN) bool {
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := &model.Rollback{
+		Net:  result,
+		VPNs: make([]model.RollbackVPN, 0),
+	}
+
+	latest := 0
+	if r, err := ReadLatestRevision(net.Id); err == nil {
+		latest = r.Number
+	}
+
+	changed := make([]*model.VPN, 0)
+	for _, id := range vpns {
+		restored := model.RollbackVPN{Id: id, Revision: first[id].Number - 1}
+
+		vpn, err := rollbackVPN(id, restored.Revision, latest, actor)
+		if vpn != nil {
+			restored.Name = vpn.Name
+		}
+		if err != nil {
+			log.Errorf("rollback of %s: failed to restore vpn %s: %v", net.Id, id, err)
+			restored.Error = err.Error()
+		} else {
+			changed = append(changed, vpn)
+		}
+
+		rollback.VPNs = append(rollback.VPNs, restored)
+	}
+
+	Publish(NetworkPropagated{Net: result, VPNs: changed})
+
+	log.Infof("rollback: %s rolled %s back to revision %d", actor.Name, net.Id, number)
+
+	return rollback, nil
+}
+
+// rollbackVPN restores a VPN's settings to a revision, keeping its keys
+func rollbackVPN(id string, number int, netNumber int, actor Actor) (*model.VPN, error) {
+	vpn, err := ReadVPN(id)
+	if err != nil {
+		return nil, errors.New("the vpn no longer exists")
+	}
+
+	revision, err := ReadRevision(id, number)
+	if err != nil {
+		return vpn, errors.New("the vpn has no earlier revision")
+	}
+	if revision.Current == nil || revision.Default == nil {
+		return vpn, errors.New("not a vpn revision")
+	}
+
+	if address, owner := addressInUse(vpn, revision.Current.Address); owner != "" {
+		return vpn, fmt.Errorf("address %s is now used by %s", address, owner)
+	}
+
+	current := *revision.Current
+	current.PrivateKey = vpn.Current.PrivateKey
+	current.PublicKey = vpn.Current.PublicKey
+	settings := *revision.Default
+	if vpn.Default != nil {
+		settings.PrivateKey = vpn.Default.PrivateKey
+		settings.PublicKey = vpn.Default.PublicKey
+	}
+
+	vpn.Current = &current
+	vpn.Default = &settings
+	vpn.UpdatedBy = actor.Name
+
+	result, err := updateVPN(id, vpn, true, actor, revisionCause{netRevision: netNumber, rollback: number})
+	if err != nil {
+		return vpn, err
+	}
+
+	return result, nil
+}
+
+// addressInUse returns an address and the VPN using it, if another VPN in
+// the network has one of the addresses
+func addressInUse(vpn *model.VPN, addresses []string) (string, string) {
+	vpns, err := ReadVPN2("netid", vpn.NetId)
+	if err != nil {
+		return "", ""
+	}
+
+	for _, address := range addresses {
+		ip := strings.Split(address, "/")[0]
+		for _, v := range vpns {
+			if v.Id == vpn.Id || v.Current == nil {
+				continue
+			}
+			for _, used := range v.Current.Address {
+				if strings.Split(used, "/")[0] == ip {
+					return address, v.Name
+				}
+			}
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,455 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"slices"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	template "github.com/nettica-com/nettica-admin/template"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long canaries are watched unless a rollout says otherwise
+const defaultRolloutWait = 15 * time.Minute
+
+// a device seen this recently is online and can be a canary
+const canaryOnline = 15 * time.Minute
+
+// a rollout left proceeding or rolling back this long was interrupted, and
+// no longer stops changes to its network
+const rolloutStale = 10 * time.Minute
+
+// rolloutActor moves rollouts on when nobody has to
+var rolloutActor = Actor{Name: "rollout", Credential: "none"}
+
+// StartRollout saves a forced update to a network but applies it only to
+// canary VPNs, chosen by plan's tag or percentage from the VPNs whose
+// devices are online.  The rest of the network gets the change once the
+// canaries have stayed healthy; see CheckRollouts.
+func StartRollout(net *model.Network, data *model.Network, plan *model.Rollout, actor Actor) (*model.Rollout, error) {
+	if !data.ForceUpdate {
+		return nil, errors.New("only a forced update can be rolled out")
+	}
+	if plan.Tag == "" && (plan.Percent <= 0 || plan.Percent > 100) {
+		return nil, errors.New("choose canaries by tag or a percentage from 1 to 100")
+	}
+
+	wait := defaultRolloutWait
+	if plan.Wait != "" {
+		var err error
+		wait, err = time.ParseDuration(plan.Wait)
+		if err != nil || wait < time.Minute {
+			return nil, errors.New("wait must be a duration of at least 1m")
+		}
+	}
+
+	if _, ok := ActiveRollout(net.Id); ok {
+		return nil, errors.New("a rollout of this network is in progress")
+	}
+	if changeToNet(net, data) == (netChange{}) {
+		return nil, errors.New("the update doesn't change the network's VPNs")
+	}
+
+	canaries, err := chooseCanaries(net.Id, plan)
+	if err != nil {
+		return nil, err
+	}
+	canary := make(map[string]bool)
+	for _, v := range canaries {
+		canary[v.Id] = true
+	}
+
+	result, err := updateNet(net.Id, data, actor, revisionCause{}, func(v *model.VPN) bool {
+		return canary[v.Id]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	revision, err := ReadLatestRevision(net.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	rollout := &model.Rollout{
+		Id:        "rollout-" + id,
+		AccountID: net.AccountID,
+		NetId:     net.Id,
+		Status:    "Canary",
+		Tag:       plan.Tag,
+		Percent:   plan.Percent,
+		Wait:      wait.String(),
+		Auto:      plan.Auto,
+		Revision:  revision.Number,
+		Before:    revision.Number - 1,
+		Canaries:  make([]string, 0),
+		CreatedBy: data.UpdatedBy,
+		UpdatedBy: data.UpdatedBy,
+		Created:   now,
+		Updated:   now,
+		Deadline:  now.Add(wait),
+	}
+	for _, v := range canaries {
+		rollout.Canaries = append(rollout.Canaries, v.Id)
+	}
+
+	err = mongo.InsertRollout(rollout)
+	if err != nil {
+		// without the rollout nothing would finish it, so undo the change
+		if _, rerr := RollbackNet(result, rollout.Before, actor); rerr != nil {
+			log.Errorf("rollout: failed to undo the change to %s: %v", net.Id, rerr)
+		}
+		return nil, err
+	}
+
+	Audit(actor, "rollout", "create", nil, rollout)
+
+	log.Infof("rollout: %s started %s of %s revision %d on %d canaries", rollout.CreatedBy, rollout.Id, net.Id, rollout.Revision, len(rollout.Canaries))
+
+	return rollout, nil
+}
+
+// chooseCanaries picks the VPNs a rollout starts with
+func chooseCanaries(netId string, plan *model.Rollout) ([]*model.VPN, error) {
+	vpns, err := ReadVPN2("netid", netId)
+	if err != nil {
+		return nil, err
+	}
+
+	online := make([]*model.VPN, 0)
+	for _, v := range vpns {
+		if !v.Enable || (plan.Tag != "" && !slices.Contains(v.Tags, plan.Tag)) {
+			continue
+		}
+		device, err := ReadDevice(v.DeviceID)
+		if err != nil || device.LastSeen == nil || time.Since(*device.LastSeen) > canaryOnline {
+			continue
+		}
+		online = append(online, v)
+	}
+
+	if len(online) == 0 {
+		return nil, fmt.Errorf("no canary has checked in within %s", canaryOnline)
+	}
+
+	if plan.Tag != "" {
+		return online, nil
+	}
+
+	// a percentage of the whole network, from the devices that are online
+	n := (len(vpns)*plan.Percent + 99) / 100
+	if n > len(online) {
+		n = len(online)
+	}
+	rand.Shuffle(len(online), func(i, j int) {
+		online[i], online[j] = online[j], online[i]
+	})
+
+	return online[:n], nil
+}
+
+// ReadRollouts of a network, newest first
+func ReadRollouts(netId string) ([]*model.Rollout, error) {
+	return mongo.ReadRollouts(netId)
+}
+
+// ReadRollout by id
+func ReadRollout(id string) (*model.Rollout, error) {
+	return mongo.ReadRollout(id)
+}
+
+// ActiveRollout returns the rollout in progress on a network, if there is one
+func ActiveRollout(netId string) (*model.Rollout, bool) {
+	rollouts, err := mongo.ReadRollouts(netId, "Canary", "Ready", "Proceeding", "Rolling Back")
+	if err != nil {
+		log.Error(err)
+		return nil, false
+	}
+
+	for _, r := range rollouts {
+		if (r.Status == "Proceeding" || r.Status == "Rolling Back") && time.Since(r.Updated) > rolloutStale {
+			continue
+		}
+		return r, true
+	}
+	return nil, false
+}
+
+// CheckRollouts moves rollouts on.  Their canaries are checked every time:
+// one that stops checking in, or doesn't have a handshake once it has the
+// change, rolls the rollout back.  Once the canaries have all had the change
+// and a handshake with it, and the rollout's wait is over, it proceeds or
+// waits to be approved.
+func CheckRollouts() {
+	rollouts, err := mongo.ReadRollouts("", "Canary", "Ready")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for _, rollout := range rollouts {
+		checkRollout(rollout)
+	}
+}
+
+func checkRollout(rollout *model.Rollout) {
+	now := time.Now().UTC()
+	wait, err := time.ParseDuration(rollout.Wait)
+	if err != nil {
+		wait = defaultRolloutWait
+	}
+
+	problem, confirmed := checkCanaries(rollout, now)
+	if problem != "" {
+		err = AbortRollout(rollout, rolloutActor, problem)
+		if err != nil {
+			log.Errorf("rollout: failed to roll back %s: %v", rollout.Id, err)
+		}
+		return
+	}
+
+	if rollout.Status != "Canary" || now.Before(rollout.Deadline) || !confirmed {
+		return
+	}
+
+	if rollout.Auto {
+		err = ProceedRollout(rollout, rolloutActor)
+		if err != nil {
+			log.Errorf("rollout: failed to proceed with %s: %v", rollout.Id, err)
+		}
+		return
+	}
+
+	ok, err := mongo.UpdateRolloutStatus(rollout.Id, "Canary", "Ready", "", rolloutActor.Name)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if ok {
+		auditRollout(rolloutActor, rollout)
+		rolloutEmail(rollout, "is ready", fmt.Sprintf("The canaries have been healthy for %s.  Approve the rollout to apply the change to the rest of the network.", wait))
+	}
+}
+
+// checkCanaries says why a canary of the rollout isn't healthy, or returns
+// "" and whether every canary has had a handshake with the change.  A canary
+// must check in every canaryOnline, and within canaryOnline of getting the
+// change have a handshake with it, if its device reports handshakes.
+// Canaries that were deleted are ignored.
+func checkCanaries(rollout *model.Rollout, now time.Time) (string, bool) {
+	confirmed := true
+
+	for _, id := range rollout.Canaries {
+		vpn, err := ReadVPN(id)
+		if err != nil {
+			continue
+		}
+		device, err := ReadDevice(vpn.DeviceID)
+		if err != nil {
+			continue
+		}
+
+		if device.LastSeen == nil || now.Sub(*device.LastSeen) > canaryOnline {
+			return fmt.Sprintf("%s hasn't checked in for %s", device.Name, canaryOnline), false
+		}
+
+		// a device gets its configuration when it checks in, so once it's
+		// been seen since the rollout started, and since its VPN was last
+		// changed, it has the change.  Changes passed on from the network
+		// don't set the VPN's Updated.
+		changed := rollout.Created
+		if vpn.Updated != nil && vpn.Updated.After(changed) {
+			changed = *vpn.Updated
+		}
+		fetched, ok := rollout.Fetched[id]
+		if !ok {
+			if !device.LastSeen.After(changed) {
+				confirmed = false
+				continue
+			}
+			fetched = device.LastSeen.UTC()
+			if rollout.Fetched == nil {
+				rollout.Fetched = make(map[string]time.Time)
+			}
+			rollout.Fetched[id] = fetched
+			err = mongo.SetRolloutFetched(rollout.Id, id, fetched)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+
+		// devices that don't report handshakes are judged by their check-ins
+		handshake, err := mongo.ReadHandshake(id)
+		if err != nil {
+			continue
+		}
+		if handshake.Reported.After(fetched) && handshake.Latest.After(fetched) {
+			continue
+		}
+		if now.Sub(fetched) > canaryOnline {
+			return fmt.Sprintf("%s hasn't had a handshake on %s since it got the change at %s", device.Name, vpn.NetName, fetched.Format(time.RFC1123)), false
+		}
+		confirmed = false
+	}
+
+	return "", confirmed
+}
+
+// ProceedRollout applies a rollout's change to the rest of its network.  A
+// rollout of a critical network was approved when it started, so it goes on
+// without another change request.
+func ProceedRollout(rollout *model.Rollout, actor Actor) error {
+	by := actor.Name
+	actor.Approval = rollout.Id
+	ok, err := mongo.UpdateRolloutStatus(rollout.Id, rollout.Status, "Proceeding", "", by)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the rollout has already moved on")
+	}
+	defer auditRollout(actor, rollout)
+
+	net, err := ReadNet(rollout.NetId)
+	if err != nil {
+		return err
+	}
+	revision, err := ReadRevision(net.Id, rollout.Before)
+	if err != nil {
+		return err
+	}
+
+	before := *net
+	settings := *revision.Default
+	before.Default = &settings
+	after := *net
+	after.ForceUpdate = true
+
+	err = propagateNetChange(&before, &after, func(v *model.VPN) bool {
+		return !slices.Contains(rollout.Canaries, v.Id)
+	}, actor)
+	if err != nil {
+		return err
+	}
+
+	_, err = mongo.UpdateRolloutStatus(rollout.Id, "Proceeding", "Complete", "", by)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("rollout: %s completed %s of %s", by, rollout.Id, rollout.NetId)
+
+	return nil
+}
+
+// AbortRollout rolls a rollout's network and canaries back, without a change
+// request if the network is critical.  The reason is the actor's too, unless
+// they gave one.
+func AbortRollout(rollout *model.Rollout, actor Actor, reason string) error {
+	by := actor.Name
+	actor.Approval = rollout.Id
+	if actor.Reason == "" {
+		actor.Reason = reason
+	}
+
+	ok, err := mongo.UpdateRolloutStatus(rollout.Id, rollout.Status, "Rolling Back", reason, by)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("the rollout has already moved on")
+	}
+	defer auditRollout(actor, rollout)
+
+	net, err := ReadNet(rollout.NetId)
+	if err != nil {
+		return err
+	}
+
+	status := "Rolled Back"
+	_, err = RollbackNet(net, rollout.Before, actor)
+	if err != nil {
+		status = "Failed"
+		reason = reason + ", and the rollback failed: " + err.Error()
+	}
+
+	_, uerr := mongo.UpdateRolloutStatus(rollout.Id, "Rolling Back", status, reason, by)
+	if uerr != nil {
+		log.Error(uerr)
+	}
+
+	log.Infof("rollout: %s rolled back %s of %s: %s", by, rollout.Id, rollout.NetId, reason)
+
+	rolloutEmail(rollout, "was rolled back", reason+".")
+
+	return err
+}
+
+// auditRollout records how a rollout moved on from where it was
+func auditRollout(actor Actor, before *model.Rollout) {
+	after, err := mongo.ReadRollout(before.Id)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	Audit(actor, "rollout", "update", before, after)
+}
+
+// ReportHandshakes records the latest handshakes a device reported for its
+// VPNs.  Handshakes for VPNs of other devices are ignored.
+func ReportHandshakes(device *model.Device, handshakes []*model.Handshake) error {
+	vpns, err := ReadVPN2("deviceid", device.Id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, h := range handshakes {
+		if !slices.ContainsFunc(vpns, func(v *model.VPN) bool { return v.Id == h.Id }) {
+			continue
+		}
+		h.DeviceID = device.Id
+		h.Latest = h.Latest.UTC()
+		h.Reported = now
+
+		err = mongo.SetHandshake(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rolloutEmail tells whoever started a rollout what happened to it
+func rolloutEmail(rollout *model.Rollout, what string, message string) {
+	net, err := ReadNet(rollout.NetId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	title := "The rollout to " + net.NetName + " " + what
+	body, err := template.NotifyEmail(title, message, os.Getenv("SERVER"), "Open Nettica")
+	if err == nil {
+		err = SendEmail(rollout.CreatedBy, title, body)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("failed to email %s about rollout %s", rollout.CreatedBy, rollout.Id)
+	}
+}
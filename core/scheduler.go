@@ -0,0 +1,159 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long a replica holds a job it's running.  If it dies mid-run another
+// replica can run the job once this has passed.
+const jobLease = 10 * time.Minute
+
+// how often each replica looks for jobs that are due
+const jobTick = 10 * time.Second
+
+// ErrJobRunning is returned when a job can't be run because it's running
+var ErrJobRunning = errors.New("the job is already running")
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+// the background jobs, run by one replica at a time
+var jobs = []*job{
+	{"expire-subscriptions", 15 * time.Minute, ExpireSubscriptions},
+	{"reclaim-credits", time.Hour, ReclaimCredits},
+	{"prune-refresh-tokens", 6 * time.Hour, PruneRefreshTokens},
+	{"rollouts", time.Minute, func() error { CheckRollouts(); return nil }},
+	{"change-requests", time.Hour, func() error { ExpireChangeRequests(); return nil }},
+	{"webhooks", 30 * time.Second, func() error {
+		CheckDeliveries()
+		checkOfflineDevices()
+		return nil
+	}},
+}
+
+var (
+	jobOwner   = replicaName()
+	jobsMu     sync.Mutex
+	jobRunning = make(map[string]bool)
+)
+
+// replicaName names this replica in the jobs it runs
+func replicaName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "nettica-api"
+	}
+	id, _ := util.RandomString(8)
+	return host + "-" + id
+}
+
+// RunScheduler runs the background jobs.  Every replica runs the scheduler,
+// and when a job is due whichever replica takes its lease in the database
+// first runs it.
+func RunScheduler() {
+	now := time.Now().UTC()
+	for _, j := range jobs {
+		err := mongo.InitJob(&model.Job{
+			Id:       j.name,
+			Interval: j.interval.String(),
+			NextRun:  now,
+		})
+		if err != nil {
+			log.Errorf("scheduler: failed to record job %s: %v", j.name, err)
+		}
+	}
+
+	for range time.Tick(jobTick) {
+		for _, j := range jobs {
+			_, err := startJob(j, false)
+			if err != nil {
+				log.Errorf("scheduler: failed to start job %s: %v", j.name, err)
+			}
+		}
+	}
+}
+
+// RunJob runs a job now, whether it's due or not, unless it's running
+func RunJob(name string) error {
+	for _, j := range jobs {
+		if j.name != name {
+			continue
+		}
+		ok, err := startJob(j, true)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrJobRunning
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown job %s", name)
+}
+
+// startJob takes the lease on a job and runs it.  It returns false if the
+// job isn't due, or is being run here or by another replica.
+func startJob(j *job, force bool) (bool, error) {
+	jobsMu.Lock()
+	if jobRunning[j.name] {
+		jobsMu.Unlock()
+		return false, nil
+	}
+	jobRunning[j.name] = true
+	jobsMu.Unlock()
+
+	now := time.Now().UTC()
+	ok, err := mongo.ClaimJob(j.name, jobOwner, now, now.Add(jobLease), force)
+	if err != nil || !ok {
+		jobsMu.Lock()
+		delete(jobRunning, j.name)
+		jobsMu.Unlock()
+		return false, err
+	}
+
+	go runJob(j, now)
+
+	return true, nil
+}
+
+// runJob runs a job this replica holds the lease on and records how it went
+func runJob(j *job, started time.Time) {
+	defer func() {
+		jobsMu.Lock()
+		delete(jobRunning, j.name)
+		jobsMu.Unlock()
+	}()
+
+	err := func() (err error) {
+		defer func() {
+			if rcvr := recover(); rcvr != nil {
+				err = fmt.Errorf("%v", rcvr)
+			}
+		}()
+		return j.run()
+	}()
+	if err != nil {
+		log.Errorf("scheduler: job %s failed: %v", j.name, err)
+	}
+
+	finished := time.Now().UTC()
+	ok, ferr := mongo.FinishJob(j.name, jobOwner, finished, started.Add(j.interval), err)
+	if ferr != nil {
+		log.Errorf("scheduler: failed to record job %s: %v", j.name, ferr)
+	} else if !ok {
+		log.Errorf("scheduler: job %s ran past its lease of %s", j.name, jobLease)
+	}
+}
@@ -25,7 +25,7 @@ var (
 )
 
 // CreateService service with all necessary data
-func CreateService(service *model.Service) (*model.Service, error) {
+func CreateService(service *model.Service, actor Actor) (*model.Service, error) {
 
 	// lock the function so only one service can be created at a time
 	CreateLock.Lock()
@@ -115,7 +115,7 @@ func CreateService(service *model.Service) (*model.Service, error) {
 			net.Default.EnableDns = false
 			net.Default.UPnP = false
 
-			service.Net, err = CreateNet(&net)
+			service.Net, err = CreateNet(&net, actor)
 			if err != nil {
 				return nil, err
 			}
@@ -154,7 +154,7 @@ func CreateService(service *model.Service) (*model.Service, error) {
 		}
 
 		// Create the device
-		service.Device, err = CreateDevice(service.Device)
+		service.Device, err = CreateDevice(service.Device, actor)
 		if err != nil {
 			return nil, err
 		}
@@ -232,7 +232,7 @@ func CreateService(service *model.Service) (*model.Service, error) {
 
 		}
 
-		service.VPN, err = CreateVPN(&vpn)
+		service.VPN, err = CreateVPN(&vpn, actor)
 		if err != nil {
 			return nil, err
 		}
@@ -258,6 +258,8 @@ func CreateService(service *model.Service) (*model.Service, error) {
 	}
 	service = v.(*model.Service)
 
+	Audit(actor, "service", "create", nil, service)
+
 	// return the service
 	return service, nil
 }
@@ -274,7 +276,7 @@ func ReadService(id string) (*model.Service, error) {
 }
 
 // UpdateService preserve keys
-func UpdateService(Id string, service *model.Service) (*model.Service, error) {
+func UpdateService(Id string, service *model.Service, actor Actor) (*model.Service, error) {
 	v, err := mongo.Deserialize(Id, "id", "services", reflect.TypeOf(model.Service{}))
 	if err != nil {
 		return nil, err
@@ -322,12 +324,14 @@ func UpdateService(Id string, service *model.Service) (*model.Service, error) {
 	}
 	service = v.(*model.Service)
 
+	Audit(actor, "service", "update", current, service)
+
 	// data modified, dump new config
 	return service, nil
 }
 
 // DeleteService from database
-func DeleteService(id string) error {
+func DeleteService(id string, actor Actor) error {
 
 	if id == "" {
 		return errors.New("id is empty")
@@ -343,7 +347,7 @@ func DeleteService(id string) error {
 
 	if service.VPN.Id != "" {
 		if service.Server == "" {
-			err = DeleteVPN(service.VPN.Id)
+			err = DeleteVPN(service.VPN.Id, actor)
 			if err != nil {
 				log.Errorf("failed to delete vpn %s (%s)", service.VPN.Id, service.VPN.Name)
 				return err
@@ -365,7 +369,7 @@ func DeleteService(id string) error {
 			return err
 		}
 		if len(vpns) == 0 {
-			err = DeleteNet(service.Net.Id)
+			err = DeleteNet(service.Net.Id, actor)
 			if err != nil {
 				log.Errorf("failed to delete net %s (%s)", service.Net.Id, service.Net.NetName)
 				return err
@@ -375,7 +379,7 @@ func DeleteService(id string) error {
 
 	if service.Device.Id != "" {
 		if service.Server == "" {
-			err = DeleteDevice(service.Device.Id)
+			err = DeleteDevice(service.Device.Id, actor)
 			if err != nil {
 				log.Errorf("failed to delete device %s (%s)", service.Device.Id, service.Device.Name)
 				return err
@@ -394,6 +398,8 @@ func DeleteService(id string) error {
 		return err
 	}
 
+	Audit(actor, "service", "delete", service, nil)
+
 	return nil
 }
 
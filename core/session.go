@@ -0,0 +1,565 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionAudience is the audience of every session token the server issues
+const SessionAudience = "nettica-api"
+
+// ErrSessionRevoked is returned for a session that was logged out
+var ErrSessionRevoked = errors.New("session has been revoked")
+
+// ErrInvalidRefreshToken is returned for a refresh token that is unknown,
+// expired, revoked or already used
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// SessionClaims are the claims of a server issued session token.  They carry
+// what the provider said about the user at login, so a token can be checked
+// by any replica without asking the provider again.
+type SessionClaims struct {
+	Email     string `json:"email"`
+	Name      string `json:"name,omitempty"`
+	Picture   string `json:"picture,omitempty"`
+	AccountID string `json:"accountid,omitempty"`
+	Provider  string `json:"provider,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// the signing keys loaded from the database, newest first
+var (
+	sessionKeys       []*sessionKey
+	sessionKeysLoaded time.Time
+	sessionKeysMutex  sync.Mutex
+)
+
+type sessionKey struct {
+	id      string
+	key     *rsa.PrivateKey
+	created time.Time
+}
+
+// how often the keys are reloaded, which is how long a key made by another
+// replica can go unnoticed
+const sessionKeysRefresh = time.Minute
+
+// SessionsEnabled is true unless SESSION_TOKENS is false, in which case the
+// provider's own token is handed to the client as before
+func SessionsEnabled() bool {
+	return os.Getenv("SESSION_TOKENS") != "false"
+}
+
+func sessionDuration(key string, def time.Duration) time.Duration {
+	if os.Getenv(key) != "" {
+		d, err := time.ParseDuration(os.Getenv(key))
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Errorf("%s is not a valid duration, using %s", key, def)
+	}
+	return def
+}
+
+// SessionLifetime is how long a session token is valid
+func SessionLifetime() time.Duration {
+	return sessionDuration("SESSION_LIFETIME", 24*time.Hour)
+}
+
+// how long a session can go without being refreshed
+func sessionRefreshLifetime() time.Duration {
+	return sessionDuration("SESSION_REFRESH_LIFETIME", 30*24*time.Hour)
+}
+
+// how long a key signs new tokens before the next one takes over
+func sessionKeyRotation() time.Duration {
+	return sessionDuration("SESSION_KEY_ROTATION", 7*24*time.Hour)
+}
+
+func sessionIssuer() string {
+	return os.Getenv("SERVER")
+}
+
+// loadSessionKeys reads the keys from the database when they are stale or force is set
+func loadSessionKeys(force bool) ([]*sessionKey, error) {
+	sessionKeysMutex.Lock()
+	defer sessionKeysMutex.Unlock()
+
+	// even when forced, don't let a flood of unknown key ids hammer the database
+	age := time.Since(sessionKeysLoaded)
+	if age < sessionKeysRefresh && (!force || age < 5*time.Second) {
+		return sessionKeys, nil
+	}
+
+	records, err := mongo.ReadSigningKeys()
+	if err != nil {
+		return sessionKeys, err
+	}
+
+	keys := make([]*sessionKey, 0, len(records))
+	for _, r := range records {
+		block, _ := pem.Decode([]byte(r.PrivateKey))
+		if block == nil {
+			log.Errorf("signing key %s is corrupt", r.Id)
+			continue
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			log.Errorf("signing key %s is corrupt: %v", r.Id, err)
+			continue
+		}
+		keys = append(keys, &sessionKey{id: r.Id, key: key, created: r.Created})
+	}
+
+	// newest first, so the first key is the one to sign with
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].created.After(keys[j].created)
+	})
+
+	sessionKeys = keys
+	sessionKeysLoaded = time.Now()
+
+	return sessionKeys, nil
+}
+
+// signingKey returns the current signing key, making a new one when the
+// newest is older than SESSION_KEY_ROTATION
+func signingKey() (*sessionKey, error) {
+	keys, err := loadSessionKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 && time.Since(keys[0].created) < sessionKeyRotation() {
+		return keys[0], nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	kid, err := util.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	record := &model.SigningKey{
+		Id:         kid,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		Created:    now,
+		// keep the key until the last token it signs has expired
+		Expires: now.Add(sessionKeyRotation() + SessionLifetime()),
+	}
+
+	err = mongo.InsertSigningKey(record)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Session signing key %s created", kid)
+
+	// reload, so replicas that rotated at the same moment settle on the newest key
+	sessionKeysMutex.Lock()
+	sessionKeysLoaded = time.Time{}
+	sessionKeysMutex.Unlock()
+
+	keys, err = loadSessionKeys(false)
+	if err != nil || len(keys) == 0 {
+		return &sessionKey{id: kid, key: key, created: now}, nil
+	}
+
+	return keys[0], nil
+}
+
+// IssueSession starts a session for a user who logged in with the named
+// provider.  It returns the session token and the refresh token that renews it.
+func IssueSession(user *model.User, provider string, device string, ip string) (string, string, error) {
+	if user == nil || user.Email == "" {
+		return "", "", errors.New("a session needs a user with an email")
+	}
+
+	id, err := util.RandomString(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	rt := &model.RefreshToken{
+		Id:        "session-" + id,
+		Sub:       user.Sub,
+		Email:     user.Email,
+		Name:      user.Name,
+		Picture:   user.Picture,
+		AccountID: user.AccountID,
+		Provider:  provider,
+		Device:    device,
+		IP:        ip,
+		Created:   time.Now().UTC(),
+	}
+
+	refresh, err := storeRefreshToken(rt)
+	if err != nil {
+		return "", "", err
+	}
+
+	raw, err := signSession(rt)
+	if err != nil {
+		return "", "", err
+	}
+
+	return raw, refresh, nil
+}
+
+// RefreshSession exchanges a refresh token for a new session token and a new
+// refresh token.  A refresh token can only be used once; using one again means
+// it was stolen, and the whole session is revoked.
+func RefreshSession(refresh string, device string, ip string) (string, string, error) {
+	hash := refreshTokenHash(refresh)
+
+	rt, err := mongo.GetRefreshToken(hash)
+	if err != nil || rt.Id == "" || rt.Revoked || time.Now().After(rt.ExpiresAt) {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	err = sessionUserActive(rt)
+	if err != nil {
+		log.Infof("SECURITY: session %s of %s not refreshed: %v", rt.Id, rt.Email, err)
+		err = revokeSessionChain(rt.Email, rt.Id)
+		if err != nil {
+			log.Errorf("failed to revoke session %s: %v", rt.Id, err)
+		}
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	now := time.Now().UTC()
+	ok, err := mongo.RotateRefreshToken(hash, now)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		log.Errorf("SECURITY ALERT: refresh token of %s for %s was reused, session revoked", rt.Id, rt.Email)
+		err = revokeSessionChain(rt.Email, rt.Id)
+		if err != nil {
+			log.Errorf("failed to revoke session %s: %v", rt.Id, err)
+		}
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	next := *rt
+	next.LastUsed = &now
+	next.Rotated = false
+	if device != "" {
+		next.Device = device
+	}
+	if ip != "" {
+		next.IP = ip
+	}
+
+	refresh, err = storeRefreshToken(&next)
+	if err != nil {
+		return "", "", err
+	}
+
+	raw, err := signSession(&next)
+	if err != nil {
+		return "", "", err
+	}
+
+	return raw, refresh, nil
+}
+
+// sessionUserActive returns an error if the user of a session has been
+// suspended since it started: a local user who is no longer active, or a
+// user whose memberships are all suspended
+func sessionUserActive(rt *model.RefreshToken) error {
+	if rt.Provider == "local" {
+		user, err := mongo.ReadLocalUser(rt.Email)
+		if err != nil {
+			return errors.New("the local user no longer exists")
+		}
+		if user.Status != "Active" {
+			return errors.New("the local user is suspended")
+		}
+	}
+
+	accounts, err := ReadAllAccounts(rt.Email)
+	if err != nil {
+		return err
+	}
+	for _, a := range accounts {
+		if a.Status != "Suspended" {
+			return nil
+		}
+	}
+	if len(accounts) > 0 {
+		return errors.New("every account of the user is suspended")
+	}
+
+	return nil
+}
+
+// ReadSessions lists the active sessions of a user
+func ReadSessions(email string) ([]*model.RefreshToken, error) {
+	return mongo.ReadSessions(email)
+}
+
+// DeleteSession logs out one of the user's sessions
+func DeleteSession(email string, id string) error {
+	sessions, err := mongo.ReadSessions(email)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		if s.Id == id {
+			log.Infof("Session %s (%s) revoked for %s", s.Id, s.Device, email)
+			return revokeSessionChain(email, id)
+		}
+	}
+
+	return errors.New("session not found")
+}
+
+// revokeSessionChain revokes the refresh tokens of a session and the session
+// tokens they issued
+func revokeSessionChain(email string, id string) error {
+	err := mongo.RevokeRefreshTokens(id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	return mongo.UpsertRevokedSession(&model.RevokedSession{
+		Id:      "sid:" + id,
+		Email:   email,
+		Revoked: now,
+		Expires: now.Add(SessionLifetime()),
+	})
+}
+
+// PruneRefreshTokens removes the refresh tokens that have expired
+func PruneRefreshTokens() error {
+	n, err := mongo.DeleteExpiredRefreshTokens(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("pruned %d expired refresh tokens", n)
+	}
+	return nil
+}
+
+func refreshTokenHash(refresh string) string {
+	h := sha256.Sum256([]byte(refresh))
+	return hex.EncodeToString(h[:])
+}
+
+// storeRefreshToken makes a new refresh token for the session and stores its hash
+func storeRefreshToken(rt *model.RefreshToken) (string, error) {
+	refresh, err := util.RandomString(48)
+	if err != nil {
+		return "", err
+	}
+
+	rt.Token = refreshTokenHash(refresh)
+	rt.IssuedAt = time.Now().UTC()
+	rt.ExpiresAt = rt.IssuedAt.Add(sessionRefreshLifetime())
+
+	err = mongo.InsertRefreshToken(rt)
+	if err != nil {
+		return "", err
+	}
+
+	return refresh, nil
+}
+
+// signSession signs a session token for the user a refresh token belongs to
+func signSession(rt *model.RefreshToken) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	jti, err := util.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &SessionClaims{
+		Email:     rt.Email,
+		Name:      rt.Name,
+		Picture:   rt.Picture,
+		AccountID: rt.AccountID,
+		Provider:  rt.Provider,
+		SessionID: rt.Id,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    sessionIssuer(),
+			Subject:   rt.Email,
+			Audience:  jwt.ClaimStrings{SessionAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(SessionLifetime())),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+
+	return token.SignedString(key.key)
+}
+
+// VerifySession checks the signature, lifetime and audience of a session
+// token and that it has not been revoked
+func VerifySession(raw string) (*SessionClaims, error) {
+	claims := &SessionClaims{}
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("session token has no key id")
+		}
+
+		keys, err := loadSessionKeys(false)
+		if err != nil {
+			return nil, err
+		}
+		if k := findSessionKey(keys, kid); k != nil {
+			return &k.key.PublicKey, nil
+		}
+
+		// another replica may have rotated the key
+		keys, err = loadSessionKeys(true)
+		if err != nil {
+			return nil, err
+		}
+		if k := findSessionKey(keys, kid); k != nil {
+			return &k.key.PublicKey, nil
+		}
+
+		return nil, errors.New("session token signed with an unknown key")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !claims.VerifyIssuer(sessionIssuer(), true) || !claims.VerifyAudience(SessionAudience, true) {
+		return nil, errors.New("session token was not issued by this server")
+	}
+	if claims.ID == "" || claims.Email == "" || claims.IssuedAt == nil {
+		return nil, errors.New("session token is missing claims")
+	}
+
+	ids := []string{claims.ID, "user:" + claims.Email}
+	if claims.SessionID != "" {
+		ids = append(ids, "sid:"+claims.SessionID)
+	}
+
+	revoked, err := mongo.ReadRevokedSessions(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revoked {
+		// revoking a user only revokes the sessions issued until then
+		if r.Id != "user:"+claims.Email || !claims.IssuedAt.Time.After(r.Revoked) {
+			return nil, ErrSessionRevoked
+		}
+	}
+
+	return claims, nil
+}
+
+func findSessionKey(keys []*sessionKey, kid string) *sessionKey {
+	for _, k := range keys {
+		if k.id == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// RevokeSession logs out a session token.  The token goes on the denylist
+// until it would have expired and the session it belongs to can no longer
+// be refreshed.
+func RevokeSession(claims *SessionClaims) error {
+	if claims.SessionID != "" {
+		err := revokeSessionChain(claims.Email, claims.SessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	expires := time.Now().Add(SessionLifetime())
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Time
+	}
+
+	return mongo.UpsertRevokedSession(&model.RevokedSession{
+		Id:      claims.ID,
+		Email:   claims.Email,
+		Revoked: time.Now().UTC(),
+		Expires: expires.UTC(),
+	})
+}
+
+// RevokeUserSessions revokes every session of a user issued until now
+func RevokeUserSessions(email string) error {
+	// token times are in whole seconds, so a session issued this second is revoked too
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err := mongo.RevokeUserRefreshTokens(email)
+	if err != nil {
+		return err
+	}
+
+	return mongo.UpsertRevokedSession(&model.RevokedSession{
+		Id:      "user:" + email,
+		Email:   email,
+		Revoked: now,
+		Expires: now.Add(SessionLifetime()),
+	})
+}
+
+// SessionJWKS returns the public signing keys as a JSON Web Key Set so other
+// services can verify session tokens
+func SessionJWKS() (map[string]interface{}, error) {
+	keys, err := loadSessionKeys(false)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		pub := &k.key.PublicKey
+		jwks = append(jwks, map[string]interface{}{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"kid": k.id,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	return map[string]interface{}{"keys": jwks}, nil
+}
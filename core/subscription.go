@@ -331,6 +331,7 @@ func ExpireSubscription(id string) error {
 		return errors.New("subscription has not expired")
 	}
 
+	before := *subscription
 	if subscription.Status != "cancelled" {
 		subscription.Status = "expired"
 		subscription.LastUpdated = subscription.Expires
@@ -339,9 +340,11 @@ func ExpireSubscription(id string) error {
 		last := time.Now().UTC()
 		subscription.LastUpdated = &last
 	}
-	_, err = UpdateSubscription(subscription.Id, subscription)
+	result, err := UpdateSubscription(subscription.Id, subscription)
 	if err != nil {
 		log.Errorf("failed to update subscription: %v", err)
+	} else {
+		Audit(SystemActor, "subscription", "update", &before, result)
 	}
 
 	// get the total number of credits available
@@ -383,7 +386,8 @@ func ExpireSubscription(id string) error {
 			device, err := ReadDevice(service.Device.Id)
 			if err == nil {
 				device.Enable = false
-				_, err = UpdateDevice(device.Id, device, false)
+				// a lock doesn't keep a service running past its subscription
+				_, err = updateDevice(device.Id, device, false, false, SystemActor)
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
@@ -402,6 +406,102 @@ func ExpireSubscription(id string) error {
 	return nil
 }
 
+// ExpireSubscriptions expires the active subscriptions past their expiry.
+// Trials expire straight away, and paid subscriptions are given
+// SUBSCRIPTION_GRACE, 24h by default, for a renewal from the store to arrive.
+func ExpireSubscriptions() error {
+	subscriptions, err := mongo.ReadExpiredSubscriptions(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	grace := sessionDuration("SUBSCRIPTION_GRACE", 24*time.Hour)
+
+	for _, subscription := range subscriptions {
+		if subscription.Issued != nil && subscription.Expires.Before(*subscription.Issued) {
+			continue
+		}
+		if subscription.Sku != "trial" && time.Since(*subscription.Expires) < grace {
+			continue
+		}
+
+		log.Infof("expiring subscription %s of %s", subscription.Id, subscription.AccountID)
+		err = ExpireSubscription(subscription.Id)
+		if err != nil {
+			log.Errorf("failed to expire subscription %s: %v", subscription.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// ReclaimCredits turns off the services of accounts running more of them
+// than their subscriptions have credits for, the newest first.  A
+// subscription's credits count until it expires, even once it's cancelled,
+// and one past its expiry counts until ExpireSubscriptions expires it.
+// Accounts that have never had a subscription aren't billed and are left
+// alone.
+func ReclaimCredits() error {
+	services, err := mongo.ReadAllServices("")
+	if err != nil {
+		return err
+	}
+
+	accounts := make(map[string][]*model.Service)
+	for _, service := range services {
+		if service.Device != nil {
+			accounts[service.AccountID] = append(accounts[service.AccountID], service)
+		}
+	}
+
+	for accountId, services := range accounts {
+		subscriptions, err := mongo.ReadAllSubscriptions(accountId)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if len(subscriptions) == 0 {
+			continue
+		}
+
+		now := time.Now().UTC()
+		credits := 0
+		for _, s := range subscriptions {
+			if s.Status == "active" || (s.Expires != nil && s.Expires.After(now)) {
+				credits += s.Credits
+			}
+		}
+
+		sort.Slice(services, func(i, j int) bool {
+			return services[i].Created.Before(services[j].Created)
+		})
+
+		running := make([]*model.Device, 0)
+		for _, service := range services {
+			device, err := ReadDevice(service.Device.Id)
+			if err == nil && device.Enable {
+				running = append(running, device)
+			}
+		}
+
+		for i := credits; i < len(running); i++ {
+			device := running[i]
+			device.Enable = false
+			// a lock doesn't keep a service running past its subscription
+			_, err = updateDevice(device.Id, device, false, false, SystemActor)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("failed to update device")
+				continue
+			}
+			log.Infof("reclaim: turned off %s, %s has %d credits for %d services", device.Id, accountId, credits, len(running))
+		}
+	}
+
+	return nil
+}
+
 func CancelSubscription(id string) error {
 
 	subscription, err := ReadSubscription(id)
@@ -413,13 +513,15 @@ func CancelSubscription(id string) error {
 		return errors.New("subscription is already cancelled")
 	}
 
+	before := *subscription
 	subscription.Status = "cancelled"
 	last := time.Now().UTC()
 	subscription.LastUpdated = &last
-	_, err = UpdateSubscription(subscription.Id, subscription)
+	result, err := UpdateSubscription(subscription.Id, subscription)
 	if err != nil {
 		return err
 	}
+	Audit(SystemActor, "subscription", "update", &before, result)
 
 	err = ExpireSubscription(subscription.Id)
 
@@ -438,15 +540,17 @@ func RenewSubscription(id string) error {
 		return nil
 	}
 
+	before := *subscription
 	last := time.Now().UTC()
 	subscription.Status = "active"
 	subscription.LastUpdated = &last
 	isDeleted := false
 	subscription.IsDeleted = &isDeleted
-	_, err = UpdateSubscription(subscription.Id, subscription)
+	result, err := UpdateSubscription(subscription.Id, subscription)
 	if err != nil {
 		return err
 	}
+	Audit(SystemActor, "subscription", "update", &before, result)
 
 	// reactivate some services
 	subscriptions, err := ReadSubscriptions(subscription.AccountID)
@@ -476,7 +580,7 @@ func RenewSubscription(id string) error {
 			device, err := ReadDevice(service.Device.Id)
 			if err == nil {
 				device.Enable = true
-				_, err = UpdateDevice(device.Id, device, false)
+				_, err = updateDevice(device.Id, device, false, false, SystemActor)
 				if err != nil {
 					log.WithFields(log.Fields{
 						"err": err,
@@ -0,0 +1,295 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// transfers that are not accepted within a week expire
+const transferLifetime = 7 * 24 * time.Hour
+
+// CreateTransfer starts handing the parent account owner to another member.
+// Any earlier pending transfer for the account is cancelled.
+func CreateTransfer(owner *model.Account, toAccountID string) (*model.Transfer, error) {
+
+	if owner.Id != owner.Parent {
+		return nil, errors.New("only the account owner can transfer the account")
+	}
+
+	member, err := ReadAccount(toAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if member.Parent != owner.Parent || member.Id == owner.Id {
+		return nil, errors.New("recipient is not a member of this account")
+	}
+
+	if member.Status != "Active" {
+		return nil, errors.New("recipient must be an active member")
+	}
+
+	if member.Email == owner.Email {
+		return nil, errors.New("recipient already owns this account")
+	}
+
+	transfers, err := mongo.ReadAllTransfers(owner.Parent)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range transfers {
+		if t.Status == "Pending" {
+			t.Status = "Cancelled"
+			t.UpdatedBy = owner.Email
+			t.Updated = time.Now().UTC()
+			err = mongo.Serialize(t.Id, "id", "transfers", t)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := &model.Transfer{
+		Id:          "transfer-" + id,
+		AccountID:   owner.Parent,
+		FromEmail:   owner.Email,
+		ToEmail:     member.Email,
+		ToAccountID: member.Id,
+		Status:      "Pending",
+		CreatedBy:   owner.Email,
+		UpdatedBy:   owner.Email,
+		Created:     time.Now().UTC(),
+	}
+	transfer.Updated = transfer.Created
+	transfer.Expires = transfer.Created.Add(transferLifetime)
+
+	errs := transfer.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("transfer validation error")
+		}
+		return nil, errors.New("failed to validate transfer")
+	}
+
+	err = mongo.Serialize(transfer.Id, "id", "transfers", transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Transfer %s of account %s from %s to %s started", transfer.Id, transfer.AccountID, transfer.FromEmail, transfer.ToEmail)
+
+	return ReadTransfer(transfer.Id)
+}
+
+// ReadTransfer by id
+func ReadTransfer(id string) (*model.Transfer, error) {
+	v, err := mongo.Deserialize(id, "id", "transfers", reflect.TypeOf(model.Transfer{}))
+	if err != nil {
+		return nil, err
+	}
+	transfer := v.(*model.Transfer)
+
+	if transfer.Status == "Pending" && time.Now().UTC().After(transfer.Expires) {
+		transfer.Status = "Expired"
+	}
+
+	return transfer, nil
+}
+
+// ReadTransfers for an account
+func ReadTransfers(accountid string) ([]*model.Transfer, error) {
+	transfers, err := mongo.ReadAllTransfers(accountid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, t := range transfers {
+		if t.Status == "Pending" && now.After(t.Expires) {
+			t.Status = "Expired"
+		}
+	}
+
+	return transfers, nil
+}
+
+// AcceptTransfer completes a pending transfer.  The owner record of the account
+// (whose id is the parent every network, device and subscription refers to) takes
+// on the recipient's identity, and the recipient's member record takes on the
+// previous owner's identity as an Admin.  Both API keys are regenerated and the
+// billing contact on the account's subscriptions moves to the new owner.  The
+// recipient accepting it is the actor.
+func AcceptTransfer(id string, actor Actor) (*model.Transfer, error) {
+	email := actor.Name
+
+	transfer, err := ReadTransfer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if transfer.Status != "Pending" {
+		return nil, errors.New("transfer is " + transfer.Status)
+	}
+
+	if transfer.ToEmail != email {
+		return nil, errors.New("transfer is not addressed to " + email)
+	}
+
+	owner, err := ReadAccount(transfer.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := ReadAccount(transfer.ToAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner.Email != transfer.FromEmail || member.Email != transfer.ToEmail || member.Parent != owner.Id {
+		return nil, errors.New("account membership changed since the transfer was started")
+	}
+
+	now := time.Now().UTC()
+	previous := *owner
+	recipient := *member
+
+	owner.Email, member.Email = member.Email, owner.Email
+	owner.Name, member.Name = member.Name, owner.Name
+	owner.Sub, member.Sub = member.Sub, owner.Sub
+	owner.Picture, member.Picture = member.Picture, owner.Picture
+	owner.UserPicture, member.UserPicture = member.UserPicture, owner.UserPicture
+
+	owner.Role = "Owner"
+	member.Role = "Admin"
+
+	// the recipient's restriction to one network isn't handed to the previous owner
+	member.NetId = ""
+
+	for _, a := range []*model.Account{owner, member} {
+		a.ApiKey, err = util.RandomString(32)
+		if err != nil {
+			return nil, err
+		}
+		a.ApiKey = "nettica-api-" + a.ApiKey
+		a.UpdatedBy = email
+		a.Updated = now
+
+		errs := a.IsValid()
+		if len(errs) != 0 {
+			for _, err := range errs {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("account validation error")
+			}
+			return nil, errors.New("failed to validate account")
+		}
+	}
+
+	// the recipient's record is written first, and put back if the owner's
+	// can't be, so the account never has two owners or none
+	err = mongo.Serialize(member.Id, "id", "accounts", member)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mongo.Serialize(owner.Id, "id", "accounts", owner)
+	if err != nil {
+		rerr := mongo.Serialize(recipient.Id, "id", "accounts", &recipient)
+		if rerr != nil {
+			log.Errorf("AcceptTransfer: failed to restore %s after a failed transfer: %v", recipient.Id, rerr)
+		}
+		return nil, err
+	}
+
+	Audit(actor, "account", "update", &previous, owner)
+	Audit(actor, "account", "update", &recipient, member)
+
+	// move the billing contact to the new owner
+	subscriptions, err := mongo.ReadAllSubscriptions(owner.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("failed to read subscriptions for transfer")
+	}
+	for _, s := range subscriptions {
+		if s.Email == transfer.FromEmail {
+			before := *s
+			s.Email = owner.Email
+			s.UpdatedBy = email
+			result, err := UpdateSubscription(s.Id, s)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("failed to update subscription billing contact")
+				continue
+			}
+			Audit(actor, "subscription", "update", &before, result)
+		}
+	}
+
+	transfer.Status = "Accepted"
+	transfer.UpdatedBy = email
+	transfer.Updated = now
+	transfer.Completed = &now
+
+	err = mongo.Serialize(transfer.Id, "id", "transfers", transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Transfer %s of account %s from %s to %s accepted", transfer.Id, transfer.AccountID, transfer.FromEmail, transfer.ToEmail)
+
+	return transfer, nil
+}
+
+// CloseTransfer declines or cancels a pending transfer
+func CloseTransfer(id string, email string, status string) (*model.Transfer, error) {
+
+	transfer, err := ReadTransfer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if transfer.Status != "Pending" {
+		return nil, errors.New("transfer is " + transfer.Status)
+	}
+
+	now := time.Now().UTC()
+	transfer.Status = status
+	transfer.UpdatedBy = email
+	transfer.Updated = now
+	transfer.Completed = &now
+
+	errs := transfer.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("transfer validation error")
+		}
+		return nil, errors.New("failed to validate transfer")
+	}
+
+	err = mongo.Serialize(transfer.Id, "id", "transfers", transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Transfer %s of account %s %s by %s", transfer.Id, transfer.AccountID, status, email)
+
+	return transfer, nil
+}
@@ -16,7 +16,7 @@ import (
 )
 
 // CreateVPN vpn with all necessary data
-func CreateVPN(vpn *model.VPN) (*model.VPN, error) {
+func CreateVPN(vpn *model.VPN, actor Actor) (*model.VPN, error) {
 
 	var err error
 	vpn.Id, err = util.RandomString(12)
@@ -30,6 +30,10 @@ func CreateVPN(vpn *model.VPN) (*model.VPN, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = checkCritical(net, actor)
+	if err != nil {
+		return nil, err
+	}
 
 	if vpn.Default == nil {
 		vpn.Default = &model.Settings{}
@@ -174,6 +178,10 @@ func CreateVPN(vpn *model.VPN) (*model.VPN, error) {
 	}
 	vpn = v.(*model.VPN)
 
+	recordRevision(vpnRevision(vpn, revisionCause{}))
+
+	Publish(VPNCreated{VPN: vpn, Actor: actor})
+
 	vpn.Complete = util.BoolPtr(true)
 	// data modified, dump new config
 	return vpn, nil
@@ -248,27 +256,82 @@ func ReadVPN(id string) (*model.VPN, error) {
 }
 
 // UpdateVPN preserve keys
-func UpdateVPN(Id string, vpn *model.VPN, flag bool) (*model.VPN, error) {
+func UpdateVPN(Id string, vpn *model.VPN, flag bool, actor Actor) (*model.VPN, error) {
+	return updateVPN(Id, vpn, flag, actor, revisionCause{})
+}
+
+func updateVPN(Id string, vpn *model.VPN, flag bool, actor Actor, cause revisionCause) (*model.VPN, error) {
 	v, err := mongo.Deserialize(Id, "id", "vpns", reflect.TypeOf(model.VPN{}))
 	if err != nil {
 		return nil, err
 	}
 	current := v.(*model.VPN)
 
+	err = checkLock("vpn "+current.Name, current.ReadOnly, current.Lock)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCriticalVPN(current, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	// locks are only changed by Lock and Unlock
+	vpn.ReadOnly = current.ReadOnly
+	vpn.Lock = current.Lock
+
+	err = prepareVPN(current, vpn, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !flag {
+		u := time.Now().UTC()
+		vpn.Updated = &u
+	}
+
+	// vpns from before revisions were kept get their first one now
+	recordRevision(vpnRevision(current, revisionCause{}))
+
+	err = mongo.Serialize(vpn.Id, "id", "vpns", vpn)
+	if err != nil {
+		return nil, err
+	}
+
+	recordRevision(vpnRevision(vpn, cause))
+
+	Publish(VPNUpdated{Before: current, After: vpn, ByNetwork: cause.netRevision != 0, Actor: actor})
+
+	/*
+		v, err = mongo.Deserialize(Id, "id", "vpns", reflect.TypeOf(model.VPN{}))
+		if err != nil {
+			return nil, err
+		}
+		vpn = v.(*model.VPN)
+	*/
+
+	// data modified, dump new config
+	return vpn, nil
+}
+
+// prepareVPN fills in the settings an update to a VPN implies, such as a
+// new address when its network's changed, and checks the result.  Addresses
+// in reserved are treated as taken along with the ones in the database.
+func prepareVPN(current *model.VPN, vpn *model.VPN, reserved []string) error {
 	if current.Id != vpn.Id {
-		return nil, errors.New("records Id mismatch")
+		return errors.New("records Id mismatch")
 	}
 
 	if current.Type == "Service" {
 		if vpn.Type != "Service" {
-			return nil, errors.New("invalid change")
+			return errors.New("invalid change")
 		}
 
 		if current.Current.PreUp != vpn.Current.PreUp ||
 			current.Current.PostUp != vpn.Current.PostUp ||
 			current.Current.PreDown != vpn.Current.PreDown ||
 			current.Current.PostDown != vpn.Current.PostDown {
-			return nil, errors.New("invalid change")
+			return errors.New("invalid change")
 		}
 	}
 
@@ -277,15 +340,16 @@ func UpdateVPN(Id string, vpn *model.VPN, flag bool) (*model.VPN, error) {
 			(vpn.Default.Address[0] != current.Default.Address[0])) {
 		reserverIps, err := GetAllReservedNetIps(vpn.NetId)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		reserverIps = append(reserverIps, reserved...)
 
 		ips := make([]string, 0)
 
 		for _, network := range vpn.Default.Address {
 			ip, err := util.GetAvailableCidr(network, reserverIps)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			ips = append(ips, ip)
 		}
@@ -300,7 +364,7 @@ func UpdateVPN(Id string, vpn *model.VPN, flag bool) (*model.VPN, error) {
 
 		device, err := ReadDevice(vpn.DeviceID)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// if its not a mac its running on the vpn's ip address
 		if device.OS != "darwin" {
@@ -347,39 +411,71 @@ func UpdateVPN(Id string, vpn *model.VPN, flag bool) (*model.VPN, error) {
 				"err": err,
 			}).Error("vpn validation error")
 		}
-		return nil, errors.New("failed to validate vpn")
+		return errors.New("failed to validate vpn")
 	}
 
-	if !flag {
-		u := time.Now().UTC()
-		vpn.Updated = &u
-	}
+	return nil
+}
 
-	err = mongo.Serialize(vpn.Id, "id", "vpns", vpn)
-	if err != nil {
-		return nil, err
+// DeleteVPN from database
+func DeleteVPN(id string, actor Actor) error {
+	return deleteVPN(id, false, actor)
+}
+
+// deleteVPN deletes a VPN on its own, or withNetwork as part of deleting
+// its network
+func deleteVPN(id string, withNetwork bool, actor Actor) error {
+
+	if id == "" {
+		return errors.New("id is empty")
 	}
 
-	/*
-		v, err = mongo.Deserialize(Id, "id", "vpns", reflect.TypeOf(model.VPN{}))
+	vpn, err := ReadVPN(id)
+	if err == nil {
+		err = checkLock("vpn "+vpn.Name, vpn.ReadOnly, vpn.Lock)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		vpn = v.(*model.VPN)
-	*/
+		err = checkCriticalVPN(vpn, actor)
+		if err != nil {
+			return err
+		}
+	}
 
-	// data modified, dump new config
-	return vpn, nil
+	err = mongo.DeleteVPN(id, "vpns")
+	if err != nil {
+		return err
+	}
+
+	if vpn != nil {
+		Publish(VPNDeleted{VPN: vpn, WithNetwork: withNetwork, Actor: actor})
+	}
+
+	return nil
 }
 
-// DeleteVPN from database
-func DeleteVPN(id string) error {
+// ReportVPNEndpoint records the endpoint a device found its VPN at when it
+// checked in.  Like what a device reports about itself, it's recorded even
+// if the VPN is locked and isn't a change anyone needs to hear about, but the
+// network's devices fetch their configuration again to find it.
+func ReportVPNEndpoint(id string, endpoint string, listenPort int, by string) error {
+	vpn, err := ReadVPN(id)
+	if err != nil {
+		return err
+	}
 
-	if id == "" {
-		return errors.New("id is empty")
+	vpn.Current.Endpoint = endpoint
+	vpn.Current.ListenPort = listenPort
+	vpn.UpdatedBy = by
+
+	err = mongo.Serialize(vpn.Id, "id", "vpns", vpn)
+	if err != nil {
+		return err
 	}
 
-	return mongo.DeleteVPN(id, "vpns")
+	flushNet(vpn.NetId)
+
+	return nil
 }
 
 // ReadVPN2 vpn by param and id
@@ -0,0 +1,312 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	relyingParty     *webauthn.WebAuthn
+	relyingPartyErr  error
+	relyingPartyOnce sync.Once
+)
+
+// getRelyingParty configures webauthn from the environment the first time it is used.
+// The relying party id defaults to the host of SERVER and the origin to SERVER itself.
+func getRelyingParty() (*webauthn.WebAuthn, error) {
+	relyingPartyOnce.Do(func() {
+		server := os.Getenv("SERVER")
+
+		rpid := os.Getenv("WEBAUTHN_RP_ID")
+		if rpid == "" {
+			u, err := url.Parse(server)
+			if err != nil || u.Hostname() == "" {
+				relyingPartyErr = errors.New("WEBAUTHN_RP_ID or SERVER must be set to use passkeys")
+				return
+			}
+			rpid = u.Hostname()
+		}
+
+		name := os.Getenv("WEBAUTHN_RP_NAME")
+		if name == "" {
+			name = "Nettica"
+		}
+
+		origins := []string{}
+		for _, o := range strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				origins = append(origins, o)
+			}
+		}
+		if len(origins) == 0 {
+			origins = append(origins, server)
+		}
+
+		relyingParty, relyingPartyErr = webauthn.New(&webauthn.Config{
+			RPID:          rpid,
+			RPDisplayName: name,
+			RPOrigins:     origins,
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+				UserVerification: protocol.VerificationRequired,
+			},
+		})
+	})
+
+	return relyingParty, relyingPartyErr
+}
+
+// passkeyUser adapts a user and their stored credentials to webauthn.User
+type passkeyUser struct {
+	email   string
+	records []*model.WebAuthnCredential
+	creds   []webauthn.Credential
+}
+
+// the user handle is a hash of the email so it has a fixed length and
+// does not disclose the email to the authenticator
+func (u *passkeyUser) WebAuthnID() []byte {
+	h := sha256.Sum256([]byte(u.email))
+	return h[:]
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.email
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.creds
+}
+
+func (u *passkeyUser) record(id []byte) *model.WebAuthnCredential {
+	key := base64.RawURLEncoding.EncodeToString(id)
+	for _, r := range u.records {
+		if r.Id == key {
+			return r
+		}
+	}
+	return nil
+}
+
+// exclusions keeps an authenticator from registering a second passkey for
+// the user
+func (u *passkeyUser) exclusions() []protocol.CredentialDescriptor {
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(u.creds))
+	for _, cred := range u.creds {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+	return exclusions
+}
+
+func readPasskeyUser(email string) (*passkeyUser, error) {
+	records, err := mongo.ReadWebAuthnCredentials(email)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &passkeyUser{email: email, records: records}
+	for _, r := range records {
+		var cred webauthn.Credential
+		if err := json.Unmarshal([]byte(r.Credential), &cred); err != nil {
+			log.Errorf("passkey %s for %s is corrupt: %v", r.Id, email, err)
+			continue
+		}
+		user.creds = append(user.creds, cred)
+	}
+
+	return user, nil
+}
+
+// ReadPasskeys lists the passkeys registered by a user
+func ReadPasskeys(email string) ([]*model.WebAuthnCredential, error) {
+	return mongo.ReadWebAuthnCredentials(email)
+}
+
+// DeletePasskey removes one of the user's passkeys
+func DeletePasskey(email string, id string) error {
+	wc, err := mongo.ReadWebAuthnCredential(id)
+	if err != nil || wc.Email != email {
+		return errors.New("passkey not found")
+	}
+
+	log.Infof("Passkey %s (%s) removed for %s", wc.Name, wc.Id, email)
+
+	return mongo.DeleteWebAuthnCredential(id)
+}
+
+// BeginPasskeyRegistration starts registering a new passkey for a logged in user
+func BeginPasskeyRegistration(email string) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	rp, err := getRelyingParty()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := readPasskeyUser(email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rp.BeginRegistration(user, webauthn.WithExclusions(user.exclusions()))
+}
+
+// FinishPasskeyRegistration verifies the authenticator's attestation and stores the passkey
+func FinishPasskeyRegistration(email string, name string, session webauthn.SessionData, r *http.Request) (*model.WebAuthnCredential, error) {
+	rp, err := getRelyingParty()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := readPasskeyUser(email)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := rp.FinishRegistration(user, session, r)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+
+	wc := &model.WebAuthnCredential{
+		Id:         base64.RawURLEncoding.EncodeToString(cred.ID),
+		Email:      email,
+		Name:       name,
+		Credential: string(raw),
+		Created:    time.Now().UTC(),
+	}
+
+	err = mongo.UpsertWebAuthnCredential(wc)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Passkey %s (%s) registered for %s", wc.Name, wc.Id, email)
+
+	return wc, nil
+}
+
+// BeginPasskeyLogin starts a login.  Given an email the browser is offered that
+// user's passkeys, otherwise any discoverable passkey for this site may be used.
+func BeginPasskeyLogin(email string) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	rp, err := getRelyingParty()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if email != "" {
+		user, err := readPasskeyUser(email)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(user.creds) > 0 {
+			return rp.BeginLogin(user)
+		}
+	}
+
+	return rp.BeginDiscoverableLogin()
+}
+
+// FinishPasskeyLogin verifies the assertion and returns the email of the user it belongs to
+func FinishPasskeyLogin(session webauthn.SessionData, r *http.Request) (string, error) {
+	rp, err := getRelyingParty()
+	if err != nil {
+		return "", err
+	}
+
+	var user *passkeyUser
+	var cred *webauthn.Credential
+
+	if len(session.UserID) > 0 {
+		// the session names the user, find them by the credential they used
+		parsed, err := protocol.ParseCredentialRequestResponse(r)
+		if err != nil {
+			return "", err
+		}
+		wc, err := mongo.ReadWebAuthnCredential(base64.RawURLEncoding.EncodeToString(parsed.RawID))
+		if err != nil {
+			return "", ErrInvalidLogin
+		}
+		user, err = readPasskeyUser(wc.Email)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(user.WebAuthnID(), session.UserID) {
+			return "", ErrInvalidLogin
+		}
+		cred, err = rp.ValidateLogin(user, session, parsed)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+			wc, err := mongo.ReadWebAuthnCredential(base64.RawURLEncoding.EncodeToString(rawID))
+			if err != nil {
+				return nil, ErrInvalidLogin
+			}
+			u, err := readPasskeyUser(wc.Email)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(u.WebAuthnID(), userHandle) {
+				return nil, ErrInvalidLogin
+			}
+			return u, nil
+		}
+
+		u, c, err := rp.FinishPasskeyLogin(handler, session, r)
+		if err != nil {
+			return "", err
+		}
+		user = u.(*passkeyUser)
+		cred = c
+	}
+
+	if cred.Authenticator.CloneWarning {
+		log.Errorf("Passkey for %s may be cloned, login refused", user.email)
+		return "", ErrInvalidLogin
+	}
+
+	// keep the sign count current so a cloned authenticator can be detected
+	wc := user.record(cred.ID)
+	if wc != nil {
+		raw, err := json.Marshal(cred)
+		if err == nil {
+			now := time.Now().UTC()
+			wc.Credential = string(raw)
+			wc.LastUsed = &now
+			err = mongo.UpsertWebAuthnCredential(wc)
+		}
+		if err != nil {
+			log.Errorf("failed to update passkey %s: %v", wc.Id, err)
+		}
+	}
+
+	return user.email, nil
+}
@@ -0,0 +1,408 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	model "github.com/nettica-com/nettica-admin/model"
+)
+
+const testServer = "https://nettica.example.com"
+
+// virtualAuthenticator is a software passkey.  It answers the options the
+// relying party sends the browser the way a platform authenticator would.
+type virtualAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+	verify    bool
+}
+
+func newVirtualAuthenticator(t *testing.T) *virtualAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+
+	return &virtualAuthenticator{id: id, key: key, verify: true}
+}
+
+func (a *virtualAuthenticator) flags() byte {
+	flags := protocol.FlagUserPresent
+	if a.verify {
+		flags |= protocol.FlagUserVerified
+	}
+	return byte(flags)
+}
+
+// authData is the authenticator data for rpid, with the attested
+// credential when one is given
+func (a *virtualAuthenticator) authData(rpid string, attested []byte) []byte {
+	hash := sha256.Sum256([]byte(rpid))
+
+	data := append([]byte{}, hash[:]...)
+	flags := a.flags()
+	if attested != nil {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	return append(data, attested...)
+}
+
+func clientData(t *testing.T, kind string, challenge protocol.URLEncodedBase64, origin string) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": challenge.String(),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func postJSON(t *testing.T, body interface{}) *http.Request {
+	t.Helper()
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1.0/auth/webauthn", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// create answers navigator.credentials.create with a "none" attestation
+func (a *virtualAuthenticator) create(t *testing.T, options *protocol.CredentialCreation, origin string) *http.Request {
+	t.Helper()
+
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := pub.Bytes()
+	cose, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: point[1:33],
+		YCoord: point[33:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attested := make([]byte, 16) // no aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, cose...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(options.Response.RelyingParty.ID, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	return postJSON(t, map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", options.Response.Challenge, origin)),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+		},
+	})
+}
+
+// get answers navigator.credentials.get, signing the challenge for the user
+func (a *virtualAuthenticator) get(t *testing.T, options *protocol.CredentialAssertion, origin string, userHandle []byte) *http.Request {
+	t.Helper()
+
+	a.signCount++
+
+	rpid := options.Response.RelyingPartyID
+	data := a.authData(rpid, nil)
+	client := clientData(t, "webauthn.get", options.Response.Challenge, origin)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, data...), clientHash[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	return postJSON(t, map[string]interface{}{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(data),
+			"signature":         base64.RawURLEncoding.EncodeToString(sig),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(userHandle),
+		},
+	})
+}
+
+// testRelyingParty configures the relying party from SERVER alone
+func testRelyingParty(t *testing.T) *webauthn.WebAuthn {
+	t.Helper()
+
+	t.Setenv("SERVER", testServer)
+	t.Setenv("WEBAUTHN_RP_ID", "")
+	t.Setenv("WEBAUTHN_RP_ORIGINS", "")
+	relyingPartyOnce = sync.Once{}
+	t.Cleanup(func() { relyingPartyOnce = sync.Once{} })
+
+	rp, err := getRelyingParty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// register a passkey for the user with the authenticator, keeping it the
+// way FinishPasskeyRegistration stores it
+func register(t *testing.T, rp *webauthn.WebAuthn, user *passkeyUser, a *virtualAuthenticator) *webauthn.Credential {
+	t.Helper()
+
+	options, session, err := rp.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := rp.FinishRegistration(user, *session, a.create(t, options, testServer))
+	if err != nil {
+		t.Fatalf("registration failed: %v", err)
+	}
+
+	raw, err := json.Marshal(cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored webauthn.Credential
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		t.Fatal(err)
+	}
+	user.creds = append(user.creds, stored)
+	user.records = append(user.records, &model.WebAuthnCredential{
+		Id:         base64.RawURLEncoding.EncodeToString(cred.ID),
+		Email:      user.email,
+		Credential: string(raw),
+	})
+
+	return cred
+}
+
+func TestPasskeyRelyingPartyFromServer(t *testing.T) {
+	rp := testRelyingParty(t)
+
+	options, _, err := rp.BeginRegistration(&passkeyUser{email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.Response.RelyingParty.ID != "nettica.example.com" {
+		t.Errorf("rp id = %q, want the host of SERVER", options.Response.RelyingParty.ID)
+	}
+	if options.Response.AuthenticatorSelection.UserVerification != protocol.VerificationRequired {
+		t.Errorf("user verification = %q, want required", options.Response.AuthenticatorSelection.UserVerification)
+	}
+}
+
+func TestPasskeyUserHandle(t *testing.T) {
+	alice := &passkeyUser{email: "alice@example.com"}
+	bob := &passkeyUser{email: "bob@example.com"}
+
+	if len(alice.WebAuthnID()) != sha256.Size {
+		t.Errorf("user handle is %d bytes, want %d", len(alice.WebAuthnID()), sha256.Size)
+	}
+	if bytes.Contains(alice.WebAuthnID(), []byte(alice.email)) {
+		t.Error("user handle discloses the email")
+	}
+	if bytes.Equal(alice.WebAuthnID(), bob.WebAuthnID()) {
+		t.Error("different users have the same handle")
+	}
+}
+
+func TestPasskeyRegisterAndLogin(t *testing.T) {
+	rp := testRelyingParty(t)
+	user := &passkeyUser{email: "alice@example.com"}
+	a := newVirtualAuthenticator(t)
+
+	cred := register(t, rp, user, a)
+	if !bytes.Equal(cred.ID, a.id) {
+		t.Fatalf("registered credential %x, want %x", cred.ID, a.id)
+	}
+	if user.record(a.id) == nil {
+		t.Error("the stored passkey isn't found by its credential id")
+	}
+
+	// a second registration must exclude the passkey the user already has
+	options, _, err := rp.BeginRegistration(user, webauthn.WithExclusions(user.exclusions()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Response.CredentialExcludeList) != 1 || !bytes.Equal(options.Response.CredentialExcludeList[0].CredentialID, a.id) {
+		t.Errorf("exclude list = %v, want the registered passkey", options.Response.CredentialExcludeList)
+	}
+
+	assertion, session, err := rp.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assertion.Response.AllowedCredentials) != 1 || !bytes.Equal(assertion.Response.AllowedCredentials[0].CredentialID, a.id) {
+		t.Errorf("allowed credentials = %v, want the registered passkey", assertion.Response.AllowedCredentials)
+	}
+
+	got, err := rp.FinishLogin(user, *session, a.get(t, assertion, testServer, user.WebAuthnID()))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if got.Authenticator.SignCount != a.signCount || got.Authenticator.CloneWarning {
+		t.Errorf("sign count = %d clone warning = %v, want %d and no warning", got.Authenticator.SignCount, got.Authenticator.CloneWarning, a.signCount)
+	}
+}
+
+func TestPasskeyDiscoverableLogin(t *testing.T) {
+	rp := testRelyingParty(t)
+	user := &passkeyUser{email: "alice@example.com"}
+	a := newVirtualAuthenticator(t)
+	register(t, rp, user, a)
+
+	assertion, session, err := rp.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the user is found from the handle the authenticator returns
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if !bytes.Equal(userHandle, user.WebAuthnID()) {
+			return nil, ErrInvalidLogin
+		}
+		return user, nil
+	}
+
+	u, _, err := rp.FinishPasskeyLogin(handler, *session, a.get(t, assertion, testServer, user.WebAuthnID()))
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if u.(*passkeyUser).email != user.email {
+		t.Errorf("logged in %s, want %s", u.(*passkeyUser).email, user.email)
+	}
+
+	assertion, session, err = rp.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &passkeyUser{email: "mallory@example.com"}
+	_, _, err = rp.FinishPasskeyLogin(handler, *session, a.get(t, assertion, testServer, other.WebAuthnID()))
+	if err == nil {
+		t.Error("login with another user's handle succeeded")
+	}
+}
+
+func TestPasskeyRejectsOtherOrigins(t *testing.T) {
+	rp := testRelyingParty(t)
+	user := &passkeyUser{email: "alice@example.com"}
+	a := newVirtualAuthenticator(t)
+
+	options, session, err := rp.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rp.FinishRegistration(user, *session, a.create(t, options, "https://phish.example.net"))
+	if err == nil {
+		t.Error("registration from another origin succeeded")
+	}
+
+	register(t, rp, user, a)
+
+	assertion, session, err := rp.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rp.FinishLogin(user, *session, a.get(t, assertion, "https://phish.example.net", user.WebAuthnID()))
+	if err == nil {
+		t.Error("login from another origin succeeded")
+	}
+}
+
+func TestPasskeyRequiresUserVerification(t *testing.T) {
+	rp := testRelyingParty(t)
+	user := &passkeyUser{email: "alice@example.com"}
+	a := newVirtualAuthenticator(t)
+	register(t, rp, user, a)
+
+	a.verify = false
+
+	assertion, session, err := rp.BeginLogin(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rp.FinishLogin(user, *session, a.get(t, assertion, testServer, user.WebAuthnID()))
+	if err == nil {
+		t.Error("login without user verification succeeded")
+	}
+}
+
+func TestPasskeyCloneWarning(t *testing.T) {
+	rp := testRelyingParty(t)
+	user := &passkeyUser{email: "alice@example.com"}
+	a := newVirtualAuthenticator(t)
+	register(t, rp, user, a)
+
+	login := func() *webauthn.Credential {
+		assertion, session, err := rp.BeginLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cred, err := rp.FinishLogin(user, *session, a.get(t, assertion, testServer, user.WebAuthnID()))
+		if err != nil {
+			t.Fatalf("login failed: %v", err)
+		}
+		return cred
+	}
+
+	user.creds[0] = *login()
+	user.creds[0] = *login()
+
+	// a copy of the authenticator replays an old counter, which
+	// FinishPasskeyLogin refuses
+	a.signCount = 0
+	if !login().Authenticator.CloneWarning {
+		t.Error("a replayed sign count was not flagged")
+	}
+}
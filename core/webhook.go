@@ -0,0 +1,321 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	model "github.com/nettica-com/nettica-admin/model"
+	mongo "github.com/nettica-com/nettica-admin/mongo"
+	util "github.com/nettica-com/nettica-admin/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// a delivery is given up after this many attempts
+const webhookAttempts = 8
+
+// how long an attempt has before another replica may make it again
+const webhookLease = 2 * time.Minute
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: webhookDialControl,
+		}).DialContext,
+	},
+	// a redirect could point anywhere, so it counts as a failure
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookDialControl keeps webhooks off the server's own network unless
+// WEBHOOK_ALLOW_PRIVATE=true
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return fmt.Errorf("webhooks can't be sent to %s", host)
+	}
+
+	return nil
+}
+
+// CreateWebhook adds a webhook to an account.  Without a secret one is made.
+func CreateWebhook(webhook *model.Webhook) (*model.Webhook, error) {
+	id, err := util.RandomString(12)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Id = "webhook-" + id
+
+	if webhook.Secret == "" {
+		secret, err := util.RandomString(32)
+		if err != nil {
+			return nil, err
+		}
+		webhook.Secret = "whsec-" + secret
+	}
+
+	webhook.Enable = true
+	webhook.Created = time.Now().UTC()
+	webhook.Updated = webhook.Created
+
+	errs := webhook.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("webhook validation error")
+		}
+		return nil, errs[0]
+	}
+
+	err = mongo.InsertWebhook(webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+// ReadWebhook by id
+func ReadWebhook(id string) (*model.Webhook, error) {
+	return mongo.ReadWebhook(id)
+}
+
+// ReadWebhooks of an account
+func ReadWebhooks(accountId string) ([]*model.Webhook, error) {
+	return mongo.ReadWebhooks(accountId, "")
+}
+
+// UpdateWebhook changes a webhook's URL, events or secret, or turns it on
+// or off
+func UpdateWebhook(current *model.Webhook, data *model.Webhook) (*model.Webhook, error) {
+	webhook := *current
+	webhook.URL = data.URL
+	webhook.Events = data.Events
+	webhook.Enable = data.Enable
+	if data.Secret != "" {
+		webhook.Secret = data.Secret
+	}
+	webhook.UpdatedBy = data.UpdatedBy
+	webhook.Updated = time.Now().UTC()
+
+	errs := webhook.IsValid()
+	if len(errs) != 0 {
+		for _, err := range errs {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("webhook validation error")
+		}
+		return nil, errs[0]
+	}
+
+	err := mongo.UpdateWebhook(&webhook)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+// DeleteWebhook and its deliveries
+func DeleteWebhook(id string) error {
+	return mongo.DeleteWebhook(id)
+}
+
+// ReadDeliveries of a webhook, the latest 100 newest first
+func ReadDeliveries(webhookId string) ([]*model.Delivery, error) {
+	return mongo.ReadDeliveries(webhookId, 100)
+}
+
+// ReadDelivery by id
+func ReadDelivery(id string) (*model.Delivery, error) {
+	return mongo.ReadDelivery(id)
+}
+
+// Redeliver sends a delivery's event to its webhook again, as a new delivery
+func Redeliver(delivery *model.Delivery) (*model.Delivery, error) {
+	webhook, err := mongo.ReadWebhook(delivery.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+	if !webhook.Enable {
+		return nil, errors.New("the webhook is disabled")
+	}
+
+	return queueDelivery(webhook, delivery.EventID, delivery.Type, delivery.Payload, delivery.Id)
+}
+
+// queueDelivery records a delivery of an event to a webhook and makes its
+// first attempt
+func queueDelivery(webhook *model.Webhook, eventId string, event string, payload string, redelivers string) (*model.Delivery, error) {
+	id, err := util.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	delivery := &model.Delivery{
+		Id:          "delivery-" + id,
+		WebhookID:   webhook.Id,
+		AccountID:   webhook.AccountID,
+		EventID:     eventId,
+		Type:        event,
+		Payload:     payload,
+		Status:      "Pending",
+		Redelivers:  redelivers,
+		Created:     now,
+		Updated:     now,
+		NextAttempt: now.Add(webhookLease),
+		Expires:     now.Add(sessionDuration("WEBHOOK_LOG_RETENTION", 30*24*time.Hour)),
+	}
+
+	err = mongo.InsertDelivery(delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	go attemptDelivery(delivery)
+
+	return delivery, nil
+}
+
+// attemptDelivery sends a delivery to its webhook.  If the webhook doesn't
+// accept it the next attempt is backed off exponentially, from 30s up to an
+// hour, until it has been tried webhookAttempts times.
+func attemptDelivery(delivery *model.Delivery) {
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.Updated = now
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+
+	webhook, err := mongo.ReadWebhook(delivery.WebhookID)
+	switch {
+	case err != nil:
+		err = errors.New("the webhook was deleted")
+	case !webhook.Enable:
+		err = errors.New("the webhook is disabled")
+	default:
+		delivery.ResponseCode, err = sendWebhook(webhook, delivery, now)
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = "Delivered"
+	case webhook == nil || !webhook.Enable || delivery.Attempts >= webhookAttempts:
+		delivery.Status = "Failed"
+		delivery.Error = err.Error()
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttempt = now.Add(webhookBackoff(delivery.Attempts))
+	}
+
+	err = mongo.UpdateDelivery(delivery)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Errorf("failed to update delivery %s", delivery.Id)
+	}
+
+	if delivery.Status == "Failed" {
+		log.Infof("webhook: gave up on delivery %s of %s to %s: %s", delivery.Id, delivery.Type, delivery.WebhookID, delivery.Error)
+	}
+}
+
+// webhookBackoff is how long to wait after a failed attempt
+func webhookBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second << (attempts - 1)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+	return backoff
+}
+
+// sendWebhook posts a delivery's payload to its webhook.  The payload is
+// signed with the webhook's secret in X-Nettica-Signature, as
+// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<payload>">, so the
+// receiver can check it and reject replays.
+func sendWebhook(webhook *model.Webhook, delivery *model.Delivery, now time.Time) (int, error) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(timestamp + "." + delivery.Payload))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Nettica-Webhooks")
+	req.Header.Set("X-Nettica-Event", delivery.Type)
+	req.Header.Set("X-Nettica-Delivery", delivery.Id)
+	req.Header.Set("X-Nettica-Signature", "t="+timestamp+",v1="+signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the webhook returned %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// CheckDeliveries makes the delivery attempts that are due, a few at a time
+func CheckDeliveries() {
+	deliveries, err := mongo.ReadDueDeliveries(time.Now().UTC())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	sem := make(chan struct{}, 8)
+	for _, delivery := range deliveries {
+		ok, err := mongo.ClaimDelivery(delivery.Id, delivery.NextAttempt, time.Now().UTC().Add(webhookLease))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		sem <- struct{}{}
+		go func(d *model.Delivery) {
+			defer func() { <-sem }()
+			attemptDelivery(d)
+		}(delivery)
+	}
+
+	// wait for the last attempts
+	for i := 0; i < cap(sem); i++ {
+		sem <- struct{}{}
+	}
+}
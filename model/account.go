@@ -23,6 +23,9 @@ type Account struct {
 	Role           string     `json:"role"                      bson:"role"`
 	Status         string     `json:"status"                    bson:"status"`
 	ApiKey         string     `json:"apiKey"                    bson:"apiKey"`
+	RequireMFA     bool       `json:"requireMfa,omitempty"      bson:"requireMfa,omitempty"`
+	AllowedIPs     []string   `json:"allowedIPs,omitempty"      bson:"allowedIPs,omitempty"`
+	DeviceAllowIPs []string   `json:"deviceAllowIPs,omitempty"  bson:"deviceAllowIPs,omitempty"`
 	CreatedBy      string     `json:"createdBy"                 bson:"createdBy"`
 	UpdatedBy      string     `json:"updatedBy"                 bson:"updatedBy"`
 	Created        time.Time  `json:"created"                   bson:"created"`
@@ -49,5 +52,13 @@ func (a Account) IsValid() []error {
 		errs = append(errs, fmt.Errorf("email is required"))
 	}
 
+	for _, list := range [][]string{a.AllowedIPs, a.DeviceAllowIPs} {
+		for _, cidr := range list {
+			if !util.IsValidCidr(cidr) {
+				errs = append(errs, fmt.Errorf("allowed address %s is not a CIDR", cidr))
+			}
+		}
+	}
+
 	return errs
 }
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+// AuditEntry records one change made through the API: who made it, with
+// which credential, from where, and what changed.  Entries are only ever
+// added, never updated or removed.
+type AuditEntry struct {
+	Id         string        `json:"id"                        bson:"id"`
+	AccountID  string        `json:"accountid"                 bson:"accountid"`
+	Kind       string        `json:"kind"                      bson:"kind"`
+	Action     string        `json:"action"                    bson:"action"`
+	ObjectID   string        `json:"objectId"                  bson:"objectId"`
+	Actor      string        `json:"actor"                     bson:"actor"`
+	Credential string        `json:"credential"                bson:"credential"`
+	IP         string        `json:"ip"                        bson:"ip"`
+	RequestID  string        `json:"requestId"                 bson:"requestId"`
+	Reason     string        `json:"reason,omitempty"          bson:"reason,omitempty"`
+	Changes    []AuditChange `json:"changes"                   bson:"changes"`
+	Created    time.Time     `json:"created"                   bson:"created"`
+}
+
+// AuditChange is a field that changed, by its path in the object's JSON
+type AuditChange struct {
+	Path string      `json:"path"                      bson:"path"`
+	From interface{} `json:"from,omitempty"            bson:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"              bson:"to,omitempty"`
+}
+
+// AuditQuery filters and pages the audit log of an account
+type AuditQuery struct {
+	AccountID string    `form:"-"`
+	Kind      string    `form:"kind"`
+	Action    string    `form:"action"`
+	ObjectID  string    `form:"objectId"`
+	Actor     string    `form:"actor"`
+	From      time.Time `form:"from"     time_format:"2006-01-02T15:04:05Z07:00"`
+	To        time.Time `form:"to"       time_format:"2006-01-02T15:04:05Z07:00"`
+	Offset    int64     `form:"offset"`
+	Limit     int64     `form:"limit"`
+}
@@ -14,6 +14,16 @@ type Auth struct {
 	Connection string   `json:"connection"`
 	IdToken    string   `json:"id_token"`
 	Providers  []string `json:"providers"`
+	Provider   string   `json:"provider,omitempty"`
+	MFA        string   `json:"mfa,omitempty"`
+	Challenge  string   `json:"challenge,omitempty"`
+	Recovery   []string `json:"recoveryCodes,omitempty"`
+
+	// a registered client and its PKCE parameters
+	Client              string `json:"client_id,omitempty"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
+	CodeVerifier        string `json:"code_verifier,omitempty"`
 }
 
 type OAuth2Token struct {
@@ -33,3 +43,11 @@ type Authentication interface {
 	Exchange2(code string) (*oauth2.Token, error)
 	UserInfo(oauth2Token *oauth2.Token) (*User, error)
 }
+
+// PasswordAuthentication is implemented by providers that check a username
+// and password themselves in the login handler.  LoginEmail maps the login
+// name to the email UserInfo will report for it.
+type PasswordAuthentication interface {
+	Authenticate(username string, password string) error
+	LoginEmail(username string) string
+}
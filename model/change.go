@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// ChangeRequest holds a change to a critical network until a second owner or
+// admin approves it.  Kind says what the change is: an update of the network
+// in Net, possibly rolled out as Rollout says, a rollback to Revision, its
+// deletion, or a VPN joining, changing in or leaving it.  Base is when the network was
+// last updated as the request was made, so an approval can tell if it has
+// changed since.
+type ChangeRequest struct {
+	Id        string     `json:"id"                        bson:"id"`
+	AccountID string     `json:"accountid"                 bson:"accountid"`
+	NetId     string     `json:"netid"                     bson:"netid"`
+	NetName   string     `json:"netName"                   bson:"netName"`
+	Kind      string     `json:"kind"                      bson:"kind"`
+	Net       *Network   `json:"net,omitempty"             bson:"net,omitempty"`
+	VPN       *VPN       `json:"vpn,omitempty"             bson:"vpn,omitempty"`
+	Revision  int        `json:"revision,omitempty"        bson:"revision,omitempty"`
+	Rollout   *Rollout   `json:"rollout,omitempty"         bson:"rollout,omitempty"`
+	Base      *time.Time `json:"base,omitempty"            bson:"base,omitempty"`
+	Status    string     `json:"status"                    bson:"status"`
+	Reason    string     `json:"reason,omitempty"          bson:"reason,omitempty"`
+	Error     string     `json:"error,omitempty"           bson:"error,omitempty"`
+	CreatedBy string     `json:"createdBy"                 bson:"createdBy"`
+	DecidedBy string     `json:"decidedBy,omitempty"       bson:"decidedBy,omitempty"`
+	Created   time.Time  `json:"created"                   bson:"created"`
+	Updated   time.Time  `json:"updated"                   bson:"updated"`
+	Expires   time.Time  `json:"expires"                   bson:"expires"`
+}
@@ -0,0 +1,31 @@
+package model
+
+// Client is an application allowed to send users through login and back to
+// one of its redirect URIs, such as the Nettica agent.  Public clients can't
+// keep a secret, so they must use PKCE unless PKCEOptional is set for apps
+// released before it was supported.  Agent clients log in with the
+// OAUTH2_AGENT_ provider settings.
+type Client struct {
+	Id           string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Public       bool     `json:"public"`
+	PKCEOptional bool     `json:"pkce_optional,omitempty"`
+	Agent        bool     `json:"agent,omitempty"`
+}
+
+// RequiresPKCE returns true if an authorization request must carry a code challenge
+func (c *Client) RequiresPKCE() bool {
+	return c.Public && !c.PKCEOptional
+}
+
+// HasRedirect returns true if uri is one of the client's redirect URIs.
+// They are compared exactly.
+func (c *Client) HasRedirect(uri string) bool {
+	for _, r := range c.RedirectURIs {
+		if r == uri {
+			return true
+		}
+	}
+	return false
+}
@@ -39,6 +39,7 @@ type Device struct {
 	App               *string    `json:"app,omitempty"             bson:"app,omitempty"`
 	HasSpecialPerms   *bool      `json:"hasSpecialPerms,omitempty" bson:"hasSpecialPerms,omitempty"`
 	ReadOnly          *bool      `json:"readonly,omitempty"        bson:"readonly,omitempty"`
+	Lock              *Lock      `json:"lock,omitempty"            bson:"lock,omitempty"`
 	TextEnabled       *bool      `json:"textEnabled,omitempty"     bson:"textEnabled,omitempty"`
 	VideoEnabled      *bool      `json:"videoEnabled,omitempty"    bson:"videoEnabled,omitempty"`
 	ConferenceEnabled *bool      `json:"conferenceEnabled,omitempty" bson:"conferenceEnabled,omitempty"`
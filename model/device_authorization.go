@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// DeviceAuthorization is an OAuth 2.0 device authorization (RFC 8628) for an
+// agent without a browser.  The agent polls with the device code, which is
+// stored as a hash, while a person approves the user code in the web UI.
+type DeviceAuthorization struct {
+	DeviceCode   string     `json:"-"                         bson:"deviceCode"`
+	UserCode     string     `json:"userCode"                  bson:"userCode"`
+	Status       string     `json:"status"                    bson:"status"`
+	Name         string     `json:"name"                      bson:"name"`
+	Platform     string     `json:"platform"                  bson:"platform"`
+	OS           string     `json:"os"                        bson:"os"`
+	Architecture string     `json:"arch"                      bson:"arch"`
+	IP           string     `json:"ip"                        bson:"ip"`
+	AccountID    string     `json:"accountid,omitempty"       bson:"accountid,omitempty"`
+	DeviceID     string     `json:"deviceid,omitempty"        bson:"deviceid,omitempty"`
+	ApprovedBy   string     `json:"approvedBy,omitempty"      bson:"approvedBy,omitempty"`
+	Interval     int        `json:"interval"                  bson:"interval"`
+	LastPoll     *time.Time `json:"-"                         bson:"lastPoll,omitempty"`
+	Created      time.Time  `json:"created"                   bson:"created"`
+	Expires      time.Time  `json:"expires"                   bson:"expires"`
+}
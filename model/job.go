@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Job is the state of a background job, shared by every API replica.  The
+// replica named by Owner runs it until LeaseUntil, and it's next run after
+// NextRun by whichever replica takes the lease then.
+type Job struct {
+	Id           string     `json:"id"                        bson:"id"`
+	Interval     string     `json:"interval"                  bson:"interval"`
+	Owner        string     `json:"owner,omitempty"           bson:"owner,omitempty"`
+	LeaseUntil   time.Time  `json:"leaseUntil"                bson:"leaseUntil"`
+	NextRun      time.Time  `json:"nextRun"                   bson:"nextRun"`
+	LastStarted  *time.Time `json:"lastStarted,omitempty"     bson:"lastStarted,omitempty"`
+	LastFinished *time.Time `json:"lastFinished,omitempty"    bson:"lastFinished,omitempty"`
+	LastStatus   string     `json:"lastStatus,omitempty"      bson:"lastStatus,omitempty"`
+	LastError    string     `json:"lastError,omitempty"       bson:"lastError,omitempty"`
+	Runs         int        `json:"runs"                      bson:"runs"`
+	Failures     int        `json:"failures"                  bson:"failures"`
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nettica-com/nettica-admin/util"
+)
+
+// LocalUser is a user of the local auth provider.  Secrets are never
+// returned to clients.
+type LocalUser struct {
+	Email        string     `json:"email"                     bson:"email"`
+	Name         string     `json:"name"                      bson:"name"`
+	Hash         string     `json:"-"                         bson:"hash"`
+	Verified     bool       `json:"verified"                  bson:"verified"`
+	Status       string     `json:"status"                    bson:"status"`
+	VerifyToken  string     `json:"-"                         bson:"verifyToken,omitempty"`
+	ResetToken   string     `json:"-"                         bson:"resetToken,omitempty"`
+	ResetExpires *time.Time `json:"-"                         bson:"resetExpires,omitempty"`
+	PasswordSet  *time.Time `json:"passwordSet,omitempty"     bson:"passwordSet,omitempty"`
+	CreatedBy    string     `json:"createdBy"                 bson:"createdBy"`
+	UpdatedBy    string     `json:"updatedBy"                 bson:"updatedBy"`
+	Created      time.Time  `json:"created"                   bson:"created"`
+	Updated      time.Time  `json:"updated"                   bson:"updated"`
+}
+
+// IsValid check if model is valid
+func (u LocalUser) IsValid() []error {
+	errs := make([]error, 0)
+
+	if !util.RegexpEmail.MatchString(u.Email) {
+		errs = append(errs, fmt.Errorf("email %s is invalid", u.Email))
+	}
+
+	switch u.Status {
+	case "Active", "Suspended":
+	default:
+		errs = append(errs, fmt.Errorf("status %s is invalid", u.Status))
+	}
+
+	return errs
+}
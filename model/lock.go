@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// Lock of a network, VPN or device.  While an object is locked its ReadOnly
+// is true and it can't be changed or deleted until whoever locked it, or an
+// owner of its account, releases it, or the lock expires.
+type Lock struct {
+	Owner   string     `json:"owner"                     bson:"owner"`
+	Reason  string     `json:"reason,omitempty"          bson:"reason,omitempty"`
+	Created time.Time  `json:"created"                   bson:"created"`
+	Expires *time.Time `json:"expires,omitempty"         bson:"expires,omitempty"`
+}
+
+// Expired returns true if the lock had an expiry and it has passed
+func (l *Lock) Expired() bool {
+	return l.Expires != nil && time.Now().After(*l.Expires)
+}
@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// LoginEvent records a login attempt, successful or not, with where it came
+// from.  Country is only known when a GeoIP database is configured.
+type LoginEvent struct {
+	Id        string    `json:"id"                        bson:"id"`
+	Email     string    `json:"email"                     bson:"email"`
+	Provider  string    `json:"provider"                  bson:"provider"`
+	Success   bool      `json:"success"                   bson:"success"`
+	Reason    string    `json:"reason,omitempty"          bson:"reason,omitempty"`
+	IP        string    `json:"ip"                        bson:"ip"`
+	UserAgent string    `json:"userAgent"                 bson:"userAgent"`
+	Country   string    `json:"country,omitempty"         bson:"country,omitempty"`
+	Created   time.Time `json:"created"                   bson:"created"`
+	Expires   time.Time `json:"-"                         bson:"expires"`
+}
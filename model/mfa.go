@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// MFA holds the TOTP enrolment and recovery codes of a user.  Like local users,
+// it is stored with its bson tags so the secrets never pass through json.
+type MFA struct {
+	Email         string    `json:"email"                     bson:"email"`
+	Secret        string    `json:"-"                         bson:"secret"`
+	Pending       string    `json:"-"                         bson:"pending,omitempty"`
+	Enabled       bool      `json:"enabled"                   bson:"enabled"`
+	RecoveryCodes []string  `json:"-"                         bson:"recoveryCodes"`
+	Remaining     int       `json:"recoveryCodesRemaining"    bson:"-"`
+	Required      bool      `json:"required"                  bson:"-"`
+	LastStep      int64     `json:"-"                         bson:"lastStep"`
+	Created       time.Time `json:"created"                   bson:"created"`
+	Updated       time.Time `json:"updated"                   bson:"updated"`
+}
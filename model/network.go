@@ -20,6 +20,7 @@ type Network struct {
 	ForceUpdate bool       `json:"forceUpdate"         bson:"forceUpdate"`
 	Critical    bool       `json:"critical"            bson:"critical"`
 	ReadOnly    *bool      `json:"readonly,omitempty"  bson:"readonly,omitempty"`
+	Lock        *Lock      `json:"lock,omitempty"      bson:"lock,omitempty"`
 	Policies    Policies   `json:"policies"            bson:"policies"`
 	Default     *Settings  `json:"default"             bson:"default"`
 	VPNs        []*VPN     `json:"vpns,omitempty"      bson:"vpns,omitempty"`
@@ -0,0 +1,19 @@
+package model
+
+// NetPreview is what an update to a network would do, worked out without
+// making it.  Errors are the reasons the update would be refused.
+type NetPreview struct {
+	Changes []AuditChange `json:"changes"`
+	Errors  []string      `json:"errors,omitempty"`
+	VPNs    []*VPNPreview `json:"vpns"`
+}
+
+// VPNPreview is how an update to its network would change a VPN.  Errors
+// are the reasons the VPN would be left as it is.
+type VPNPreview struct {
+	Id       string        `json:"id"`
+	Name     string        `json:"name"`
+	DeviceID string        `json:"deviceid"`
+	Changes  []AuditChange `json:"changes"`
+	Errors   []string      `json:"errors,omitempty"`
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProvisioningRule makes a user a member of an account the first time they
+// log in, so owners don't have to invite everyone.  A rule matches the domain
+// of the user's email, when the provider says it is verified, a group the
+// provider lists in the user's claims, or both.  A group name means nothing
+// outside the provider that issued it, so a group rule also needs a domain or
+// the Issuer of the provider.  NetId limits the membership to one network.
+type ProvisioningRule struct {
+	Id        string    `json:"id"                        bson:"id"`
+	AccountID string    `json:"accountid"                 bson:"accountid"`
+	Domain    string    `json:"domain,omitempty"          bson:"domain,omitempty"`
+	Group     string    `json:"group,omitempty"           bson:"group,omitempty"`
+	Issuer    string    `json:"issuer,omitempty"          bson:"issuer,omitempty"`
+	Role      string    `json:"role"                      bson:"role"`
+	NetId     string    `json:"netId,omitempty"           bson:"netId,omitempty"`
+	NetName   string    `json:"netName,omitempty"         bson:"netName,omitempty"`
+	CreatedBy string    `json:"createdBy"                 bson:"createdBy"`
+	UpdatedBy string    `json:"updatedBy"                 bson:"updatedBy"`
+	Created   time.Time `json:"created"                   bson:"created"`
+	Updated   time.Time `json:"updated"                   bson:"updated"`
+}
+
+// IsValid check if model is valid
+func (r ProvisioningRule) IsValid() []error {
+	errs := make([]error, 0)
+
+	if r.Id == "" {
+		errs = append(errs, fmt.Errorf("id is required"))
+	}
+
+	if r.AccountID == "" {
+		errs = append(errs, fmt.Errorf("accountid is required"))
+	}
+
+	if r.Domain == "" && r.Group == "" {
+		errs = append(errs, fmt.Errorf("domain or group is required"))
+	}
+
+	if r.Group != "" && r.Domain == "" && r.Issuer == "" {
+		errs = append(errs, fmt.Errorf("a group rule needs a domain or an issuer"))
+	}
+
+	// nobody becomes an owner by logging in
+	if r.Role != "Admin" && r.Role != "User" && r.Role != "Guest" {
+		errs = append(errs, fmt.Errorf("role %s is invalid", r.Role))
+	}
+
+	return errs
+}
+
+// Matches returns true if the rule applies to a user from the issuer with the
+// email's domain and groups.  domain is empty unless the email is verified.
+func (r ProvisioningRule) Matches(issuer string, domain string, groups []string) bool {
+	if r.Domain == "" && r.Issuer == "" {
+		return false
+	}
+	if r.Domain != "" && r.Domain != domain {
+		return false
+	}
+	if r.Issuer != "" && r.Issuer != issuer {
+		return false
+	}
+	if r.Group == "" {
+		return true
+	}
+	for _, g := range groups {
+		if g == r.Group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// RateLimit is a token bucket shared by every API replica.  Id names the
+// limit and who it applies to, such as login:ip:192.0.2.1.
+type RateLimit struct {
+	Id      string    `json:"id"                        bson:"id"`
+	Tokens  float64   `json:"tokens"                    bson:"tokens"`
+	Allowed bool      `json:"allowed"                   bson:"allowed"`
+	Updated time.Time `json:"updated"                   bson:"updated"`
+	Expires time.Time `json:"expires"                   bson:"expires"`
+}
+
+// LoginFailure counts the failed logins of a user since their last success.
+// Once there are too many the user is locked out until LockedUntil.
+type LoginFailure struct {
+	Id          string     `json:"id"                        bson:"id"`
+	Failures    int        `json:"failures"                  bson:"failures"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"     bson:"lockedUntil,omitempty"`
+	Updated     time.Time  `json:"updated"                   bson:"updated"`
+	Expires     time.Time  `json:"expires"                   bson:"expires"`
+}
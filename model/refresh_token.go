@@ -2,14 +2,26 @@ package model
 
 import "time"
 
-// RefreshToken represents a stored OAuth2 refresh token and its metadata
-// Place this file as model/refresh_token.go
-
+// RefreshToken represents a stored OAuth2 refresh token and its metadata.
+// Refresh tokens the server issues for its own sessions also carry the
+// session they belong to.  Every token of a session shares its Id and is
+// stored as a hash; each use rotates it to a new token.
 type RefreshToken struct {
-	Token     string    `json:"token"      bson:"token"`
-	Sub       string    `json:"sub"        bson:"sub"`
-	Email     string    `json:"email"      bson:"email"`
-	IssuedAt  time.Time `json:"issued_at"  bson:"issued_at"`
-	ExpiresAt time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
-	Revoked   bool      `json:"revoked"    bson:"revoked"`
+	Token     string     `json:"-"                    bson:"token"`
+	Sub       string     `json:"sub"                  bson:"sub"`
+	Email     string     `json:"email"                bson:"email"`
+	IssuedAt  time.Time  `json:"issued_at"            bson:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	Revoked   bool       `json:"revoked"              bson:"revoked"`
+	Id        string     `json:"id,omitempty"         bson:"id,omitempty"`
+	Name      string     `json:"-"                    bson:"name,omitempty"`
+	Picture   string     `json:"-"                    bson:"picture,omitempty"`
+	AccountID string     `json:"-"                    bson:"accountid,omitempty"`
+	Provider  string     `json:"provider,omitempty"   bson:"provider,omitempty"`
+	Device    string     `json:"device,omitempty"     bson:"device,omitempty"`
+	IP        string     `json:"ip,omitempty"         bson:"ip,omitempty"`
+	Created   time.Time  `json:"created,omitempty"    bson:"created,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"  bson:"last_used,omitempty"`
+	Rotated   bool       `json:"-"                    bson:"rotated,omitempty"`
+	Current   bool       `json:"current"              bson:"-"`
 }
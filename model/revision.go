@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// Revision is a numbered version of the settings of a network or VPN.  A
+// network's revisions keep its Default settings and a VPN's its Default and
+// Current settings, without the private key.  NetRevision is set on the VPN
+// revisions that a change to their network made, and Rollback on revisions
+// that rolled back to an earlier one.
+type Revision struct {
+	Id          string    `json:"id"                        bson:"id"`
+	Kind        string    `json:"kind"                      bson:"kind"`
+	ObjectID    string    `json:"objectId"                  bson:"objectId"`
+	AccountID   string    `json:"accountid"                 bson:"accountid"`
+	NetId       string    `json:"netid"                     bson:"netid"`
+	Number      int       `json:"number"                    bson:"number"`
+	NetRevision int       `json:"netRevision,omitempty"     bson:"netRevision,omitempty"`
+	Rollback    int       `json:"rollback,omitempty"        bson:"rollback,omitempty"`
+	Default     *Settings `json:"default,omitempty"         bson:"default,omitempty"`
+	Current     *Settings `json:"current,omitempty"         bson:"current,omitempty"`
+	CreatedBy   string    `json:"createdBy"                 bson:"createdBy"`
+	Created     time.Time `json:"created"                   bson:"created"`
+}
+
+// Rollback is the outcome of rolling a network back to a revision
+type Rollback struct {
+	Net  *Network      `json:"net"`
+	VPNs []RollbackVPN `json:"vpns"`
+}
+
+// RollbackVPN says whether a VPN the rolled back changes touched was restored
+type RollbackVPN struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Revision int    `json:"revision"`
+	Error    string `json:"error,omitempty"`
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// Rollout is a change to a network's settings applied to a few canary VPNs
+// first.  Once the canaries have checked in healthy for Wait the change goes
+// to the rest of the network, automatically if Auto is set or else when it's
+// approved.  If a canary stops checking in the network and canaries are
+// rolled back to revision Before.  Fetched is when each canary's device was
+// first seen with the change.
+type Rollout struct {
+	Id        string               `json:"id"                        bson:"id"`
+	AccountID string               `json:"accountid"                 bson:"accountid"`
+	NetId     string               `json:"netid"                     bson:"netid"`
+	Status    string               `json:"status"                    bson:"status"`
+	Tag       string               `json:"tag,omitempty"             bson:"tag,omitempty"`
+	Percent   int                  `json:"percent,omitempty"         bson:"percent,omitempty"`
+	Wait      string               `json:"wait"                      bson:"wait"`
+	Auto      bool                 `json:"auto"                      bson:"auto"`
+	Revision  int                  `json:"revision"                  bson:"revision"`
+	Before    int                  `json:"before"                    bson:"before"`
+	Canaries  []string             `json:"canaries"                  bson:"canaries"`
+	Fetched   map[string]time.Time `json:"fetched,omitempty"         bson:"fetched,omitempty"`
+	Reason    string               `json:"reason,omitempty"          bson:"reason,omitempty"`
+	CreatedBy string               `json:"createdBy"                 bson:"createdBy"`
+	UpdatedBy string               `json:"updatedBy"                 bson:"updatedBy"`
+	Created   time.Time            `json:"created"                   bson:"created"`
+	Updated   time.Time            `json:"updated"                   bson:"updated"`
+	Deadline  time.Time            `json:"deadline"                  bson:"deadline"`
+}
+
+// Handshake is the latest WireGuard handshake a device reported for one of
+// its VPNs, with any of the VPN's peers.  Id is the VPN's.
+type Handshake struct {
+	Id       string    `json:"id"                        bson:"id"`
+	DeviceID string    `json:"deviceid"                  bson:"deviceid"`
+	Latest   time.Time `json:"latest"                    bson:"latest"`
+	Reported time.Time `json:"reported"                  bson:"reported"`
+}
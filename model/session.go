@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// SigningKey is an RSA key the server signs session tokens with.  Keys are
+// shared by every API replica through the database and are removed once no
+// token signed with them can still be valid.
+type SigningKey struct {
+	Id         string    `json:"kid"                       bson:"id"`
+	PrivateKey string    `json:"-"                         bson:"privateKey"`
+	Created    time.Time `json:"created"                   bson:"created"`
+	Expires    time.Time `json:"expires"                   bson:"expires"`
+}
+
+// RevokedSession denies a session token before it expires.  Id is either the
+// token id, or "user:" and an email to revoke every session of that user
+// issued before Revoked.
+type RevokedSession struct {
+	Id      string    `json:"id"                        bson:"id"`
+	Email   string    `json:"email"                     bson:"email"`
+	Revoked time.Time `json:"revoked"                   bson:"revoked"`
+	Expires time.Time `json:"expires"                   bson:"expires"`
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nettica-com/nettica-admin/util"
+)
+
+// Transfer structure records the hand over of an account from its owner
+// to another member of the account
+type Transfer struct {
+	Id          string     `json:"id"                        bson:"id"`
+	AccountID   string     `json:"accountid"                 bson:"accountid"`
+	FromEmail   string     `json:"fromEmail"                 bson:"fromEmail"`
+	ToEmail     string     `json:"toEmail"                   bson:"toEmail"`
+	ToAccountID string     `json:"toAccountid"               bson:"toAccountid"`
+	Status      string     `json:"status"                    bson:"status"`
+	CreatedBy   string     `json:"createdBy"                 bson:"createdBy"`
+	UpdatedBy   string     `json:"updatedBy"                 bson:"updatedBy"`
+	Created     time.Time  `json:"created"                   bson:"created"`
+	Updated     time.Time  `json:"updated"                   bson:"updated"`
+	Expires     time.Time  `json:"expires"                   bson:"expires"`
+	Completed   *time.Time `json:"completed,omitempty"       bson:"completed,omitempty"`
+}
+
+// IsValid check if model is valid
+func (t Transfer) IsValid() []error {
+	errs := make([]error, 0)
+
+	if t.Id == "" {
+		errs = append(errs, fmt.Errorf("id is required"))
+	}
+
+	if t.AccountID == "" {
+		errs = append(errs, fmt.Errorf("accountid is required"))
+	}
+
+	if t.ToAccountID == "" {
+		errs = append(errs, fmt.Errorf("toAccountid is required"))
+	}
+
+	if !util.RegexpEmail.MatchString(t.FromEmail) {
+		errs = append(errs, fmt.Errorf("fromEmail %s is invalid", t.FromEmail))
+	}
+
+	if !util.RegexpEmail.MatchString(t.ToEmail) {
+		errs = append(errs, fmt.Errorf("toEmail %s is invalid", t.ToEmail))
+	}
+
+	switch t.Status {
+	case "Pending", "Accepted", "Declined", "Cancelled", "Expired":
+	default:
+		errs = append(errs, fmt.Errorf("status %s is invalid", t.Status))
+	}
+
+	return errs
+}
@@ -17,6 +17,8 @@ type User struct {
 	Picture   string    `json:"picture"      bson:"picture"`
 	Issuer    string    `json:"issuer"       bson:"issuer"`
 	Plan      string    `json:"plan"         bson:"plan"`
+	Groups    []string  `json:"groups,omitempty" bson:"groups,omitempty"`
+	Verified  bool      `json:"verified"     bson:"verified"`
 	IssuedAt  time.Time `json:"issuedAt"     bson:"issuedAt"`
 	CreatedBy string    `json:"createdBy"    bson:"createdBy"`
 	Created   time.Time `json:"created_at"   bson:"created_at"`
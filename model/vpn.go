@@ -30,6 +30,7 @@ type VPN struct {
 	FailCount         int        `json:"failCount"                 bson:"failCount"`
 	Enable            bool       `json:"enable"                    bson:"enable"`
 	ReadOnly          *bool      `json:"readonly,omitempty"        bson:"readonly,omitempty"`
+	Lock              *Lock      `json:"lock,omitempty"            bson:"lock,omitempty"`
 	TextEnabled       *bool      `json:"textEnabled,omitempty"     bson:"textEnabled,omitempty"`
 	VideoEnabled      *bool      `json:"videoEnabled,omitempty"    bson:"videoEnabled,omitempty"`
 	ConferenceEnabled *bool      `json:"conferenceEnabled,omitempty" bson:"conferenceEnabled,omitempty"`
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// WebAuthnCredential is a passkey registered by a user.  The credential
+// itself is kept as the json the webauthn library produces.
+type WebAuthnCredential struct {
+	Id         string     `json:"id"                        bson:"id"`
+	Email      string     `json:"email"                     bson:"email"`
+	Name       string     `json:"name"                      bson:"name"`
+	Credential string     `json:"-"                         bson:"credential"`
+	Created    time.Time  `json:"created"                   bson:"created"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"        bson:"lastUsed,omitempty"`
+}
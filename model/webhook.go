@@ -0,0 +1,103 @@
+package model
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// WebhookEvents are the types of event a webhook can subscribe to, or "*"
+// for all of them
+var WebhookEvents = []string{
+	"device.created", "device.updated", "device.deleted", "device.offline",
+	"vpn.created", "vpn.updated", "vpn.deleted",
+	"network.created", "network.updated", "network.deleted",
+	"member.created", "member.updated", "member.deleted",
+	"subscription.created", "subscription.updated", "subscription.deleted",
+}
+
+// Webhook sends an account's events of the types it subscribes to to URL.
+// Every delivery is signed with Secret.
+type Webhook struct {
+	Id        string    `json:"id"                        bson:"id"`
+	AccountID string    `json:"accountid"                 bson:"accountid"`
+	URL       string    `json:"url"                       bson:"url"`
+	Secret    string    `json:"secret"                    bson:"secret"`
+	Events    []string  `json:"events"                    bson:"events"`
+	Enable    bool      `json:"enable"                    bson:"enable"`
+	CreatedBy string    `json:"createdBy"                 bson:"createdBy"`
+	UpdatedBy string    `json:"updatedBy"                 bson:"updatedBy"`
+	Created   time.Time `json:"created"                   bson:"created"`
+	Updated   time.Time `json:"updated"                   bson:"updated"`
+}
+
+// IsValid check if model is valid
+func (w Webhook) IsValid() []error {
+	errs := make([]error, 0)
+
+	if w.Id == "" {
+		errs = append(errs, fmt.Errorf("id is required"))
+	}
+
+	if w.AccountID == "" {
+		errs = append(errs, fmt.Errorf("accountid is required"))
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("url %s is invalid", w.URL))
+	}
+
+	if len(w.Events) == 0 {
+		errs = append(errs, fmt.Errorf("at least one event is required"))
+	}
+	for _, e := range w.Events {
+		if e != "*" && !slices.Contains(WebhookEvents, e) {
+			errs = append(errs, fmt.Errorf("event %s is invalid", e))
+		}
+	}
+
+	return errs
+}
+
+// Subscribes returns true if the webhook is sent events of the type
+func (w Webhook) Subscribes(event string) bool {
+	return w.Enable && (slices.Contains(w.Events, "*") || slices.Contains(w.Events, event))
+}
+
+// Event is something that happened to an account's devices, VPNs, networks,
+// members or subscriptions.  Data is the object after the change, or before
+// it for a delete, without its secrets.
+type Event struct {
+	Id        string                 `json:"id"                        bson:"id"`
+	Type      string                 `json:"type"                      bson:"type"`
+	AccountID string                 `json:"accountid"                 bson:"accountid"`
+	ObjectID  string                 `json:"objectId"                  bson:"objectId"`
+	Actor     string                 `json:"actor,omitempty"           bson:"actor,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"            bson:"data,omitempty"`
+	Changes   []AuditChange          `json:"changes,omitempty"         bson:"changes,omitempty"`
+	Created   time.Time              `json:"created"                   bson:"created"`
+	Expires   time.Time              `json:"-"                         bson:"expires"`
+}
+
+// Delivery is an attempt to send an event to a webhook, retried until the
+// webhook accepts it or it fails too many times.  Payload is the JSON that
+// was signed and sent.
+type Delivery struct {
+	Id           string    `json:"id"                        bson:"id"`
+	WebhookID    string    `json:"webhookId"                 bson:"webhookId"`
+	AccountID    string    `json:"accountid"                 bson:"accountid"`
+	EventID      string    `json:"eventId"                   bson:"eventId"`
+	Type         string    `json:"type"                      bson:"type"`
+	Payload      string    `json:"payload"                   bson:"payload"`
+	Status       string    `json:"status"                    bson:"status"`
+	Attempts     int       `json:"attempts"                  bson:"attempts"`
+	ResponseCode int       `json:"responseCode,omitempty"    bson:"responseCode,omitempty"`
+	Error        string    `json:"error,omitempty"           bson:"error,omitempty"`
+	Redelivers   string    `json:"redelivers,omitempty"      bson:"redelivers,omitempty"`
+	Created      time.Time `json:"created"                   bson:"created"`
+	Updated      time.Time `json:"updated"                   bson:"updated"`
+	NextAttempt  time.Time `json:"nextAttempt"               bson:"nextAttempt"`
+	Expires      time.Time `json:"-"                         bson:"expires"`
+}
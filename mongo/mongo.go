@@ -179,6 +179,11 @@ func Deserialize(id string, parm string, col string, t reflect.Type) (interface{
 		var c *model.Server
 		err = collection.FindOne(ctx, filter).Decode(&c)
 		return c, err
+
+	case "model.Transfer":
+		var c *model.Transfer
+		err = collection.FindOne(ctx, filter).Decode(&c)
+		return c, err
 	}
 	log.Infof("reflect.TypeOf(t) = %v", t.String())
 
@@ -1063,6 +1068,249 @@ func GetPushers() ([]*model.Pusher, error) {
 	return pushers, err
 }
 
+// ReadAllTransfers for an account from MongoDB
+func ReadAllTransfers(accountid string) ([]*model.Transfer, error) {
+
+	if !validate(accountid) {
+		return nil, errors.New("invalid id")
+	}
+
+	transfers := make([]*model.Transfer, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+
+	collection := client.Database("nettica").Collection("transfers")
+
+	filter := bson.D{{Key: "accountid", Value: accountid}}
+
+	cursor, err := collection.Find(ctx, filter)
+
+	if err == nil {
+
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var transfer *model.Transfer
+			err = cursor.Decode(&transfer)
+			if err == nil {
+				transfers = append(transfers, transfer)
+			}
+		}
+
+	}
+
+	return transfers, err
+}
+
+// ReadAllProvisioningRules for an account from MongoDB
+func ReadAllProvisioningRules(accountid string) ([]*model.ProvisioningRule, error) {
+
+	if !validate(accountid) {
+		return nil, errors.New("invalid id")
+	}
+
+	return readProvisioningRules(bson.D{{Key: "accountid", Value: accountid}})
+}
+
+// ReadMatchingProvisioningRules reads the rules of every account that could
+// apply to a user with the email domain or one of the groups
+func ReadMatchingProvisioningRules(domain string, groups []string) ([]*model.ProvisioningRule, error) {
+
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "domain", Value: domain}},
+		bson.D{{Key: "group", Value: bson.D{{Key: "$in", Value: groups}}}},
+	}}}
+
+	return readProvisioningRules(filter)
+}
+
+func readProvisioningRules(filter bson.D) ([]*model.ProvisioningRule, error) {
+
+	rules := make([]*model.ProvisioningRule, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+
+	collection := client.Database("nettica").Collection("provisioning_rules")
+
+	cursor, err := collection.Find(ctx, filter)
+
+	if err == nil {
+
+		defer cursor.Close(ctx)
+		for cursor.Next(ctx) {
+			var rule *model.ProvisioningRule
+			err = cursor.Decode(&rule)
+			if err == nil {
+				rules = append(rules, rule)
+			}
+		}
+
+	}
+
+	return rules, err
+}
+
+// ReadLocalUser reads a local auth provider user by email.  Local users are
+// stored with their bson tags so password hashes never pass through json.
+func ReadLocalUser(email string) (*model.LocalUser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("local_users")
+	var u model.LocalUser
+	err = collection.FindOne(ctx, bson.M{"email": email}).Decode(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// UpsertLocalUser creates or replaces a local auth provider user
+func UpsertLocalUser(u *model.LocalUser) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("local_users")
+	_, err = collection.ReplaceOne(ctx, bson.M{"email": u.Email}, u, options.Replace().SetUpsert(true))
+	return err
+}
+
+// ReadMFA reads the MFA enrolment of a user by email
+func ReadMFA(email string) (*model.MFA, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("mfa")
+	var m model.MFA
+	err = collection.FindOne(ctx, bson.M{"email": email}).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpsertMFA creates or replaces the MFA enrolment of a user
+func UpsertMFA(m *model.MFA) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("mfa")
+	_, err = collection.ReplaceOne(ctx, bson.M{"email": m.Email}, m, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteMFA removes the MFA enrolment of a user
+func DeleteMFA(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("mfa")
+	_, err = collection.DeleteOne(ctx, bson.M{"email": email})
+	return err
+}
+
+// ReadWebAuthnCredentials reads the passkeys registered by a user
+func ReadWebAuthnCredentials(email string) ([]*model.WebAuthnCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("webauthn")
+	cursor, err := collection.Find(ctx, bson.M{"email": email})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	credentials := make([]*model.WebAuthnCredential, 0)
+	for cursor.Next(ctx) {
+		var wc model.WebAuthnCredential
+		if err := cursor.Decode(&wc); err == nil {
+			credentials = append(credentials, &wc)
+		}
+	}
+	return credentials, nil
+}
+
+// ReadWebAuthnCredential reads a passkey by its credential id
+func ReadWebAuthnCredential(id string) (*model.WebAuthnCredential, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("webauthn")
+	var wc model.WebAuthnCredential
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&wc)
+	if err != nil {
+		return nil, err
+	}
+	return &wc, nil
+}
+
+// UpsertWebAuthnCredential creates or replaces a passkey
+func UpsertWebAuthnCredential(wc *model.WebAuthnCredential) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("webauthn")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": wc.Id}, wc, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteWebAuthnCredential removes a passkey
+func DeleteWebAuthnCredential(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("webauthn")
+	_, err = collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
 // StoreRefreshToken stores a refresh token in the refresh_tokens collection
 func StoreRefreshToken(token, sub, email string, issuedAt, expiresAt time.Time) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -1142,62 +1390,1250 @@ func ListRefreshTokensForUser(sub string) ([]*model.RefreshToken, error) {
 	return tokens, nil
 }
 
-// Initialize the mongo db and create the indexes
-func Initialize() error {
+// InsertRefreshToken stores a refresh token of a server issued session
+func InsertRefreshToken(rt *model.RefreshToken) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
 	client, err := getMongoClient()
 	if err != nil {
 		log.Errorf("getMongoClient: %v", err)
 		return err
 	}
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	_, err = collection.InsertOne(ctx, rt)
+	return err
+}
 
-	// users
-
-	collection := client.Database("nettica").Collection("users")
-
-	// create an index for the email field
-	index := mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil}
-	_, err = collection.Indexes().CreateOne(ctx, index)
+// RotateRefreshToken marks a refresh token used.  It returns false if the
+// token was already used or revoked, so only one caller can rotate it.
+func RotateRefreshToken(token string, used time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
 	}
-
-	// accounts
-
-	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"token": token, "rotated": bson.M{"$ne": true}, "revoked": false},
+		bson.M{"$set": bson.M{"rotated": true, "last_used": used}})
 	if err != nil {
-		log.Error(err)
+		return false, err
 	}
-	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil})
+	return result.ModifiedCount == 1, nil
+}
+
+// ReadSessions reads the current refresh token of each active session of a user
+func ReadSessions(email string) ([]*model.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
 	}
-	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"parent": 1}, Options: nil})
-	if err != nil {
-		log.Error(err)
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	filter := bson.M{
+		"email":      email,
+		"id":         bson.M{"$exists": true},
+		"rotated":    bson.M{"$ne": true},
+		"revoked":    false,
+		"expires_at": bson.M{"$gt": time.Now().UTC()},
 	}
-	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"apiKey": 1}, Options: nil})
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"created": -1}))
 	if err != nil {
-		log.Error(err)
+		return nil, err
 	}
+	defer cursor.Close(ctx)
+	sessions := make([]*model.RefreshToken, 0)
+	for cursor.Next(ctx) {
+		var rt model.RefreshToken
+		if err := cursor.Decode(&rt); err == nil {
+			sessions = append(sessions, &rt)
+		}
+	}
+	return sessions, nil
+}
 
-	// devices
-
-	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+// RevokeRefreshTokens revokes every refresh token of a session
+func RevokeRefreshTokens(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getMongoClient: %v", err)
+		return err
 	}
-	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"accountid": 1}, Options: nil})
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	_, err = collection.UpdateMany(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// RevokeUserRefreshTokens revokes the refresh tokens of every session of a user
+func RevokeUserRefreshTokens(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getMongoClient: %v", err)
+		return err
 	}
-	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"createdBy": 1}, Options: nil})
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	_, err = collection.UpdateMany(ctx, bson.M{"email": email, "id": bson.M{"$exists": true}}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// InsertDeviceAuthorization stores a new device authorization
+func InsertDeviceAuthorization(da *model.DeviceAuthorization) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
 	if err != nil {
-		log.Error(err)
+		log.Errorf("getMongoClient: %v", err)
+		return err
 	}
-	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"apiKey": 1}, Options: nil})
+	collection := client.Database("nettica").Collection("device_authorizations")
+	_, err = collection.InsertOne(ctx, da)
+	return err
+}
+
+// ReadDeviceAuthorization reads a device authorization by its deviceCode or userCode
+func ReadDeviceAuthorization(field string, value string) (*model.DeviceAuthorization, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("device_authorizations")
+	var da model.DeviceAuthorization
+	err = collection.FindOne(ctx, bson.M{field: value}).Decode(&da)
+	if err != nil {
+		return nil, err
+	}
+	return &da, nil
+}
+
+// UpdateDeviceAuthorization replaces a device authorization
+func UpdateDeviceAuthorization(da *model.DeviceAuthorization) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("device_authorizations")
+	_, err = collection.ReplaceOne(ctx, bson.M{"deviceCode": da.DeviceCode}, da)
+	return err
+}
+
+// UpdateDeviceAuthorizationPoll records when an agent last polled and the interval it must keep
+func UpdateDeviceAuthorizationPoll(deviceCode string, lastPoll time.Time, interval int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("device_authorizations")
+	_, err = collection.UpdateOne(ctx, bson.M{"deviceCode": deviceCode}, bson.M{"$set": bson.M{"lastPoll": lastPoll, "interval": interval}})
+	return err
+}
+
+// ClaimDeviceAuthorization moves a device authorization from one status to
+// another.  It returns false if the status was not from, so only one caller
+// can make each move.
+func ClaimDeviceAuthorization(deviceCode string, from string, to string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("device_authorizations")
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"deviceCode": deviceCode, "status": from},
+		bson.M{"$set": bson.M{"status": to}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// ReadSigningKeys reads the session signing keys that have not expired
+func ReadSigningKeys() ([]*model.SigningKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("signing_keys")
+	cursor, err := collection.Find(ctx, bson.M{"expires": bson.M{"$gt": time.Now().UTC()}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	keys := make([]*model.SigningKey, 0)
+	for cursor.Next(ctx) {
+		var k model.SigningKey
+		if err := cursor.Decode(&k); err == nil {
+			keys = append(keys, &k)
+		}
+	}
+	return keys, nil
+}
+
+// InsertSigningKey stores a new session signing key
+func InsertSigningKey(k *model.SigningKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("signing_keys")
+	_, err = collection.InsertOne(ctx, k)
+	return err
+}
+
+// UpsertRevokedSession adds a session, or all of a user's sessions, to the denylist
+func UpsertRevokedSession(r *model.RevokedSession) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("revoked_sessions")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": r.Id}, r, options.Replace().SetUpsert(true))
+	return err
+}
+
+// ReadRevokedSessions reads the denylist entries with any of the given ids
+func ReadRevokedSessions(ids []string) ([]*model.RevokedSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("revoked_sessions")
+	cursor, err := collection.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	revoked := make([]*model.RevokedSession, 0)
+	for cursor.Next(ctx) {
+		var r model.RevokedSession
+		if err := cursor.Decode(&r); err == nil {
+			revoked = append(revoked, &r)
+		}
+	}
+	return revoked, nil
+}
+
+// TakeRateLimitToken refills the token bucket id for the time since it was
+// last used and takes a token if there is one.  The whole update is one
+// atomic operation, so replicas sharing the bucket never overspend it.  It
+// returns whether a token was taken and the tokens left.
+func TakeRateLimitToken(id string, burst float64, rate float64, expires time.Time) (bool, float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, 0, err
+	}
+	collection := client.Database("nettica").Collection("rate_limits")
+
+	now := time.Now().UTC()
+	elapsed := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated", now}}}}, 1000}}
+	refilled := bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$tokens", burst}}, bson.M{"$multiply": bson.A{elapsed, rate}}}}}}
+
+	pipeline := bson.A{
+		bson.M{"$set": bson.M{"tokens": refilled, "updated": now, "expires": expires}},
+		bson.M{"$set": bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}},
+		bson.M{"$set": bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var limit model.RateLimit
+	err = collection.FindOneAndUpdate(ctx, bson.M{"id": id}, pipeline, opts).Decode(&limit)
+	if mongo.IsDuplicateKeyError(err) {
+		// another replica created the bucket first
+		err = collection.FindOneAndUpdate(ctx, bson.M{"id": id}, pipeline, opts).Decode(&limit)
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	return limit.Allowed, limit.Tokens, nil
+}
+
+// ReadLoginFailure reads the failed logins of a user
+func ReadLoginFailure(id string) (*model.LoginFailure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("login_failures")
+	var failure model.LoginFailure
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&failure)
+	if err != nil {
+		return nil, err
+	}
+	return &failure, nil
+}
+
+// AddLoginFailure counts a failed login and returns the user's failures
+func AddLoginFailure(id string, expires time.Time) (*model.LoginFailure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("login_failures")
+
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"updated": time.Now().UTC(), "expires": expires},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var failure model.LoginFailure
+	err = collection.FindOneAndUpdate(ctx, bson.M{"id": id}, update, opts).Decode(&failure)
+	if mongo.IsDuplicateKeyError(err) {
+		err = collection.FindOneAndUpdate(ctx, bson.M{"id": id}, update, opts).Decode(&failure)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &failure, nil
+}
+
+// LockLogin locks a user out until the given time
+func LockLogin(id string, until time.Time, expires time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("login_failures")
+	_, err = collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"lockedUntil": until, "expires": expires}})
+	return err
+}
+
+// DeleteLoginFailure forgets the failed logins of a user
+func DeleteLoginFailure(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("login_failures")
+	_, err = collection.DeleteOne(ctx, bson.M{"id": id})
+	return err
+}
+
+// InsertLoginEvent adds a login attempt to the login history
+func InsertLoginEvent(event *model.LoginEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("login_history")
+	_, err = collection.InsertOne(ctx, event)
+	return err
+}
+
+// ReadLoginHistory reads the latest login attempts of a user, newest first
+func ReadLoginHistory(email string, limit int64) ([]*model.LoginEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("login_history")
+	opts := options.Find().SetSort(bson.M{"created": -1}).SetLimit(limit)
+	cursor, err := collection.Find(ctx, bson.M{"email": email}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	events := make([]*model.LoginEvent, 0)
+	for cursor.Next(ctx) {
+		var event model.LoginEvent
+		if err := cursor.Decode(&event); err == nil {
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func InsertAuditEntry(entry *model.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("audit")
+	_, err = collection.InsertOne(ctx, entry)
+	return err
+}
+
+// ReadAuditEntries reads a page of an account's audit log, newest first, and
+// the number of entries matching the query
+func ReadAuditEntries(q *model.AuditQuery) ([]*model.AuditEntry, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, 0, err
+	}
+	collection := client.Database("nettica").Collection("audit")
+
+	filter := bson.M{"accountid": q.AccountID}
+	if q.Kind != "" {
+		filter["kind"] = q.Kind
+	}
+	if q.Action != "" {
+		filter["action"] = q.Action
+	}
+	if q.ObjectID != "" {
+		filter["objectId"] = q.ObjectID
+	}
+	if q.Actor != "" {
+		filter["actor"] = q.Actor
+	}
+	created := bson.M{}
+	if !q.From.IsZero() {
+		created["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		created["$lt"] = q.To
+	}
+	if len(created) > 0 {
+		filter["created"] = created
+	}
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().SetSort(bson.M{"created": -1}).SetSkip(q.Offset).SetLimit(q.Limit)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+	entries := make([]*model.AuditEntry, 0)
+	for cursor.Next(ctx) {
+		var entry model.AuditEntry
+		if err := cursor.Decode(&entry); err == nil {
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, total, nil
+}
+
+// InsertRevision adds a revision.  The number of a revision is unique for
+// its object, so a revision numbered concurrently fails as a duplicate.
+func InsertRevision(revision *model.Revision) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("revisions")
+	_, err = collection.InsertOne(ctx, revision)
+	return err
+}
+
+// ReadRevision reads a revision of a network or VPN by its number
+func ReadRevision(objectId string, number int) (*model.Revision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("revisions")
+	var revision model.Revision
+	err = collection.FindOne(ctx, bson.M{"objectId": objectId, "number": number}).Decode(&revision)
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// ReadLatestRevision reads the newest revision of a network or VPN
+func ReadLatestRevision(objectId string) (*model.Revision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("revisions")
+	var revision model.Revision
+	opts := options.FindOne().SetSort(bson.M{"number": -1})
+	err = collection.FindOne(ctx, bson.M{"objectId": objectId}, opts).Decode(&revision)
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// ReadRevisions reads the revisions of a network or VPN, newest first
+func ReadRevisions(objectId string) ([]*model.Revision, error) {
+	return readRevisions(bson.M{"objectId": objectId}, -1)
+}
+
+// ReadRevisionsForNet reads the VPN revisions made by changes to a network
+// after its revision number, oldest first
+func ReadRevisionsForNet(netId string, number int) ([]*model.Revision, error) {
+	return readRevisions(bson.M{"netid": netId, "kind": "vpn", "netRevision": bson.M{"$gt": number}}, 1)
+}
+
+func readRevisions(filter bson.M, order int) ([]*model.Revision, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("revisions")
+	opts := options.Find().SetSort(bson.D{{Key: "number", Value: order}})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	revisions := make([]*model.Revision, 0)
+	for cursor.Next(ctx) {
+		var revision model.Revision
+		if err := cursor.Decode(&revision); err == nil {
+			revisions = append(revisions, &revision)
+		}
+	}
+	return revisions, nil
+}
+
+// InsertRollout adds a rollout
+func InsertRollout(rollout *model.Rollout) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("rollouts")
+	_, err = collection.InsertOne(ctx, rollout)
+	return err
+}
+
+// ReadRollout reads a rollout by id
+func ReadRollout(id string) (*model.Rollout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("rollouts")
+	var rollout model.Rollout
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&rollout)
+	if err != nil {
+		return nil, err
+	}
+	return &rollout, nil
+}
+
+// ReadRollouts reads the rollouts of a network, or with netId "" the ones
+// with one of the statuses, newest first
+func ReadRollouts(netId string, status ...string) ([]*model.Rollout, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("rollouts")
+
+	filter := bson.M{}
+	if netId != "" {
+		filter["netid"] = netId
+	}
+	if len(status) > 0 {
+		filter["status"] = bson.M{"$in": status}
+	}
+
+	opts := options.Find().SetSort(bson.M{"created": -1})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	rollouts := make([]*model.Rollout, 0)
+	for cursor.Next(ctx) {
+		var rollout model.Rollout
+		if err := cursor.Decode(&rollout); err == nil {
+			rollouts = append(rollouts, &rollout)
+		}
+	}
+	return rollouts, nil
+}
+
+// UpdateRolloutStatus moves a rollout from one status to another.  It
+// returns false if the rollout wasn't in status from, such as when another
+// replica moved it first.
+func UpdateRolloutStatus(id string, from string, to string, reason string, updatedBy string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("rollouts")
+
+	set := bson.M{"status": to, "updatedBy": updatedBy, "updated": time.Now().UTC()}
+	if reason != "" {
+		set["reason"] = reason
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"id": id, "status": from}, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// SetRolloutFetched records when a rollout's canary was first seen with the change
+func SetRolloutFetched(id string, vpnId string, fetched time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("rollouts")
+
+	_, err = collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"fetched." + vpnId: fetched}})
+	return err
+}
+
+// SetHandshake records the latest handshake a device reported for a VPN
+func SetHandshake(handshake *model.Handshake) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("handshakes")
+	opts := options.Replace().SetUpsert(true)
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": handshake.Id}, handshake, opts)
+	return err
+}
+
+// ReadHandshake reads the latest handshake reported for a VPN
+func ReadHandshake(id string) (*model.Handshake, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("handshakes")
+	var handshake model.Handshake
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&handshake)
+	if err != nil {
+		return nil, err
+	}
+	return &handshake, nil
+}
+
+// InsertChangeRequest adds a change request
+func InsertChangeRequest(request *model.ChangeRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("change_requests")
+	_, err = collection.InsertOne(ctx, request)
+	return err
+}
+
+// ReadChangeRequest reads a change request by id
+func ReadChangeRequest(id string) (*model.ChangeRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("change_requests")
+	var request model.ChangeRequest
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&request)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// ReadChangeRequests reads the change requests of a network, or with netId
+// "" the ones with one of the statuses, newest first
+func ReadChangeRequests(netId string, status ...string) ([]*model.ChangeRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("change_requests")
+
+	filter := bson.M{}
+	if netId != "" {
+		filter["netid"] = netId
+	}
+	if len(status) > 0 {
+		filter["status"] = bson.M{"$in": status}
+	}
+
+	opts := options.Find().SetSort(bson.M{"created": -1})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	requests := make([]*model.ChangeRequest, 0)
+	for cursor.Next(ctx) {
+		var request model.ChangeRequest
+		if err := cursor.Decode(&request); err == nil {
+			requests = append(requests, &request)
+		}
+	}
+	return requests, nil
+}
+
+// UpdateChangeRequestStatus moves a change request from one status to
+// another.  It returns false if the request wasn't in status from, such as
+// when someone else decided it first.
+func UpdateChangeRequestStatus(id string, from string, to string, decidedBy string, reason string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("change_requests")
+
+	set := bson.M{"status": to, "updated": time.Now().UTC()}
+	if decidedBy != "" {
+		set["decidedBy"] = decidedBy
+	}
+	if reason != "" {
+		set["error"] = reason
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"id": id, "status": from}, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// SetLock locks a network, VPN or device in a collection, or with a nil lock
+// releases it, if its lock is still from, the one it was read with.  It
+// returns false if the lock was changed in the meantime.
+func SetLock(id string, col string, from *model.Lock, lock *model.Lock) (bool, error) {
+	if !validate(id) || !validate(col) {
+		return false, errors.New("invalid id")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection(col)
+
+	filter := bson.M{"id": id, "lock": nil}
+	if from != nil {
+		filter = bson.M{"id": id, "lock.owner": from.Owner, "lock.created": from.Created}
+	}
+
+	update := bson.M{"$set": bson.M{"readonly": true, "lock": lock}}
+	if lock == nil {
+		update = bson.M{"$set": bson.M{"readonly": false}, "$unset": bson.M{"lock": ""}}
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// InsertWebhook adds a webhook
+func InsertWebhook(webhook *model.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("webhooks")
+	_, err = collection.InsertOne(ctx, webhook)
+	return err
+}
+
+// ReadWebhook reads a webhook by id
+func ReadWebhook(id string) (*model.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("webhooks")
+	var webhook model.Webhook
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&webhook)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// ReadWebhooks reads the webhooks of an account, or with accountId "" the
+// enabled webhooks of every account subscribed to the event
+func ReadWebhooks(accountId string, event string) ([]*model.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("webhooks")
+
+	filter := bson.M{}
+	if accountId != "" {
+		filter["accountid"] = accountId
+	}
+	if event != "" {
+		filter["enable"] = true
+		filter["events"] = bson.M{"$in": bson.A{event, "*"}}
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	webhooks := make([]*model.Webhook, 0)
+	for cursor.Next(ctx) {
+		var webhook model.Webhook
+		if err := cursor.Decode(&webhook); err == nil {
+			webhooks = append(webhooks, &webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+// UpdateWebhook replaces a webhook
+func UpdateWebhook(webhook *model.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("webhooks")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": webhook.Id}, webhook)
+	return err
+}
+
+// DeleteWebhook removes a webhook and its deliveries
+func DeleteWebhook(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	_, err = client.Database("nettica").Collection("webhooks").DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	_, err = client.Database("nettica").Collection("deliveries").DeleteMany(ctx, bson.M{"webhookId": id})
+	return err
+}
+
+// InsertEvent adds an event.  It returns false if an event with its id was
+// already added, such as by another replica.
+func InsertEvent(event *model.Event) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("events")
+	_, err = collection.InsertOne(ctx, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// InsertDelivery adds a delivery
+func InsertDelivery(delivery *model.Delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("deliveries")
+	_, err = collection.InsertOne(ctx, delivery)
+	return err
+}
+
+// ReadDelivery reads a delivery by id
+func ReadDelivery(id string) (*model.Delivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("deliveries")
+	var delivery model.Delivery
+	err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&delivery)
+	if err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// ReadDeliveries reads the latest deliveries to a webhook, newest first
+func ReadDeliveries(webhookId string, limit int64) ([]*model.Delivery, error) {
+	opts := options.Find().SetSort(bson.M{"created": -1}).SetLimit(limit)
+	return readDeliveries(bson.M{"webhookId": webhookId}, opts)
+}
+
+// ReadDueDeliveries reads the pending deliveries whose next attempt is due
+func ReadDueDeliveries(now time.Time) ([]*model.Delivery, error) {
+	opts := options.Find().SetSort(bson.M{"nextAttempt": 1}).SetLimit(500)
+	return readDeliveries(bson.M{"status": "Pending", "nextAttempt": bson.M{"$lte": now}}, opts)
+}
+
+func readDeliveries(filter bson.M, opts *options.FindOptionsBuilder) ([]*model.Delivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("deliveries")
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	deliveries := make([]*model.Delivery, 0)
+	for cursor.Next(ctx) {
+		var delivery model.Delivery
+		if err := cursor.Decode(&delivery); err == nil {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+// ClaimDelivery puts a pending delivery's next attempt off until a time, so
+// no other replica makes the attempt due now.  It returns false if the
+// delivery isn't due at the time it was read any more.
+func ClaimDelivery(id string, due time.Time, until time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("deliveries")
+
+	filter := bson.M{"id": id, "status": "Pending", "nextAttempt": due}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"nextAttempt": until}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// UpdateDelivery replaces a delivery
+func UpdateDelivery(delivery *model.Delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("deliveries")
+	_, err = collection.ReplaceOne(ctx, bson.M{"id": delivery.Id}, delivery)
+	return err
+}
+
+// ReadExpiredSubscriptions reads the active subscriptions that expired before now
+func ReadExpiredSubscriptions(now time.Time) ([]*model.Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return nil, err
+	}
+	collection := client.Database("nettica").Collection("subscriptions")
+
+	filter := bson.M{
+		"status":    "active",
+		"expires":   bson.M{"$lt": now},
+		"isDeleted": bson.M{"$ne": true},
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	subscriptions := make([]*model.Subscription, 0)
+	for cursor.Next(ctx) {
+		var subscription model.Subscription
+		if err := cursor.Decode(&subscription); err == nil {
+			subscriptions = append(subscriptions, &subscription)
+		}
+	}
+	return subscriptions, nil
+}
+
+// DeleteExpiredRefreshTokens removes the refresh tokens that expired before now
+func DeleteExpiredRefreshTokens(now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return 0, err
+	}
+	collection := client.Database("nettica").Collection("refresh_tokens")
+	result, err := collection.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lt": now}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// InitJob records a job's state if it doesn't have any yet
+func InitJob(job *model.Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+	collection := client.Database("nettica").Collection("jobs")
+	opts := options.UpdateOne().SetUpsert(true)
+	_, err = collection.UpdateOne(ctx, bson.M{"id": job.Id}, bson.M{"$setOnInsert": job}, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// another replica recorded it first
+		return nil
+	}
+	return err
+}
+
+// ClaimJob takes the lease on a job until the given time, if it's due and
+// nobody else holds it.  With force it's taken even if the job isn't due.
+// It returns false if the lease wasn't taken.
+func ClaimJob(id string, owner string, now time.Time, until time.Time, force bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("jobs")
+
+	filter := bson.M{"id": id, "leaseUntil": bson.M{"$lte": now}}
+	if !force {
+		filter["nextRun"] = bson.M{"$lte": now}
+	}
+	update := bson.M{"$set": bson.M{"owner": owner, "leaseUntil": until, "lastStarted": now}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// FinishJob records how a run of a job went, when it's next due, and gives
+// up the lease.  It returns false if the owner no longer held the lease.
+func FinishJob(id string, owner string, finished time.Time, next time.Time, failure error) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return false, err
+	}
+	collection := client.Database("nettica").Collection("jobs")
+
+	set := bson.M{
+		"leaseUntil":   finished,
+		"nextRun":      next,
+		"lastFinished": finished,
+		"lastStatus":   "Succeeded",
+		"lastError":    "",
+	}
+	failures := 0
+	if failure != nil {
+		set["lastStatus"] = "Failed"
+		set["lastError"] = failure.Error()
+		failures = 1
+	}
+	update := bson.M{
+		"$set": set,
+		"$inc": bson.M{"runs": 1, "failures": failures},
+	}
+	result, err := collection.UpdateOne(ctx, bson.M{"id": id, "owner": owner}, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Initialize the mongo db and create the indexes
+func Initialize() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := getMongoClient()
+	if err != nil {
+		log.Errorf("getMongoClient: %v", err)
+		return err
+	}
+
+	// users
+
+	collection := client.Database("nettica").Collection("users")
+
+	// create an index for the email field
+	index := mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil}
+	_, err = collection.Indexes().CreateOne(ctx, index)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// accounts
+
+	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"parent": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("accounts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"apiKey": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// devices
+
+	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"accountid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"createdBy": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("devices").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"apiKey": 1}, Options: nil})
 	if err != nil {
 		log.Error(err)
 	}
@@ -1278,6 +2714,10 @@ func Initialize() error {
 	if err != nil {
 		log.Error(err)
 	}
+	_, err = client.Database("nettica").Collection("subscriptions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires", Value: 1}}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
 
 	// services
 
@@ -1344,6 +2784,244 @@ func Initialize() error {
 	if err != nil {
 		log.Error(err)
 	}
+	_, err = client.Database("nettica").Collection("refresh_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("refresh_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	// session refresh tokens are removed once the session can no longer be refreshed
+	_, err = client.Database("nettica").Collection("refresh_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0).SetPartialFilterExpression(bson.M{"id": bson.M{"$exists": true}})})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// transfers
+
+	_, err = client.Database("nettica").Collection("transfers").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("transfers").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"accountid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// local_users
+
+	_, err = client.Database("nettica").Collection("local_users").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// mfa
+
+	_, err = client.Database("nettica").Collection("mfa").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// webauthn
+
+	_, err = client.Database("nettica").Collection("webauthn").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("webauthn").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// signing_keys
+
+	_, err = client.Database("nettica").Collection("signing_keys").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("signing_keys").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// revoked_sessions
+
+	_, err = client.Database("nettica").Collection("revoked_sessions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("revoked_sessions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// device_authorizations
+
+	_, err = client.Database("nettica").Collection("device_authorizations").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"deviceCode": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("device_authorizations").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"userCode": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("device_authorizations").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// provisioning_rules
+
+	_, err = client.Database("nettica").Collection("provisioning_rules").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("provisioning_rules").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"accountid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("provisioning_rules").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"domain": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("provisioning_rules").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"group": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// rate_limits
+
+	_, err = client.Database("nettica").Collection("rate_limits").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("rate_limits").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// login_failures
+
+	_, err = client.Database("nettica").Collection("login_failures").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("login_failures").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// login_history
+
+	_, err = client.Database("nettica").Collection("login_history").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"email": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("login_history").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// audit
+
+	_, err = client.Database("nettica").Collection("audit").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "accountid", Value: 1}, {Key: "created", Value: -1}}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("audit").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"objectId": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// revisions
+
+	_, err = client.Database("nettica").Collection("revisions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "objectId", Value: 1}, {Key: "number", Value: -1}}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("revisions").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "netid", Value: 1}, {Key: "netRevision", Value: 1}}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// rollouts
+
+	_, err = client.Database("nettica").Collection("rollouts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("rollouts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"netid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("rollouts").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"status": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// handshakes
+
+	_, err = client.Database("nettica").Collection("handshakes").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// change requests
+
+	_, err = client.Database("nettica").Collection("change_requests").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("change_requests").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"netid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("change_requests").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"status": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// webhooks
+
+	_, err = client.Database("nettica").Collection("webhooks").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("webhooks").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"accountid": 1}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("events").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("events").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("deliveries").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("deliveries").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "created", Value: -1}}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("deliveries").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttempt", Value: 1}}, Options: nil})
+	if err != nil {
+		log.Error(err)
+	}
+	_, err = client.Database("nettica").Collection("deliveries").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"expires": 1}, Options: options.Index().SetExpireAfterSeconds(0)})
+	if err != nil {
+		log.Error(err)
+	}
+
+	// jobs
+	_, err = client.Database("nettica").Collection("jobs").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"id": 1}, Options: options.Index().SetUnique(true)})
+	if err != nil {
+		log.Error(err)
+	}
 
 	return nil
 }
@@ -351,6 +351,36 @@ func DumpUserEmail(accountId string) ([]byte, error) {
 	})
 }
 
+// NotifyEmail is a short message with an optional call to action
+func NotifyEmail(title, message, link, button string) ([]byte, error) {
+	file := "notify.html"
+	server := os.Getenv("SERVER")
+
+	bytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := template.New("notify").Parse(string(bytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return dump(t, struct {
+		Title   string
+		Message string
+		Link    string
+		Button  string
+		Server  string
+	}{
+		Title:   title,
+		Message: message,
+		Link:    link,
+		Button:  button,
+		Server:  server,
+	})
+}
+
 func dump(tpl *template.Template, data interface{}) ([]byte, error) {
 	var tplBuff bytes.Buffer
 
@@ -20,6 +20,12 @@ const routes = [
     component: () => import('../views/Agent.vue'),
     meta: { requiresAuth: false },
   },
+  {
+    path: '/device',
+    name: 'device',
+    component: () => import('../views/DeviceAuthorize.vue'),
+    meta: { requiresAuth: true },
+  },
   {
     path: '/devices',
     name: 'devices',
@@ -44,6 +50,18 @@ const routes = [
     component: () => import('../views/Services.vue'),
     meta: { requiresAuth: true },
   },
+  {
+    path: '/verify',
+    name: 'verify',
+    component: () => import('../views/LocalLink.vue'),
+    meta: { requiresAuth: false },
+  },
+  {
+    path: '/reset',
+    name: 'reset',
+    component: () => import('../views/LocalLink.vue'),
+    meta: { requiresAuth: false },
+  },
   {
     path: '/login/:pathMatch(.*)*',
     name: 'login',
@@ -14,6 +14,10 @@ export const useAuthStore = defineStore('auth', {
     authRedirectUrl: '',
     requiresAuth: true,
     intendedRoute: '',
+    mfa: '',
+    challenge: '',
+    mfaEnrollment: null,
+    recoveryCodes: [],
   }),
 
   getters: {
@@ -31,14 +35,15 @@ export const useAuthStore = defineStore('auth', {
       }
     },
 
-    async oauth2_url() {
+    async oauth2_url(provider) {
       if (TokenService.getToken()) {
         ApiService.setHeader()
         await this.fetchUser()
         return
       }
       try {
-        const resp = await ApiService.get('/auth/oauth2_url')
+        const query = provider ? '?provider=' + encodeURIComponent(provider) : ''
+        const resp = await ApiService.get('/auth/oauth2_url' + query)
         if (resp.clientId) {
           this.clientId = resp.clientId
           TokenService.saveClientId(resp.clientId)
@@ -70,6 +75,15 @@ export const useAuthStore = defineStore('auth', {
       try {
         const resp = await ApiService.post('/auth/login', data)
         // console.log('login', resp)
+        if (resp.mfa) {
+          // the password was accepted, a second factor is needed
+          this.mfa = resp.mfa
+          this.challenge = resp.challenge
+          if (resp.mfa === 'enroll') {
+            this.mfaEnrollment = await ApiService.post('/auth/mfa/enroll', { challenge: resp.challenge })
+          }
+          return
+        }
         this.code = resp.code
         TokenService.saveCode(resp.code)
         this.State = resp.state
@@ -84,6 +98,36 @@ export const useAuthStore = defineStore('auth', {
       }
     },
 
+    async mfa_verify(code) {
+      try {
+        const resp = await ApiService.post('/auth/mfa/verify', { challenge: this.challenge, code })
+        this.State = resp.state
+        TokenService.saveState(resp.state)
+        this.authRedirectUrl = resp.redirect_uri
+        this.mfa = ''
+        this.challenge = ''
+        this.mfaEnrollment = null
+        if (resp.recoveryCodes && resp.recoveryCodes.length > 0) {
+          // show the recovery codes once before continuing
+          this.recoveryCodes = resp.recoveryCodes
+          return
+        }
+        this.authStatus = 'redirect'
+      } catch (err) {
+        this.error = err.response?.data?.error
+        if (err.response?.status === 401) {
+          this.mfa = ''
+          this.challenge = ''
+          this.mfaEnrollment = null
+        }
+      }
+    },
+
+    mfa_continue() {
+      this.recoveryCodes = []
+      this.authStatus = 'redirect'
+    },
+
     async oauth2_exchange(data) {
       // console.log('oauth2_exchange', data)
       if (data.clientId === undefined) {
@@ -167,5 +167,18 @@ export const useDeviceStore = defineStore('device', {
     readConfigs() {
       this.devices.forEach((device) => this.readConfig(device))
     },
+
+    // device authorizations started by agents without a browser
+    readAuthorization(userCode) {
+      return ApiService.get('/auth/device?user_code=' + encodeURIComponent(userCode))
+    },
+
+    approveAuthorization(data) {
+      return ApiService.post('/auth/device/approve', data)
+    },
+
+    denyAuthorization(data) {
+      return ApiService.post('/auth/device/deny', data)
+    },
   },
 })